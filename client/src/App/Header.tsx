@@ -1,7 +1,11 @@
 import React from "react";
 
-import { useWebRTC, State as WebRTCState } from "../WebRTC";
-import { useTunerStatus, Status as TunerStatus } from "../TunerStatus";
+import { useWebRTC, State as WebRTCState, CaptionService } from "../WebRTC";
+import {
+  useTunerStatus,
+  Status as TunerStatus,
+  AudioStream,
+} from "../TunerStatus";
 import rpc from "../rpc";
 import useConfig from "../useConfig";
 
@@ -11,6 +15,10 @@ export default function Header() {
       <Title />
       <PowerButton />
       <StatusIndicator />
+      <TimeshiftControls />
+      <AudioSelector />
+      <CaptionSelector />
+      <QualitySelector />
     </header>
   );
 }
@@ -76,6 +84,139 @@ function StatusIndicator() {
   );
 }
 
+// rewindSeconds is how far each press of the rewind button goes back.
+const rewindSeconds = 10;
+
+function TimeshiftControls() {
+  const webRTC = useWebRTC();
+  const tunerStatus = useTunerStatus();
+  const timeshift = webRTC.Timeshift;
+  if (
+    timeshift === undefined ||
+    tunerStatus.Connection !== "Connected" ||
+    tunerStatus.State !== "Playing"
+  ) {
+    return null;
+  }
+
+  return (
+    <div className="TimeshiftControls">
+      <button
+        className="TimeshiftControls__Button"
+        onClick={() => webRTC.rewind(rewindSeconds)}
+      >
+        −{rewindSeconds}s
+      </button>
+      <button
+        className="TimeshiftControls__Button"
+        onClick={() => webRTC.setPaused(!timeshift.Paused)}
+      >
+        {timeshift.Paused ? "Play" : "Pause"}
+      </button>
+      <button
+        className={`TimeshiftControls__Button ${
+          timeshift.Live ? "TimeshiftControls__Button--Live" : ""
+        }`}
+        disabled={timeshift.Live}
+        onClick={() => webRTC.goLive()}
+      >
+        {timeshift.Live ? "Live" : `−${Math.round(timeshift.Delay)}s`}
+      </button>
+    </div>
+  );
+}
+
+function QualitySelector() {
+  const webRTC = useWebRTC();
+  if (webRTC.Quality === undefined) {
+    return null;
+  }
+
+  return (
+    <select
+      className="QualitySelector"
+      aria-label="Quality"
+      value={webRTC.Quality.Profile}
+      onChange={(evt) => webRTC.setQualityProfile(evt.target.value)}
+    >
+      {webRTC.Quality.Profiles.map((profile) => (
+        <option key={profile.Name} value={profile.Name}>
+          {profile.Description}
+        </option>
+      ))}
+    </select>
+  );
+}
+
+function CaptionSelector() {
+  const webRTC = useWebRTC();
+  if (
+    webRTC.Captions === undefined ||
+    webRTC.Captions.CaptionServices.length === 0
+  ) {
+    return null;
+  }
+
+  return (
+    <select
+      className="CaptionSelector"
+      aria-label="Captions"
+      value={webRTC.Captions.CaptionService}
+      onChange={(evt) => webRTC.setCaptionService(evt.target.value)}
+    >
+      <option value="">Captions Off</option>
+      {webRTC.Captions.CaptionServices.map((service) => (
+        <option key={service.Name} value={service.Name}>
+          {captionServiceString(service)}
+        </option>
+      ))}
+    </select>
+  );
+}
+
+function captionServiceString(service: CaptionService): string {
+  if (service.Language === undefined) {
+    return service.Name;
+  }
+  return `${service.Name} (${service.Language.toUpperCase()})`;
+}
+
+function AudioSelector() {
+  const tunerStatus = useTunerStatus();
+  if (
+    tunerStatus.Connection !== "Connected" ||
+    tunerStatus.State !== "Playing" ||
+    tunerStatus.AudioStreams === undefined ||
+    tunerStatus.AudioStreams.length < 2
+  ) {
+    return null;
+  }
+
+  return (
+    <select
+      className="AudioSelector"
+      aria-label="Audio"
+      value={tunerStatus.AudioPID}
+      onChange={(evt) => {
+        rpc("select-audio", { PID: Number(evt.target.value) }).catch(
+          console.error,
+        );
+      }}
+    >
+      {tunerStatus.AudioStreams.map((stream, i) => (
+        <option key={stream.PID} value={stream.PID}>
+          {audioStreamString(stream, i)}
+        </option>
+      ))}
+    </select>
+  );
+}
+
+function audioStreamString(stream: AudioStream, index: number): string {
+  const name = stream.Language?.toUpperCase() ?? `Audio ${index + 1}`;
+  return stream.Descriptive ? `${name} (Described)` : name;
+}
+
 function statusString(webRTC: WebRTCState, tunerStatus: TunerStatus): string {
   if (webRTC.Connection.Status !== "Connected") {
     return webRTC.Connection.Status;
@@ -97,8 +238,26 @@ function statusString(webRTC: WebRTCState, tunerStatus: TunerStatus): string {
   }
 
   if (tunerStatus.State === "Playing") {
+    if (tunerStatus.AudioOnly) {
+      return `Listening to ${tunerStatus.ChannelName} (No Video)`;
+    }
+    if (tunerStatus.VideoOnly) {
+      return `Watching ${tunerStatus.ChannelName} (No Audio)`;
+    }
+    if (tunerStatus.Preemption !== undefined) {
+      const { ChannelName, At } = tunerStatus.Preemption;
+      const at = new Date(At).toLocaleTimeString([], {
+        hour: "numeric",
+        minute: "2-digit",
+      });
+      return `Watching ${tunerStatus.ChannelName} (Recording ${ChannelName} at ${at})`;
+    }
     return `Watching ${tunerStatus.ChannelName}`;
   }
 
+  if (tunerStatus.State === "Retrying") {
+    return `Lost ${tunerStatus.ChannelName}, Retrying`;
+  }
+
   return tunerStatus.State;
 }
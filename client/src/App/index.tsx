@@ -26,7 +26,10 @@ export default function App() {
         selected={selectedChannel}
         onTune={(ch) => rpc("tune", { ChannelName: ch }).catch(console.error)}
       />
-      <VideoPlayer stream={webRTC.MediaStream} />
+      <VideoPlayer
+        stream={webRTC.MediaStream}
+        caption={webRTC.Caption?.Lines ?? null}
+      />
     </div>
   );
 }
@@ -41,8 +44,21 @@ function PageTitle() {
   return <title>{titleText}</title>;
 }
 
-function VideoPlayer({ stream }: { stream: undefined | MediaStream }) {
+// captionCueDuration is the longest that a caption stays on screen without
+// being replaced, in seconds. The server sends a new caption (possibly with no
+// lines) whenever the displayed text changes, so this only needs to outlast
+// the longest caption.
+const captionCueDuration = 60 * 60;
+
+function VideoPlayer({
+  stream,
+  caption,
+}: {
+  stream: undefined | MediaStream;
+  caption: null | string[];
+}) {
   const videoElement = React.useRef<null | HTMLVideoElement>(null);
+  const captionTrack = React.useRef<null | TextTrack>(null);
 
   React.useEffect(() => {
     if (videoElement.current !== null) {
@@ -50,14 +66,30 @@ function VideoPlayer({ stream }: { stream: undefined | MediaStream }) {
     }
   }, [stream]);
 
+  React.useEffect(() => {
+    const video = videoElement.current;
+    if (video === null) {
+      return;
+    }
+
+    captionTrack.current ??= video.addTextTrack("captions", "Captions");
+    const track = captionTrack.current;
+    track.mode = "showing";
+    for (const cue of Array.from(track.cues ?? [])) {
+      track.removeCue(cue);
+    }
+    if (caption !== null && caption.length > 0) {
+      const start = video.currentTime;
+      track.addCue(
+        new VTTCue(start, start + captionCueDuration, caption.join("\n")),
+      );
+    }
+  }, [caption]);
+
   /* eslint-disable jsx-a11y/media-has-caption */
-  // Lack of closed caption support is a longstanding deficiency in Hypcast.
-  // After experimenting with several approaches in GStreamer, I'm ashamed to
-  // say that I have yet to identify one that works reliably and consistently.
-  // Also, it is not clear that the eventual implementation of closed captions
-  // will involve WebVTT, which is what this rule actually looks for (through
-  // the presence of a <track> element), so it may need to remain disabled even
-  // after closed caption support is in place.
+  // Closed captions arrive over the WebRTC socket rather than through a
+  // <track> element, which is what this rule actually looks for. The player
+  // shows them through a text track that it adds to the video at runtime.
   return (
     <main className="VideoPlayer">
       <video
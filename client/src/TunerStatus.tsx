@@ -1,8 +1,32 @@
 import React from "react";
 
-type TunerStatus =
-  | { State: "Starting" | "Playing"; ChannelName: string }
-  | { State: "Stopped"; Error: undefined | string };
+export type AudioStream = {
+  PID: number;
+  Language?: string;
+  Descriptive?: boolean;
+};
+
+// Preemption warns that a scheduled recording will soon switch the tuner to
+// another channel.
+export type Preemption = {
+  ChannelName: string;
+  At: string;
+};
+
+type TunerStatus = { Preemption?: Preemption } & (
+  | { State: "Starting"; ChannelName: string; Programs?: string[] }
+  | {
+      State: "Playing";
+      ChannelName: string;
+      Programs?: string[];
+      AudioOnly?: boolean;
+      VideoOnly?: boolean;
+      AudioStreams?: AudioStream[];
+      AudioPID?: number;
+    }
+  | { State: "Retrying"; ChannelName: string; Error: string }
+  | { State: "Stopped"; Error: undefined | string }
+);
 
 export type Status =
   | { Connection: "Disconnected" | "Connecting" }
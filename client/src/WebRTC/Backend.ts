@@ -4,7 +4,44 @@ export type ConnectionState =
   | { Status: "Disconnected" | "Connecting" | "Connected" }
   | { Status: "Error"; Error: Error };
 
-type Message = { SDP: RTCSessionDescriptionInit };
+export interface QualityProfile {
+  Name: string;
+  Description: string;
+}
+
+export interface QualityState {
+  Profiles: QualityProfile[];
+  Profile: string;
+}
+
+export interface CaptionService {
+  Name: string;
+  Language?: string;
+}
+
+export interface CaptionState {
+  CaptionServices: CaptionService[];
+  CaptionService: string;
+}
+
+export interface Caption {
+  Service: string;
+  Lines: null | string[];
+}
+
+export interface TimeshiftState {
+  Live: boolean;
+  Paused: boolean;
+  Delay: number;
+  Available: number;
+}
+
+type Message =
+  | { SDP: RTCSessionDescriptionInit }
+  | QualityState
+  | CaptionState
+  | { Caption: Caption }
+  | { Timeshift: TimeshiftState };
 
 /* eslint-disable @typescript-eslint/no-unsafe-declaration-merging */
 // TODO: I need to figure out what's up with this one.
@@ -21,6 +58,21 @@ declare interface Backend {
 
   emit(event: "streamremoved"): boolean;
   on(event: "streamremoved", listener: () => void): this;
+
+  emit(event: "qualitychange", state: QualityState): boolean;
+  on(event: "qualitychange", listener: (state: QualityState) => void): this;
+
+  emit(event: "captionschange", state: CaptionState): boolean;
+  on(event: "captionschange", listener: (state: CaptionState) => void): this;
+
+  emit(event: "caption", caption: Caption): boolean;
+  on(event: "caption", listener: (caption: Caption) => void): this;
+
+  emit(event: "timeshiftchange", state: TimeshiftState): boolean;
+  on(
+    event: "timeshiftchange",
+    listener: (state: TimeshiftState) => void,
+  ): this;
 }
 
 class Backend extends EventEmitter {
@@ -68,10 +120,53 @@ class Backend extends EventEmitter {
     this.ws.close();
   }
 
+  setQualityProfile(name: string) {
+    this.ws.send(JSON.stringify({ Profile: name }));
+  }
+
+  setCaptionService(name: string) {
+    this.ws.send(JSON.stringify({ CaptionService: name }));
+  }
+
+  setPaused(paused: boolean) {
+    this.ws.send(JSON.stringify({ Pause: paused }));
+  }
+
+  rewind(seconds: number) {
+    this.ws.send(JSON.stringify({ Rewind: seconds }));
+  }
+
+  goLive() {
+    this.ws.send(JSON.stringify({ Live: true }));
+  }
+
   private handleSocketMessage(evt: MessageEvent) {
     const message: Message = JSON.parse(evt.data);
-    console.log("Received WebRTC offer", message);
-    this.handleRTCOffer(message.SDP);
+    if ("SDP" in message) {
+      console.log("Received WebRTC offer", message);
+      this.handleRTCOffer(message.SDP);
+      return;
+    }
+
+    if ("Caption" in message) {
+      this.emit("caption", message.Caption);
+      return;
+    }
+
+    if ("Timeshift" in message) {
+      console.log("Received timeshift state", message);
+      this.emit("timeshiftchange", message.Timeshift);
+      return;
+    }
+
+    if ("CaptionServices" in message) {
+      console.log("Received caption services", message);
+      this.emit("captionschange", message);
+      return;
+    }
+
+    console.log("Received quality profiles", message);
+    this.emit("qualitychange", message);
   }
 
   private async handleRTCOffer(sdp: RTCSessionDescriptionInit) {
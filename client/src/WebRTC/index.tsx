@@ -1,10 +1,30 @@
 import React from "react";
 
-import { default as Backend, ConnectionState } from "./Backend";
+import {
+  default as Backend,
+  Caption,
+  CaptionService,
+  CaptionState,
+  ConnectionState,
+  QualityProfile,
+  QualityState,
+  TimeshiftState,
+} from "./Backend";
+
+export type { CaptionService, QualityProfile };
 
 export interface State {
   Connection: ConnectionState;
   MediaStream: undefined | MediaStream;
+  Quality: undefined | QualityState;
+  Captions: undefined | CaptionState;
+  Caption: undefined | Caption;
+  Timeshift: undefined | TimeshiftState;
+  setQualityProfile: (name: string) => void;
+  setCaptionService: (name: string) => void;
+  setPaused: (paused: boolean) => void;
+  rewind: (seconds: number) => void;
+  goLive: () => void;
 }
 
 const Context = React.createContext<State | null>(null);
@@ -21,9 +41,11 @@ export const WebRTCProvider = ({ children }: { children: React.ReactNode }) => {
   const [state, dispatch] = React.useReducer(reduce, null, () =>
     defaultState(),
   );
+  const backendRef = React.useRef<null | Backend>(null);
 
   React.useEffect(() => {
     const backend = new Backend();
+    backendRef.current = backend;
     dispatch({ kind: "connectionchange", state: backend.connectionState });
 
     backend.on("connectionchange", (state: ConnectionState) =>
@@ -33,26 +55,84 @@ export const WebRTCProvider = ({ children }: { children: React.ReactNode }) => {
       dispatch({ kind: "streamreceived", stream }),
     );
     backend.on("streamremoved", () => dispatch({ kind: "streamremoved" }));
+    backend.on("qualitychange", (quality: QualityState) =>
+      dispatch({ kind: "qualitychange", quality }),
+    );
+    backend.on("captionschange", (captions: CaptionState) =>
+      dispatch({ kind: "captionschange", captions }),
+    );
+    backend.on("caption", (caption: Caption) =>
+      dispatch({ kind: "caption", caption }),
+    );
+    backend.on("timeshiftchange", (timeshift: TimeshiftState) =>
+      dispatch({ kind: "timeshiftchange", timeshift }),
+    );
 
     return () => {
+      backendRef.current = null;
       backend.close();
     };
   }, []);
 
-  return <Context value={state}>{children}</Context>;
+  const setQualityProfile = React.useCallback((name: string) => {
+    backendRef.current?.setQualityProfile(name);
+  }, []);
+
+  const setCaptionService = React.useCallback((name: string) => {
+    backendRef.current?.setCaptionService(name);
+  }, []);
+
+  const setPaused = React.useCallback((paused: boolean) => {
+    backendRef.current?.setPaused(paused);
+  }, []);
+
+  const rewind = React.useCallback((seconds: number) => {
+    backendRef.current?.rewind(seconds);
+  }, []);
+
+  const goLive = React.useCallback(() => {
+    backendRef.current?.goLive();
+  }, []);
+
+  const value = React.useMemo(
+    () => ({
+      ...state,
+      setQualityProfile,
+      setCaptionService,
+      setPaused,
+      rewind,
+      goLive,
+    }),
+    [state, setQualityProfile, setCaptionService, setPaused, rewind, goLive],
+  );
+
+  return <Context value={value}>{children}</Context>;
 };
 
-const defaultState = (): State => ({
+type ReducerState = Omit<
+  State,
+  "setQualityProfile" | "setCaptionService" | "setPaused" | "rewind" | "goLive"
+>;
+
+const defaultState = (): ReducerState => ({
   Connection: { Status: "Connecting" },
   MediaStream: undefined,
+  Quality: undefined,
+  Captions: undefined,
+  Caption: undefined,
+  Timeshift: undefined,
 });
 
 type Action =
   | { kind: "connectionchange"; state: ConnectionState }
   | { kind: "streamreceived"; stream: MediaStream }
-  | { kind: "streamremoved" };
+  | { kind: "streamremoved" }
+  | { kind: "qualitychange"; quality: QualityState }
+  | { kind: "captionschange"; captions: CaptionState }
+  | { kind: "caption"; caption: Caption }
+  | { kind: "timeshiftchange"; timeshift: TimeshiftState };
 
-const reduce = (state: State, action: Action): State => {
+const reduce = (state: ReducerState, action: Action): ReducerState => {
   switch (action.kind) {
     case "connectionchange":
       return { ...state, Connection: action.state };
@@ -62,5 +142,17 @@ const reduce = (state: State, action: Action): State => {
 
     case "streamremoved":
       return { ...state, MediaStream: undefined };
+
+    case "qualitychange":
+      return { ...state, Quality: action.quality };
+
+    case "captionschange":
+      return { ...state, Captions: action.captions };
+
+    case "caption":
+      return { ...state, Caption: action.caption };
+
+    case "timeshiftchange":
+      return { ...state, Timeshift: action.timeshift };
   }
 };
@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
 	"log/slog"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,13 +21,31 @@ import (
 	"github.com/featherbread/hypcast/internal/assets"
 	"github.com/featherbread/hypcast/internal/atsc"
 	"github.com/featherbread/hypcast/internal/atsc/tuner"
+	"github.com/featherbread/hypcast/internal/dvr"
+	"github.com/featherbread/hypcast/internal/gst"
 )
 
 var (
-	flagAddr          string
-	flagChannels      string
-	flagAssets        string
-	flagVideoPipeline string
+	flagAddr              string
+	flagChannels          string
+	flagAssets            string
+	flagVideoPipeline     string
+	flagPipelineDir       string
+	flagAudioProfile      string
+	flagNormalizeLoudness bool
+	flagLoudnessTarget    float64
+	flagSource            string
+	flagSourceDir         string
+	flagAdapters          string
+	flagTuneTimeout       time.Duration
+	flagWatchdogTimeout   time.Duration
+	flagRetryDelay        time.Duration
+	flagRetryMaxDelay     time.Duration
+	flagTimeshift         time.Duration
+	flagRecordingsDir     string
+	flagPriority          string
+	flagPreemptionWarning time.Duration
+	flagRecordingsQuota   float64
 )
 
 func init() {
@@ -40,22 +63,140 @@ func init() {
 	)
 	flag.StringVar(
 		&flagVideoPipeline, "video-pipeline", "default",
-		`Video pipeline implementation (default, lowpower, vaapi)`,
+		`Video pipeline implementation (default, lowpower, vaapi, or the name of a template in -pipeline-dir)`,
+	)
+	flag.StringVar(
+		&flagPipelineDir, "pipeline-dir", "",
+		"Directory of <name>.tmpl files defining custom video pipelines",
+	)
+	flag.StringVar(
+		&flagAudioProfile, "audio-profile", "stereo",
+		"Audio encoding (stereo, or surround to also offer 5.1 audio to clients that support it)",
+	)
+	flag.BoolVar(
+		&flagNormalizeLoudness, "normalize-loudness", false,
+		"Normalize the loudness of audio across programs (also switchable at runtime through the API)",
+	)
+	flag.Float64Var(
+		&flagLoudnessTarget, "loudness-target", tuner.DefaultLoudnessTarget,
+		"Target integrated loudness in LUFS for -normalize-loudness",
+	)
+	flag.StringVar(
+		&flagSource, "source", "dvb",
+		"Signal source (dvb, file, test); file and test simulate a tuner without DVB hardware",
+	)
+	flag.StringVar(
+		&flagSourceDir, "source-dir", "",
+		"Directory of <channel name>.ts files to loop for the file source",
+	)
+	flag.StringVar(
+		&flagAdapters, "adapters", "0",
+		"Comma-separated DVB adapters for the tuner pool, each as adapter or adapter:frontend; the first is the default tuner",
+	)
+	flag.DurationVar(
+		&flagTuneTimeout, "tune-timeout", 15*time.Second,
+		"Time to wait for video after tuning before reporting no signal (0 to disable)",
+	)
+	flag.DurationVar(
+		&flagWatchdogTimeout, "watchdog-timeout", 10*time.Second,
+		"Time without video or audio data before a stream is considered lost (0 to disable)",
+	)
+	flag.DurationVar(
+		&flagRetryDelay, "retry-delay", 1*time.Second,
+		"Initial delay before retuning to a lost channel (0 to disable retuning)",
+	)
+	flag.DurationVar(
+		&flagRetryMaxDelay, "retry-max-delay", 1*time.Minute,
+		"Maximum delay between repeated attempts to retune to a lost channel",
+	)
+	flag.DurationVar(
+		&flagTimeshift, "timeshift", 0,
+		"How far viewers can pause and rewind live TV, buffered in memory for each tuner (0 to disable)",
+	)
+	flag.StringVar(
+		&flagRecordingsDir, "recordings-dir", "",
+		"Directory for recordings and recording schedules (empty to disable recording)",
+	)
+	flag.StringVar(
+		&flagPriority, "recording-priority", string(dvr.PriorityRecordings),
+		"Whether scheduled recordings may take a tuner from its viewers when none is free (recordings), or not (viewers)",
+	)
+	flag.DurationVar(
+		&flagPreemptionWarning, "preemption-warning", 2*time.Minute,
+		"Time before a scheduled recording takes a tuner from its viewers to warn them (0 to disable)",
+	)
+	flag.Float64Var(
+		&flagRecordingsQuota, "recordings-quota", 0,
+		"Maximum size of all recordings in GB, beyond which the oldest are removed (0 for no limit)",
 	)
 }
 
 func main() {
 	flag.Parse()
 
+	source := tuner.ParseSource(flagSource)
 	channels, err := readChannelsConf(flagChannels)
+	if errors.Is(err, fs.ErrNotExist) && source != tuner.SourceDVB {
+		slog.Info("Using simulated channels", "channels", flagChannels, "source", source)
+		channels, err = tuner.SimulatedChannels(source, flagSourceDir)
+	}
 	if err != nil {
 		slog.Error("Failed to load channels", "channels", flagChannels, "error", err)
 		os.Exit(1)
 	}
 
-	vp := tuner.ParseVideoPipeline(flagVideoPipeline)
-	tuner := tuner.NewTuner(channels, vp)
-	http.Handle("/api/", api.NewHandler(tuner))
+	adapters, err := parseAdapters(flagAdapters)
+	if err != nil {
+		slog.Error("Invalid adapters", "adapters", flagAdapters, "error", err)
+		os.Exit(1)
+	}
+
+	vp, pipelineTemplate, err := selectVideoPipeline(flagVideoPipeline, flagPipelineDir)
+	if err != nil {
+		slog.Error("Invalid video pipeline", "pipeline", flagVideoPipeline, "dir", flagPipelineDir, "error", err)
+		os.Exit(1)
+	}
+
+	tuners := make([]*tuner.Tuner, len(adapters))
+	for i, adapter := range adapters {
+		tuners[i] = tuner.NewTuner(channels, tuner.Config{
+			NewPipeline:       gst.Factory,
+			VideoPipeline:     vp,
+			PipelineTemplate:  pipelineTemplate,
+			AudioProfile:      tuner.ParseAudioProfile(flagAudioProfile),
+			NormalizeLoudness: flagNormalizeLoudness,
+			LoudnessTarget:    flagLoudnessTarget,
+			Source:            source,
+			SourceDir:         flagSourceDir,
+			Adapter:           adapter.Adapter,
+			Frontend:          adapter.Frontend,
+			TuneTimeout:       flagTuneTimeout,
+			WatchdogTimeout:   flagWatchdogTimeout,
+			RetryMinDelay:     flagRetryDelay,
+			RetryMaxDelay:     flagRetryMaxDelay,
+			TimeshiftWindow:   flagTimeshift,
+		})
+	}
+	pool := tuner.NewPool(tuners...)
+
+	var recorder *dvr.Recorder
+	if flagRecordingsDir != "" {
+		priority, err := dvr.ParsePriority(flagPriority)
+		if err != nil {
+			slog.Error("Invalid recording priority", "priority", flagPriority, "error", err)
+			os.Exit(1)
+		}
+		recorder, err = dvr.New(flagRecordingsDir, pool, dvr.Policy{
+			Priority: priority,
+			Warning:  flagPreemptionWarning,
+			Quota:    int64(flagRecordingsQuota * 1e9),
+		})
+		if err != nil {
+			slog.Error("Failed to start recorder", "dir", flagRecordingsDir, "error", err)
+			os.Exit(1)
+		}
+	}
+	http.Handle("/api/", api.NewHandler(pool, recorder))
 
 	var assetLogAttr slog.Attr
 	if flagAssets != "" {
@@ -76,6 +217,10 @@ func main() {
 		slog.String("addr", flagAddr),
 		slog.String("channels", flagChannels),
 		slog.String("pipeline", string(vp)),
+		slog.String("audio", string(tuner.ParseAudioProfile(flagAudioProfile))),
+		slog.String("source", string(source)),
+		slog.String("adapters", flagAdapters),
+		slog.String("recordings", flagRecordingsDir),
 		assetLogAttr,
 	)
 	server := http.Server{Addr: flagAddr}
@@ -95,6 +240,9 @@ func main() {
 		stopCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		server.Shutdown(stopCtx)
+		if recorder != nil {
+			recorder.Close()
+		}
 	}
 }
 
@@ -107,3 +255,63 @@ func readChannelsConf(path string) ([]atsc.Channel, error) {
 
 	return atsc.ParseChannelsConf(f)
 }
+
+// selectVideoPipeline selects the named video pipeline, loading any custom
+// pipeline templates from dir if it is not empty. Without dir, unknown names
+// select the default pipeline.
+func selectVideoPipeline(name, dir string) (tuner.VideoPipeline, *tuner.PipelineTemplate, error) {
+	vp := tuner.ParseVideoPipeline(name)
+	if dir == "" {
+		return vp, nil, nil
+	}
+
+	templates, err := tuner.LoadPipelineTemplates(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	if pt, ok := templates[tuner.VideoPipeline(name)]; ok {
+		return tuner.VideoPipeline(name), pt, nil
+	}
+	if string(vp) != name {
+		return "", nil, fmt.Errorf("no built-in pipeline or %s.tmpl template named %q", name, name)
+	}
+	return vp, nil, nil
+}
+
+type adapterSpec struct {
+	Adapter  uint
+	Frontend uint
+}
+
+// parseAdapters parses a comma-separated list of DVB devices, each of the form
+// "adapter" or "adapter:frontend" with the frontend defaulting to 0. Each
+// device may appear only once, as two tuners can't share a frontend.
+func parseAdapters(list string) ([]adapterSpec, error) {
+	var specs []adapterSpec
+	seen := make(map[adapterSpec]bool)
+	for field := range strings.SplitSeq(list, ",") {
+		adapter, frontend, hasFrontend := strings.Cut(strings.TrimSpace(field), ":")
+
+		var spec adapterSpec
+		a, err := strconv.ParseUint(adapter, 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid adapter %q", field)
+		}
+		spec.Adapter = uint(a)
+
+		if hasFrontend {
+			f, err := strconv.ParseUint(frontend, 10, 0)
+			if err != nil {
+				return nil, fmt.Errorf("invalid frontend %q", field)
+			}
+			spec.Frontend = uint(f)
+		}
+
+		if seen[spec] {
+			return nil, fmt.Errorf("duplicate adapter %d:%d", spec.Adapter, spec.Frontend)
+		}
+		seen[spec] = true
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAdapters(t *testing.T) {
+	testCases := []struct {
+		Description string
+		List        string
+		Want        []adapterSpec
+		WantErr     string
+	}{
+		{
+			Description: "single adapter",
+			List:        "0",
+			Want:        []adapterSpec{{Adapter: 0}},
+		},
+		{
+			Description: "adapters and frontends",
+			List:        "0, 1:1,1",
+			Want:        []adapterSpec{{Adapter: 0}, {Adapter: 1, Frontend: 1}, {Adapter: 1}},
+		},
+		{
+			Description: "invalid adapter",
+			List:        "0,a",
+			WantErr:     `invalid adapter "a"`,
+		},
+		{
+			Description: "invalid frontend",
+			List:        "0:b",
+			WantErr:     `invalid frontend "0:b"`,
+		},
+		{
+			Description: "duplicate with default frontend",
+			List:        "1:1,0,0:0",
+			WantErr:     "duplicate adapter 0:0",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Description, func(t *testing.T) {
+			specs, err := parseAdapters(tc.List)
+			if tc.WantErr != "" {
+				assert.EqualError(t, err, tc.WantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Want, specs)
+		})
+	}
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/featherbread/hypcast/internal/api/rpc"
 	"github.com/featherbread/hypcast/internal/atsc/tuner"
+	"github.com/featherbread/hypcast/internal/dvr"
 )
 
 var websocketUpgrader = &websocket.Upgrader{
@@ -19,28 +20,57 @@ var websocketUpgrader = &websocket.Upgrader{
 	CheckOrigin: func(_ *http.Request) bool { return true },
 }
 
-// Handler serves the Hypcast API for a single tuner.
+// Handler serves the Hypcast API for a pool of tuners.
+//
+// Routes under /api/tuners/{id}/ operate on the tuner with the corresponding ID
+// in the pool, while the equivalent routes directly under /api/ operate on the
+// pool's default tuner. Routes for recordings operate on the pool as a whole.
 type Handler struct {
-	mux   *http.ServeMux
-	tuner *tuner.Tuner
+	mux      *http.ServeMux
+	tuners   *tuner.Pool
+	recorder *dvr.Recorder
 }
 
-// NewHandler creates a Handler serving the Hypcast API for tuner.
-func NewHandler(tuner *tuner.Tuner) *Handler {
+// NewHandler creates a Handler serving the Hypcast API for a pool of tuners,
+// which records through recorder. A nil recorder disables the routes for
+// recordings.
+func NewHandler(tuners *tuner.Pool, recorder *dvr.Recorder) *Handler {
 	h := &Handler{
-		mux:   http.NewServeMux(),
-		tuner: tuner,
+		mux:      http.NewServeMux(),
+		tuners:   tuners,
+		recorder: recorder,
 	}
 
 	h.mux.HandleFunc("GET /api/config/channels", h.handleConfigChannels)
+	h.mux.HandleFunc("GET /api/tuners", h.handleTuners)
+
+	if recorder != nil {
+		h.mux.HandleFunc("GET /api/recordings", h.handleRecordings)
+		h.mux.HandleFunc("DELETE /api/recordings/{recording}", h.handleDeleteRecording)
+		h.mux.HandleFunc("GET /api/schedules", h.handleSchedules)
+		h.mux.HandleFunc("GET /api/conflicts", h.handleConflicts)
+		h.mux.HandleFunc("GET /api/removals", h.handleRemovals)
+		h.mux.Handle("/api/rpc/start-recording", rpc.HTTPHandler(h.rpcStartRecording))
+		h.mux.Handle("/api/rpc/stop-recording", rpc.HTTPHandler(h.rpcStopRecording))
+		h.mux.Handle("/api/rpc/delete-recording", rpc.HTTPHandler(h.rpcDeleteRecording))
+		h.mux.Handle("/api/rpc/schedule-recording", rpc.HTTPHandler(h.rpcScheduleRecording))
+		h.mux.Handle("/api/rpc/cancel-schedule", rpc.HTTPHandler(h.rpcCancelSchedule))
+
+		// The websocket library is expected to enforce its own method checks.
+		h.mux.HandleFunc("/api/recordings/{recording}/socket/webrtc-peer", h.handleSocketRecordingPeer)
+	}
 
-	// The RPC framework is expected to enforce its own method checks.
-	h.mux.Handle("/api/rpc/stop", rpc.HTTPHandler(h.rpcStop))
-	h.mux.Handle("/api/rpc/tune", rpc.HTTPHandler(h.rpcTune))
+	for _, prefix := range []string{"/api", "/api/tuners/{id}"} {
+		// The RPC framework is expected to enforce its own method checks.
+		h.mux.Handle(prefix+"/rpc/stop", rpc.HTTPHandler(h.rpcStop))
+		h.mux.Handle(prefix+"/rpc/tune", rpc.HTTPHandler(h.rpcTune))
+		h.mux.Handle(prefix+"/rpc/select-audio", rpc.HTTPHandler(h.rpcSelectAudio))
+		h.mux.Handle(prefix+"/rpc/normalize-loudness", rpc.HTTPHandler(h.rpcNormalizeLoudness))
 
-	// The websocket library is expected to enforce its own method checks.
-	h.mux.HandleFunc("/api/socket/webrtc-peer", h.handleSocketWebRTCPeer)
-	h.mux.HandleFunc("/api/socket/tuner-status", h.handleSocketTunerStatus)
+		// The websocket library is expected to enforce its own method checks.
+		h.mux.HandleFunc(prefix+"/socket/webrtc-peer", h.handleSocketWebRTCPeer)
+		h.mux.HandleFunc(prefix+"/socket/tuner-status", h.handleSocketTunerStatus)
+	}
 
 	return h
 }
@@ -49,32 +79,124 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.mux.ServeHTTP(w, r)
 }
 
+var errTunerNotFound = errors.New("tuner not found")
+
+// tunerForRequest returns the tuner identified by the {id} wildcard of r's
+// route, or the default tuner for routes without this wildcard, along with the
+// tuner's ID.
+func (h *Handler) tunerForRequest(r *http.Request) (id string, t *tuner.Tuner, ok bool) {
+	id = r.PathValue("id")
+	if id == "" {
+		id = h.tuners.DefaultID()
+	}
+	t, ok = h.tuners.Get(id)
+	return
+}
+
 func (h *Handler) handleConfigChannels(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(slices.Collect(h.tuner.ChannelNames()))
+	json.NewEncoder(w).Encode(slices.Collect(h.tuners.Default().ChannelNames()))
+}
+
+type tunerInfoMsg struct {
+	ID string
+	tunerStatusMsg
+}
+
+func (h *Handler) handleTuners(w http.ResponseWriter, r *http.Request) {
+	infos := make([]tunerInfoMsg, 0, h.tuners.Len())
+	for id, t := range h.tuners.All() {
+		infos = append(infos, tunerInfoMsg{
+			ID:             id,
+			tunerStatusMsg: mapTunerStatusToMessage(t.Status()),
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
 }
 
 func (h *Handler) rpcStop(r *http.Request, _ struct{}) (code int, body any) {
-	slog.Info("Stopping tuner", "client", r.RemoteAddr)
-	if err := h.tuner.Stop(); err != nil {
+	id, t, ok := h.tunerForRequest(r)
+	if !ok {
+		return http.StatusNotFound, errTunerNotFound
+	}
+
+	slog.Info("Stopping tuner", "client", r.RemoteAddr, "tuner", id)
+	var err error
+	if h.recorder != nil {
+		err = h.recorder.StopTuner(id)
+	} else {
+		err = t.Stop()
+	}
+	switch {
+	case errors.Is(err, dvr.ErrTunerRecording):
+		return http.StatusConflict, err
+	case err != nil:
 		return http.StatusInternalServerError, err
 	}
 	return http.StatusNoContent, nil
 }
 
 func (h *Handler) rpcTune(r *http.Request, params struct{ ChannelName string }) (code int, body any) {
+	id, t, ok := h.tunerForRequest(r)
+	if !ok {
+		return http.StatusNotFound, errTunerNotFound
+	}
 	if params.ChannelName == "" {
 		return http.StatusBadRequest, errors.New("channel name required")
 	}
 
-	slog.Info("Tuning to channel", "client", r.RemoteAddr, "channel", params.ChannelName)
-	err := h.tuner.Tune(params.ChannelName)
+	slog.Info(
+		"Tuning to channel",
+		"client", r.RemoteAddr, "tuner", id, "channel", params.ChannelName,
+	)
+	// The Recorder decides whether viewers may take the tuner away from any
+	// scheduled recording that it's making.
+	var err error
+	if h.recorder != nil {
+		err = h.recorder.Tune(id, params.ChannelName)
+	} else {
+		err = t.Tune(params.ChannelName)
+	}
 	switch {
 	case errors.Is(err, tuner.ErrChannelNotFound):
 		return http.StatusBadRequest, err
+	case errors.Is(err, dvr.ErrTunerRecording):
+		return http.StatusConflict, err
 	case err != nil:
 		return http.StatusInternalServerError, err
 	}
 
 	return http.StatusNoContent, nil
 }
+
+func (h *Handler) rpcSelectAudio(r *http.Request, params struct{ PID uint }) (code int, body any) {
+	id, t, ok := h.tunerForRequest(r)
+	if !ok {
+		return http.StatusNotFound, errTunerNotFound
+	}
+
+	slog.Info("Selecting audio stream", "client", r.RemoteAddr, "tuner", id, "pid", params.PID)
+	err := t.SelectAudio(params.PID)
+	switch {
+	case errors.Is(err, tuner.ErrAudioStreamNotFound):
+		return http.StatusBadRequest, err
+	case err != nil:
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusNoContent, nil
+}
+
+func (h *Handler) rpcNormalizeLoudness(r *http.Request, params struct{ Enabled bool }) (code int, body any) {
+	id, t, ok := h.tunerForRequest(r)
+	if !ok {
+		return http.StatusNotFound, errTunerNotFound
+	}
+
+	slog.Info("Setting loudness normalization", "client", r.RemoteAddr, "tuner", id, "enabled", params.Enabled)
+	if err := t.SetLoudnessNormalization(params.Enabled); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/featherbread/hypcast/internal/atsc/tuner"
+	"github.com/featherbread/hypcast/internal/dvr"
+)
+
+// recordingMsg describes a recording, with its duration in seconds. Active
+// recordings are still in progress.
+type recordingMsg struct {
+	ID          string
+	ChannelName string
+	TunerID     string
+	Start       time.Time
+	Duration    float64
+	Size        int64
+	Active      bool
+	ScheduleID  string        `json:",omitempty"`
+	Error       string        `json:",omitempty"`
+	Dropped     int           `json:",omitempty"`
+	Retention   dvr.Retention `json:",omitzero"`
+}
+
+func (h *Handler) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	recordings, err := h.recorder.Recordings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	msgs := make([]recordingMsg, len(recordings))
+	for i, rec := range recordings {
+		msgs[i] = recordingMsg{
+			ID:          rec.ID,
+			ChannelName: rec.ChannelName,
+			TunerID:     rec.TunerID,
+			Start:       rec.Start,
+			Duration:    rec.Duration().Seconds(),
+			Size:        rec.Size,
+			Active:      rec.End.IsZero(),
+			ScheduleID:  rec.ScheduleID,
+			Error:       rec.Error,
+			Dropped:     rec.Dropped,
+			Retention:   rec.Retention,
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msgs)
+}
+
+func (h *Handler) handleDeleteRecording(w http.ResponseWriter, r *http.Request) {
+	code, body := h.rpcDeleteRecording(r, struct{ ID string }{r.PathValue("recording")})
+	if err, ok := body.(error); ok {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.WriteHeader(code)
+}
+
+func (h *Handler) rpcDeleteRecording(r *http.Request, params struct{ ID string }) (code int, body any) {
+	slog.Info("Deleting recording", "client", r.RemoteAddr, "id", params.ID)
+	err := h.recorder.Delete(params.ID)
+	switch {
+	case errors.Is(err, dvr.ErrRecordingNotFound):
+		return http.StatusNotFound, err
+	case err != nil:
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusNoContent, nil
+}
+
+func (h *Handler) handleSocketRecordingPeer(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("recording")
+	player, err := h.recorder.Play(id)
+	switch {
+	case errors.Is(err, dvr.ErrRecordingNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer player.Close()
+
+	ctx, shutdown := context.WithCancelCause(r.Context())
+	wh := &WebRTCHandler{
+		log:      slog.With("client", r.RemoteAddr, "recording", id),
+		tuner:    player.Tuner(),
+		player:   player,
+		ctx:      ctx,
+		shutdown: shutdown,
+	}
+	wh.ServeHTTP(w, r)
+}
+
+func (h *Handler) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.recorder.Schedules())
+}
+
+func (h *Handler) handleConflicts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.recorder.Conflicts())
+}
+
+func (h *Handler) handleRemovals(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.recorder.Removals())
+}
+
+type recordingIDMsg struct {
+	ID string
+}
+
+func (h *Handler) rpcStartRecording(r *http.Request, params struct{ ChannelName string }) (code int, body any) {
+	if params.ChannelName == "" {
+		return http.StatusBadRequest, errors.New("channel name required")
+	}
+
+	slog.Info("Starting recording", "client", r.RemoteAddr, "channel", params.ChannelName)
+	rec, err := h.recorder.Start(params.ChannelName)
+	switch {
+	case errors.Is(err, tuner.ErrChannelNotFound):
+		return http.StatusBadRequest, err
+	case errors.Is(err, dvr.ErrNoTunerAvailable):
+		return http.StatusConflict, err
+	case err != nil:
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, recordingIDMsg{ID: rec.ID}
+}
+
+func (h *Handler) rpcStopRecording(r *http.Request, params struct{ ID string }) (code int, body any) {
+	slog.Info("Stopping recording", "client", r.RemoteAddr, "id", params.ID)
+	err := h.recorder.Stop(params.ID)
+	switch {
+	case errors.Is(err, dvr.ErrRecordingNotFound):
+		return http.StatusNotFound, err
+	case err != nil:
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusNoContent, nil
+}
+
+func (h *Handler) rpcScheduleRecording(r *http.Request, params struct {
+	ChannelName string
+	Start       time.Time
+	End         time.Time
+	Retention   dvr.Retention
+}) (code int, body any) {
+	if params.ChannelName == "" {
+		return http.StatusBadRequest, errors.New("channel name required")
+	}
+
+	slog.Info(
+		"Scheduling recording",
+		"client", r.RemoteAddr, "channel", params.ChannelName, "start", params.Start, "end", params.End,
+	)
+	s, err := h.recorder.Schedule(params.ChannelName, params.Start, params.End, params.Retention)
+	switch {
+	case errors.Is(err, tuner.ErrChannelNotFound), errors.Is(err, dvr.ErrInvalidSchedule):
+		return http.StatusBadRequest, err
+	case err != nil:
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, recordingIDMsg{ID: s.ID}
+}
+
+func (h *Handler) rpcCancelSchedule(r *http.Request, params struct{ ID string }) (code int, body any) {
+	slog.Info("Canceling scheduled recording", "client", r.RemoteAddr, "id", params.ID)
+	err := h.recorder.CancelSchedule(params.ID)
+	switch {
+	case errors.Is(err, dvr.ErrScheduleNotFound):
+		return http.StatusNotFound, err
+	case err != nil:
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusNoContent, nil
+}
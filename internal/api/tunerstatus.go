@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 
@@ -24,10 +25,16 @@ type TunerStatusHandler struct {
 }
 
 func (h *Handler) handleSocketTunerStatus(w http.ResponseWriter, r *http.Request) {
+	id, t, ok := h.tunerForRequest(r)
+	if !ok {
+		http.Error(w, errTunerNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
 	ctx, shutdown := context.WithCancelCause(r.Context())
 	tsh := &TunerStatusHandler{
-		log:      slog.With("client", r.RemoteAddr),
-		tuner:    h.tuner,
+		log:      slog.With("client", r.RemoteAddr, "tuner", id),
+		tuner:    t,
 		ctx:      ctx,
 		shutdown: shutdown,
 	}
@@ -62,7 +69,7 @@ func (tsh *TunerStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 func (tsh *TunerStatusHandler) sendNewTunerStatus(s tuner.Status) {
 	tsh.logTunerStatus(s)
-	msg := tsh.mapTunerStatusToMessage(s)
+	msg := mapTunerStatusToMessage(s)
 	if err := tsh.socket.WriteJSON(msg); err != nil {
 		tsh.shutdown(err)
 	}
@@ -73,9 +80,21 @@ func (tsh *TunerStatusHandler) logTunerStatus(s tuner.Status) {
 	if s.ChannelName != "" {
 		attrs = append(attrs, slog.String("channel", s.ChannelName))
 	}
+	if len(s.Programs) > 0 {
+		attrs = append(attrs, slog.Any("programs", s.Programs))
+	}
+	if s.AudioOnly {
+		attrs = append(attrs, slog.Bool("audioOnly", true))
+	}
+	if s.VideoOnly {
+		attrs = append(attrs, slog.Bool("videoOnly", true))
+	}
 	if s.Error != nil {
 		attrs = append(attrs, slog.String("error", s.Error.Error()))
 	}
+	if s.Preemption != nil {
+		attrs = append(attrs, slog.String("preemptedBy", s.Preemption.ChannelName))
+	}
 	tsh.log.LogAttrs(tsh.ctx, slog.LevelInfo, "Sending tuner status", attrs...)
 }
 
@@ -100,23 +119,59 @@ func (tsh *TunerStatusHandler) waitForCleanup() {
 
 type tunerStatusMsg struct {
 	State       string
-	ChannelName string `json:",omitempty"`
-	Error       string `json:",omitempty"`
+	ChannelName string   `json:",omitempty"`
+	Error       string   `json:",omitempty"`
+	Programs    []string `json:",omitempty"`
+	AudioOnly   bool     `json:",omitempty"`
+	VideoOnly   bool     `json:",omitempty"`
+
+	AudioStreams []audioStreamMsg `json:",omitempty"`
+	AudioPID     uint             `json:",omitempty"`
+
+	Preemption *preemptionMsg `json:",omitempty"`
+}
+
+// preemptionMsg warns that a scheduled recording will retune the tuner to
+// ChannelName at the time At.
+type preemptionMsg struct {
+	ChannelName string
+	At          time.Time
+}
+
+type audioStreamMsg struct {
+	PID         uint
+	Language    string `json:",omitempty"`
+	Descriptive bool   `json:",omitempty"`
 }
 
 var tunerStateStrings = map[tuner.State]string{
 	tuner.StateStopped:  "Stopped",
 	tuner.StateStarting: "Starting",
 	tuner.StatePlaying:  "Playing",
+	tuner.StateRetrying: "Retrying",
 }
 
-func (tsh *TunerStatusHandler) mapTunerStatusToMessage(s tuner.Status) tunerStatusMsg {
+func mapTunerStatusToMessage(s tuner.Status) tunerStatusMsg {
 	msg := tunerStatusMsg{
 		State:       tunerStateStrings[s.State],
 		ChannelName: s.ChannelName,
+		Programs:    s.Programs,
+		AudioOnly:   s.AudioOnly,
+		VideoOnly:   s.VideoOnly,
+		AudioPID:    s.AudioPID,
+	}
+	for _, as := range s.AudioStreams {
+		msg.AudioStreams = append(msg.AudioStreams, audioStreamMsg{
+			PID:         as.PID,
+			Language:    as.Language,
+			Descriptive: as.Descriptive,
+		})
 	}
 	if s.Error != nil {
 		msg.Error = s.Error.Error()
 	}
+	if p := s.Preemption; p != nil {
+		msg.Preemption = &preemptionMsg{ChannelName: p.ChannelName, At: p.At}
+	}
 	return msg
 }
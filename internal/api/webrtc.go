@@ -6,18 +6,38 @@ import (
 	"errors"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 
 	"github.com/featherbread/hypcast/internal/atsc/tuner"
 	"github.com/featherbread/hypcast/internal/watch"
 )
 
-var webrtcAPI *webrtc.API
+// Bounds for the send-side bandwidth estimate of each peer connection, in bits
+// per second. The estimate starts high so that viewers on a good connection
+// receive full quality video right away, and only falls once the client's
+// feedback shows signs of congestion.
+const (
+	bweInitialBitrate = 10_000_000
+	bweMinBitrate     = 500_000
+	bweMaxBitrate     = 20_000_000
+)
 
-func init() {
+// newPeerConnection creates a peer connection that sends the tuner's codecs,
+// including multichannel Opus for clients that can play surround audio, along
+// with an estimator of the bandwidth available to the peer. Every peer
+// connection gets its own API instance, since the congestion control
+// interceptor only exposes estimators through the API that created them.
+func newPeerConnection() (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
 	// https://tools.ietf.org/html/rfc3551#section-3
 	//
 	// "This profile reserves payload type numbers in the range 96-127 exclusively
@@ -25,6 +45,7 @@ func init() {
 	const (
 		videoPayloadType = 96 + iota
 		audioPayloadType
+		surroundAudioPayloadType
 	)
 
 	var me webrtc.MediaEngine
@@ -35,31 +56,122 @@ func init() {
 		me.RegisterCodec(
 			webrtc.RTPCodecParameters{PayloadType: audioPayloadType, RTPCodecCapability: tuner.AudioCodecCapability},
 			webrtc.RTPCodecTypeAudio),
+		me.RegisterCodec(
+			webrtc.RTPCodecParameters{PayloadType: surroundAudioPayloadType, RTPCodecCapability: tuner.SurroundAudioCodecCapability},
+			webrtc.RTPCodecTypeAudio),
 	)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
+	}
+
+	// Clients request full key frames through FIR as well as PLI, both of which
+	// the tuner answers by forcing a key frame from the encoder.
+	me.RegisterFeedback(webrtc.RTCPFeedback{Type: "ccm", Parameter: "fir"}, webrtc.RTPCodecTypeVideo)
+
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(bweInitialBitrate),
+			gcc.SendSideBWEMinBitrate(bweMinBitrate),
+			gcc.SendSideBWEMaxBitrate(bweMaxBitrate),
+			// The encoder already produces video at roughly the rate that the
+			// estimate allows, and pacing its output would only add latency.
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return nil, nil, err
 	}
 
-	webrtcAPI = webrtc.NewAPI(webrtc.WithMediaEngine(&me))
+	var estimator cc.BandwidthEstimator
+	congestionController.OnNewPeerConnection(func(_ string, e cc.BandwidthEstimator) {
+		estimator = e
+	})
+
+	var registry interceptor.Registry
+	registry.Add(congestionController)
+	err = errors.Join(
+		webrtc.ConfigureTWCCHeaderExtensionSender(&me, &registry),
+		webrtc.RegisterDefaultInterceptors(&me, &registry),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(&me), webrtc.WithInterceptorRegistry(&registry))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, nil, err
+	}
+	// The interceptor creates the estimator while building the peer connection.
+	return pc, estimator, nil
 }
 
 type WebRTCHandler struct {
 	log       *slog.Logger
 	tuner     *tuner.Tuner
+	program   string
+	player    *tuner.Player // Controls playback of a recording, or nil for live TV.
 	ctx       context.Context
 	shutdown  context.CancelCauseFunc
 	waitGroup sync.WaitGroup
 
-	socket  *websocket.Conn
-	rtcPeer *webrtc.PeerConnection
-	watch   watch.Watch
+	socket   *websocket.Conn
+	socketMu sync.Mutex
+	rtcPeer  *webrtc.PeerConnection
+	viewer   *tuner.Viewer
+	watch    watch.Watch
+	profile  string
+
+	// layerChanged wakes the handler to switch to the video layer that the
+	// tuner selected for the viewer after a change in its bandwidth estimate.
+	// The estimator can't switch layers itself, as it would wait on mu while
+	// the handler renegotiates the session.
+	layerChanged chan struct{}
+
+	// mu protects the tracks that the handler sends, which change with updates
+	// from the tuner, with changes to the viewer's video layer or the client's
+	// support for surround audio, and as the viewer leaves or returns to live
+	// through the tuner's timeshift buffer.
+	mu          sync.Mutex
+	tracks      tuner.Tracks
+	layer       tuner.Layer
+	videoSender *webrtc.RTPSender
+	audioSender *webrtc.RTPSender
+
+	timeshiftWatch watch.Watch
+	shifted        bool
+	shiftTracks    tuner.Tracks
+
+	// captionsMu protects the captions of the handler's program, along with the
+	// caption service that the client chose and the last caption that the
+	// handler sent for it.
+	captionsMu     sync.Mutex
+	captionsWatch  watch.Watch
+	captions       tuner.Captions
+	captionService string
+	sentCaption    captionMsg
 }
 
 func (h *Handler) handleSocketWebRTCPeer(w http.ResponseWriter, r *http.Request) {
+	id, t, ok := h.tunerForRequest(r)
+	if !ok {
+		http.Error(w, errTunerNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	// By default, clients receive the tuner's current channel. Clients can
+	// instead request any other program on the same frequency by channel name.
+	program := r.URL.Query().Get("channel")
+	log := slog.With("client", r.RemoteAddr, "tuner", id)
+	if program != "" {
+		log = log.With("program", program)
+	}
+
 	ctx, shutdown := context.WithCancelCause(r.Context())
 	wh := &WebRTCHandler{
-		log:      slog.With("client", r.RemoteAddr),
-		tuner:    h.tuner,
+		log:      log,
+		tuner:    t,
+		program:  program,
 		ctx:      ctx,
 		shutdown: shutdown,
 	}
@@ -73,6 +185,16 @@ func (wh *WebRTCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		wh.log.Info("Disconnected WebRTC socket", "error", context.Cause(wh.ctx))
 	}()
 
+	if wh.program != "" {
+		release, err := wh.tuner.AddProgram(wh.program)
+		if err != nil {
+			wh.shutdown(err)
+			http.Error(w, err.Error(), programErrorStatus(err))
+			return
+		}
+		defer release()
+	}
+
 	var err error
 	wh.socket, err = websocketUpgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -80,24 +202,104 @@ func (wh *WebRTCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer wh.socket.Close()
 
-	wh.rtcPeer, err = webrtcAPI.NewPeerConnection(webrtc.Configuration{})
+	var estimator cc.BandwidthEstimator
+	wh.rtcPeer, estimator, err = newPeerConnection()
 	if err != nil {
+		wh.shutdown(err)
 		return
 	}
 	defer wh.rtcPeer.Close()
 
+	// The tuner selects a video layer for the viewer based on its bandwidth, and
+	// encodes each layer for the most constrained of its viewers, so that a
+	// single client on a poor connection doesn't stall.
+	wh.viewer = wh.tuner.AddViewer(wh.program)
+	defer wh.viewer.Close()
+	wh.layer = wh.viewer.Layer()
+	wh.layerChanged = make(chan struct{}, 1)
+	estimator.OnTargetBitrateChange(func(bps int) {
+		wh.viewer.SetAvailableBitrate(bps)
+		select {
+		case wh.layerChanged <- struct{}{}:
+		default:
+		}
+	})
+
+	wh.waitGroup.Add(1)
+	go func() {
+		defer wh.waitGroup.Done()
+		wh.handleLayerChanges()
+	}()
+
+	wh.profile = profileAuto
+	if err := wh.sendProfiles(); err != nil {
+		wh.shutdown(err)
+		return
+	}
+
+	// A new viewer can't decode anything until the next key frame, so we make
+	// sure that it doesn't have to wait for a natural one.
+	wh.rtcPeer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			wh.requestKeyFrame()
+		}
+	})
+
 	wh.waitGroup.Add(1)
 	go func() {
 		defer wh.waitGroup.Done()
 		wh.handleClientSessionAnswers()
 	}()
 
-	wh.watch = wh.tuner.WatchTracks(wh.handleTrackUpdate)
+	if wh.player != nil {
+		wh.waitGroup.Add(1)
+		go func() {
+			defer wh.waitGroup.Done()
+			wh.reportPlayback()
+		}()
+	}
+
+	if wh.program == "" {
+		wh.watch = wh.tuner.WatchTracks(wh.handleTrackUpdate)
+	} else {
+		wh.watch, err = wh.tuner.WatchProgramTracks(wh.program, wh.handleTrackUpdate)
+		if err != nil {
+			wh.shutdown(err)
+			return
+		}
+	}
 	defer wh.watch.Cancel()
 
+	if wh.program == "" {
+		wh.captionsWatch = wh.tuner.WatchCaptions(wh.handleCaptionsUpdate)
+	} else {
+		wh.captionsWatch, err = wh.tuner.WatchProgramCaptions(wh.program, wh.handleCaptionsUpdate)
+		if err != nil {
+			wh.shutdown(err)
+			return
+		}
+	}
+	defer wh.captionsWatch.Cancel()
+
+	if wh.viewer.CanTimeshift() {
+		wh.timeshiftWatch = wh.viewer.WatchTimeshift(wh.handleTimeshiftUpdate)
+		defer wh.timeshiftWatch.Cancel()
+	}
+
 	<-wh.ctx.Done()
 }
 
+func programErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, tuner.ErrChannelNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, tuner.ErrProgramUnavailable):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func (wh *WebRTCHandler) handleClientSessionAnswers() {
 	for {
 		_, r, err := wh.socket.NextReader()
@@ -106,25 +308,389 @@ func (wh *WebRTCHandler) handleClientSessionAnswers() {
 			return
 		}
 
-		var msg struct{ SDP webrtc.SessionDescription }
+		// Clients send session answers in response to our offers, and may also
+		// choose one of the quality profiles that we advertise, or a caption
+		// service (with an empty name to turn captions off). Clients watching a
+		// recording may also pause or resume it, or seek to a position within it
+		// in seconds. Clients watching live TV may pause or resume it too, rewind
+		// by a number of seconds (or skip forward with a negative number), or
+		// return to live, within the tuner's timeshift window.
+		var msg struct {
+			SDP            *webrtc.SessionDescription
+			Profile        string
+			CaptionService *string
+			Pause          *bool
+			Seek           *float64
+			Rewind         *float64
+			Live           bool
+		}
 		if err := json.NewDecoder(r).Decode(&msg); err != nil {
 			wh.shutdown(err)
 			return
 		}
 
-		if err := wh.rtcPeer.SetRemoteDescription(msg.SDP); err != nil {
+		if msg.SDP != nil {
+			if err := wh.rtcPeer.SetRemoteDescription(*msg.SDP); err != nil {
+				wh.shutdown(err)
+				return
+			}
+			if err := wh.updateAudio(); err != nil {
+				wh.shutdown(err)
+				return
+			}
+		}
+
+		if msg.Profile != "" {
+			if err := wh.handleProfileRequest(msg.Profile); err != nil {
+				wh.shutdown(err)
+				return
+			}
+		}
+
+		if msg.CaptionService != nil {
+			if err := wh.handleCaptionServiceRequest(*msg.CaptionService); err != nil {
+				wh.shutdown(err)
+				return
+			}
+		}
+
+		if msg.Pause != nil || msg.Seek != nil || msg.Rewind != nil || msg.Live {
+			var err error
+			if wh.player != nil {
+				err = wh.handlePlaybackRequest(msg.Pause, msg.Seek)
+			} else {
+				err = wh.handleTimeshiftRequest(msg.Pause, msg.Seek, msg.Rewind, msg.Live)
+			}
+			if err != nil {
+				wh.shutdown(err)
+				return
+			}
+		}
+	}
+}
+
+// playbackMsg describes the progress of a recording's playback, with its
+// position and duration in seconds.
+type playbackMsg struct {
+	Position float64
+	Duration float64
+	Paused   bool
+	Ended    bool
+}
+
+// playbackReportInterval is how often the handler reports the progress of a
+// recording's playback to the client.
+const playbackReportInterval = time.Second
+
+func (wh *WebRTCHandler) handlePlaybackRequest(pause *bool, seek *float64) error {
+	if seek != nil {
+		position := time.Duration(*seek * float64(time.Second))
+		wh.log.Info("Received seek request", "position", position)
+		if err := wh.player.Seek(position); err != nil {
+			return err
+		}
+	}
+
+	if pause != nil {
+		wh.log.Info("Received pause request", "pause", *pause)
+		var err error
+		if *pause {
+			err = wh.player.Pause()
+		} else {
+			err = wh.player.Resume()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return wh.sendPlayback()
+}
+
+// reportPlayback periodically sends the progress of the recording's playback
+// to the client, until the handler shuts down.
+func (wh *WebRTCHandler) reportPlayback() {
+	ticker := time.NewTicker(playbackReportInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := wh.sendPlayback(); err != nil {
 			wh.shutdown(err)
 			return
 		}
+		select {
+		case <-wh.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (wh *WebRTCHandler) sendPlayback() error {
+	status := wh.player.Status()
+	return wh.writeJSON(struct{ Playback playbackMsg }{playbackMsg{
+		Position: status.Position.Seconds(),
+		Duration: status.Duration.Seconds(),
+		Paused:   status.Paused,
+		Ended:    status.Ended,
+	}})
+}
+
+// timeshiftMsg describes the viewer's position relative to live TV, with the
+// delay behind live and the furthest that the viewer can rewind in seconds.
+type timeshiftMsg struct {
+	Live      bool
+	Paused    bool
+	Delay     float64
+	Available float64
+}
+
+func (wh *WebRTCHandler) handleTimeshiftRequest(pause *bool, seek, rewind *float64, live bool) error {
+	if seek != nil {
+		wh.log.Warn("Ignoring seek request outside of a recording")
+	}
+	if live {
+		wh.log.Info("Received live request")
+		wh.viewer.GoLive()
+	}
+
+	var err error
+	if rewind != nil {
+		d := time.Duration(*rewind * float64(time.Second))
+		wh.log.Info("Received rewind request", "duration", d)
+		err = wh.viewer.Rewind(d)
+	}
+	if pause != nil && err == nil {
+		wh.log.Info("Received pause request", "pause", *pause)
+		if *pause {
+			err = wh.viewer.Pause()
+		} else {
+			err = wh.viewer.Resume()
+		}
+	}
+
+	// Timeshifting comes and goes with the tuner's stream, so a request that
+	// arrives at the wrong moment isn't worth dropping the client over.
+	if errors.Is(err, tuner.ErrTimeshiftUnavailable) {
+		wh.log.Warn("Ignoring timeshift request", "error", err)
+		return nil
+	}
+	return err
+}
+
+func (wh *WebRTCHandler) handleTimeshiftUpdate(status tuner.TimeshiftStatus) {
+	if err := wh.switchTimeshift(!status.Live); err != nil {
+		wh.shutdown(err)
+		return
+	}
+	err := wh.writeJSON(struct{ Timeshift timeshiftMsg }{timeshiftMsg{
+		Live:      status.Live,
+		Paused:    status.Paused,
+		Delay:     status.Delay.Seconds(),
+		Available: status.Available.Seconds(),
+	}})
+	if err != nil {
+		wh.shutdown(err)
 	}
 }
 
+// switchTimeshift switches the tracks that the handler sends between the
+// tuner's current tracks and the viewer's own timeshifted tracks. As both sets
+// of tracks use the same codecs, this doesn't require renegotiation of the
+// session.
+func (wh *WebRTCHandler) switchTimeshift(shifted bool) error {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	if shifted == wh.shifted {
+		return nil
+	}
+
+	wh.log.Info("Switching timeshift", "live", !shifted)
+	wh.shifted = shifted
+	if shifted && wh.shiftTracks == (tuner.Tracks{}) {
+		wh.shiftTracks = wh.viewer.TimeshiftTracks()
+	}
+	if wh.videoSender == nil {
+		return nil // We'll send the right tracks once we have them.
+	}
+	if err := wh.videoSender.ReplaceTrack(wh.sentTracks().Video[wh.layer]); err != nil {
+		return err
+	}
+	if err := wh.switchAudio(); err != nil {
+		return err
+	}
+	if !shifted {
+		// The viewer rejoins the live stream in the middle, just like a new one.
+		wh.requestKeyFrame()
+	}
+	return nil
+}
+
+// sentTracks returns the set of tracks that the handler sends from: the
+// viewer's own tracks while it is behind live, or the tuner's tracks
+// otherwise. wh.mu must be held.
+func (wh *WebRTCHandler) sentTracks() tuner.Tracks {
+	if wh.shifted {
+		return wh.shiftTracks
+	}
+	return wh.tracks
+}
+
+// qualityProfile is a named preference for video quality that a client can
+// choose for itself.
+type qualityProfile struct {
+	Name        string
+	Description string
+
+	// layer is the video layer that the profile fixes for the viewer, or nil to
+	// let the tuner select a layer based on the viewer's bandwidth.
+	layer *tuner.Layer
+}
+
+const profileAuto = "auto"
+
+// profileLayers names the profile that fixes each video layer.
+var profileLayers = [tuner.NumLayers]qualityProfile{
+	tuner.LayerHigh:   {Name: "max", Description: "Maximum quality"},
+	tuner.LayerMedium: {Name: "balanced", Description: "Balanced"},
+	tuner.LayerLow:    {Name: "saver", Description: "Data saver"},
+}
+
+// qualityProfiles returns the profiles that clients of the handler's tuner may
+// choose from: automatic quality, and a fixed choice of each of the tuner's
+// video layers.
+func (wh *WebRTCHandler) qualityProfiles() []qualityProfile {
+	profiles := []qualityProfile{{Name: profileAuto, Description: "Automatic"}}
+	for _, layer := range wh.tuner.Layers() {
+		profile := profileLayers[layer]
+		profile.layer = &layer
+		profiles = append(profiles, profile)
+	}
+	return profiles
+}
+
+// sendProfiles advertises the available quality profiles to the client, along
+// with the name of the profile that currently applies to it.
+func (wh *WebRTCHandler) sendProfiles() error {
+	return wh.writeJSON(struct {
+		Profiles []qualityProfile
+		Profile  string
+	}{wh.qualityProfiles(), wh.profile})
+}
+
+func (wh *WebRTCHandler) handleProfileRequest(name string) error {
+	wh.log.Info("Received quality profile request", "profile", name)
+
+	profiles := wh.qualityProfiles()
+	idx := slices.IndexFunc(profiles, func(p qualityProfile) bool { return p.Name == name })
+	if idx < 0 {
+		// A client could ask for a profile that the tuner no longer offers, so
+		// we remind it of the ones that it can choose from instead.
+		wh.log.Warn("Ignoring unknown quality profile", "profile", name)
+		return wh.sendProfiles()
+	}
+
+	profile := profiles[idx]
+	if profile.layer == nil {
+		wh.viewer.SetAutoLayer()
+	} else {
+		wh.viewer.SetLayer(*profile.layer)
+	}
+	wh.profile = profile.Name
+	wh.updateLayer()
+	return wh.sendProfiles()
+}
+
+func (wh *WebRTCHandler) handleLayerChanges() {
+	for {
+		select {
+		case <-wh.ctx.Done():
+			return
+		case <-wh.layerChanged:
+			wh.updateLayer()
+		}
+	}
+}
+
+// updateLayer switches the video track that the handler sends to the layer that
+// the tuner selected for the viewer. As every layer uses the same codec, this
+// doesn't require renegotiation of the session.
+func (wh *WebRTCHandler) updateLayer() {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	layer := wh.viewer.Layer()
+	if layer == wh.layer {
+		return
+	}
+
+	wh.log.Info("Switching video layer", "from", wh.layer, "to", layer)
+	wh.layer = layer
+	if wh.videoSender == nil {
+		return // We'll send the new layer once we have tracks.
+	}
+	if err := wh.videoSender.ReplaceTrack(wh.sentTracks().Video[layer]); err != nil {
+		wh.shutdown(err)
+		return
+	}
+	wh.requestKeyFrame()
+}
+
+// updateAudio switches the audio track that the handler sends to the surround
+// audio track if the client's answer accepted its codec, or to the stereo track
+// otherwise. The client's answer lists both codecs for the same transceiver, so
+// this doesn't require renegotiation of the session either.
+func (wh *WebRTCHandler) updateAudio() error {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	return wh.switchAudio()
+}
+
+// switchAudio implements updateAudio, choosing from the set of tracks that the
+// handler currently sends. wh.mu must be held.
+func (wh *WebRTCHandler) switchAudio() error {
+	if wh.audioSender == nil {
+		return nil
+	}
+
+	tracks := wh.sentTracks()
+	track := tracks.Audio
+	if tracks.SurroundAudio != nil && acceptsSurroundAudio(wh.audioSender) {
+		track = tracks.SurroundAudio
+	}
+	if track == nil || track == wh.audioSender.Track() {
+		return nil
+	}
+
+	wh.log.Info("Switching audio track", "surround", track == tracks.SurroundAudio)
+	return wh.audioSender.ReplaceTrack(track)
+}
+
+// acceptsSurroundAudio returns whether the session negotiated for sender
+// includes the codec for surround audio.
+func acceptsSurroundAudio(sender *webrtc.RTPSender) bool {
+	return slices.ContainsFunc(sender.GetParameters().Codecs, func(c webrtc.RTPCodecParameters) bool {
+		return strings.EqualFold(c.MimeType, tuner.SurroundAudioCodecCapability.MimeType)
+	})
+}
+
 func (wh *WebRTCHandler) handleTrackUpdate(ts tuner.Tracks) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	if ts == wh.tracks {
+		// The tuner keeps the same tracks across channel changes, and the peer
+		// connection keeps sending whatever they carry without renegotiation.
+		return
+	}
+
 	wh.logTracks(ts)
 	if err := wh.replaceTracks(ts); err != nil {
 		wh.shutdown(err)
 		return
 	}
+	wh.tracks = ts
 	if err := wh.renegotiateSession(); err != nil {
 		wh.shutdown(err)
 		return
@@ -172,10 +738,19 @@ func (wh *WebRTCHandler) renegotiateSession() error {
 
 	<-gatherComplete
 	msg := struct{ SDP webrtc.SessionDescription }{*wh.rtcPeer.LocalDescription()}
-	return wh.socket.WriteJSON(msg)
+	return wh.writeJSON(msg)
+}
+
+// writeJSON sends a message to the client, which may happen concurrently from
+// both track updates and client requests.
+func (wh *WebRTCHandler) writeJSON(v any) error {
+	wh.socketMu.Lock()
+	defer wh.socketMu.Unlock()
+	return wh.socket.WriteJSON(v)
 }
 
 func (wh *WebRTCHandler) removeTracks() error {
+	wh.videoSender, wh.audioSender = nil, nil
 	for _, sender := range wh.rtcPeer.GetSenders() {
 		if err := wh.rtcPeer.RemoveTrack(sender); err != nil {
 			return err
@@ -192,11 +767,12 @@ func (wh *WebRTCHandler) addTracks(ts tuner.Tracks) error {
 }
 
 func (wh *WebRTCHandler) addTracksWithExistingTransceivers(ts tuner.Tracks) error {
-	if _, err := wh.rtcPeer.AddTrack(ts.Video); err != nil {
-		return err
-	}
-	if _, err := wh.rtcPeer.AddTrack(ts.Audio); err != nil {
-		return err
+	for _, track := range wh.selectTracks(ts) {
+		sender, err := wh.rtcPeer.AddTrack(track)
+		if err != nil {
+			return err
+		}
+		wh.startSender(sender)
 	}
 	return nil
 }
@@ -205,13 +781,144 @@ func (wh *WebRTCHandler) addTracksWithNewTransceivers(ts tuner.Tracks) error {
 	init := webrtc.RTPTransceiverInit{
 		Direction: webrtc.RTPTransceiverDirectionSendonly,
 	}
-	if _, err := wh.rtcPeer.AddTransceiverFromTrack(ts.Video, init); err != nil {
-		return err
+	for _, track := range wh.selectTracks(ts) {
+		transceiver, err := wh.rtcPeer.AddTransceiverFromTrack(track, init)
+		if err != nil {
+			return err
+		}
+		wh.startSender(transceiver.Sender())
+	}
+	return nil
+}
+
+// selectTracks returns the tracks from ts that the handler should send, with
+// the video track for the viewer's current layer and the stereo audio track
+// until the client accepts surround audio. A program without video or audio
+// has no track of that kind to send.
+func (wh *WebRTCHandler) selectTracks(ts tuner.Tracks) []webrtc.TrackLocal {
+	var tracks []webrtc.TrackLocal
+	for _, track := range []webrtc.TrackLocal{ts.Video[wh.layer], ts.Audio} {
+		if track != nil {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks
+}
+
+// startSender keeps track of a newly added sender, and starts processing RTCP
+// feedback for it.
+func (wh *WebRTCHandler) startSender(sender *webrtc.RTPSender) {
+	switch sender.Track().Kind() {
+	case webrtc.RTPCodecTypeVideo:
+		wh.videoSender = sender
+	case webrtc.RTPCodecTypeAudio:
+		wh.audioSender = sender
 	}
-	if _, err := wh.rtcPeer.AddTransceiverFromTrack(ts.Audio, init); err != nil {
+	wh.startRTCPReader(sender)
+}
+
+// startRTCPReader processes RTCP feedback from the client for sender until the
+// sender is stopped, either by removing its track or by closing the peer
+// connection.
+func (wh *WebRTCHandler) startRTCPReader(sender *webrtc.RTPSender) {
+	wh.waitGroup.Add(1)
+	go func() {
+		defer wh.waitGroup.Done()
+		for {
+			packets, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, packet := range packets {
+				switch packet.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					wh.requestKeyFrame()
+				}
+			}
+		}
+	}()
+}
+
+// requestKeyFrame requests a key frame for the viewer's current video layer.
+func (wh *WebRTCHandler) requestKeyFrame() {
+	layer := wh.viewer.Layer()
+	if wh.program == "" {
+		wh.tuner.RequestKeyFrame(layer)
+	} else {
+		wh.tuner.RequestProgramKeyFrame(wh.program, layer)
+	}
+}
+
+type captionServiceMsg struct {
+	Name     string
+	Language string `json:",omitempty"`
+}
+
+// captionMsg carries the lines of text that a caption service displays, which
+// replace any that the client displayed before.
+type captionMsg struct {
+	Service string
+	Lines   []string
+}
+
+func (wh *WebRTCHandler) handleCaptionsUpdate(c tuner.Captions) {
+	wh.captionsMu.Lock()
+	defer wh.captionsMu.Unlock()
+
+	servicesChanged := !slices.Equal(c.Services, wh.captions.Services)
+	wh.captions = c
+	if servicesChanged {
+		if err := wh.sendCaptionServices(); err != nil {
+			wh.shutdown(err)
+			return
+		}
+	}
+	if err := wh.sendCaption(); err != nil {
+		wh.shutdown(err)
+	}
+}
+
+func (wh *WebRTCHandler) handleCaptionServiceRequest(name string) error {
+	wh.log.Info("Received caption service request", "service", name)
+
+	wh.captionsMu.Lock()
+	defer wh.captionsMu.Unlock()
+
+	// Clients may choose a service that the program doesn't carry yet, since
+	// services first found in the video only appear once they display text.
+	wh.captionService = name
+	if err := wh.sendCaptionServices(); err != nil {
 		return err
 	}
-	return nil
+	return wh.sendCaption()
+}
+
+// sendCaptionServices advertises the caption services of the handler's program
+// to the client, along with the name of the service that the client chose.
+// wh.captionsMu must be held.
+func (wh *WebRTCHandler) sendCaptionServices() error {
+	services := make([]captionServiceMsg, len(wh.captions.Services))
+	for i, s := range wh.captions.Services {
+		services[i] = captionServiceMsg{Name: s.Name, Language: s.Language}
+	}
+	return wh.writeJSON(struct {
+		CaptionServices []captionServiceMsg
+		CaptionService  string
+	}{services, wh.captionService})
+}
+
+// sendCaption sends the text of the client's chosen caption service, unless the
+// client already has it. wh.captionsMu must be held.
+func (wh *WebRTCHandler) sendCaption() error {
+	msg := captionMsg{Service: wh.captionService}
+	if msg.Service != "" {
+		msg.Lines = wh.captions.Text[msg.Service]
+	}
+	if msg.Service == wh.sentCaption.Service && slices.Equal(msg.Lines, wh.sentCaption.Lines) {
+		return nil
+	}
+	wh.sentCaption = msg
+	return wh.writeJSON(struct{ Caption captionMsg }{msg})
 }
 
 func (wh *WebRTCHandler) hasTransceivers() bool {
@@ -222,5 +929,11 @@ func (wh *WebRTCHandler) waitForCleanup() {
 	if wh.watch != nil {
 		wh.watch.Wait()
 	}
+	if wh.captionsWatch != nil {
+		wh.captionsWatch.Wait()
+	}
+	if wh.timeshiftWatch != nil {
+		wh.timeshiftWatch.Wait()
+	}
 	wh.waitGroup.Wait()
 }
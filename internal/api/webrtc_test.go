@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/featherbread/hypcast/internal/atsc"
+	"github.com/featherbread/hypcast/internal/atsc/tuner"
+	"github.com/featherbread/hypcast/internal/pipeline/pipelinetest"
+)
+
+const timeout = 5 * time.Second
+
+func TestProfileRequest(t *testing.T) {
+	wh, client := newTestWebRTCHandler(t)
+	go wh.handleClientSessionAnswers()
+
+	// Choosing a profile should fix the viewer's layer, even with plenty of
+	// bandwidth for a better one.
+	wh.viewer.SetAvailableBitrate(bweMaxBitrate)
+	require.NoError(t, client.WriteJSON(map[string]any{"Profile": "saver"}))
+	assert.Equal(t, "saver", readProfiles(t, client).Profile)
+	assert.Equal(t, tuner.LayerLow, wh.viewer.Layer())
+	wh.mu.Lock()
+	assert.Equal(t, tuner.LayerLow, wh.layer, "handler did not switch layers")
+	wh.mu.Unlock()
+
+	// Returning to auto should let the tuner select the layer again.
+	require.NoError(t, client.WriteJSON(map[string]any{"Profile": profileAuto}))
+	assert.Equal(t, profileAuto, readProfiles(t, client).Profile)
+	assert.Equal(t, tuner.LayerHigh, wh.viewer.Layer())
+
+	// An unknown profile should leave the choice alone, and keep the session
+	// open.
+	require.NoError(t, client.WriteJSON(map[string]any{"Profile": "bogus"}))
+	msg := readProfiles(t, client)
+	assert.Equal(t, profileAuto, msg.Profile)
+	assert.Len(t, msg.Profiles, 1+len(wh.tuner.Layers()))
+	assert.Equal(t, tuner.LayerHigh, wh.viewer.Layer())
+	assert.NoError(t, context.Cause(wh.ctx))
+}
+
+func TestSeekLive(t *testing.T) {
+	wh, client := newTestWebRTCHandler(t)
+	go wh.handleClientSessionAnswers()
+
+	// Seeking only applies to recordings, and shouldn't cost a live viewer its
+	// session. The profile request that follows shows that the handler moved on.
+	require.NoError(t, client.WriteJSON(map[string]any{"Seek": 90}))
+	require.NoError(t, client.WriteJSON(map[string]any{"Profile": profileAuto}))
+	assert.Equal(t, profileAuto, readProfiles(t, client).Profile)
+	assert.NoError(t, context.Cause(wh.ctx))
+}
+
+type profilesMsg struct {
+	Profiles []struct{ Name, Description string }
+	Profile  string
+}
+
+func readProfiles(t *testing.T, client *websocket.Conn) profilesMsg {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(timeout))
+	var msg profilesMsg
+	require.NoError(t, client.ReadJSON(&msg))
+	return msg
+}
+
+// newTestWebRTCHandler returns a handler for a viewer of a stopped tuner, along
+// with the client end of the handler's socket. The handler has no peer
+// connection, so it can only handle requests that don't involve one.
+func newTestWebRTCHandler(t *testing.T) (*WebRTCHandler, *websocket.Conn) {
+	t.Helper()
+
+	channels := []atsc.Channel{{Name: "KCTS-HD", FrequencyHz: 189_000_000, Modulation: atsc.Modulation8VSB, ProgramID: 3}}
+	tnr := tuner.NewTuner(channels, tuner.Config{NewPipeline: pipelinetest.NewFactory().New})
+	t.Cleanup(func() { tnr.Stop() })
+
+	sockets := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		socket, err := websocketUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		sockets <- socket
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	ctx, shutdown := context.WithCancelCause(context.Background())
+	t.Cleanup(func() { shutdown(nil) })
+	wh := &WebRTCHandler{
+		log:      slog.Default(),
+		tuner:    tnr,
+		ctx:      ctx,
+		shutdown: shutdown,
+		socket:   <-sockets,
+		viewer:   tnr.AddViewer(""),
+		profile:  profileAuto,
+	}
+	t.Cleanup(func() { wh.socket.Close() })
+	t.Cleanup(wh.viewer.Close)
+	return wh, client
+}
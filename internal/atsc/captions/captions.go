@@ -0,0 +1,190 @@
+// Package captions decodes the CEA-608 and CEA-708 closed captions carried in
+// the cc_data of ATSC video, and tracks the text that each caption service
+// displays as it changes.
+package captions
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Service describes a caption service of a program.
+type Service struct {
+	// Name identifies the service: "CC1" through "CC4" for the CEA-608 caption
+	// channels carried for legacy receivers, or "Service1" through "Service63"
+	// for CEA-708 services.
+	Name string
+
+	// Language is the ISO 639-2 code for the language of the service, such as
+	// "eng" or "spa", or empty if the program does not specify one.
+	Language string
+}
+
+// ServicesFromDescriptor returns the caption services announced by the data of
+// an ATSC caption service descriptor (tag 0x86) in a program map table.
+func ServicesFromDescriptor(data []byte) []Service {
+	if len(data) < 1 {
+		return nil
+	}
+
+	var services []Service
+	count := int(data[0] & 0x1F)
+	data = data[1:]
+	for range count {
+		// Each service has a 3 byte language code, 1 byte identifying the
+		// service, and 2 bytes of flags.
+		if len(data) < 6 {
+			break
+		}
+		var name string
+		if digital := data[3]&0x80 != 0; digital {
+			name = serviceName708(int(data[3] & 0x3F))
+		} else if line21Field := data[3] & 0x01; line21Field == 0 {
+			name = serviceName608(0)
+		} else {
+			name = serviceName608(2)
+		}
+		language := strings.TrimRight(string(data[:3]), "\x00 ")
+		services = append(services, Service{Name: name, Language: language})
+		data = data[6:]
+	}
+	return services
+}
+
+func serviceName608(channel int) string { return "CC" + strconv.Itoa(channel+1) }
+func serviceName708(number int) string  { return "Service" + strconv.Itoa(number) }
+
+// compareServiceNames orders CEA-608 channels before CEA-708 services, and
+// each kind by number.
+func compareServiceNames(a, b string) int {
+	key := func(name string) (int, int) {
+		if n, ok := strings.CutPrefix(name, "CC"); ok {
+			i, _ := strconv.Atoi(n)
+			return 0, i
+		}
+		i, _ := strconv.Atoi(strings.TrimPrefix(name, "Service"))
+		return 1, i
+	}
+	ak, an := key(a)
+	bk, bn := key(b)
+	return cmp.Or(cmp.Compare(ak, bk), cmp.Compare(an, bn))
+}
+
+// Decoder decodes caption data for every service that it finds. The zero value
+// is ready to use.
+type Decoder struct {
+	fields   [2]field608
+	channels [4]*channel608
+	packet   []byte
+	services map[int]*service708
+
+	text map[string][]string
+}
+
+// Each construct in cc_data begins with a byte holding its cc_valid flag and
+// cc_type, which identifies one of the NTSC fields for CEA-608 data or a part
+// of a DTVCC packet for CEA-708 data.
+const (
+	ccValid    = 0x04
+	ccTypeMask = 0x03
+
+	ccTypeField1      = 0
+	ccTypeField2      = 1
+	ccTypePacketData  = 2
+	ccTypePacketStart = 3
+
+	ccDataTripletBytes = 3
+)
+
+// Decode accepts the cc_data of a single video frame, a series of 3 byte
+// constructs as defined by CEA-708, and reports whether the text displayed by
+// any service changed as a result, including by the appearance of a new
+// service.
+func (d *Decoder) Decode(ccData []byte) (changed bool) {
+	for len(ccData) >= ccDataTripletBytes {
+		header, b1, b2 := ccData[0], ccData[1], ccData[2]
+		ccData = ccData[ccDataTripletBytes:]
+
+		valid := header&ccValid != 0
+		switch header & ccTypeMask {
+		case ccTypeField1, ccTypeField2:
+			if valid {
+				field := int(header & ccTypeMask)
+				d.decode608(field, b1&0x7F, b2&0x7F)
+			}
+		case ccTypePacketStart:
+			d.packet = d.packet[:0]
+			if valid {
+				d.packet = append(d.packet, b1, b2)
+				d.finishPacket()
+			}
+		case ccTypePacketData:
+			if valid && len(d.packet) > 0 {
+				d.packet = append(d.packet, b1, b2)
+				d.finishPacket()
+			}
+		}
+	}
+	return d.updateText()
+}
+
+// finishPacket decodes the pending DTVCC packet once it is complete.
+func (d *Decoder) finishPacket() {
+	size := int(d.packet[0]&0x3F) * 2
+	if size == 0 {
+		size = 128
+	}
+	if len(d.packet) < size {
+		return
+	}
+	d.decodePacket(d.packet[1:size])
+	d.packet = d.packet[:0]
+}
+
+// updateText records the text that each service now displays, and reports
+// whether it differs from the text last recorded.
+func (d *Decoder) updateText() (changed bool) {
+	current := make(map[string][]string)
+	for i, c := range d.channels {
+		if c != nil {
+			current[serviceName608(i)] = c.text()
+		}
+	}
+	for number, s := range d.services {
+		current[serviceName708(number)] = s.text()
+	}
+
+	if maps.EqualFunc(current, d.text, slices.Equal) {
+		return false
+	}
+	d.text = current
+	return true
+}
+
+// Services returns the names of the services for which the decoder has found
+// data, with CEA-608 channels before CEA-708 services.
+func (d *Decoder) Services() []string {
+	return slices.SortedFunc(maps.Keys(d.text), compareServiceNames)
+}
+
+// Text returns the lines of text that each service displays, keyed by service
+// name. The caller may keep the result, which the decoder never modifies.
+func (d *Decoder) Text() map[string][]string {
+	return maps.Clone(d.text)
+}
+
+// displayText returns the non-empty rows of a caption display with the
+// surrounding spaces trimmed, treating zero runes as spaces.
+func displayText(rows [][]rune) []string {
+	var lines []string
+	for _, row := range rows {
+		line := strings.TrimSpace(strings.ReplaceAll(string(row), "\x00", " "))
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,196 @@
+package captions_test
+
+import (
+	"math/bits"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/featherbread/hypcast/internal/atsc/captions"
+)
+
+// line21 returns cc_data carrying pairs of CEA-608 bytes for the given field,
+// with each byte's odd parity bit set as a broadcaster would.
+func line21(field int, pairs ...[2]byte) []byte {
+	parity := func(b byte) byte {
+		if bits.OnesCount8(b)%2 == 0 {
+			return b | 0x80
+		}
+		return b
+	}
+	var data []byte
+	for _, p := range pairs {
+		data = append(data, 0xFC|byte(field), parity(p[0]), parity(p[1]))
+	}
+	return data
+}
+
+// chars returns the CEA-608 pairs that write s.
+func chars(s string) [][2]byte {
+	var pairs [][2]byte
+	for chunk := range slices.Chunk([]byte(s), 2) {
+		pair := [2]byte{chunk[0]}
+		if len(chunk) > 1 {
+			pair[1] = chunk[1]
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+// Control codes for CC1, each of which broadcasters send twice.
+var (
+	resumeCaptionLoading = [2]byte{0x14, 0x20}
+	endOfCaption         = [2]byte{0x14, 0x2F}
+	rollUp2              = [2]byte{0x14, 0x25}
+	carriageReturn       = [2]byte{0x14, 0x2D}
+	eraseDisplayed       = [2]byte{0x14, 0x2C}
+	row15                = [2]byte{0x14, 0x60}
+)
+
+func twice(code [2]byte) [][2]byte { return [][2]byte{code, code} }
+
+func TestDecode608PopOn(t *testing.T) {
+	var d captions.Decoder
+
+	loading := slices.Concat(
+		twice(resumeCaptionLoading),
+		twice(row15),
+		chars("HELLO,"),
+		[][2]byte{{0x11, 0x37}},    // ♪
+		twice([2]byte{0x14, 0x40}), // Row 14
+		chars("Espa~ol CAFE"),
+		[][2]byte{{0x12, 0x21}}, // É, replacing E
+	)
+	d.Decode(line21(0, loading...))
+	if got := d.Text()["CC1"]; len(got) > 0 {
+		t.Errorf("pop-on caption displayed before end of caption: %q", got)
+	}
+
+	if !d.Decode(line21(0, twice(endOfCaption)...)) {
+		t.Errorf("Decode did not report a change at end of caption")
+	}
+	want := []string{"Español CAFÉ", "HELLO,♪"}
+	if diff := cmp.Diff(want, d.Text()["CC1"]); diff != "" {
+		t.Errorf("unexpected CC1 text (-want +got):\n%s", diff)
+	}
+
+	d.Decode(line21(0, twice(eraseDisplayed)...))
+	if got := d.Text()["CC1"]; len(got) > 0 {
+		t.Errorf("caption displayed after erasing: %q", got)
+	}
+}
+
+func TestDecode608RollUp(t *testing.T) {
+	var d captions.Decoder
+
+	data := line21(0, slices.Concat(
+		twice(rollUp2),
+		chars("ONE"),
+		twice(carriageReturn),
+		chars("TWO"),
+		twice(carriageReturn),
+		chars("THREE"),
+	)...)
+	d.Decode(data)
+
+	want := []string{"TWO", "THREE"}
+	if diff := cmp.Diff(want, d.Text()["CC1"]); diff != "" {
+		t.Errorf("unexpected CC1 text (-want +got):\n%s", diff)
+	}
+}
+
+func TestDecode608Channels(t *testing.T) {
+	var d captions.Decoder
+
+	// CC2 shares the first field with CC1, and its control codes set 0x08 in
+	// their first byte. CC3 uses the same codes as CC1, but on the second field.
+	cc2RollUp := [2]byte{0x1C, 0x25}
+	d.Decode(slices.Concat(
+		line21(0, slices.Concat(twice(cc2RollUp), chars("SEGUNDO"))...),
+		line21(1, slices.Concat(twice(rollUp2), chars("TERCERO"))...),
+		line21(1, [2]byte{0x01, 0x03}, [2]byte{'X', 'D'}, [2]byte{0x0F, 0x00}), // XDS
+	))
+
+	want := map[string][]string{
+		"CC2": {"SEGUNDO"},
+		"CC3": {"TERCERO"},
+	}
+	if diff := cmp.Diff(want, d.Text()); diff != "" {
+		t.Errorf("unexpected text (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"CC2", "CC3"}, d.Services()); diff != "" {
+		t.Errorf("unexpected services (-want +got):\n%s", diff)
+	}
+}
+
+// dtvcc returns cc_data carrying a DTVCC packet with a single block of data
+// for the given service.
+func dtvcc(service int, block ...byte) []byte {
+	packet := []byte{0, byte(service<<5 | len(block))}
+	packet = append(packet, block...)
+	if len(packet)%2 != 0 {
+		packet = append(packet, 0)
+	}
+	packet[0] = byte(len(packet) / 2)
+
+	var data []byte
+	for i, pair := range slices.Collect(slices.Chunk(packet, 2)) {
+		header := byte(0xFE)
+		if i == 0 {
+			header = 0xFF
+		}
+		data = append(data, header, pair[0], pair[1])
+	}
+	return data
+}
+
+func TestDecode708(t *testing.T) {
+	var d captions.Decoder
+
+	// Define window 0 hidden with 2 rows of 32 columns, and write to it.
+	d.Decode(dtvcc(1, slices.Concat(
+		[]byte{0x98, 0x00, 0x40, 0x00, 0x01, 0x1F, 0x00},
+		[]byte("Hello,"), []byte{0x0D}, []byte("world"),
+		[]byte{0x10, 0x25}, // EXT1 …
+	)...))
+	if got := d.Text()["Service1"]; len(got) > 0 {
+		t.Errorf("hidden window displayed text: %q", got)
+	}
+
+	// Display the window, then define and display window 1 above it.
+	if !d.Decode(dtvcc(1, 0x89, 0x01)) {
+		t.Errorf("Decode did not report a change when displaying a window")
+	}
+	d.Decode(dtvcc(1, slices.Concat(
+		[]byte{0x99, 0x20, 0x00, 0x00, 0x00, 0x1F, 0x00},
+		[]byte("Top"),
+	)...))
+	want := []string{"Top", "Hello,", "world…"}
+	if diff := cmp.Diff(want, d.Text()["Service1"]); diff != "" {
+		t.Errorf("unexpected Service1 text (-want +got):\n%s", diff)
+	}
+
+	// Scroll window 0 with another carriage return, then delete window 1.
+	d.Decode(dtvcc(1, slices.Concat([]byte{0x80, 0x0D}, []byte("again"), []byte{0x8C, 0x02})...))
+	want = []string{"world…", "again"}
+	if diff := cmp.Diff(want, d.Text()["Service1"]); diff != "" {
+		t.Errorf("unexpected Service1 text (-want +got):\n%s", diff)
+	}
+}
+
+func TestServicesFromDescriptor(t *testing.T) {
+	data := []byte{
+		0xC2,
+		'e', 'n', 'g', 0x7E, 0x3F, 0xFF, // Line 21, field 1
+		's', 'p', 'a', 0xC2, 0x3F, 0xFF, // Service 2
+	}
+	want := []captions.Service{
+		{Name: "CC1", Language: "eng"},
+		{Name: "Service2", Language: "spa"},
+	}
+	if diff := cmp.Diff(want, captions.ServicesFromDescriptor(data)); diff != "" {
+		t.Errorf("unexpected services (-want +got):\n%s", diff)
+	}
+}
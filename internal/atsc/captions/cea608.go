@@ -0,0 +1,289 @@
+package captions
+
+// The CEA-608 caption display is a grid of 15 rows of 32 columns.
+const (
+	rows608 = 15
+	cols608 = 32
+)
+
+// mode608 is the captioning mode of a CEA-608 channel, which determines where
+// its text appears.
+type mode608 int
+
+const (
+	// modeNone ignores text until the channel selects a captioning mode.
+	modeNone mode608 = iota
+	// modePopOn builds captions off screen, and displays each one in full.
+	modePopOn
+	// modeRollUp displays text as it arrives at the bottom of a window of rows
+	// that scrolls up with each new line.
+	modeRollUp
+	// modePaintOn displays text as it arrives at any position.
+	modePaintOn
+	// modeText ignores the text service that shares the channel's data.
+	modeText
+)
+
+// field608 tracks the state of one NTSC field's data, which carries two
+// caption channels.
+type field608 struct {
+	// channel is the channel that receives characters, as selected by the last
+	// control code.
+	channel int
+	// lastControl holds the last control code, which is commonly sent twice in a
+	// row for redundancy, so that the decoder can skip the repeat.
+	lastControl [2]byte
+	// xds indicates that the field is carrying extended data services packets,
+	// whose characters are not captions.
+	xds bool
+}
+
+// channel608 tracks the displayed and non-displayed memories of a single
+// CEA-608 caption channel.
+type channel608 struct {
+	mode       mode608
+	displayed  [rows608][cols608]rune
+	buffered   [rows608][cols608]rune
+	row, col   int
+	rollUpRows int
+}
+
+func (d *Decoder) decode608(field int, b1, b2 byte) {
+	f := &d.fields[field]
+
+	switch {
+	case b1 == 0 && b2 == 0:
+		return // Padding
+	case b1 >= 0x01 && b1 <= 0x0F:
+		// Extended data services, on field 2 only. 0x0F ends a packet, and a
+		// caption control code also interrupts one.
+		f.xds = b1 != 0x0F
+		f.lastControl = [2]byte{}
+		return
+	case b1 >= 0x10 && b1 <= 0x1F:
+		f.xds = false
+		code := [2]byte{b1, b2}
+		if code == f.lastControl {
+			f.lastControl = [2]byte{}
+			return
+		}
+		f.lastControl = code
+		f.channel = field*2 + int(b1&0x08>>3)
+		d.channel608(f.channel).control(b1&^0x08, b2)
+		return
+	}
+
+	f.lastControl = [2]byte{}
+	if f.xds {
+		return
+	}
+	c := d.channel608(f.channel)
+	c.put(basicChar608(b1))
+	if b2 >= 0x20 {
+		c.put(basicChar608(b2))
+	}
+}
+
+func (d *Decoder) channel608(i int) *channel608 {
+	if d.channels[i] == nil {
+		d.channels[i] = &channel608{row: rows608 - 1}
+	}
+	return d.channels[i]
+}
+
+// control applies a control code, whose first byte is given as if for the
+// channel's field's first channel.
+func (c *channel608) control(b1, b2 byte) {
+	switch {
+	case b2 < 0x20:
+		return // Not a valid control code.
+	case b2 >= 0x40:
+		c.preambleAddress(b1, b2)
+	case (b1 == 0x14 || b1 == 0x15) && b2 <= 0x2F:
+		c.command(b2)
+	case b1 == 0x17 && b2 >= 0x21 && b2 <= 0x23:
+		// Tab offsets move the cursor 1 to 3 columns to the right.
+		c.col = min(c.col+int(b2-0x20), cols608-1)
+	case b1 == 0x11 && b2 <= 0x2F:
+		// Mid-row codes change text attributes, and display as a space.
+		c.put(' ')
+	case b1 == 0x11 && b2 <= 0x3F:
+		c.put(specialChars608[b2-0x30])
+	case (b1 == 0x12 || b1 == 0x13) && b2 <= 0x3F:
+		// Extended characters replace the basic character sent just before them,
+		// which receivers without support for them would display instead.
+		c.backspace()
+		c.put(extendedChars608[b1-0x12][b2-0x20])
+	}
+}
+
+// command applies a miscellaneous control code.
+func (c *channel608) command(b2 byte) {
+	switch b2 {
+	case 0x20: // Resume caption loading
+		c.mode = modePopOn
+	case 0x21: // Backspace
+		c.backspace()
+	case 0x24: // Delete to end of row
+		mem := c.memory()
+		for col := c.col; col < cols608; col++ {
+			mem[c.row][col] = 0
+		}
+	case 0x25, 0x26, 0x27: // Roll-up captions with 2, 3, or 4 rows
+		if c.mode != modeRollUp {
+			c.displayed = [rows608][cols608]rune{}
+			c.buffered = [rows608][cols608]rune{}
+			c.row = rows608 - 1
+		}
+		c.mode = modeRollUp
+		c.rollUpRows = int(b2-0x25) + 2
+		c.col = 0
+	case 0x29: // Resume direct captioning
+		c.mode = modePaintOn
+	case 0x2A, 0x2B: // Text restart, resume text display
+		c.mode = modeText
+	case 0x2C: // Erase displayed memory
+		c.displayed = [rows608][cols608]rune{}
+	case 0x2D: // Carriage return
+		if c.mode == modeRollUp {
+			c.rollUp()
+		}
+	case 0x2E: // Erase non-displayed memory
+		c.buffered = [rows608][cols608]rune{}
+	case 0x2F: // End of caption
+		c.displayed, c.buffered = c.buffered, c.displayed
+		c.mode = modePopOn
+	}
+}
+
+// preambleAddressRows maps the first byte of a preamble address code to the
+// rows that it addresses, for second bytes from 0x40-0x5F and 0x60-0x7F.
+var preambleAddressRows = map[byte][2]int{
+	0x11: {0, 1},
+	0x12: {2, 3},
+	0x15: {4, 5},
+	0x16: {6, 7},
+	0x17: {8, 9},
+	0x10: {10, -1},
+	0x13: {11, 12},
+	0x14: {13, 14},
+}
+
+// preambleAddress moves the cursor to the row and indentation given by a
+// preamble address code.
+func (c *channel608) preambleAddress(b1, b2 byte) {
+	rows, ok := preambleAddressRows[b1]
+	if !ok {
+		return
+	}
+	row := rows[(b2&0x20)>>5]
+	if row < 0 {
+		return
+	}
+
+	if c.mode == modeRollUp && row != c.row {
+		// The window of roll-up rows moves along with its base row.
+		row = max(row, c.rollUpRows-1)
+		var moved [rows608][cols608]rune
+		for i := range c.rollUpRows {
+			if src := c.row - i; src >= 0 {
+				moved[row-i] = c.displayed[src]
+			}
+		}
+		c.displayed = moved
+	}
+
+	c.row = row
+	c.col = 0
+	if b2&0x10 != 0 {
+		c.col = int(b2&0x0E>>1) * 4
+	}
+}
+
+// memory returns the memory that receives the channel's text.
+func (c *channel608) memory() *[rows608][cols608]rune {
+	if c.mode == modePopOn {
+		return &c.buffered
+	}
+	return &c.displayed
+}
+
+// put writes r at the cursor, which advances up to the last column. The last
+// column receives every character beyond it.
+func (c *channel608) put(r rune) {
+	if c.mode == modeNone || c.mode == modeText {
+		return
+	}
+	c.memory()[c.row][c.col] = r
+	c.col = min(c.col+1, cols608-1)
+}
+
+func (c *channel608) backspace() {
+	if c.col > 0 {
+		c.col--
+		c.memory()[c.row][c.col] = 0
+	}
+}
+
+// rollUp scrolls the roll-up window by one row, leaving the cursor at the start
+// of an empty base row.
+func (c *channel608) rollUp() {
+	top := max(c.row-c.rollUpRows+1, 0)
+	for row := range c.row {
+		if row < top {
+			c.displayed[row] = [cols608]rune{}
+		} else {
+			c.displayed[row] = c.displayed[row+1]
+		}
+	}
+	c.displayed[c.row] = [cols608]rune{}
+	c.col = 0
+}
+
+func (c *channel608) text() []string {
+	rows := make([][]rune, rows608)
+	for i := range c.displayed {
+		rows[i] = c.displayed[i][:]
+	}
+	return displayText(rows)
+}
+
+// basicChar608 returns the character for a byte from the CEA-608 basic
+// character set, which mostly follows ASCII.
+func basicChar608(b byte) rune {
+	switch b {
+	case 0x2A:
+		return 'á'
+	case 0x5C:
+		return 'é'
+	case 0x5E:
+		return 'í'
+	case 0x5F:
+		return 'ó'
+	case 0x60:
+		return 'ú'
+	case 0x7B:
+		return 'ç'
+	case 0x7C:
+		return '÷'
+	case 0x7D:
+		return 'Ñ'
+	case 0x7E:
+		return 'ñ'
+	case 0x7F:
+		return '█'
+	}
+	return rune(b)
+}
+
+// specialChars608 holds the special characters for second bytes 0x30-0x3F. The
+// transparent space at 0x39 displays as a space.
+var specialChars608 = []rune("®°½¿™¢£♪à èâêîôû")
+
+// extendedChars608 holds the extended characters for second bytes 0x20-0x3F,
+// with the Spanish, miscellaneous, and French set for a first byte of 0x12,
+// and the Portuguese, German, and Danish set for 0x13.
+var extendedChars608 = [2][]rune{
+	[]rune("ÁÉÓÚÜü‘¡*'—©℠•“”ÀÂÇÈÊËëÎÏïÔÙùÛ«»"),
+	[]rune("ÃãÍÌìÒòÕõ{}\\^_|~ÄäÖöß¥¤│ÅåØø┌┐└┘"),
+}
@@ -0,0 +1,297 @@
+package captions
+
+import (
+	"cmp"
+	"slices"
+)
+
+// numWindows708 is the number of windows that each CEA-708 service may define.
+const numWindows708 = 8
+
+// service708 tracks the windows of a single CEA-708 caption service.
+type service708 struct {
+	windows [numWindows708]*window708
+	current int
+}
+
+// window708 tracks the text of a single window of a CEA-708 service, along with
+// the attributes that affect which of its text is displayed. The decoder
+// ignores the window's styling and exact placement.
+type window708 struct {
+	visible  bool
+	anchor   int // Vertical position of the window, for ordering its text.
+	rows     [][]rune
+	row, col int
+}
+
+// decodePacket decodes the service blocks of a DTVCC packet, excluding the
+// packet's header.
+func (d *Decoder) decodePacket(data []byte) {
+	for len(data) > 0 {
+		number, size := int(data[0]>>5), int(data[0]&0x1F)
+		data = data[1:]
+		if number == 7 {
+			// Extended service numbers follow in their own byte.
+			if len(data) < 1 {
+				return
+			}
+			number, data = int(data[0]&0x3F), data[1:]
+		}
+		if number == 0 || size > len(data) {
+			return // The rest of the packet is padding.
+		}
+
+		if d.services == nil {
+			d.services = make(map[int]*service708)
+		}
+		s, ok := d.services[number]
+		if !ok {
+			s = &service708{}
+			d.services[number] = s
+		}
+		s.decode(data[:size])
+		data = data[size:]
+	}
+}
+
+// c1ParamLengths holds the number of parameter bytes that follow each command
+// in the C1 code set, from 0x80 to 0x9F.
+var c1ParamLengths = [32]int{
+	0, 0, 0, 0, 0, 0, 0, 0, // CW0-CW7: Set current window
+	1, 1, 1, 1, 1, 1, 0, 0, // CLW, DSW, HDW, TGW, DLW, DLY, DLC, RST
+	2, 3, 2, 0, 0, 0, 0, 4, // SPA, SPC, SPL, reserved, SWA
+	6, 6, 6, 6, 6, 6, 6, 6, // DF0-DF7: Define window
+}
+
+// decode applies the commands and text of a service block.
+func (s *service708) decode(data []byte) {
+	for len(data) > 0 {
+		code := data[0]
+		data = data[1:]
+
+		switch {
+		case code == 0x10: // EXT1
+			if len(data) < 1 {
+				return
+			}
+			n := extendedParamLength708(data)
+			if n < 0 || n > len(data)-1 {
+				return
+			}
+			if r, ok := g2Chars708[data[0]]; ok {
+				s.put(r)
+			}
+			data = data[1+n:]
+
+		case code < 0x20: // C0
+			n := 0
+			switch {
+			case code >= 0x18:
+				n = 2
+			case code >= 0x11:
+				n = 1
+			}
+			if n > len(data) {
+				return
+			}
+			s.control(code, data[:n])
+			data = data[n:]
+
+		case code < 0x80: // G0
+			if code == 0x7F {
+				s.put('♪')
+			} else {
+				s.put(rune(code))
+			}
+
+		case code < 0xA0: // C1
+			n := c1ParamLengths[code-0x80]
+			if n > len(data) {
+				return
+			}
+			s.command(code, data[:n])
+			data = data[n:]
+
+		default: // G1
+			s.put(rune(code))
+		}
+	}
+}
+
+// extendedParamLength708 returns the number of bytes that follow the code at
+// the start of data within the extended code sets, or -1 if data ends before
+// the length of a variable-length command.
+func extendedParamLength708(data []byte) int {
+	switch code := data[0]; {
+	case code < 0x08:
+		return 0
+	case code < 0x10:
+		return 1
+	case code < 0x18:
+		return 2
+	case code < 0x20:
+		return 3
+	case code < 0x80:
+		return 0 // G2
+	case code < 0x88:
+		return 4
+	case code < 0x90:
+		return 5
+	case code < 0xA0:
+		if len(data) < 2 {
+			return -1
+		}
+		return 1 + int(data[1]&0x1F)
+	default:
+		return 0 // G3
+	}
+}
+
+// g2Chars708 holds the characters of the G2 code set.
+var g2Chars708 = map[byte]rune{
+	0x20: ' ', 0x21: ' ', 0x25: '…', 0x2A: 'Š', 0x2C: 'Œ',
+	0x30: '█', 0x31: '‘', 0x32: '’', 0x33: '“', 0x34: '”', 0x35: '•',
+	0x39: '™', 0x3A: 'š', 0x3C: 'œ', 0x3D: '℠', 0x3F: 'Ÿ',
+	0x76: '⅛', 0x77: '⅜', 0x78: '⅝', 0x79: '⅞',
+	0x7A: '│', 0x7B: '┐', 0x7C: '└', 0x7D: '─', 0x7E: '┘', 0x7F: '┌',
+}
+
+// control applies a code from the C0 code set.
+func (s *service708) control(code byte, params []byte) {
+	w := s.windows[s.current]
+	switch code {
+	case 0x08: // Backspace
+		if w != nil && w.col > 0 {
+			w.col--
+			if w.col < len(w.rows[w.row]) {
+				w.rows[w.row][w.col] = 0
+			}
+		}
+	case 0x0C: // Form feed
+		if w != nil {
+			w.clear()
+			w.row, w.col = 0, 0
+		}
+	case 0x0D: // Carriage return
+		if w != nil {
+			w.newline()
+		}
+	case 0x0E: // Horizontal carriage return
+		if w != nil {
+			w.rows[w.row] = nil
+			w.col = 0
+		}
+	case 0x18: // P16: A 16-bit character
+		s.put(rune(params[0])<<8 | rune(params[1]))
+	}
+}
+
+// command applies a command from the C1 code set.
+func (s *service708) command(code byte, params []byte) {
+	switch {
+	case code <= 0x87: // Set current window
+		s.current = int(code - 0x80)
+
+	case code <= 0x8C: // Clear, display, hide, toggle, or delete windows
+		for id, w := range s.windows {
+			if params[0]&(1<<id) == 0 || w == nil {
+				continue
+			}
+			switch code {
+			case 0x88:
+				w.clear()
+			case 0x89:
+				w.visible = true
+			case 0x8A:
+				w.visible = false
+			case 0x8B:
+				w.visible = !w.visible
+			case 0x8C:
+				s.windows[id] = nil
+			}
+		}
+
+	case code == 0x8F: // Reset
+		*s = service708{}
+
+	case code == 0x92: // Set pen location
+		if w := s.windows[s.current]; w != nil {
+			w.row = min(int(params[0]&0x0F), len(w.rows)-1)
+			w.col = int(params[1] & 0x3F)
+		}
+
+	case code >= 0x98: // Define window
+		id := int(code - 0x98)
+		s.current = id
+		w := s.windows[id]
+		if w == nil {
+			w = &window708{}
+			s.windows[id] = w
+		}
+		w.visible = params[0]&0x20 != 0
+		w.anchor = int(params[1] & 0x7F)
+		w.resize(int(params[3]&0x0F) + 1)
+	}
+}
+
+// put writes r to the current window at its pen location.
+func (s *service708) put(r rune) {
+	w := s.windows[s.current]
+	if w == nil {
+		return
+	}
+	row := w.rows[w.row]
+	for len(row) <= w.col {
+		row = append(row, 0)
+	}
+	row[w.col] = r
+	w.rows[w.row] = row
+	w.col++
+}
+
+func (w *window708) clear() {
+	for i := range w.rows {
+		w.rows[i] = nil
+	}
+}
+
+// newline moves the pen to the start of the next row, scrolling the window's
+// text up if the pen is already in its last row.
+func (w *window708) newline() {
+	w.col = 0
+	if w.row < len(w.rows)-1 {
+		w.row++
+		return
+	}
+	copy(w.rows, w.rows[1:])
+	w.rows[len(w.rows)-1] = nil
+}
+
+// resize changes the number of rows in the window, keeping its last rows of
+// text.
+func (w *window708) resize(n int) {
+	if n < len(w.rows) {
+		w.rows = slices.Clone(w.rows[len(w.rows)-n:])
+	} else {
+		w.rows = append(w.rows, make([][]rune, n-len(w.rows))...)
+	}
+	w.row = min(w.row, n-1)
+}
+
+// text returns the text of the service's visible windows, from the top of the
+// screen to the bottom.
+func (s *service708) text() []string {
+	var visible []*window708
+	for _, w := range s.windows {
+		if w != nil && w.visible {
+			visible = append(visible, w)
+		}
+	}
+	slices.SortStableFunc(visible, func(a, b *window708) int { return cmp.Compare(a.anchor, b.anchor) })
+
+	var rows [][]rune
+	for _, w := range visible {
+		rows = append(rows, w.rows...)
+	}
+	return displayText(rows)
+}
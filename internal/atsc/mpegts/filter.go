@@ -0,0 +1,110 @@
+package mpegts
+
+import (
+	"io"
+	"slices"
+)
+
+// ProgramFilter extracts a single program from a multiplex, producing a
+// transport stream that carries only the program's map table and elementary
+// streams, along with a program association table that lists the program
+// alone. Players treat the result like a recording of the program itself.
+type ProgramFilter struct {
+	w       io.Writer
+	number  uint16
+	packets packetReader
+	scanner Scanner
+
+	// started indicates that the filter has written its first program
+	// association table, before which the program's other packets would be
+	// meaningless.
+	started bool
+	patCC   uint8
+}
+
+// NewProgramFilter creates a filter that writes the program with the given
+// number to w. A zero number selects the program with the lowest number in the
+// multiplex.
+func NewProgramFilter(w io.Writer, number uint16) *ProgramFilter {
+	return &ProgramFilter{w: w, number: number}
+}
+
+// Write accepts the next chunk of the multiplex, which need not align with
+// packet boundaries, and writes any of the program's packets that it completes.
+// The filter drops everything up to the first program association table that
+// follows the program's map table.
+func (f *ProgramFilter) Write(data []byte) (int, error) {
+	var err error
+	f.packets.read(data, func(pkt []byte) {
+		if err == nil {
+			err = f.filterPacket(pkt)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (f *ProgramFilter) filterPacket(pkt []byte) error {
+	f.scanner.readPacket(pkt)
+	prog, ok := f.program()
+	if !ok {
+		return nil
+	}
+
+	pid := packetPID(pkt)
+	switch {
+	case pid == patPID:
+		if pkt[1]&0x40 == 0 {
+			return nil // Our replacement fits in the first packet of the table.
+		}
+		f.started = true
+		_, err := f.w.Write(f.patPacket(prog))
+		return err
+
+	case !f.started:
+		return nil
+
+	case pid == prog.PMTPID || pid == prog.PCRPID ||
+		slices.ContainsFunc(prog.Streams, func(es ElementaryStream) bool { return es.PID == pid }):
+		_, err := f.w.Write(pkt)
+		return err
+	}
+	return nil
+}
+
+// program returns the program that the filter extracts, once the filter has
+// read its map table.
+func (f *ProgramFilter) program() (Program, bool) {
+	number := f.number
+	if number == 0 {
+		for n := range f.scanner.pat {
+			if number == 0 || n < number {
+				number = n
+			}
+		}
+	}
+	prog, ok := f.scanner.programs[number]
+	return prog, ok
+}
+
+// patPacket returns a packet carrying a program association table that lists
+// prog alone, and otherwise matches the multiplex's own table.
+func (f *ProgramFilter) patPacket(prog Program) []byte {
+	section := []byte{
+		tableIDPAT, 0xB0, 5 + 4 + 4,
+		byte(f.scanner.tsid >> 8), byte(f.scanner.tsid),
+		0xC1 | f.scanner.patVersion<<1,
+		0x00, 0x00,
+		byte(prog.Number >> 8), byte(prog.Number),
+		0xE0 | byte(prog.PMTPID>>8), byte(prog.PMTPID),
+	}
+	crc := CRC32(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	pkt := []byte{syncByte, 0x40, 0x00, 0x10 | f.patCC, 0x00}
+	f.patCC = (f.patCC + 1) & 0x0F
+	pkt = append(pkt, section...)
+	return append(pkt, slices.Repeat([]byte{0xFF}, PacketSize-len(pkt))...)
+}
@@ -0,0 +1,353 @@
+// Package mpegts reads program-specific information from MPEG transport
+// streams, such as the types of the elementary streams that make up each
+// program in a broadcast multiplex, and extracts single programs from them.
+package mpegts
+
+import "slices"
+
+// PacketSize is the size of a single transport stream packet in bytes.
+const PacketSize = 188
+
+const (
+	syncByte = 0x47
+	patPID   = 0x0000
+
+	tableIDPAT = 0x00
+	tableIDPMT = 0x02
+)
+
+// StreamType identifies the format of an elementary stream, as listed in a
+// program map table.
+type StreamType uint8
+
+// The following are the stream types commonly found in ATSC broadcasts and on
+// cable systems.
+const (
+	StreamTypeMPEG2Video StreamType = 0x02
+	StreamTypeMPEG1Audio StreamType = 0x03
+	StreamTypeMPEG2Audio StreamType = 0x04
+	StreamTypePrivate    StreamType = 0x06 // Identified by its descriptors
+	StreamTypeAACADTS    StreamType = 0x0F
+	StreamTypeAACLATM    StreamType = 0x11
+	StreamTypeH264       StreamType = 0x1B
+	StreamTypeH265       StreamType = 0x24
+	StreamTypeAC3        StreamType = 0x81
+	StreamTypeSCTE35     StreamType = 0x86
+	StreamTypeEAC3       StreamType = 0x87
+)
+
+// The following are the tags of descriptors that further identify or describe
+// elementary streams.
+const (
+	DescriptorTagISO639Language = 0x0A
+	DescriptorTagAVCVideo       = 0x28
+	DescriptorTagDVBAC3         = 0x6A
+	DescriptorTagDVBEAC3        = 0x7A
+	DescriptorTagCaptionService = 0x86
+)
+
+// Descriptor is a single descriptor from a program map table.
+type Descriptor struct {
+	Tag  uint8
+	Data []byte
+}
+
+// ElementaryStream describes a single stream of a program, as listed in the
+// program's map table.
+type ElementaryStream struct {
+	Type        StreamType
+	PID         uint16
+	Descriptors []Descriptor
+}
+
+// Descriptor returns the first of the stream's descriptors with the given tag.
+func (es ElementaryStream) Descriptor(tag uint8) (Descriptor, bool) {
+	for _, d := range es.Descriptors {
+		if d.Tag == tag {
+			return d, true
+		}
+	}
+	return Descriptor{}, false
+}
+
+// Program describes a single program of a multiplex, as listed in the program
+// association table and the program's map table.
+type Program struct {
+	Number  uint16
+	PMTPID  uint16
+	PCRPID  uint16
+	Streams []ElementaryStream
+}
+
+// Scanner reads the program association table and program map tables from
+// transport stream data, which it accepts in chunks of any size.
+type Scanner struct {
+	packets  packetReader
+	sections map[uint16][]byte
+
+	pat        map[uint16]uint16 // PMT PID by program number
+	tsid       uint16            // Transport stream ID from the PAT
+	patVersion uint8
+	programs   map[uint16]Program
+}
+
+// Write accepts the next chunk of a transport stream. It always consumes all
+// of data, skipping over any malformed packets or sections. It never returns
+// an error, but implements io.Writer for convenience.
+func (s *Scanner) Write(data []byte) (int, error) {
+	s.packets.read(data, s.readPacket)
+	return len(data), nil
+}
+
+// packetReader splits transport stream data, which it accepts in chunks of any
+// size, into whole packets.
+type packetReader struct {
+	buf []byte
+}
+
+// read calls fn with each whole packet that data completes, skipping over any
+// data that is out of sync with the packet boundaries. fn must not retain the
+// packet.
+func (r *packetReader) read(data []byte, fn func(pkt []byte)) {
+	r.buf = append(r.buf, data...)
+	for {
+		start := slices.Index(r.buf, syncByte)
+		if start < 0 {
+			r.buf = r.buf[:0]
+			break
+		}
+		if len(r.buf)-start < PacketSize {
+			r.buf = append(r.buf[:0], r.buf[start:]...)
+			break
+		}
+		if len(r.buf)-start > PacketSize && r.buf[start+PacketSize] != syncByte {
+			// Not actually the start of a packet, so try to resynchronize.
+			r.buf = r.buf[start+1:]
+			continue
+		}
+		fn(r.buf[start : start+PacketSize])
+		r.buf = r.buf[start+PacketSize:]
+	}
+}
+
+func packetPID(pkt []byte) uint16 {
+	return uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+}
+
+// Done indicates whether the scanner has read the program association table,
+// along with the map table of every program that it lists.
+func (s *Scanner) Done() bool {
+	if s.pat == nil {
+		return false
+	}
+	for number := range s.pat {
+		if _, ok := s.programs[number]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ProgramDone indicates whether the scanner has read the map table of the
+// numbered program, or has read a program association table that doesn't list
+// the program, without waiting on the map tables of any other programs.
+func (s *Scanner) ProgramDone(number uint16) bool {
+	if s.pat == nil {
+		return false
+	}
+	if _, ok := s.pat[number]; !ok {
+		return true
+	}
+	_, ok := s.programs[number]
+	return ok
+}
+
+// Programs returns every program whose map table the scanner has read, in
+// order of program number.
+func (s *Scanner) Programs() []Program {
+	programs := make([]Program, 0, len(s.programs))
+	for _, p := range s.programs {
+		programs = append(programs, p)
+	}
+	slices.SortFunc(programs, func(a, b Program) int { return int(a.Number) - int(b.Number) })
+	return programs
+}
+
+func (s *Scanner) readPacket(pkt []byte) {
+	pid := packetPID(pkt)
+	if !s.isPSI(pid) {
+		return
+	}
+
+	start := pkt[1]&0x40 != 0
+	payload := pkt[4:]
+	switch pkt[3] >> 4 & 0x3 {
+	case 0b01:
+		// Payload only.
+	case 0b11:
+		n := int(payload[0]) + 1
+		if n > len(payload) {
+			return
+		}
+		payload = payload[n:]
+	default:
+		return
+	}
+
+	if s.sections == nil {
+		s.sections = make(map[uint16][]byte)
+	}
+
+	if !start {
+		if section, ok := s.sections[pid]; ok {
+			s.sections[pid] = append(section, payload...)
+			s.readSections(pid)
+		}
+		return
+	}
+
+	// The pointer field skips over the end of the previous section to the start
+	// of the next.
+	if len(payload) == 0 || int(payload[0])+1 > len(payload) {
+		delete(s.sections, pid)
+		return
+	}
+	pointer := int(payload[0])
+	if section, ok := s.sections[pid]; ok {
+		s.sections[pid] = append(section, payload[1:1+pointer]...)
+		s.readSections(pid)
+	}
+	s.sections[pid] = slices.Clone(payload[1+pointer:])
+	s.readSections(pid)
+}
+
+// readSections reads every complete section buffered for pid, and keeps any
+// incomplete section that follows them to continue in later packets. Stuffing
+// bytes end the sections of a packet.
+func (s *Scanner) readSections(pid uint16) {
+	data := s.sections[pid]
+	for len(data) > 0 && data[0] != 0xFF {
+		if len(data) < 3 {
+			s.sections[pid] = slices.Clone(data)
+			return
+		}
+		length := 3 + (int(data[1]&0x0F)<<8 | int(data[2]))
+		if len(data) < length {
+			s.sections[pid] = slices.Clone(data)
+			return
+		}
+		s.readSection(pid, data[:length])
+		data = data[length:]
+	}
+	delete(s.sections, pid)
+}
+
+func (s *Scanner) isPSI(pid uint16) bool {
+	if pid == patPID {
+		return true
+	}
+	for _, pmtPID := range s.pat {
+		if pid == pmtPID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scanner) readSection(pid uint16, section []byte) {
+	// The checksum of a valid section, including its own CRC field, is zero.
+	if len(section) < 12 || CRC32(section) != 0 {
+		return
+	}
+
+	if section[5]&0x01 == 0 {
+		return // Not yet applicable.
+	}
+
+	body := section[8 : len(section)-4]
+	switch {
+	case pid == patPID && section[0] == tableIDPAT:
+		s.tsid = uint16(section[3])<<8 | uint16(section[4])
+		s.patVersion = section[5] >> 1 & 0x1F
+		s.readPAT(body)
+	case section[0] == tableIDPMT:
+		s.readPMT(pid, uint16(section[3])<<8|uint16(section[4]), body)
+	}
+}
+
+func (s *Scanner) readPAT(body []byte) {
+	pat := make(map[uint16]uint16)
+	for ; len(body) >= 4; body = body[4:] {
+		number := uint16(body[0])<<8 | uint16(body[1])
+		pid := uint16(body[2]&0x1F)<<8 | uint16(body[3])
+		if number != 0 { // Program 0 points to the network information table.
+			pat[number] = pid
+		}
+	}
+	s.pat = pat
+}
+
+func (s *Scanner) readPMT(pid, number uint16, body []byte) {
+	if s.pat[number] != pid || len(body) < 4 {
+		return
+	}
+
+	p := Program{
+		Number: number,
+		PMTPID: pid,
+		PCRPID: uint16(body[0]&0x1F)<<8 | uint16(body[1]),
+	}
+	infoLength := int(body[2]&0x0F)<<8 | int(body[3])
+	if 4+infoLength > len(body) {
+		return
+	}
+	body = body[4+infoLength:]
+
+	for len(body) >= 5 {
+		es := ElementaryStream{
+			Type: StreamType(body[0]),
+			PID:  uint16(body[1]&0x1F)<<8 | uint16(body[2]),
+		}
+		esInfoLength := int(body[3]&0x0F)<<8 | int(body[4])
+		if 5+esInfoLength > len(body) {
+			return
+		}
+		es.Descriptors = readDescriptors(body[5 : 5+esInfoLength])
+		p.Streams = append(p.Streams, es)
+		body = body[5+esInfoLength:]
+	}
+
+	if s.programs == nil {
+		s.programs = make(map[uint16]Program)
+	}
+	s.programs[number] = p
+}
+
+func readDescriptors(data []byte) []Descriptor {
+	var descriptors []Descriptor
+	for len(data) >= 2 {
+		n := int(data[1])
+		if 2+n > len(data) {
+			break
+		}
+		descriptors = append(descriptors, Descriptor{Tag: data[0], Data: data[2 : 2+n]})
+		data = data[2+n:]
+	}
+	return descriptors
+}
+
+// CRC32 computes the CRC-32/MPEG-2 checksum used by PSI sections.
+func CRC32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,251 @@
+package mpegts_test
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/featherbread/hypcast/internal/atsc/mpegts"
+	"github.com/featherbread/hypcast/internal/atsc/mpegts/mpegtstest"
+)
+
+var testPrograms = []mpegts.Program{
+	{
+		Number: 3,
+		PMTPID: 48,
+		PCRPID: 49,
+		Streams: []mpegts.ElementaryStream{
+			{Type: mpegts.StreamTypeMPEG2Video, PID: 49},
+			{Type: mpegts.StreamTypeAC3, PID: 52, Descriptors: []mpegts.Descriptor{
+				{Tag: mpegts.DescriptorTagISO639Language, Data: []byte("eng\x00")},
+			}},
+		},
+	},
+	{
+		Number: 4,
+		PMTPID: 64,
+		PCRPID: 65,
+		Streams: []mpegts.ElementaryStream{
+			{Type: mpegts.StreamTypeH264, PID: 65, Descriptors: []mpegts.Descriptor{
+				{Tag: mpegts.DescriptorTagAVCVideo, Data: []byte{66, 0xC0, 30, 0x3F}},
+			}},
+			{Type: mpegts.StreamTypeEAC3, PID: 68},
+		},
+	},
+}
+
+func TestScanner(t *testing.T) {
+	data := mpegtstest.PSI(testPrograms...)
+
+	testCases := []struct {
+		Description string
+		Data        []byte
+		ChunkSize   int
+	}{
+		{
+			Description: "whole packets",
+			Data:        data,
+			ChunkSize:   mpegts.PacketSize,
+		},
+		{
+			Description: "unaligned chunks",
+			Data:        data,
+			ChunkSize:   100,
+		},
+		{
+			Description: "leading garbage",
+			Data:        append([]byte{0x00, 0x47, 0x12, 0x47, 0x34}, data...),
+			ChunkSize:   37,
+		},
+		{
+			Description: "unrelated packets",
+			Data: slices.Concat(
+				mpegtstest.Packets(49, make([]byte, 300)),
+				data,
+				mpegtstest.Packets(52, make([]byte, 100)),
+			),
+			ChunkSize: 500,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Description, func(t *testing.T) {
+			var s mpegts.Scanner
+			for chunk := range slices.Chunk(tc.Data, tc.ChunkSize) {
+				s.Write(chunk)
+			}
+
+			if !s.Done() {
+				t.Fatalf("scanner not done after reading all tables")
+			}
+			if diff := cmp.Diff(testPrograms, s.Programs()); diff != "" {
+				t.Errorf("unexpected programs (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestScannerIncomplete(t *testing.T) {
+	data := mpegtstest.PSI(testPrograms...)
+
+	var s mpegts.Scanner
+	s.Write(data[:2*mpegts.PacketSize])
+	if s.Done() {
+		t.Fatalf("scanner done before reading every program map table")
+	}
+	if got := len(s.Programs()); got != 1 {
+		t.Errorf("scanner read %d programs, want 1", got)
+	}
+
+	s.Write(data[2*mpegts.PacketSize:])
+	if !s.Done() {
+		t.Errorf("scanner not done after reading all tables")
+	}
+}
+
+func TestScannerSharedPackets(t *testing.T) {
+	programs := slices.Clone(testPrograms)
+	for i := range programs {
+		programs[i].PMTPID = 48
+	}
+	// A long descriptor carries the first map table into a second packet.
+	programs[0].Streams = slices.Clone(programs[0].Streams)
+	programs[0].Streams[0].Descriptors = []mpegts.Descriptor{{Tag: 0x05, Data: bytes.Repeat([]byte("HDMV"), 50)}}
+
+	pat := mpegtstest.Packets(0, mpegtstest.PAT(programs...))
+	first, second := mpegtstest.PMT(programs[0]), mpegtstest.PMT(programs[1])
+	split := mpegts.PacketSize - 5
+
+	testCases := []struct {
+		Description string
+		Data        []byte
+	}{
+		{
+			Description: "two sections in one packet",
+			Data:        slices.Concat(pat, mpegtstest.Packets(48, first, second)),
+		},
+		{
+			Description: "section ends after pointer field",
+			Data: slices.Concat(
+				pat,
+				mpegtstest.Packet(48, true, 0, slices.Concat([]byte{0x00}, first[:split])),
+				mpegtstest.Packet(48, true, 1, slices.Concat([]byte{byte(len(first) - split)}, first[split:], second)),
+			),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Description, func(t *testing.T) {
+			var s mpegts.Scanner
+			s.Write(tc.Data)
+
+			if !s.Done() {
+				t.Fatalf("scanner not done after reading all tables")
+			}
+			if diff := cmp.Diff(programs, s.Programs()); diff != "" {
+				t.Errorf("unexpected programs (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestScannerProgramDone(t *testing.T) {
+	data := mpegtstest.PSI(testPrograms...)
+
+	var s mpegts.Scanner
+	s.Write(data[:mpegts.PacketSize])
+	if s.ProgramDone(3) {
+		t.Fatalf("program done before reading its map table")
+	}
+	if !s.ProgramDone(5) {
+		t.Errorf("missing program not done after reading association table")
+	}
+
+	// The map table of one program should be enough for that program, even
+	// while another's is missing.
+	s.Write(data[mpegts.PacketSize : 2*mpegts.PacketSize])
+	if !s.ProgramDone(3) {
+		t.Errorf("program not done after reading its map table")
+	}
+	if s.ProgramDone(4) || s.Done() {
+		t.Errorf("done before reading every program map table")
+	}
+}
+
+func TestScannerChecksum(t *testing.T) {
+	data := mpegtstest.PSI(testPrograms...)
+	data[10] ^= 0xFF // Corrupt the PAT's first program number.
+
+	var s mpegts.Scanner
+	s.Write(data)
+	if s.Done() {
+		t.Fatalf("scanner accepted a corrupted program association table")
+	}
+	if got := s.Programs(); len(got) > 0 {
+		t.Errorf("scanner read programs without a valid association table: %v", got)
+	}
+}
+
+func TestElementaryStreamDescriptor(t *testing.T) {
+	es := testPrograms[1].Streams[0]
+
+	d, ok := es.Descriptor(mpegts.DescriptorTagAVCVideo)
+	if !ok || d.Data[0] != 66 {
+		t.Errorf("Descriptor(AVCVideo) = %v, %v; want profile 66", d, ok)
+	}
+	if _, ok := es.Descriptor(mpegts.DescriptorTagDVBEAC3); ok {
+		t.Errorf("Descriptor(DVBEAC3) found a missing descriptor")
+	}
+}
+
+func TestProgramFilter(t *testing.T) {
+	// esPacket returns a packet of elementary stream data for pid.
+	esPacket := func(pid uint16, b byte) []byte {
+		pkt := []byte{0x47, byte(pid >> 8), byte(pid), 0x10}
+		return append(pkt, slices.Repeat([]byte{b}, mpegts.PacketSize-len(pkt))...)
+	}
+	psi := mpegtstest.PSI(testPrograms...)
+	data := slices.Concat(
+		esPacket(49, 0xA0), // Before any tables
+		psi,
+		esPacket(49, 0xA1), // Before a table that the filter writes
+		esPacket(65, 0xB1),
+		psi,
+		esPacket(49, 0xA2),
+		esPacket(52, 0xA3),
+		esPacket(65, 0xB2),
+		esPacket(68, 0xB3),
+		esPacket(0x1FFB, 0xC0), // ATSC PSIP
+	)
+
+	for _, number := range []uint16{3, 0} {
+		var out bytes.Buffer
+		f := mpegts.NewProgramFilter(&out, number)
+		for chunk := range slices.Chunk(data, 100) {
+			n, err := f.Write(chunk)
+			if n != len(chunk) || err != nil {
+				t.Fatalf("Write(%d bytes) = %d, %v", len(chunk), n, err)
+			}
+		}
+
+		var s mpegts.Scanner
+		s.Write(out.Bytes())
+		if diff := cmp.Diff(testPrograms[:1], s.Programs()); diff != "" {
+			t.Errorf("program %d: unexpected programs in output (-want +got):\n%s", number, diff)
+		}
+
+		var payloads []byte
+		for pkt := range slices.Chunk(out.Bytes(), mpegts.PacketSize) {
+			if pid := uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2]); pid == 49 || pid == 52 {
+				payloads = append(payloads, pkt[4])
+			} else if pid != 0 && pid != 48 {
+				t.Errorf("program %d: output includes packet for PID %d", number, pid)
+			}
+		}
+		if want := []byte{0xA2, 0xA3}; !bytes.Equal(payloads, want) {
+			t.Errorf("program %d: got elementary stream data %x, want %x", number, payloads, want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Package mpegtstest builds transport stream data for tests that exercise the
+// reading of program-specific information.
+package mpegtstest
+
+import (
+	"slices"
+
+	"github.com/featherbread/hypcast/internal/atsc/mpegts"
+)
+
+// PSI returns transport stream packets carrying a program association table
+// for programs, followed by the program map table of each program.
+func PSI(programs ...mpegts.Program) []byte {
+	data := Packets(0, PAT(programs...))
+	for _, p := range programs {
+		data = append(data, Packets(p.PMTPID, PMT(p))...)
+	}
+	return data
+}
+
+// PAT returns a program association table section for programs.
+func PAT(programs ...mpegts.Program) []byte {
+	var pat []byte
+	for _, p := range programs {
+		pat = append(pat, byte(p.Number>>8), byte(p.Number), 0xE0|byte(p.PMTPID>>8), byte(p.PMTPID))
+	}
+	return Section(0x00, 1, pat)
+}
+
+// PMT returns a program map table section for p.
+func PMT(p mpegts.Program) []byte {
+	pmt := []byte{0xE0 | byte(p.PCRPID>>8), byte(p.PCRPID), 0xF0, 0x00}
+	for _, es := range p.Streams {
+		var info []byte
+		for _, d := range es.Descriptors {
+			info = append(info, d.Tag, byte(len(d.Data)))
+			info = append(info, d.Data...)
+		}
+		pmt = append(pmt,
+			byte(es.Type), 0xE0|byte(es.PID>>8), byte(es.PID),
+			0xF0|byte(len(info)>>8), byte(len(info)))
+		pmt = append(pmt, info...)
+	}
+	return Section(0x02, p.Number, pmt)
+}
+
+// Section returns a complete long-form PSI section with the given table ID and
+// table ID extension, whose body follows the section's header and precedes its
+// CRC.
+func Section(tableID uint8, extension uint16, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{
+		tableID, 0xB0 | byte(length>>8), byte(length),
+		byte(extension >> 8), byte(extension),
+		0xC1, // Version 0, currently applicable
+		0x00, 0x00,
+	}
+	section = append(section, body...)
+	crc := mpegts.CRC32(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// Packets splits PSI sections into transport stream packets for pid, padding
+// the final packet with stuffing bytes. Sections may share a packet when more
+// than one is given, but only the first packet starts a payload unit.
+func Packets(pid uint16, sections ...[]byte) []byte {
+	var data []byte
+	payload := append([]byte{0x00}, slices.Concat(sections...)...) // Pointer field
+	for i := 0; len(payload) > 0; i++ {
+		n := min(len(payload), mpegts.PacketSize-4)
+		data = append(data, Packet(pid, i == 0, i, payload[:n])...)
+		payload = payload[n:]
+	}
+	return data
+}
+
+// Packet returns a single transport stream packet for pid carrying payload,
+// which must include the pointer field if start is set, padded with stuffing
+// bytes. counter is the packet's continuity counter.
+func Packet(pid uint16, start bool, counter int, payload []byte) []byte {
+	packet := []byte{0x47, byte(pid>>8) & 0x1F, byte(pid), 0x10 | byte(counter&0x0F)}
+	if start {
+		packet[1] |= 0x40 // Payload unit start
+	}
+	packet = append(packet, payload...)
+	return append(packet, slices.Repeat([]byte{0xFF}, mpegts.PacketSize-len(packet))...)
+}
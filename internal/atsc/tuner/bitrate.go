@@ -0,0 +1,203 @@
+package tuner
+
+import (
+	"log/slog"
+	"strconv"
+
+	"github.com/featherbread/hypcast/internal/watch"
+)
+
+const (
+	// videoEncoderName is the prefix for the names of the video encoder elements
+	// in each program branch. See [Layer.encoderName].
+	videoEncoderName = "venc"
+
+	// audioBitrate is the fixed bitrate of encoded stereo audio, in bits per second.
+	audioBitrate = 128_000
+
+	// surroundAudioBitrate is the fixed bitrate of encoded 5.1 audio, in bits
+	// per second.
+	surroundAudioBitrate = 256_000
+)
+
+// Viewer represents a single WebRTC client receiving tracks from the tuner,
+// whose connection determines the video layer that it receives and may limit
+// the bitrate at which the tuner encodes that layer.
+type Viewer struct {
+	tuner       *Tuner
+	channelName string
+	available   int
+	layer       Layer
+	fixedLayer  bool
+
+	// shift and timeshift track the viewer's position relative to live. See
+	// [Viewer.Pause].
+	shift     viewerShift
+	timeshift *watch.Value[TimeshiftStatus]
+}
+
+// AddViewer registers a client receiving the tuner's current tracks if
+// channelName is empty, or the program tracks for the named channel otherwise.
+//
+// As the client reports estimates of its available bandwidth through
+// [Viewer.SetAvailableBitrate], the tuner selects the best video layer that the
+// client can receive, unless the client has chosen a layer for itself with
+// [Viewer.SetLayer]. The tuner also lowers the bitrate of each layer as needed
+// so that its stream does not stall on a poor connection. Viewers of the same
+// layer of a program share one encoder, so the tuner encodes each layer for the
+// most constrained of its viewers.
+//
+// The caller must close the viewer once the client disconnects.
+func (t *Tuner) AddViewer(channelName string) *Viewer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	v := &Viewer{
+		tuner:       t,
+		channelName: channelName,
+		layer:       t.nearestLayer(LayerHigh),
+		timeshift:   watch.NewValue(TimeshiftStatus{Live: true}),
+	}
+	t.viewers[v] = struct{}{}
+	return v
+}
+
+// Layer returns the video layer that the viewer should receive.
+func (v *Viewer) Layer() Layer {
+	v.tuner.mu.Lock()
+	defer v.tuner.mu.Unlock()
+	return v.layer
+}
+
+// SetAvailableBitrate updates the estimate of the bandwidth available to the
+// viewer in bits per second, covering both video and audio along with the
+// overhead of their transport. A non-positive value indicates that the
+// bandwidth is unknown.
+func (v *Viewer) SetAvailableBitrate(bps int) {
+	t := v.tuner
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.viewers[v]; !ok {
+		return
+	}
+	v.available = bps
+	if !v.fixedLayer {
+		v.layer = t.autoLayer(v.layer, bps)
+	}
+	t.updateBitrates()
+}
+
+// SetLayer fixes the video layer that the viewer receives, regardless of its
+// available bandwidth. If the tuner does not produce the layer, the viewer
+// receives the nearest one that it does produce.
+func (v *Viewer) SetLayer(layer Layer) {
+	t := v.tuner
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.viewers[v]; !ok {
+		return
+	}
+	v.fixedLayer = true
+	v.layer = t.nearestLayer(layer)
+	t.updateBitrates()
+}
+
+// SetAutoLayer reverts the effect of [Viewer.SetLayer], so that the viewer's
+// video layer once again follows its available bandwidth.
+func (v *Viewer) SetAutoLayer() {
+	t := v.tuner
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.viewers[v]; !ok {
+		return
+	}
+	v.fixedLayer = false
+	v.layer = t.autoLayer(v.layer, v.available)
+	t.updateBitrates()
+}
+
+// Close unregisters the viewer, so that its bandwidth no longer limits the
+// tuner's video, and stops any playback behind live.
+func (v *Viewer) Close() {
+	t := v.tuner
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.viewers[v]; !ok {
+		return
+	}
+	v.stopReplay()
+	delete(t.viewers, v)
+	t.updateBitrates()
+}
+
+// watches returns whether the viewer receives the tracks of prog. t.mu must be
+// held.
+func (v *Viewer) watches(prog *program) bool {
+	if v.channelName == "" {
+		return v.tuner.isPrimary(prog)
+	}
+	return v.channelName == prog.channel.Name
+}
+
+// updateBitrates adjusts the video bitrates of every running program to suit
+// its current viewers. t.mu must be held.
+func (t *Tuner) updateBitrates() {
+	for _, prog := range t.programs {
+		t.updateBitrate(prog)
+	}
+}
+
+// updateBitrate adjusts the bitrate of each of prog's video layers to suit the
+// most constrained of the layer's viewers. To avoid reconfiguring encoders on
+// every minor fluctuation in the viewers' estimates, it ignores changes smaller
+// than 10% unless they reach the bounds of the layer's allowed range. t.mu must
+// be held.
+func (t *Tuner) updateBitrate(prog *program) {
+	if prog.branch == nil {
+		return // Applied once the branch starts.
+	}
+
+	configs := t.layerConfigs()
+	for _, l := range t.Layers() {
+		if l == LayerHigh && prog.streams.Passthrough {
+			continue
+		}
+		config := configs[l]
+		target := config.MaxBitrate
+		for v := range t.viewers {
+			if v.available > 0 && v.layer == l && v.watches(prog) {
+				target = min(target, videoBitrateFor(v.available))
+			}
+		}
+		target = max(target, config.MinBitrate)
+
+		current := prog.videoBitrates[l]
+		if target == current {
+			continue
+		}
+		if diff := max(target, current) - min(target, current); diff*10 < current &&
+			target != config.MinBitrate && target != config.MaxBitrate {
+			continue
+		}
+
+		err := prog.branch.SetProperty(l.encoderName(), "bitrate", strconv.FormatUint(uint64(target), 10))
+		if err != nil {
+			slog.Warn("Failed to set video bitrate", "channel", prog.channel.Name, "layer", l, "error", err)
+			continue
+		}
+		prog.videoBitrates[l] = target
+		slog.Info("Set video bitrate", "channel", prog.channel.Name, "layer", l, "kbps", target)
+	}
+}
+
+// videoBitrateFor converts a viewer's available bandwidth in bits per second to
+// a video bitrate in kbps, leaving room for audio and for the overhead of RTP
+// packets and retransmissions.
+func videoBitrateFor(available int) uint {
+	kbps := (available*85/100 - audioBitrate) / 1000
+	return uint(max(kbps, 0))
+}
@@ -0,0 +1,87 @@
+package tuner
+
+import (
+	"slices"
+	"time"
+
+	"github.com/featherbread/hypcast/internal/atsc/captions"
+	"github.com/featherbread/hypcast/internal/pipeline"
+	"github.com/featherbread/hypcast/internal/watch"
+)
+
+// Captions represents the closed captions of a program as currently displayed.
+type Captions struct {
+	// Services lists the program's caption services: those announced by its
+	// program map table, followed by any others found in its video.
+	Services []captions.Service
+
+	// Text holds the lines of text that each service currently displays, keyed
+	// by service name. Clients must not modify it.
+	Text map[string][]string
+}
+
+// WatchCaptions sets up a handler function to continuously receive the closed
+// captions of the tuner's current channel as they change. See the watch
+// package documentation for details.
+func (t *Tuner) WatchCaptions(handler func(Captions)) watch.Watch {
+	return t.captions.Watch(handler)
+}
+
+// WatchProgramCaptions is like [Tuner.WatchCaptions], but for the program of the
+// named channel, whose captions are present whenever the tuner is streaming it.
+func (t *Tuner) WatchProgramCaptions(channelName string, handler func(Captions)) (watch.Watch, error) {
+	c, ok := t.programCaptions[channelName]
+	if !ok {
+		return nil, ErrChannelNotFound
+	}
+	return c.Watch(handler), nil
+}
+
+// setProgramCaptions publishes the captions of prog, which become the tuner's
+// current captions while prog is the tuner's current program. Sinks may call
+// setProgramCaptions without holding t.mu.
+func (t *Tuner) setProgramCaptions(prog *program, c Captions) {
+	t.programCaptions[prog.channel.Name].Set(c)
+
+	t.captionsMu.Lock()
+	defer t.captionsMu.Unlock()
+	if t.current.Load() == prog {
+		t.captions.Set(c)
+	}
+}
+
+// updateCurrentCaptions publishes the captions of the current channel's
+// program as the tuner's current captions, following a change in the current
+// program. t.mu must be held.
+func (t *Tuner) updateCurrentCaptions() {
+	t.captionsMu.Lock()
+	defer t.captionsMu.Unlock()
+
+	var c Captions
+	if prog := t.current.Load(); prog != nil {
+		c = t.programCaptions[prog.channel.Name].Get()
+	}
+	t.captions.Set(c)
+}
+
+// createCaptionsSink decodes the caption data that accompanies each frame of
+// prog's video, and publishes the program's captions as they change.
+func (t *Tuner) createCaptionsSink(prog *program) pipeline.SinkFunc {
+	var (
+		decoder  captions.Decoder
+		services = prog.streams.CaptionServices
+	)
+	return func(data []byte, _ time.Duration) {
+		if !decoder.Decode(data) {
+			return
+		}
+
+		c := Captions{Services: slices.Clone(services), Text: decoder.Text()}
+		for _, name := range decoder.Services() {
+			if !slices.ContainsFunc(services, func(s captions.Service) bool { return s.Name == name }) {
+				c.Services = append(c.Services, captions.Service{Name: name})
+			}
+		}
+		t.setProgramCaptions(prog, c)
+	}
+}
@@ -0,0 +1,153 @@
+package tuner
+
+import "fmt"
+
+// Layer identifies one of the video encodings that the tuner produces for each
+// program from a single decode of its signal. Clients receive one layer at a
+// time, so that each can trade video quality for bandwidth independently of
+// others watching the same program.
+type Layer int
+
+const (
+	// LayerHigh carries video at the size of the source, up to 1080p.
+	LayerHigh Layer = iota
+	// LayerMedium carries video scaled to 720p.
+	LayerMedium
+	// LayerLow carries video scaled to 360p.
+	LayerLow
+
+	// NumLayers is the number of distinct layers.
+	NumLayers = iota
+)
+
+var layerNames = [NumLayers]string{
+	LayerHigh:   "high",
+	LayerMedium: "medium",
+	LayerLow:    "low",
+}
+
+// ParseLayer selects a Layer by its name, as returned by [Layer.String].
+func ParseLayer(name string) (Layer, error) {
+	for l, layerName := range layerNames {
+		if name == layerName {
+			return Layer(l), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown layer %q", name)
+}
+
+// String returns the name of the layer.
+func (l Layer) String() string {
+	if l < 0 || l >= NumLayers {
+		return fmt.Sprintf("Layer(%d)", int(l))
+	}
+	return layerNames[l]
+}
+
+// sinkName returns the name of the appsink element that receives the layer's
+// encoded video.
+func (l Layer) sinkName() string {
+	return sinkNameVideo + "-" + l.String()
+}
+
+// encoderName returns the name of the video encoder element for the layer,
+// whose bitrate the tuner adjusts to suit the layer's viewers.
+func (l Layer) encoderName() string {
+	return videoEncoderName + "-" + l.String()
+}
+
+// layerConfig describes how a video pipeline produces a single layer.
+type layerConfig struct {
+	// Width and Height give the size of the layer's video, or zero to keep the
+	// size of the source.
+	Width, Height uint
+
+	// MinBitrate and MaxBitrate bound the bitrate of the layer's video in kbps.
+	// A zero MaxBitrate indicates that the pipeline does not produce the layer.
+	MinBitrate, MaxBitrate uint
+}
+
+// videoLayers defines the layers that each video pipeline produces. The
+// low-power pipeline only produces a single small layer, as its name implies.
+var videoLayers = map[VideoPipeline][NumLayers]layerConfig{
+	VideoPipelineDefault: {
+		LayerHigh:   {MinBitrate: 3000, MaxBitrate: 8000},
+		LayerMedium: {Width: 1280, Height: 720, MinBitrate: 1200, MaxBitrate: 4000},
+		LayerLow:    {Width: 640, Height: 360, MinBitrate: 300, MaxBitrate: 1200},
+	},
+	VideoPipelineLowPower: {
+		LayerLow: {Width: 640, Height: 360, MinBitrate: 300, MaxBitrate: 2500},
+	},
+	VideoPipelineVAAPI: {
+		LayerHigh:   {MinBitrate: 4000, MaxBitrate: 12000},
+		LayerMedium: {Width: 1280, Height: 720, MinBitrate: 1500, MaxBitrate: 6000},
+		LayerLow:    {Width: 640, Height: 360, MinBitrate: 300, MaxBitrate: 1500},
+	},
+}
+
+// layerConfigs returns the configuration of every layer for the tuner's video
+// pipeline.
+func (t *Tuner) layerConfigs() [NumLayers]layerConfig {
+	if configs, ok := videoLayers[t.config.VideoPipeline]; ok {
+		return configs
+	}
+	return videoLayers[VideoPipelineDefault]
+}
+
+// hasLayer returns whether the tuner's video pipeline produces layer l.
+func (t *Tuner) hasLayer(l Layer) bool {
+	return l >= 0 && l < NumLayers && t.layerConfigs()[l].MaxBitrate > 0
+}
+
+// Layers returns the video layers that the tuner produces for each program,
+// from highest to lowest quality.
+func (t *Tuner) Layers() []Layer {
+	var layers []Layer
+	for l := range Layer(NumLayers) {
+		if t.hasLayer(l) {
+			layers = append(layers, l)
+		}
+	}
+	return layers
+}
+
+// nearestLayer returns l if the tuner's video pipeline produces it, or else the
+// closest layer that it does produce, preferring lower quality.
+func (t *Tuner) nearestLayer(l Layer) Layer {
+	for next := l; next < NumLayers; next++ {
+		if t.hasLayer(next) {
+			return next
+		}
+	}
+	for next := l - 1; next >= 0; next-- {
+		if t.hasLayer(next) {
+			return next
+		}
+	}
+	return l
+}
+
+// autoLayer selects the highest quality layer whose minimum bitrate fits within
+// the available bandwidth in bits per second, for a viewer currently receiving
+// the current layer. To avoid switching back and forth as the estimate of the
+// bandwidth fluctuates, moving to a higher quality layer requires 25% more than
+// its minimum bitrate. autoLayer keeps the current layer while the bandwidth is
+// unknown, and falls back to the lowest quality layer if none fit.
+func (t *Tuner) autoLayer(current Layer, available int) Layer {
+	if available <= 0 {
+		return t.nearestLayer(current)
+	}
+
+	layers := t.Layers()
+	video := videoBitrateFor(available)
+	for _, l := range layers {
+		need := t.layerConfigs()[l].MinBitrate
+		if l < current {
+			need = need * 5 / 4
+		}
+		if video >= need {
+			return l
+		}
+	}
+	return layers[len(layers)-1]
+}
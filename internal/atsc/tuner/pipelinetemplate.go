@@ -0,0 +1,197 @@
+package tuner
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/featherbread/hypcast/internal/atsc"
+)
+
+// PipelineTemplate is a user-defined variant of the tuner's built-in pipeline
+// description template, which replaces any of the built-in definitions with
+// its own. See [LoadPipelineTemplates].
+type PipelineTemplate struct {
+	tmpl *template.Template
+
+	// surroundAudio indicates that the template's audio branches encode 5.1
+	// audio when asked to. See [Tuner.surroundAudioSink].
+	surroundAudio bool
+}
+
+// pipelineTemplateExt is the file extension of user-defined pipeline templates.
+const pipelineTemplateExt = ".tmpl"
+
+// LoadPipelineTemplates loads a user-defined pipeline template from every file
+// in dir named NAME.tmpl, and returns the templates keyed by the VideoPipeline
+// that each defines. Selecting one of these pipelines through
+// [Config.VideoPipeline] and [Config.PipelineTemplate] gives the tuner a
+// customized pipeline without changes to Hypcast itself.
+//
+// Each file uses text/template syntax, and may {{define}} any of the templates
+// that make up the built-in pipeline description, such as "video-encode" or
+// "program", to replace the built-in definition. The replacements receive the
+// same data as the built-in definitions, including the channel's Modulation,
+// FrequencyHz, and ProgramID, and the VideoPipeline field holds NAME. Files
+// named after a built-in pipeline replace definitions within that pipeline,
+// and keep its set of video layers.
+//
+// LoadPipelineTemplates validates every template by rendering it for a sample
+// channel, and fails if the result does not define the appsink elements that
+// the tuner expects for audio, for each video layer, for probing the
+// multiplex, and for recording it. The appsink for closed captions is optional, and the tuner only
+// delivers captions for programs whose branches define it. Likewise, the tuner
+// only delivers surround audio under [AudioProfileSurround] if the template
+// defines the appsink named by .SurroundAudio whenever that field is set.
+func LoadPipelineTemplates(dir string) (map[VideoPipeline]*PipelineTemplate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make(map[VideoPipeline]*PipelineTemplate)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), pipelineTemplateExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		pt, err := loadPipelineTemplate(path)
+		if err == nil {
+			err = pt.validate(VideoPipeline(name))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("pipeline template %s: %w", path, err)
+		}
+		templates[VideoPipeline(name)] = pt
+	}
+	return templates, nil
+}
+
+func loadPipelineTemplate(path string) (*PipelineTemplate, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.Must(pipelineDescriptionTemplate.Clone()).Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	return &PipelineTemplate{tmpl: tmpl}, nil
+}
+
+// validationChannel is a sample channel for rendering pipeline templates
+// during validation.
+var validationChannel = atsc.Channel{
+	Name:        "Validation",
+	Modulation:  atsc.Modulation8VSB,
+	FrequencyHz: 189_000_000,
+	VideoPID:    49,
+	AudioPID:    52,
+	ProgramID:   3,
+}
+
+// validate renders the template for the named video pipeline, and checks that
+// the results are usable by a tuner.
+func (pt *PipelineTemplate) validate(vp VideoPipeline) error {
+	// Render the audio branch as if the template encodes surround audio, to
+	// find out whether it really does.
+	pt.surroundAudio = true
+	t := &Tuner{config: Config{
+		VideoPipeline:    vp,
+		PipelineTemplate: pt,
+		AudioProfile:     AudioProfileSurround,
+		Source:           SourceDVB,
+	}}
+
+	source, err := t.createPipelineDescription("source", validationChannel, programStreams{})
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(elementNames(teeNamePattern, source), muxElementName) {
+		return fmt.Errorf("source pipeline does not define a tee named %q", muxElementName)
+	}
+	playback, err := t.renderPipelineDescription("playback", validationChannel, programStreams{}, "validation.ts")
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(elementNames(teeNamePattern, playback), muxElementName) {
+		return fmt.Errorf("playback pipeline does not define a tee named %q", muxElementName)
+	}
+
+	probe, err := t.createPipelineDescription("probe", validationChannel, programStreams{})
+	if err != nil {
+		return err
+	}
+	record, err := t.createPipelineDescription("record", validationChannel, programStreams{})
+	if err != nil {
+		return err
+	}
+	program, err := t.createPipelineDescription("program", validationChannel, defaultStreams)
+	if err != nil {
+		return err
+	}
+	audio, err := t.createPipelineDescription("program-audio", validationChannel, defaultStreams)
+	if err != nil {
+		return err
+	}
+	pt.surroundAudio = slices.Contains(elementNames(appsinkNamePattern, audio), sinkNameSurroundAudio)
+
+	return errors.Join(
+		checkSinks("probe", probe, []string{sinkNameProbe}),
+		checkSinks("record", record, []string{sinkNameRecord}),
+		checkSinks("program", program, t.videoSinkNames()),
+		checkSinks("program-audio", audio, []string{sinkNameAudio}),
+	)
+}
+
+// checkSinks returns an error unless the named pipeline description defines
+// an appsink for each of the wanted names.
+func checkSinks(name, description string, want []string) error {
+	sinks := elementNames(appsinkNamePattern, description)
+	var errs []error
+	for _, sink := range want {
+		if !slices.Contains(sinks, sink) {
+			errs = append(errs, fmt.Errorf("%s pipeline does not define an appsink named %q", name, sink))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var (
+	teeNamePattern     = regexp.MustCompile(`\btee\s+name=([\w-]+)`)
+	appsinkNamePattern = regexp.MustCompile(`\bappsink\s+name=([\w-]+)`)
+)
+
+func elementNames(pattern *regexp.Regexp, description string) []string {
+	var names []string
+	for _, match := range pattern.FindAllStringSubmatch(description, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// videoSinkNames returns the names of every sink that the tuner expects in each
+// program's video branch.
+func (t *Tuner) videoSinkNames() []string {
+	var names []string
+	for _, l := range t.Layers() {
+		names = append(names, l.sinkName())
+	}
+	return names
+}
+
+// pipelineTemplate returns the template that defines the tuner's pipelines.
+func (t *Tuner) pipelineTemplate() *template.Template {
+	if t.config.PipelineTemplate != nil {
+		return t.config.PipelineTemplate.tmpl
+	}
+	return pipelineDescriptionTemplate
+}
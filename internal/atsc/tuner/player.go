@@ -0,0 +1,250 @@
+package tuner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/featherbread/hypcast/internal/atsc"
+	"github.com/featherbread/hypcast/internal/atsc/mpegts"
+	"github.com/featherbread/hypcast/internal/pipeline"
+)
+
+// recordingScanLimit is the most of a recording that NewPlayer reads in search
+// of its program's map table.
+const recordingScanLimit = 4 << 20
+
+// ErrPlaybackStopped is returned when controlling a Player whose playback has
+// failed or been closed.
+var ErrPlaybackStopped error = errors.New("playback stopped")
+
+// Player plays a transport stream file written by [Tuner.Record] through the
+// same pipelines and WebRTC tracks as a live tuner, so that clients can watch
+// a recording just like a live channel, while pausing and seeking within it.
+//
+// A Player owns the pipeline that reads its recording, and handles the
+// pipeline's events itself, so that reaching the end of the recording simply
+// ends playback. It streams the recording through a tuner of its own, which
+// supplies the program branches, tracks, and viewers for clients, but never
+// tunes, times out, or retries.
+type Player struct {
+	tuner    *Tuner
+	pipeline pipeline.Pipeline
+
+	mu     sync.Mutex
+	paused bool
+	ended  bool
+}
+
+// PlaybackStatus describes the progress of a Player through its recording.
+type PlaybackStatus struct {
+	// Position is the current position within the recording, and Duration is
+	// the length of the recording, or zero if the player can't determine it.
+	Position time.Duration
+	Duration time.Duration
+
+	Paused bool
+
+	// Ended indicates that playback reached the end of the recording, from
+	// which a Seek can restart it.
+	Ended bool
+}
+
+// NewPlayer starts playing the recording of the named channel at path, with
+// the same pipeline configuration as the tuner, but without using or
+// disturbing the tuner itself. The recording must carry a single program, as
+// recordings by Record do. The player must be closed once it is no longer
+// needed.
+func (t *Tuner) NewPlayer(channelName, path string) (*Player, error) {
+	program, err := readRecordedProgram(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The player's tuner reads a file like SourceFile, so that its branches
+	// don't drop data as they would for a live source.
+	config := t.config
+	config.NormalizeLoudness = t.LoudnessNormalization()
+	config.Source = SourceFile
+	config.SourceDir = ""
+	config.WatchdogTimeout = 0 // A paused recording produces no data.
+	config.RetryMinDelay, config.RetryMaxDelay = 0, 0
+	config.TimeshiftWindow = 0 // The player pauses and seeks on its own.
+
+	channel := atsc.Channel{Name: channelName, ProgramID: uint(program.Number)}
+	pt := NewTuner([]atsc.Channel{channel}, config)
+	// Probing the file would race through it ahead of the program branches, so
+	// the player starts with the streams that it already found.
+	streams, err := pt.selectStreams(channel, program)
+	if err != nil {
+		return nil, err
+	}
+	description, err := pt.renderPipelineDescription("playback", channel, programStreams{}, path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := config.NewPipeline(description)
+	if err != nil {
+		return nil, err
+	}
+
+	player := &Player{tuner: pt, pipeline: p}
+	p.SetEventHandler(player.handlePipelineEvent)
+
+	slog.Info("Starting playback", "channel", channelName, "path", path)
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if err := pt.streamFrom(p, channel, streams); err != nil {
+		return nil, err
+	}
+	return player, nil
+}
+
+// readRecordedProgram reads the first program listed in the recording at path.
+func readRecordedProgram(path string) (mpegts.Program, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return mpegts.Program{}, err
+	}
+	defer f.Close()
+
+	var (
+		scanner mpegts.Scanner
+		buf     = make([]byte, 64<<10)
+	)
+	for read := 0; read < recordingScanLimit && !scanner.Done(); {
+		n, err := f.Read(buf)
+		scanner.Write(buf[:n])
+		read += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return mpegts.Program{}, err
+		}
+	}
+
+	programs := scanner.Programs()
+	if !scanner.Done() || len(programs) == 0 {
+		return mpegts.Program{}, fmt.Errorf("no program found in recording %s", path)
+	}
+	return programs[0], nil
+}
+
+// Tuner returns the tuner that streams the recording, for clients to watch.
+// Clients must not tune, stop, or record through this tuner.
+func (p *Player) Tuner() *Tuner {
+	return p.tuner
+}
+
+// Close stops playback and releases the player's pipeline.
+func (p *Player) Close() error {
+	return p.tuner.Stop()
+}
+
+// Pause pauses playback at the current position.
+func (p *Player) Pause() error {
+	return p.control(func() error {
+		if err := p.pipeline.Pause(); err != nil {
+			return err
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.paused = true
+		return nil
+	})
+}
+
+// Resume resumes paused playback.
+func (p *Player) Resume() error {
+	return p.control(func() error {
+		if err := p.pipeline.Start(); err != nil {
+			return err
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.paused = false
+		return nil
+	})
+}
+
+// Seek moves playback to the nearest key frame at or before position, which
+// is clamped to the start of the recording. Seeking restarts playback that has
+// ended, and keeps paused playback paused.
+func (p *Player) Seek(position time.Duration) error {
+	return p.control(func() error {
+		position = max(position, 0)
+		slog.Info("Seeking playback", "channel", p.tuner.channel.Name, "position", position)
+		if err := p.pipeline.Seek(position); err != nil {
+			return err
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.ended = false
+		return nil
+	})
+}
+
+// Status returns the current progress of playback.
+func (p *Player) Status() PlaybackStatus {
+	var status PlaybackStatus
+	p.control(func() error {
+		// A pipeline that has yet to preroll can't report its position, which
+		// might as well be the start.
+		status.Position, status.Duration, _ = p.pipeline.Position()
+		return nil
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status.Paused, status.Ended = p.paused, p.ended
+	if status.Ended && status.Duration > 0 {
+		status.Position = status.Duration
+	}
+	return status
+}
+
+// control calls fn as long as the player's pipeline is still streaming through
+// its tuner, which keeps the tuner from closing the pipeline until fn returns.
+// It returns ErrPlaybackStopped if the player was closed or playback failed.
+func (p *Player) control(fn func() error) error {
+	t := p.tuner
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pipeline != p.pipeline {
+		return ErrPlaybackStopped
+	}
+	return fn()
+}
+
+// handlePipelineEvent is called synchronously from GStreamer threads (possibly
+// while the tuner's lock is held) for every event posted by the player's
+// pipeline.
+func (p *Player) handlePipelineEvent(ev pipeline.Event) {
+	switch ev.Type {
+	case pipeline.EventError:
+		go p.tuner.handleStreamLoss(p.pipeline, ev.Err)
+	case pipeline.EventEOS:
+		go p.handleEnded()
+	case pipeline.EventWarning:
+		slog.Warn("Playback pipeline warning", "error", ev.Err)
+	}
+}
+
+// handleEnded records that playback reached the end of the recording, unless
+// the player was already stopped. The pipeline stays in place so that playback
+// can seek back into the recording.
+func (p *Player) handleEnded() {
+	p.control(func() error {
+		slog.Info("Reached end of recording", "channel", p.tuner.channel.Name)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.ended = true
+		return nil
+	})
+}
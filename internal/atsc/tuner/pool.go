@@ -0,0 +1,64 @@
+package tuner
+
+import (
+	"iter"
+	"strconv"
+)
+
+// Pool represents a fixed set of tuners, each identified by a string ID. The
+// first tuner in the pool is its default tuner.
+type Pool struct {
+	ids    []string
+	tuners map[string]*Tuner
+}
+
+// NewPool creates a Pool from a non-empty list of tuners, whose IDs are their
+// decimal indexes in the list.
+func NewPool(tuners ...*Tuner) *Pool {
+	if len(tuners) == 0 {
+		panic("tuner pool requires at least one tuner")
+	}
+
+	p := &Pool{
+		ids:    make([]string, len(tuners)),
+		tuners: make(map[string]*Tuner, len(tuners)),
+	}
+	for i, t := range tuners {
+		id := strconv.Itoa(i)
+		p.ids[i] = id
+		p.tuners[id] = t
+	}
+	return p
+}
+
+// Default returns the default tuner of the pool.
+func (p *Pool) Default() *Tuner {
+	return p.tuners[p.DefaultID()]
+}
+
+// DefaultID returns the ID of the default tuner of the pool.
+func (p *Pool) DefaultID() string {
+	return p.ids[0]
+}
+
+// Get returns the tuner with the provided ID, if one exists.
+func (p *Pool) Get(id string) (t *Tuner, ok bool) {
+	t, ok = p.tuners[id]
+	return
+}
+
+// All returns an iterator over the IDs and tuners of the pool, in order.
+func (p *Pool) All() iter.Seq2[string, *Tuner] {
+	return func(yield func(string, *Tuner) bool) {
+		for _, id := range p.ids {
+			if !yield(id, p.tuners[id]) {
+				break
+			}
+		}
+	}
+}
+
+// Len returns the number of tuners in the pool.
+func (p *Pool) Len() int {
+	return len(p.ids)
+}
@@ -0,0 +1,30 @@
+package tuner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+	first, _ := newTestTuner(t, Config{})
+	second, _ := newTestTuner(t, Config{})
+	pool := NewPool(first, second)
+
+	assert.Equal(t, 2, pool.Len())
+	assert.Equal(t, "0", pool.DefaultID())
+	assert.Same(t, first, pool.Default())
+
+	got, ok := pool.Get("1")
+	assert.True(t, ok)
+	assert.Same(t, second, got)
+
+	_, ok = pool.Get("2")
+	assert.False(t, ok)
+
+	var ids []string
+	for id := range pool.All() {
+		ids = append(ids, id)
+	}
+	assert.Equal(t, []string{"0", "1"}, ids)
+}
@@ -0,0 +1,495 @@
+package tuner
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/featherbread/hypcast/internal/atsc"
+	"github.com/featherbread/hypcast/internal/pipeline"
+	"github.com/featherbread/hypcast/internal/watch"
+)
+
+// ErrProgramUnavailable is returned when adding a program whose channel is not
+// carried by the multiplex that the tuner is currently receiving.
+var ErrProgramUnavailable error = errors.New("program not available on current frequency")
+
+// program represents a single program from the current multiplex, which the
+// tuner streams through its own branch of the pipeline.
+type program struct {
+	channel atsc.Channel
+	tracks  *trackSet
+
+	// watchdogs holds the watchdog for each of the program's sinks by name.
+	watchdogs map[string]*watchdog
+
+	// branch and audioBranch stream the program's video and audio once the tuner
+	// knows the formats of its streams, and are nil until then. Meanwhile, probe
+	// reads the program map tables of the multiplex to find those formats.
+	branch      pipeline.Branch
+	audioBranch pipeline.Branch
+	probe       pipeline.Branch
+	streams     programStreams
+
+	// videoBitrates holds the bitrate of the program's video encoder for each
+	// layer in kbps.
+	videoBitrates [NumLayers]uint
+
+	// started indicates that the program has delivered video data.
+	started bool
+
+	// lastKeyFrameRequests holds the time of the last key frame request that the
+	// tuner passed to the program's branch for each layer.
+	lastKeyFrameRequests [NumLayers]time.Time
+
+	// refs counts the callers of AddProgram that have not yet released the
+	// program.
+	refs int
+}
+
+// AddProgram starts streaming the program for the named channel alongside the
+// tuner's current channel, so that clients can watch both at once without a
+// second tuner. The channel must be carried on the same frequency as the
+// tuner's current channel, or AddProgram returns ErrProgramUnavailable. Tracks
+// for the program are available through [Tuner.WatchProgramTracks].
+//
+// Every successful call to AddProgram must be balanced by a call to the
+// returned release function. The tuner stops streaming the program once every
+// caller has released it, unless it is the tuner's current channel. The program
+// also stops if the tuner is stopped, retuned to another frequency, or loses
+// its stream, after which release does nothing.
+func (t *Tuner) AddProgram(channelName string) (release func(), err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	channel, ok := t.channelMap[channelName]
+	if !ok {
+		return nil, ErrChannelNotFound
+	}
+	if t.pipeline == nil || !sameMultiplex(channel, t.channel) {
+		return nil, ErrProgramUnavailable
+	}
+
+	prog, ok := t.programs[channel.Name]
+	if !ok {
+		prog, err = t.startProgram(channel)
+		if err != nil {
+			return nil, err
+		}
+		t.updateBitrate(prog)
+		t.updateProgramStatus()
+	}
+
+	prog.refs++
+	return sync.OnceFunc(func() { t.releaseProgram(prog) }), nil
+}
+
+// WatchProgramTracks sets up a handler function to continuously receive the
+// WebRTC tracks for the named channel's program, which are present whenever
+// the tuner is streaming the program either as its current channel or through
+// [Tuner.AddProgram]. See the watch package documentation for details.
+func (t *Tuner) WatchProgramTracks(channelName string, handler func(Tracks)) (watch.Watch, error) {
+	tracks, ok := t.programTracks[channelName]
+	if !ok {
+		return nil, ErrChannelNotFound
+	}
+	return tracks.Watch(handler), nil
+}
+
+// switchProgram makes channel the tuner's current channel by switching to its
+// program within the current pipeline, which must be receiving the same
+// multiplex. The previous channel's program stops unless it was added through
+// AddProgram. If switchProgram fails, it leaves the tuner with no running
+// pipeline, following the same rules as tune. t.mu must be held.
+func (t *Tuner) switchProgram(channel atsc.Channel) (err error) {
+	slog.Info("Switching program", "from", t.channel.Name, "to", channel.Name)
+
+	defer func() {
+		if err != nil {
+			t.destroyAnyRunningPipeline()
+		}
+	}()
+
+	prev := t.programs[t.channel.Name]
+	prog, ok := t.programs[channel.Name]
+	if !ok {
+		prog, err = t.startProgram(channel)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.channel = channel
+	t.current.Store(prog)
+	t.resetTimeshift(prog)
+	t.updateCurrentCaptions()
+	if prev != nil && prev.refs == 0 {
+		t.stopProgram(prev)
+	}
+	t.updateBitrates()
+
+	t.stopTuneTimer()
+	t.tracks.Set(t.currentTracks.Tracks())
+	if prog.started {
+		// Clients of the current tracks are joining the program in the middle of
+		// its stream, and shouldn't have to wait for its next natural key frame.
+		prog.lastKeyFrameRequests = [NumLayers]time.Time{}
+		for _, l := range t.Layers() {
+			t.requestKeyFrame(prog, l)
+		}
+		t.setPlaying()
+		return nil
+	}
+
+	t.setStatus(Status{
+		State:       StateStarting,
+		ChannelName: channel.Name,
+		Programs:    t.extraProgramNames(),
+	})
+	t.startTuneTimer(t.pipeline)
+	return nil
+}
+
+// keyFrameRequestInterval is the minimum time between key frame requests for a
+// single layer of a program, which bounds the cost of key frames when many
+// clients request them at once.
+const keyFrameRequestInterval = time.Second
+
+// RequestKeyFrame asks the encoder for a layer of the current channel's program
+// to produce a key frame as soon as possible, so that clients can recover from
+// packet loss or begin decoding in the middle of the stream. The tuner ignores
+// requests for a layer that arrive too soon after the last one that it
+// honored.
+func (t *Tuner) RequestKeyFrame(layer Layer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if prog := t.current.Load(); prog != nil {
+		t.requestKeyFrame(prog, layer)
+	}
+}
+
+// RequestProgramKeyFrame is like [Tuner.RequestKeyFrame], but for the program
+// of the named channel. It does nothing if the tuner is not streaming the
+// program.
+func (t *Tuner) RequestProgramKeyFrame(channelName string, layer Layer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if prog, ok := t.programs[channelName]; ok {
+		t.requestKeyFrame(prog, layer)
+	}
+}
+
+// requestKeyFrame implements key frame requests for a layer of prog, subject to
+// keyFrameRequestInterval. t.mu must be held.
+func (t *Tuner) requestKeyFrame(prog *program, layer Layer) {
+	if !t.hasLayer(layer) || prog.branch == nil {
+		return
+	}
+	if layer == LayerHigh && prog.streams.Passthrough {
+		return // No encoder to ask; the broadcast's own key frames will do.
+	}
+
+	now := time.Now()
+	if now.Sub(prog.lastKeyFrameRequests[layer]) < keyFrameRequestInterval {
+		return
+	}
+	prog.lastKeyFrameRequests[layer] = now
+
+	if err := prog.branch.RequestKeyFrame(layer.sinkName()); err != nil {
+		slog.Warn("Failed to request key frame", "channel", prog.channel.Name, "layer", layer, "error", err)
+	}
+}
+
+// SameMultiplex returns whether the named channels are carried on the same
+// frequency, such that the tuner can receive both at once. It returns false if
+// either channel is unknown.
+func (t *Tuner) SameMultiplex(a, b string) bool {
+	chA, okA := t.channelMap[a]
+	chB, okB := t.channelMap[b]
+	return okA && okB && sameMultiplex(chA, chB)
+}
+
+func sameMultiplex(a, b atsc.Channel) bool {
+	return a.FrequencyHz == b.FrequencyHz && a.Modulation == b.Modulation
+}
+
+func (t *Tuner) releaseProgram(prog *program) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.programs[prog.channel.Name] != prog {
+		return // Already stopped along with the rest of the stream.
+	}
+
+	prog.refs--
+	if prog.refs > 0 || t.isPrimary(prog) {
+		return
+	}
+	t.stopProgram(prog)
+	t.updateProgramStatus()
+}
+
+// startProgram begins streaming channel's program within the current pipeline,
+// and publishes its tracks. If the tuner does not yet know the formats of the
+// program's streams, it probes the multiplex for them before adding a branch
+// for the program itself. t.mu must be held.
+func (t *Tuner) startProgram(channel atsc.Channel) (prog *program, err error) {
+	tracks, ok := t.programTrackPairs[channel.Name]
+	if !ok {
+		streamID := fmt.Sprintf("Tuner(%p)/%d/%d", t, channel.FrequencyHz, channel.ProgramID)
+		tracks, err = t.newTrackSet(streamID)
+		if err != nil {
+			return nil, err
+		}
+		t.programTrackPairs[channel.Name] = tracks
+	}
+
+	prog = &program{
+		channel:   channel,
+		tracks:    tracks,
+		watchdogs: make(map[string]*watchdog),
+	}
+	for l, config := range t.layerConfigs() {
+		prog.videoBitrates[l] = config.MaxBitrate
+	}
+
+	// The test source generates its own signals, with nothing to probe.
+	streams, ok := t.streams[channel.Name]
+	if t.config.Source == SourceTest {
+		streams, ok = defaultStreams, true
+	}
+	if ok {
+		err = t.startProgramBranch(prog, streams)
+	} else {
+		err = t.startProbe(prog)
+	}
+	if err != nil {
+		t.stopProgram(prog)
+		return nil, err
+	}
+
+	t.programs[channel.Name] = prog
+	return prog, nil
+}
+
+// startProgramBranch adds branches to the current pipeline that decode prog's
+// streams and encode them for WebRTC, and publishes the program's tracks. The
+// first sample of the program's video, or of its audio if it lacks video,
+// starts the program. t.mu must be held.
+func (t *Tuner) startProgramBranch(prog *program, streams programStreams) error {
+	description, err := t.createPipelineDescription("program", prog.channel, streams)
+	if err != nil {
+		return err
+	}
+
+	branch, err := t.pipeline.AddBranch(muxElementName, description)
+	if err != nil {
+		return err
+	}
+	prog.branch = branch
+	prog.streams = streams
+
+	p := t.pipeline
+	for _, l := range t.Layers() {
+		name := l.sinkName()
+		branch.SetSink(name, t.superviseSink(p, prog, name, streams.Video != "", t.createProgramSink(prog, name)))
+	}
+	// User-defined templates might not extract captions, and a program might
+	// not carry any, so the captions sink has no watchdog.
+	if slices.Contains(elementNames(appsinkNamePattern, description), sinkNameCaptions) {
+		branch.SetSink(sinkNameCaptions, t.createCaptionsSink(prog))
+	}
+	t.setProgramCaptions(prog, Captions{Services: streams.CaptionServices})
+
+	slog.Info("Starting program branch", "channel", prog.channel.Name,
+		"video", streams.Video, "passthrough", streams.Passthrough)
+	if err := branch.Start(); err != nil {
+		return err
+	}
+	if err := t.startAudioBranch(prog); err != nil {
+		return err
+	}
+	t.programTracks[prog.channel.Name].Set(streams.tracks(prog.tracks))
+	return nil
+}
+
+// startAudioBranch adds a branch to the current pipeline that decodes the audio
+// stream selected by prog.streams and encodes it for WebRTC. t.mu must be held.
+func (t *Tuner) startAudioBranch(prog *program) error {
+	streams := prog.streams
+	description, err := t.createPipelineDescription("program-audio", prog.channel, streams)
+	if err != nil {
+		return err
+	}
+
+	branch, err := t.pipeline.AddBranch(muxElementName, description)
+	if err != nil {
+		return err
+	}
+	prog.audioBranch = branch
+
+	sink := t.createProgramSink(prog, sinkNameAudio)
+	branch.SetSink(sinkNameAudio, t.superviseSink(t.pipeline, prog, sinkNameAudio, streams.Video == "", sink))
+	// The surround audio comes from the same decoder as the stereo audio, whose
+	// watchdog covers both.
+	if name := t.surroundAudioSink(); name != "" {
+		branch.SetSink(name, t.createProgramSink(prog, name))
+	}
+
+	slog.Info("Starting program audio branch", "channel", prog.channel.Name,
+		"audio", streams.Audio, "pid", streams.AudioPID)
+	return branch.Start()
+}
+
+// ErrAudioStreamNotFound is returned when selecting an audio stream that the
+// current channel's program does not carry.
+var ErrAudioStreamNotFound = errors.New("audio stream not found")
+
+// SelectAudio switches the current channel's program to the audio stream with
+// the given PID, as listed in the tuner's status, without interrupting its
+// video. The tuner keeps the selection whenever it streams the same channel in
+// the future, as long as the program still carries the stream.
+func (t *Tuner) SelectAudio(pid uint) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prog := t.current.Load()
+	if prog == nil || prog.branch == nil {
+		return fmt.Errorf("%w: no program is streaming", ErrAudioStreamNotFound)
+	}
+	streams, ok := prog.streams.withAudio(pid)
+	if !ok {
+		return fmt.Errorf("%w: %s has no audio stream with PID %d", ErrAudioStreamNotFound, prog.channel.Name, pid)
+	}
+
+	t.audioPIDs[prog.channel.Name] = pid
+	t.streams[prog.channel.Name] = streams
+	if pid == prog.streams.AudioPID {
+		return nil
+	}
+
+	slog.Info("Switching audio stream", "channel", prog.channel.Name, "from", prog.streams.AudioPID, "to", pid)
+	prog.streams = streams
+	if err := t.restartAudioBranch(prog); err != nil {
+		return err
+	}
+
+	if s := t.status.Get(); s.State == StatePlaying {
+		s.AudioPID = pid
+		t.setStatus(s)
+	}
+	return nil
+}
+
+// SetLoudnessNormalization switches loudness normalization of the tuner's audio
+// on or off, overriding [Config.NormalizeLoudness]. The change applies right
+// away to every program that the tuner streams, without interrupting their
+// video.
+func (t *Tuner) SetLoudnessNormalization(enabled bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if enabled == t.normalizeLoudness {
+		return nil
+	}
+	slog.Info("Setting loudness normalization", "enabled", enabled, "target", t.loudnessTarget())
+	t.normalizeLoudness = enabled
+
+	var errs []error
+	for _, prog := range t.programs {
+		if t.pipeline == nil {
+			break // Losing the current program destroyed the whole pipeline.
+		}
+		if prog.audioBranch == nil {
+			continue // Applied once the branch starts.
+		}
+		errs = append(errs, t.restartAudioBranch(prog))
+	}
+	return errors.Join(errs...)
+}
+
+// LoudnessNormalization returns whether the tuner normalizes the loudness of
+// its audio.
+func (t *Tuner) LoudnessNormalization() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.normalizeLoudness
+}
+
+// restartAudioBranch replaces prog's audio branch with a new one that follows
+// the current selection of its audio stream and the tuner's audio settings.
+// t.mu must be held.
+func (t *Tuner) restartAudioBranch(prog *program) error {
+	err := prog.audioBranch.Close()
+	slog.Info("Stopped program audio branch", "channel", prog.channel.Name, "error", err)
+	if err := t.startAudioBranch(prog); err != nil {
+		t.loseProgram(prog, err)
+		return err
+	}
+	return nil
+}
+
+// stopProgram removes prog's branches from the current pipeline, and clears its
+// tracks. t.mu must be held.
+func (t *Tuner) stopProgram(prog *program) {
+	for _, wd := range prog.watchdogs {
+		wd.Stop()
+	}
+	clear(prog.watchdogs)
+
+	if t.current.CompareAndSwap(prog, nil) {
+		t.resetTimeshift(nil)
+		t.updateCurrentCaptions()
+	}
+	if prog.probe != nil {
+		prog.probe.Close()
+		prog.probe = nil
+	}
+	var errs []error
+	if prog.branch != nil {
+		errs = append(errs, prog.branch.Close())
+	}
+	if prog.audioBranch != nil {
+		errs = append(errs, prog.audioBranch.Close())
+	}
+	err := errors.Join(errs...)
+	slog.Info("Stopped program branch", "channel", prog.channel.Name, "error", err)
+
+	if t.programs[prog.channel.Name] == prog {
+		delete(t.programs, prog.channel.Name)
+		t.programTracks[prog.channel.Name].Set(Tracks{})
+		t.programCaptions[prog.channel.Name].Set(Captions{})
+	}
+}
+
+// isPrimary returns whether prog is the program for the tuner's current
+// channel. t.mu must be held.
+func (t *Tuner) isPrimary(prog *program) bool {
+	return t.current.Load() == prog
+}
+
+// extraProgramNames returns the names of channels other than the current
+// channel whose programs are streaming, in sorted order. t.mu must be held.
+func (t *Tuner) extraProgramNames() []string {
+	var names []string
+	for name := range t.programs {
+		if name != t.channel.Name {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// updateProgramStatus republishes the tuner's status to reflect a change in
+// its extra programs. t.mu must be held.
+func (t *Tuner) updateProgramStatus() {
+	s := t.status.Get()
+	s.Programs = t.extraProgramNames()
+	t.setStatus(s)
+}
@@ -0,0 +1,323 @@
+package tuner
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/featherbread/hypcast/internal/atsc"
+	"github.com/featherbread/hypcast/internal/atsc/mpegts"
+	"github.com/featherbread/hypcast/internal/pipeline"
+)
+
+// ErrRecordingInterrupted ends a recording when the tuner stops streaming its
+// channel's multiplex for any reason other than a request to end the recording.
+var ErrRecordingInterrupted error = errors.New("recording interrupted")
+
+// recordBufferSize is how much of the multiplex a recording holds in memory
+// while its writer falls behind, about half a minute of a full ATSC multiplex.
+// A recording drops and counts whatever arrives beyond this, rather than stall
+// the pipeline that it shares with the tuner's viewers.
+var recordBufferSize = 64 << 20
+
+// Recording is a recording of a single channel's program by a tuner. See
+// [Tuner.Record].
+type Recording struct {
+	tuner   *Tuner
+	channel atsc.Channel
+
+	// branch feeds the recording from the tuner's current pipeline, and is nil
+	// while the tuner has no pipeline, such as while it waits to retry a lost
+	// stream. The tuner's lock protects it.
+	branch pipeline.Branch
+
+	// mu protects the data that the recording's sink buffers for the writer
+	// goroutine, which drains it to filter, along with the end of the
+	// recording. The writer goroutine closes done once it has drained every
+	// buffer after the recording ends, and never writes again.
+	mu           sync.Mutex
+	wake         *sync.Cond
+	pending      [][]byte
+	pendingBytes int
+	dropped      int
+	writeErr     error
+	ended        bool
+	err          error
+
+	filter *mpegts.ProgramFilter
+	done   chan struct{}
+}
+
+// Record starts recording the program of the named channel to w, which
+// receives a transport stream carrying the program's video, audio, and
+// captions exactly as broadcast, without any of the multiplex's other programs.
+// The test source has no broadcast, so its recordings carry an encoding of its
+// test signals instead.
+//
+// If the tuner is stopped, Record tunes it to the channel, and the tuner stops
+// again once its last recording ends, unless a client has tuned it in the
+// meantime. Otherwise, the channel must be carried on the same frequency as the
+// tuner's current channel, or Record returns ErrProgramUnavailable.
+//
+// A recording continues across changes to programs on the same frequency, and
+// across any automatic retries of a lost stream, though it will miss whatever
+// the tuner does not receive. Writes to w happen on a goroutine of their own,
+// which buffers the multiplex while w falls behind, and drops whatever it can't
+// buffer; see [Recording.Dropped]. A recording ends with
+// ErrRecordingInterrupted if the tuner is stopped, retuned to another
+// frequency, or loses its stream for good, or with the error from w if a write
+// to w fails. Every recording that does not end on its own must be ended with
+// [Recording.Stop].
+func (t *Tuner) Record(channelName string, w io.Writer) (*Recording, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	channel, ok := t.channelMap[channelName]
+	if !ok {
+		return nil, ErrChannelNotFound
+	}
+
+	if t.pipeline == nil && t.retryTimer == nil {
+		slog.Info("Tuning to start recording", "channel", channel.Name)
+		if err := t.tuneChannel(channel); err != nil {
+			return nil, err
+		}
+		t.recordingOnly = true
+	} else if !sameMultiplex(channel, t.channel) {
+		return nil, ErrProgramUnavailable
+	}
+
+	r := &Recording{
+		tuner:   t,
+		channel: channel,
+		filter:  mpegts.NewProgramFilter(w, uint16(channel.ProgramID)),
+		done:    make(chan struct{}),
+	}
+	r.wake = sync.NewCond(&r.mu)
+	if t.pipeline != nil {
+		if err := t.startRecordingBranch(r); err != nil {
+			if r.branch != nil {
+				r.branch.Close()
+			}
+			t.stopIfRecordingOnly()
+			return nil, err
+		}
+	}
+	t.recordings[r] = struct{}{}
+	go r.drain()
+	slog.Info("Started recording", "channel", channel.Name)
+	return r, nil
+}
+
+// ChannelName returns the name of the channel that the recording is recording.
+func (r *Recording) ChannelName() string {
+	return r.channel.Name
+}
+
+// Stop ends the recording if it has not already ended, waits for it to write
+// whatever it has buffered, and returns the error that ended it, if any. Once
+// Stop returns, the recording will not write to its writer again.
+func (r *Recording) Stop() error {
+	t := r.tuner
+	t.mu.Lock()
+	if _, ok := t.recordings[r]; ok {
+		t.endRecording(r, nil)
+		t.stopIfRecordingOnly()
+	}
+	t.mu.Unlock()
+	<-r.done
+	return r.err
+}
+
+// Dropped returns the number of buffers of the multiplex that the recording
+// has dropped so far because its writer fell too far behind. Any dropped
+// buffer leaves a gap in the recorded stream.
+func (r *Recording) Dropped() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dropped
+}
+
+// Done returns a channel that is closed when the recording ends and has
+// written whatever it buffered.
+func (r *Recording) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns the error that ended the recording, or nil if the recording ended
+// through a call to Stop or has not yet ended.
+func (r *Recording) Err() error {
+	select {
+	case <-r.done:
+		return r.err
+	default:
+		return nil
+	}
+}
+
+// write is the sink function for the recording's branch, which buffers data
+// for the writer goroutine without waiting for the writer.
+func (r *Recording) write(data []byte, _ time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ended || r.writeErr != nil {
+		return
+	}
+	if r.pendingBytes+len(data) > recordBufferSize {
+		r.dropped++
+		if r.dropped == 1 {
+			slog.Warn("Recording fell behind and is dropping data", "channel", r.channel.Name)
+		}
+		return
+	}
+	r.pending = append(r.pending, bytes.Clone(data))
+	r.pendingBytes += len(data)
+	r.wake.Signal()
+}
+
+// drain writes the recording's buffered data to its filter until the recording
+// ends and every buffer is written, then closes r.done.
+func (r *Recording) drain() {
+	r.mu.Lock()
+	defer func() {
+		if r.err == nil {
+			r.err = r.writeErr
+		}
+		if r.dropped > 0 {
+			slog.Warn("Recording dropped data", "channel", r.channel.Name, "buffers", r.dropped)
+		}
+		r.mu.Unlock()
+		close(r.done)
+	}()
+
+	for {
+		for len(r.pending) == 0 && !r.ended {
+			r.wake.Wait()
+		}
+		if len(r.pending) == 0 {
+			return
+		}
+
+		batch := r.pending
+		r.pending = nil
+		failed := r.writeErr != nil
+		r.mu.Unlock()
+
+		var (
+			written int
+			err     error
+		)
+		for _, data := range batch {
+			written += len(data)
+			if !failed && err == nil {
+				_, err = r.filter.Write(data)
+			}
+		}
+
+		r.mu.Lock()
+		r.pendingBytes -= written
+		if err != nil && r.writeErr == nil {
+			r.writeErr = err
+			go r.tuner.handleRecordingFailure(r, err)
+		}
+	}
+}
+
+// handleRecordingFailure ends r with err, unless r already ended.
+func (t *Tuner) handleRecordingFailure(r *Recording, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.recordings[r]; ok {
+		t.endRecording(r, err)
+		t.stopIfRecordingOnly()
+	}
+}
+
+// startRecordingBranch adds a branch to the current pipeline that feeds the
+// multiplex to r. On failure, the caller must close any branch that it leaves
+// in r.branch. t.mu must be held.
+func (t *Tuner) startRecordingBranch(r *Recording) error {
+	description, err := t.createPipelineDescription("record", r.channel, programStreams{})
+	if err != nil {
+		return err
+	}
+
+	branch, err := t.pipeline.AddBranch(muxElementName, description)
+	if err != nil {
+		return err
+	}
+	r.branch = branch
+	branch.SetSink(sinkNameRecord, r.write)
+	return branch.Start()
+}
+
+// resumeRecordings reattaches every recording to the current pipeline, which
+// the tuner has just created, and ends any recording whose channel is not
+// carried by the pipeline's multiplex. t.mu must be held.
+func (t *Tuner) resumeRecordings() {
+	for r := range t.recordings {
+		if !sameMultiplex(r.channel, t.channel) {
+			t.endRecording(r, ErrRecordingInterrupted)
+			continue
+		}
+		if err := t.startRecordingBranch(r); err != nil {
+			t.endRecording(r, err)
+		}
+	}
+}
+
+// detachRecordings closes every recording's branch before the tuner destroys
+// its pipeline, and leaves the recordings to continue in the next pipeline.
+// t.mu must be held.
+func (t *Tuner) detachRecordings() {
+	for r := range t.recordings {
+		if r.branch != nil {
+			r.branch.Close()
+			r.branch = nil
+		}
+	}
+}
+
+// interruptRecordings ends every recording with ErrRecordingInterrupted. t.mu
+// must be held.
+func (t *Tuner) interruptRecordings() {
+	for r := range t.recordings {
+		t.endRecording(r, ErrRecordingInterrupted)
+	}
+}
+
+// endRecording ends r, which must be one of the tuner's recordings, with err.
+// t.mu must be held.
+func (t *Tuner) endRecording(r *Recording, err error) {
+	delete(t.recordings, r)
+	if r.branch != nil {
+		r.branch.Close()
+		r.branch = nil
+	}
+
+	r.mu.Lock()
+	r.ended = true
+	r.err = err
+	r.wake.Signal()
+	r.mu.Unlock()
+
+	if err != nil {
+		slog.Error("Recording failed", "channel", r.channel.Name, "error", err)
+	} else {
+		slog.Info("Stopped recording", "channel", r.channel.Name)
+	}
+}
+
+// stopIfRecordingOnly stops the tuner if it was started by Record, and now has
+// neither recordings nor viewers to serve. t.mu must be held.
+func (t *Tuner) stopIfRecordingOnly() {
+	if t.recordingOnly && len(t.recordings) == 0 && len(t.viewers) == 0 {
+		slog.Info("Stopping tuner after last recording")
+		t.stop()
+	}
+}
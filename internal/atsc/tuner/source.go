@@ -0,0 +1,110 @@
+package tuner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/featherbread/hypcast/internal/atsc"
+)
+
+// Source controls where a Tuner receives its signal from.
+type Source string
+
+const (
+	// SourceDVB receives a live signal from a DVB tuner device. This is the only
+	// source suitable for actually watching TV.
+	SourceDVB Source = "dvb"
+
+	// SourceFile loops an MPEG transport stream file for each channel, named
+	// after the channel with a ".ts" extension, from a configured directory.
+	// Each file is demuxed and transcoded as if it came from a DVB device.
+	SourceFile Source = "file"
+
+	// SourceTest generates a test pattern labeled with the channel name along
+	// with a test tone, without any input. It requires the textoverlay element
+	// from the GStreamer pango plugin.
+	SourceTest Source = "test"
+)
+
+// ParseSource selects a Source by name. Unknown names will return SourceDVB.
+func ParseSource(name string) Source {
+	switch {
+	default:
+		return SourceDVB
+	case name == string(SourceFile):
+		return SourceFile
+	case name == string(SourceTest):
+		return SourceTest
+	}
+}
+
+// sourceFileExt is the extension of transport stream files for SourceFile.
+const sourceFileExt = ".ts"
+
+// sourceFile returns the path of the transport stream file for channel when
+// the tuner uses SourceFile, or an empty string for any other source.
+func (t *Tuner) sourceFile(channel atsc.Channel) (string, error) {
+	if t.config.Source != SourceFile {
+		return "", nil
+	}
+
+	path := filepath.Join(t.config.SourceDir, channel.Name+sourceFileExt)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("no source file for channel %s: %w", channel.Name, err)
+	}
+	return path, nil
+}
+
+// SimulatedChannels returns a channel list for running a tuner with a simulated
+// source when no channels.conf file is available. For SourceFile, it returns a
+// channel for every transport stream file in dir. For SourceTest, it returns a
+// fixed list of test channels. SimulatedChannels returns an error for any other
+// source.
+//
+// Every simulated channel has a distinct frequency, and selects the first
+// program of the transport stream.
+func SimulatedChannels(source Source, dir string) ([]atsc.Channel, error) {
+	var names []string
+	switch source {
+	default:
+		return nil, fmt.Errorf("source %q cannot be simulated", source)
+
+	case SourceTest:
+		names = []string{"TEST-1", "TEST-2", "TEST-3", "TEST-4"}
+
+	case SourceFile:
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name, ok := strings.CutSuffix(entry.Name(), sourceFileExt)
+			if ok && !entry.IsDir() {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no %s files found in %s", sourceFileExt, dir)
+		}
+		slices.Sort(names)
+	}
+
+	// These frequencies correspond to US broadcast channels 2 and up, which
+	// makes them look sort of plausible.
+	const (
+		baseFrequencyHz    = 57_000_000
+		channelBandwidthHz = 6_000_000
+	)
+	channels := make([]atsc.Channel, len(names))
+	for i, name := range names {
+		channels[i] = atsc.Channel{
+			Name:        name,
+			FrequencyHz: uint(baseFrequencyHz + i*channelBandwidthHz),
+			Modulation:  atsc.Modulation8VSB,
+		}
+	}
+	return channels, nil
+}
@@ -0,0 +1,324 @@
+package tuner
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+
+	"github.com/featherbread/hypcast/internal/atsc"
+	"github.com/featherbread/hypcast/internal/atsc/captions"
+	"github.com/featherbread/hypcast/internal/atsc/mpegts"
+	"github.com/featherbread/hypcast/internal/pipeline"
+)
+
+// videoCodec identifies the format of a program's video stream, as used by the
+// pipeline description template to select a decoder.
+type videoCodec string
+
+const (
+	videoCodecMPEG2 videoCodec = "mpeg2"
+	videoCodecH264  videoCodec = "h264"
+	videoCodecH265  videoCodec = "h265"
+)
+
+// audioCodec identifies the format of a program's audio stream, as used by the
+// pipeline description template to select a decoder.
+type audioCodec string
+
+const (
+	audioCodecAC3     audioCodec = "ac3"
+	audioCodecEAC3    audioCodec = "eac3"
+	audioCodecAAC     audioCodec = "aac"
+	audioCodecAACLATM audioCodec = "aac-latm"
+	audioCodecMPEG    audioCodec = "mpeg"
+)
+
+// programStreams describes the elementary streams of a program that the tuner
+// decodes, as read from the program's map table.
+type programStreams struct {
+	// Video and Audio are empty for a program that lacks a stream of that kind
+	// in a supported format.
+	Video videoCodec
+	Audio audioCodec
+
+	// AudioStreams lists every audio stream of the program in a supported
+	// format, and AudioPID identifies the one that the tuner decodes. A zero
+	// AudioPID selects the first audio stream that the demuxer finds.
+	AudioStreams []AudioStream
+	AudioPID     uint
+
+	// CaptionServices lists the caption services that the program announces
+	// for its video.
+	CaptionServices []captions.Service
+
+	// Passthrough indicates that the program's video already fits the tuner's
+	// WebRTC video codec, so that the tuner can deliver it as LayerHigh without
+	// decoding and encoding it again.
+	Passthrough bool
+}
+
+// defaultStreams describes the MPEG-2 video and AC-3 audio that nearly every
+// ATSC broadcast carries.
+var defaultStreams = programStreams{Video: videoCodecMPEG2, Audio: audioCodecAC3}
+
+// selectStreams chooses the video and audio streams of p for the tuner to
+// decode. It prefers the audio stream last selected for the channel through
+// SelectAudio, then the streams with the PIDs listed in channel, and otherwise
+// selects the first stream of each kind in a supported format. It fails only if
+// the program has neither video nor audio.
+func (t *Tuner) selectStreams(channel atsc.Channel, p mpegts.Program) (programStreams, error) {
+	var (
+		streams          programStreams
+		video            *mpegts.ElementaryStream
+		unsupportedTypes []mpegts.StreamType
+	)
+	for _, es := range p.Streams {
+		if codec := videoCodecOf(es); codec != "" {
+			if streams.Video == "" || uint(es.PID) == channel.VideoPID {
+				streams.Video = codec
+				video = &es
+			}
+			continue
+		}
+		if codec := audioCodecOf(es); codec != "" {
+			streams.AudioStreams = append(streams.AudioStreams, newAudioStream(es, codec))
+			continue
+		}
+		unsupportedTypes = append(unsupportedTypes, es.Type)
+	}
+
+	if len(streams.AudioStreams) > 0 {
+		streams, _ = streams.withAudio(streams.AudioStreams[0].PID)
+		for _, pid := range []uint{channel.AudioPID, t.audioPIDs[channel.Name]} {
+			if selected, ok := streams.withAudio(pid); ok {
+				streams = selected
+			}
+		}
+	}
+
+	if streams.Video == "" && streams.Audio == "" {
+		return programStreams{}, fmt.Errorf("program %d has no supported video or audio stream (stream types: %#x)", p.Number, unsupportedTypes)
+	}
+	if len(unsupportedTypes) > 0 && (streams.Video == "" || streams.Audio == "") {
+		slog.Warn("Program lacks video or audio", "channel", channel.Name,
+			"video", streams.Video, "audio", streams.Audio, "unsupported", fmt.Sprintf("%#x", unsupportedTypes))
+	}
+
+	if video != nil {
+		if d, ok := video.Descriptor(mpegts.DescriptorTagCaptionService); ok {
+			streams.CaptionServices = captions.ServicesFromDescriptor(d.Data)
+		}
+	}
+	streams.Passthrough = t.hasLayer(LayerHigh) && streams.Video == videoCodecH264 && isWebRTCCompatibleH264(*video)
+	return streams, nil
+}
+
+// newAudioStream describes es, which carries audio in the given format.
+func newAudioStream(es mpegts.ElementaryStream, codec audioCodec) AudioStream {
+	as := AudioStream{PID: uint(es.PID), codec: codec}
+	// Each entry in the descriptor has a 3 byte language code and 1 byte type.
+	if d, ok := es.Descriptor(mpegts.DescriptorTagISO639Language); ok && len(d.Data) >= 4 {
+		const audioTypeVisualImpairedCommentary = 0x03
+		as.Language = strings.TrimRight(string(d.Data[:3]), "\x00 ")
+		as.Descriptive = d.Data[3] == audioTypeVisualImpairedCommentary
+	}
+	return as
+}
+
+// withAudio returns a copy of s that decodes the audio stream with the given
+// PID, and whether s includes such a stream.
+func (s programStreams) withAudio(pid uint) (programStreams, bool) {
+	for _, as := range s.AudioStreams {
+		if as.PID == pid {
+			s.Audio = as.codec
+			s.AudioPID = pid
+			return s, true
+		}
+	}
+	return s, false
+}
+
+// tracks returns the tracks of ts that carry the streams, leaving out those
+// that would carry a slate or silence.
+func (s programStreams) tracks(ts *trackSet) Tracks {
+	tracks := ts.Tracks()
+	if s.Video == "" {
+		tracks.Video = [NumLayers]webrtc.TrackLocal{}
+	}
+	if s.Audio == "" {
+		tracks.Audio, tracks.SurroundAudio = nil, nil
+	}
+	return tracks
+}
+
+func videoCodecOf(es mpegts.ElementaryStream) videoCodec {
+	switch es.Type {
+	case mpegts.StreamTypeMPEG2Video:
+		return videoCodecMPEG2
+	case mpegts.StreamTypeH264:
+		return videoCodecH264
+	case mpegts.StreamTypeH265:
+		return videoCodecH265
+	default:
+		return ""
+	}
+}
+
+func audioCodecOf(es mpegts.ElementaryStream) audioCodec {
+	switch es.Type {
+	case mpegts.StreamTypeAC3:
+		return audioCodecAC3
+	case mpegts.StreamTypeEAC3:
+		return audioCodecEAC3
+	case mpegts.StreamTypeAACADTS:
+		return audioCodecAAC
+	case mpegts.StreamTypeAACLATM:
+		return audioCodecAACLATM
+	case mpegts.StreamTypeMPEG1Audio, mpegts.StreamTypeMPEG2Audio:
+		return audioCodecMPEG
+	case mpegts.StreamTypePrivate:
+		// Some cable systems follow DVB conventions for Dolby audio.
+		if _, ok := es.Descriptor(mpegts.DescriptorTagDVBEAC3); ok {
+			return audioCodecEAC3
+		}
+		if _, ok := es.Descriptor(mpegts.DescriptorTagDVBAC3); ok {
+			return audioCodecAC3
+		}
+	}
+	return ""
+}
+
+// isWebRTCCompatibleH264 returns whether the AVC video descriptor of es
+// promises a stream that decoders can handle under the tuner's negotiated
+// profile-level-id: the Constrained Baseline profile at level 4.0 or below.
+// See videoCodecFMTP.
+func isWebRTCCompatibleH264(es mpegts.ElementaryStream) bool {
+	d, ok := es.Descriptor(mpegts.DescriptorTagAVCVideo)
+	if !ok || len(d.Data) < 3 {
+		return false
+	}
+
+	const (
+		profileBaseline = 66
+		profileMain     = 77
+		constraintSet0  = 0x80
+		constraintSet1  = 0x40
+	)
+	profile, constraints, level := d.Data[0], d.Data[1], d.Data[2]
+	constrained := (profile == profileBaseline && constraints&constraintSet1 != 0) ||
+		(profile == profileMain && constraints&constraintSet0 != 0)
+	return constrained && level <= 40
+}
+
+// startProbe adds a branch to the current pipeline that reads the program map
+// tables of the multiplex, so that the tuner can build a branch for prog that
+// matches the formats of its streams. t.mu must be held.
+func (t *Tuner) startProbe(prog *program) error {
+	description, err := t.createPipelineDescription("probe", prog.channel, programStreams{})
+	if err != nil {
+		return err
+	}
+
+	probe, err := t.pipeline.AddBranch(muxElementName, description)
+	if err != nil {
+		return err
+	}
+	prog.probe = probe
+
+	var (
+		p       = t.pipeline
+		scanner mpegts.Scanner
+		done    atomic.Bool
+	)
+	// A channel without a program ID takes the first program of the multiplex,
+	// so only the map tables of every program settle which one that is.
+	// Otherwise, the probe needn't wait on the map tables of other programs,
+	// which may be slow or missing.
+	finished := scanner.Done
+	if number := prog.channel.ProgramID; number != 0 {
+		finished = func() bool { return scanner.ProgramDone(uint16(number)) }
+	}
+	probe.SetSink(sinkNameProbe, func(data []byte, _ time.Duration) {
+		if done.Load() {
+			return
+		}
+		scanner.Write(data)
+		if finished() && !done.Swap(true) {
+			go t.handleProbeComplete(p, prog, scanner.Programs())
+		}
+	})
+
+	slog.Info("Probing program streams", "channel", prog.channel.Name)
+	return probe.Start()
+}
+
+// handleProbeComplete records the streams of every known channel among the
+// programs of p's multiplex, and starts streaming prog along with any other
+// programs of p that were waiting for the same information. It does nothing if
+// prog or p was already stopped.
+func (t *Tuner) handleProbeComplete(p pipeline.Pipeline, prog *program, programs []mpegts.Program) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pipeline != p || t.programs[prog.channel.Name] != prog || prog.probe == nil {
+		return
+	}
+
+	for _, channel := range t.channels {
+		if !sameMultiplex(channel, prog.channel) {
+			continue
+		}
+		mp, ok := findProgram(programs, channel.ProgramID)
+		if !ok {
+			continue
+		}
+		streams, err := t.selectStreams(channel, mp)
+		if err != nil {
+			slog.Warn("Unsupported program streams", "channel", channel.Name, "error", err)
+			continue
+		}
+		t.streams[channel.Name] = streams
+	}
+
+	for _, pending := range t.programs {
+		if pending.probe == nil {
+			continue
+		}
+		streams, ok := t.streams[pending.channel.Name]
+		if !ok && pending != prog {
+			continue // Still waiting for its own probe, which may yet succeed.
+		}
+
+		pending.probe.Close()
+		pending.probe = nil
+
+		var err error
+		if ok {
+			err = t.startProgramBranch(pending, streams)
+		} else if mp, found := findProgram(programs, pending.channel.ProgramID); !found {
+			err = fmt.Errorf("program %d not found in multiplex", pending.channel.ProgramID)
+		} else {
+			_, err = t.selectStreams(pending.channel, mp)
+		}
+		if err != nil {
+			t.loseProgram(pending, err)
+			continue
+		}
+		t.updateBitrate(pending)
+	}
+}
+
+// findProgram returns the program with the given number from programs, or the
+// first program if number is zero, following the behavior of tsdemux.
+func findProgram(programs []mpegts.Program, number uint) (mpegts.Program, bool) {
+	for _, p := range programs {
+		if number == 0 || uint(p.Number) == number {
+			return p, true
+		}
+	}
+	return mpegts.Program{}, false
+}
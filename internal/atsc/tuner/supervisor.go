@@ -0,0 +1,254 @@
+package tuner
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/featherbread/hypcast/internal/atsc"
+	"github.com/featherbread/hypcast/internal/pipeline"
+)
+
+// errPipelineEOS is reported when the pipeline's source stops producing data,
+// which a live DVB source should never do on its own.
+var errPipelineEOS = errors.New("transcode pipeline reached end of stream")
+
+// handlePipelineEvent is called synchronously from GStreamer threads (possibly
+// while t.mu is held by a call to Tune or Stop) for every event posted by p.
+func (t *Tuner) handlePipelineEvent(p pipeline.Pipeline, ev pipeline.Event) {
+	switch ev.Type {
+	case pipeline.EventError:
+		go t.handleStreamLoss(p, ev.Err)
+	case pipeline.EventEOS:
+		go t.handleStreamLoss(p, errPipelineEOS)
+	case pipeline.EventWarning:
+		slog.Warn("Transcode pipeline warning", "error", ev.Err)
+	}
+}
+
+// superviseSink wraps a sink of prog to report the loss of the program if the
+// sink stops receiving samples for longer than the configured watchdog timeout,
+// replacing the watchdog of any previous sink with the same name. If start is
+// set, it also reports the first sample received as the start of the program's
+// stream. t.mu must be held.
+func (t *Tuner) superviseSink(p pipeline.Pipeline, prog *program, name string, start bool, sink pipeline.SinkFunc) pipeline.SinkFunc {
+	var wd *watchdog
+	if timeout := t.config.WatchdogTimeout; timeout > 0 {
+		wd = newWatchdog(timeout, func() {
+			t.handleProgramLoss(p, prog, fmt.Errorf("no %s data received for %v", name, timeout))
+		})
+		if prev, ok := prog.watchdogs[name]; ok {
+			prev.Stop()
+		}
+		prog.watchdogs[name] = wd
+	}
+
+	var started atomic.Bool
+	return func(data []byte, duration time.Duration) {
+		if wd != nil {
+			wd.Feed()
+		}
+		if start && !started.Swap(true) {
+			go t.handleProgramStarted(p, prog)
+		}
+		sink(data, duration)
+	}
+}
+
+// startTuneTimer arranges for p to fail with ErrNoSignal if it does not start
+// streaming within the configured tune timeout. t.mu must be held.
+func (t *Tuner) startTuneTimer(p pipeline.Pipeline) {
+	timeout := t.config.TuneTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	channel := t.channel
+	t.startTimer = time.AfterFunc(timeout, func() {
+		err := fmt.Errorf("%w: no video received from %s within %v", ErrNoSignal, channel.Name, timeout)
+		t.handleStreamLoss(p, err)
+	})
+}
+
+// stopTuneTimer prevents any pending tune timeout from firing. t.mu must be
+// held.
+func (t *Tuner) stopTuneTimer() {
+	if t.startTimer != nil {
+		t.startTimer.Stop()
+		t.startTimer = nil
+	}
+}
+
+// handleProgramStarted records that prog has proven that it can deliver video,
+// and reports that p is playing if prog is the current channel's program. It
+// does nothing if prog or p was already stopped.
+func (t *Tuner) handleProgramStarted(p pipeline.Pipeline, prog *program) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pipeline != p || t.programs[prog.channel.Name] != prog || prog.started {
+		return // Stale, or already reported by another video layer.
+	}
+
+	prog.started = true
+	if t.isPrimary(prog) {
+		t.setPlaying()
+	}
+}
+
+// setPlaying reports that the current channel is playing, along with any
+// stream that its program lacks. t.mu must be held.
+func (t *Tuner) setPlaying() {
+	var streams programStreams
+	if prog := t.current.Load(); prog != nil {
+		streams = prog.streams
+	}
+
+	slog.Info("Transcode pipeline is streaming", "channel", t.channel.Name, "video", streams.Video, "audio", streams.Audio)
+	t.stopTuneTimer()
+	t.established = true
+	t.retryDelay = t.config.RetryMinDelay
+	t.setStatus(Status{
+		State:        StatePlaying,
+		ChannelName:  t.channel.Name,
+		Programs:     t.extraProgramNames(),
+		AudioOnly:    streams.Video == "",
+		VideoOnly:    streams.Audio == "",
+		AudioStreams: streams.AudioStreams,
+		AudioPID:     streams.AudioPID,
+	})
+}
+
+// handleProgramLoss handles a failure of prog within p. The loss of the current
+// channel's program is the loss of the whole stream, while any other program is
+// simply stopped. It does nothing if prog or p was already stopped.
+func (t *Tuner) handleProgramLoss(p pipeline.Pipeline, prog *program, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pipeline == p && t.programs[prog.channel.Name] == prog {
+		t.loseProgram(prog, err)
+	}
+}
+
+// loseProgram implements handleProgramLoss for a program of the current
+// pipeline. The tuner also forgets the formats of the program's streams, so
+// that it reads them again the next time it starts the program, in case the
+// loss followed a change in the program's streams (such as the disappearance
+// of its audio). t.mu must be held.
+func (t *Tuner) loseProgram(prog *program, err error) {
+	delete(t.streams, prog.channel.Name)
+
+	if t.isPrimary(prog) {
+		t.loseStream(err)
+		return
+	}
+
+	slog.Error("Lost program stream", "channel", prog.channel.Name, "error", err)
+	t.stopProgram(prog)
+	t.updateProgramStatus()
+}
+
+// handleStreamLoss tears down p following a failure that occurred after it was
+// started, and either schedules a retry on the same channel or publishes err as
+// a final status. It does nothing if p was already replaced or destroyed by a
+// newer call to Tune or Stop.
+func (t *Tuner) handleStreamLoss(p pipeline.Pipeline, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pipeline == p {
+		t.loseStream(err)
+	}
+}
+
+// loseStream implements handleStreamLoss for the current pipeline. t.mu must be
+// held.
+func (t *Tuner) loseStream(err error) {
+	slog.Error("Lost transcode pipeline stream", "channel", t.channel.Name, "error", err)
+	t.destroyAnyRunningPipeline()
+
+	if t.config.RetryMinDelay <= 0 || !t.established {
+		t.recordingOnly = false
+		t.interruptRecordings()
+		t.setStatus(Status{Error: err})
+		t.tracks.Set(Tracks{})
+		return
+	}
+	t.scheduleRetry(err)
+}
+
+// scheduleRetry arranges for the tuner to retune to the channel of its last
+// pipeline after the current backoff delay, and publishes cause as the reason
+// for the retry. t.mu must be held.
+func (t *Tuner) scheduleRetry(cause error) {
+	channel := t.channel
+	delay := t.retryDelay
+	t.retryDelay = min(2*delay, t.config.RetryMaxDelay)
+
+	slog.Info("Scheduling tuner retry", "channel", channel.Name, "delay", delay)
+	t.setStatus(Status{
+		State:       StateRetrying,
+		ChannelName: channel.Name,
+		Error:       cause,
+	})
+
+	t.retryGen++
+	gen := t.retryGen
+	t.retryTimer = time.AfterFunc(delay, func() { t.retry(gen, channel) })
+}
+
+func (t *Tuner) retry(gen uint64, channel atsc.Channel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.retryTimer == nil || t.retryGen != gen {
+		return // Canceled by a newer call to Tune or Stop.
+	}
+	t.retryTimer = nil
+
+	slog.Info("Retrying tune", "channel", channel.Name)
+	if err := t.tune(channel); err != nil {
+		t.scheduleRetry(err)
+	}
+}
+
+// cancelRetry prevents any scheduled retry from running. t.mu must be held.
+func (t *Tuner) cancelRetry() {
+	if t.retryTimer != nil {
+		t.retryTimer.Stop()
+		t.retryTimer = nil
+	}
+}
+
+// watchdog calls a function if it is not fed at least once per timeout period,
+// starting from the first time that it is fed.
+type watchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+	stopped atomic.Bool
+}
+
+func newWatchdog(timeout time.Duration, expire func()) *watchdog {
+	timer := time.AfterFunc(timeout, expire)
+	timer.Stop()
+	return &watchdog{timeout: timeout, timer: timer}
+}
+
+// Feed starts or restarts the watchdog's timeout period, unless the watchdog is
+// stopped.
+func (wd *watchdog) Feed() {
+	if !wd.stopped.Load() {
+		wd.timer.Reset(wd.timeout)
+	}
+}
+
+// Stop prevents the watchdog from expiring in the future. A concurrent Feed may
+// still allow one more expiration, so the expiration function must be prepared
+// to handle it.
+func (wd *watchdog) Stop() {
+	wd.stopped.Store(true)
+	wd.timer.Stop()
+}
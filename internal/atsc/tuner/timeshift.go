@@ -0,0 +1,520 @@
+package tuner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media"
+
+	"github.com/featherbread/hypcast/internal/watch"
+)
+
+// ErrTimeshiftUnavailable is returned when timeshifting a viewer of a tuner
+// without a timeshift window, of a tuner that isn't streaming, or of a program
+// added through AddProgram.
+var ErrTimeshiftUnavailable error = errors.New("timeshift not available")
+
+// TimeshiftStatus describes what a viewer is watching relative to the live
+// stream of the tuner's current channel.
+type TimeshiftStatus struct {
+	// Live indicates that the viewer receives the tuner's current tracks.
+	// Otherwise, the viewer receives the tracks from [Viewer.TimeshiftTracks],
+	// which are Paused or play behind live by Delay.
+	Live   bool
+	Paused bool
+	Delay  time.Duration
+
+	// Available is how far behind live the viewer can rewind, as limited by
+	// Config.TimeshiftWindow and the time since the current channel started.
+	Available time.Duration
+}
+
+// viewerShift holds the state of a viewer that watches behind live.
+type viewerShift struct {
+	// tracks receive the viewer's samples from the timeshift buffer, and live
+	// for as long as the viewer does once it first leaves live.
+	tracks *trackSet
+
+	// While paused, seq and at are the sequence number and arrival time of the
+	// next sample that the viewer will receive. Otherwise, a non-nil replay
+	// writes samples to the viewer's tracks, delay after they arrived.
+	paused bool
+	seq    uint64
+	at     time.Time
+	delay  time.Duration
+	replay *replay
+}
+
+// live returns whether the viewer receives the tuner's current tracks.
+func (vs *viewerShift) live() bool {
+	return !vs.paused && vs.replay == nil
+}
+
+// CanTimeshift returns whether the tuner keeps a timeshift buffer that the
+// viewer can pause and rewind within.
+func (v *Viewer) CanTimeshift() bool {
+	return v.tuner.timeshift != nil && v.channelName == ""
+}
+
+// Pause freezes the viewer at its current position in the tuner's current
+// channel, while the tuner continues to buffer the live stream for it to
+// resume from. Other viewers are unaffected.
+func (v *Viewer) Pause() error {
+	t := v.tuner
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := v.prepareTimeshift(); err != nil {
+		return err
+	}
+	vs := &v.shift
+	switch {
+	case vs.paused:
+		return nil
+	case vs.replay != nil:
+		vs.seq, vs.at = vs.replay.halt()
+		vs.replay = nil
+	default:
+		vs.seq, vs.at = t.timeshift.end(), time.Now()
+	}
+	vs.paused = true
+	v.publishTimeshift()
+	return nil
+}
+
+// Resume resumes a paused viewer from where it paused, or from the oldest
+// buffered key frame if the point where it paused has since fallen out of the
+// timeshift window. The viewer remains behind live by however long it was
+// paused.
+func (v *Viewer) Resume() error {
+	t := v.tuner
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := v.prepareTimeshift(); err != nil {
+		return err
+	}
+	vs := &v.shift
+	if !vs.paused {
+		return nil
+	}
+	seq, at := vs.seq, vs.at
+	if t.timeshift.evicted(seq) {
+		seq, at, _ = t.timeshift.seek(time.Time{}, v.layer.sinkName())
+	}
+	vs.paused = false
+	v.playFrom(seq, at)
+	v.publishTimeshift()
+	return nil
+}
+
+// Rewind moves the viewer back by d from its current position, to the nearest
+// key frame at or before that point within the timeshift window. A negative d
+// skips forward, and returns the viewer to live if it would reach or pass the
+// live stream. A paused viewer remains paused at its new position.
+func (v *Viewer) Rewind(d time.Duration) error {
+	t := v.tuner
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := v.prepareTimeshift(); err != nil {
+		return err
+	}
+	vs := &v.shift
+	now := time.Now()
+	from := now
+	switch {
+	case vs.paused:
+		from = vs.at
+	case vs.replay != nil:
+		from = now.Add(-vs.delay)
+	}
+
+	target := from.Add(-d)
+	if !target.Before(now) {
+		v.goLive()
+		v.publishTimeshift()
+		return nil
+	}
+	seq, at, ok := t.timeshift.seek(target, v.layer.sinkName())
+	if !ok {
+		return nil // There's nothing to rewind into yet.
+	}
+
+	if vs.paused {
+		vs.seq, vs.at = seq, at
+	} else {
+		v.stopReplay()
+		v.playFrom(seq, at)
+	}
+	v.publishTimeshift()
+	return nil
+}
+
+// GoLive returns the viewer to the tuner's current tracks.
+func (v *Viewer) GoLive() {
+	t := v.tuner
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.viewers[v]; !ok || v.shift.live() {
+		return
+	}
+	v.goLive()
+	v.publishTimeshift()
+}
+
+// Timeshift returns the viewer's current position relative to live.
+func (v *Viewer) Timeshift() TimeshiftStatus {
+	v.tuner.mu.Lock()
+	defer v.tuner.mu.Unlock()
+	return v.timeshiftStatus()
+}
+
+// WatchTimeshift sets up a watch on the viewer's position relative to live,
+// which receives the viewer's status whenever it pauses, resumes, rewinds, or
+// returns to live, whether by the viewer's own request or because the tuner
+// left the channel that it was watching. See [watch.Value.Watch] for details.
+func (v *Viewer) WatchTimeshift(handler func(TimeshiftStatus)) watch.Watch {
+	return v.timeshift.Watch(handler)
+}
+
+// TimeshiftTracks returns the tracks that carry the viewer's own samples while
+// it is not live, which have the same formats as the tuner's current tracks.
+// They are empty until the viewer first leaves live.
+func (v *Viewer) TimeshiftTracks() Tracks {
+	v.tuner.mu.Lock()
+	defer v.tuner.mu.Unlock()
+
+	if v.shift.tracks == nil {
+		return Tracks{}
+	}
+	return v.shift.tracks.Tracks()
+}
+
+// prepareTimeshift ensures that the viewer can leave live, and creates its own
+// tracks if it has yet to do so. t.mu must be held.
+func (v *Viewer) prepareTimeshift() error {
+	t := v.tuner
+	if _, ok := t.viewers[v]; !ok || !v.CanTimeshift() || t.current.Load() == nil {
+		return ErrTimeshiftUnavailable
+	}
+	if v.shift.tracks != nil {
+		return nil
+	}
+	tracks, err := t.newTrackSet(fmt.Sprintf("Viewer(%p)", v))
+	if err != nil {
+		return err
+	}
+	v.shift.tracks = tracks
+	return nil
+}
+
+// playFrom starts replaying the timeshift buffer to the viewer's tracks from
+// the sample with sequence number seq, which arrived at the given time. t.mu
+// must be held.
+func (v *Viewer) playFrom(seq uint64, at time.Time) {
+	vs := &v.shift
+	vs.delay = time.Since(at)
+	vs.replay = startReplay(v.tuner.timeshift, vs.tracks, v.layer.sinkName(), seq, vs.delay)
+}
+
+// stopReplay stops any replay of the timeshift buffer to the viewer's tracks.
+// t.mu must be held.
+func (v *Viewer) stopReplay() {
+	if v.shift.replay != nil {
+		v.shift.replay.halt()
+		v.shift.replay = nil
+	}
+}
+
+// goLive returns the viewer to the tuner's current tracks. t.mu must be held.
+func (v *Viewer) goLive() {
+	v.stopReplay()
+	v.shift.paused = false
+}
+
+// timeshiftStatus returns the viewer's current position relative to live. t.mu
+// must be held.
+func (v *Viewer) timeshiftStatus() TimeshiftStatus {
+	vs := &v.shift
+	status := TimeshiftStatus{Live: vs.live(), Paused: vs.paused}
+	switch {
+	case vs.paused:
+		status.Delay = time.Since(vs.at)
+	case vs.replay != nil:
+		status.Delay = vs.delay
+	}
+	if t := v.tuner; t.timeshift != nil && v.channelName == "" {
+		if oldest, ok := t.timeshift.oldest(); ok {
+			status.Available = time.Since(oldest)
+		}
+	}
+	return status
+}
+
+// publishTimeshift notifies watchers of the viewer's current position relative
+// to live. t.mu must be held.
+func (v *Viewer) publishTimeshift() {
+	v.timeshift.Set(v.timeshiftStatus())
+}
+
+// resetTimeshift empties the timeshift buffer, which then holds samples from
+// prog alone, and returns every viewer behind live to live. The tuner resets
+// the buffer whenever its current program changes. t.mu must be held.
+func (t *Tuner) resetTimeshift(prog *program) {
+	if t.timeshift == nil {
+		return
+	}
+	t.timeshift.reset(prog)
+	for v := range t.viewers {
+		if !v.shift.live() {
+			v.goLive()
+			v.publishTimeshift()
+		}
+	}
+}
+
+// timeshiftBuffer holds the samples that the current program's sinks produced
+// within the timeshift window, for viewers to watch behind live. Samples are
+// numbered in order of arrival, starting from zero when the tuner is created.
+type timeshiftBuffer struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	prog    *program
+	first   uint64 // The sequence number of samples[0].
+	samples []bufferedSample
+	added   chan struct{} // Closed and replaced as each sample arrives.
+}
+
+type bufferedSample struct {
+	media.Sample
+	sink     string
+	at       time.Time
+	keyFrame bool
+}
+
+func newTimeshiftBuffer(window time.Duration) *timeshiftBuffer {
+	return &timeshiftBuffer{window: window, added: make(chan struct{})}
+}
+
+// reset empties the buffer, which then holds samples from prog alone.
+func (b *timeshiftBuffer) reset(prog *program) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.prog = prog
+	b.first += uint64(len(b.samples))
+	b.samples = nil
+}
+
+// add appends a sample from prog's named sink, unless the buffer holds another
+// program, and discards samples that have fallen out of the window.
+func (b *timeshiftBuffer) add(prog *program, sink string, sample media.Sample) {
+	now := time.Now()
+	keyFrame := strings.HasPrefix(sink, sinkNameVideo+"-") && isKeyFrame(sample.Data)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.prog != prog {
+		return
+	}
+	b.samples = append(b.samples, bufferedSample{Sample: sample, sink: sink, at: now, keyFrame: keyFrame})
+
+	cutoff := now.Add(-b.window)
+	n := sort.Search(len(b.samples), func(i int) bool { return !b.samples[i].at.Before(cutoff) })
+	if n > 0 {
+		// The backing array outlives the samples that we slice off of its front,
+		// so drop their data right away.
+		clear(b.samples[:n])
+		b.samples = b.samples[n:]
+		b.first += uint64(n)
+	}
+
+	close(b.added)
+	b.added = make(chan struct{})
+}
+
+// end returns the sequence number of the next sample to arrive.
+func (b *timeshiftBuffer) end() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.first + uint64(len(b.samples))
+}
+
+// evicted returns whether the sample with sequence number seq has fallen out
+// of the buffer.
+func (b *timeshiftBuffer) evicted(seq uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return seq < b.first
+}
+
+// oldest returns the arrival time of the oldest sample in the buffer, or false
+// if the buffer is empty.
+func (b *timeshiftBuffer) oldest() (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.samples) == 0 {
+		return time.Time{}, false
+	}
+	return b.samples[0].at, true
+}
+
+// seek finds the sample from which to start playing at the given time: the
+// last key frame from the named sink that arrived at or before then, or the
+// first one after then if there is no such key frame. Without any key frames
+// from the sink, seek finds the first sample at or after the given time. It
+// returns the sequence number and arrival time of the sample, or false if the
+// buffer is empty.
+func (b *timeshiftBuffer) seek(at time.Time, sink string) (seq uint64, sampleAt time.Time, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.samples) == 0 {
+		return 0, time.Time{}, false
+	}
+	i := sort.Search(len(b.samples), func(i int) bool { return b.samples[i].at.After(at) })
+	j := b.keyFrameBefore(i, sink)
+	if j < 0 {
+		j = b.keyFrameFrom(i, sink)
+	}
+	if j < 0 {
+		j = min(i, len(b.samples)-1)
+	}
+	return b.first + uint64(j), b.samples[j].at, true
+}
+
+// keyFrameBefore returns the index of the last key frame from sink before
+// index i, or -1 if there is none. b.mu must be held.
+func (b *timeshiftBuffer) keyFrameBefore(i int, sink string) int {
+	for j := i - 1; j >= 0; j-- {
+		if s := &b.samples[j]; s.keyFrame && s.sink == sink {
+			return j
+		}
+	}
+	return -1
+}
+
+// keyFrameFrom returns the index of the first key frame from sink at or after
+// index i, or -1 if there is none. b.mu must be held.
+func (b *timeshiftBuffer) keyFrameFrom(i int, sink string) int {
+	for j := i; j < len(b.samples); j++ {
+		if s := &b.samples[j]; s.keyFrame && s.sink == sink {
+			return j
+		}
+	}
+	return -1
+}
+
+// next returns the sample with sequence number seq and its sequence number. If
+// that sample has fallen out of the buffer, next instead returns the oldest key
+// frame from keySink, so that playback resumes where the viewer can decode it.
+// If the sample has yet to arrive, next returns a channel that is closed once
+// another sample does.
+func (b *timeshiftBuffer) next(seq uint64, keySink string) (bufferedSample, uint64, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if seq < b.first {
+		seq = b.first + uint64(max(b.keyFrameFrom(0, keySink), 0))
+	}
+	if i := seq - b.first; i < uint64(len(b.samples)) {
+		return b.samples[i], seq, nil
+	}
+	return bufferedSample{}, seq, b.added
+}
+
+// replay writes samples from a timeshift buffer to a viewer's tracks, each at a
+// fixed delay after it arrived.
+type replay struct {
+	stop chan struct{}
+	done chan struct{}
+
+	// seq and at are the sequence number and arrival time of the next sample
+	// to write. They belong to the replay goroutine until done is closed.
+	seq uint64
+	at  time.Time
+}
+
+// startReplay starts writing samples from b to tracks, beginning with the
+// sample with sequence number seq. keySink names the sink whose key frames the
+// viewer needs in order to decode its video, should the replay fall behind the
+// buffer.
+func startReplay(b *timeshiftBuffer, tracks *trackSet, keySink string, seq uint64, delay time.Duration) *replay {
+	r := &replay{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		seq:  seq,
+		at:   time.Now().Add(-delay),
+	}
+	go r.run(b, tracks, keySink, delay)
+	return r
+}
+
+func (r *replay) run(b *timeshiftBuffer, tracks *trackSet, keySink string, delay time.Duration) {
+	defer close(r.done)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		sample, seq, added := b.next(r.seq, keySink)
+		r.seq = seq
+		if added != nil {
+			r.at = time.Now().Add(-delay)
+			select {
+			case <-added:
+				continue
+			case <-r.stop:
+				return
+			}
+		}
+
+		r.at = sample.at
+		if wait := time.Until(sample.at.Add(delay)); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-r.stop:
+				return
+			}
+		}
+		if track := tracks.forSink(sample.sink); track != nil {
+			track.WriteSample(sample.Sample)
+		}
+		r.seq++
+	}
+}
+
+// halt stops the replay, and returns the sequence number and arrival time of
+// the next sample that it would have written.
+func (r *replay) halt() (seq uint64, at time.Time) {
+	close(r.stop)
+	<-r.done
+	return r.seq, r.at
+}
+
+// isKeyFrame returns whether an H.264 access unit in Annex B format contains
+// an IDR picture, from which a decoder can start.
+func isKeyFrame(data []byte) bool {
+	const nalTypeIDR = 5
+	for {
+		i := bytes.Index(data, []byte{0, 0, 1})
+		if i < 0 || i+3 >= len(data) {
+			return false
+		}
+		if data[i+3]&0x1f == nalTypeIDR {
+			return true
+		}
+		data = data[i+3:]
+	}
+}
@@ -9,14 +9,17 @@ import (
 	"log/slog"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v4"
 	"github.com/pion/webrtc/v4/pkg/media"
 
 	"github.com/featherbread/hypcast/internal/atsc"
-	"github.com/featherbread/hypcast/internal/gst"
+	"github.com/featherbread/hypcast/internal/pipeline"
 	"github.com/featherbread/hypcast/internal/watch"
 )
 
@@ -30,8 +33,11 @@ const (
 	// start streaming.
 	StateStarting
 	// StatePlaying means that the tuner is locked onto a singal and is actively
-	// streaming video.
+	// streaming video, as evidenced by the arrival of decoded video data.
 	StatePlaying
+	// StateRetrying means that the tuner lost the stream for a channel, and is
+	// waiting to try tuning to the same channel again.
+	StateRetrying
 )
 
 // Status represents the public state of the tuner for reading by clients.
@@ -39,13 +45,69 @@ type Status struct {
 	State       State
 	ChannelName string
 	Error       error
+
+	// Programs lists the names of any channels besides ChannelName that the
+	// tuner is streaming from the same multiplex. See [Tuner.AddProgram].
+	Programs []string
+
+	// AudioOnly and VideoOnly report that the program of the playing channel
+	// lacks video or audio. The tuner's current tracks then carry a slate in
+	// place of the missing video, or silence in place of the missing audio, so
+	// that clients can keep their sessions across channel changes.
+	AudioOnly bool
+	VideoOnly bool
+
+	// AudioStreams lists the audio streams of the playing channel's program, and
+	// AudioPID identifies the one that the tuner is streaming. See
+	// [Tuner.SelectAudio].
+	AudioStreams []AudioStream
+	AudioPID     uint
+
+	// Preemption warns that the tuner will soon switch channels on behalf of
+	// something that outranks its viewers, or is nil. See
+	// [Tuner.SetPreemption].
+	Preemption *Preemption
+}
+
+// Preemption describes a planned switch of the tuner to another channel, such
+// as one that a scheduled recording requires.
+type Preemption struct {
+	ChannelName string
+	At          time.Time
+}
+
+// AudioStream describes one of the audio streams of a program, such as its main
+// audio or a secondary audio program (SAP) in another language.
+type AudioStream struct {
+	PID uint
+
+	// Language is the ISO 639-2 code for the language of the stream, such as
+	// "eng" or "spa", or empty if the program does not specify one.
+	Language string
+
+	// Descriptive indicates that the stream carries commentary for visually
+	// impaired viewers (descriptive video service).
+	Descriptive bool
+
+	codec audioCodec
 }
 
 // Tracks represents the current set of video and audio tracks for use by WebRTC
 // clients.
 type Tracks struct {
-	Video webrtc.TrackLocal
+	// Video holds a track for each video layer, indexed by Layer. Clients
+	// receive one of these at a time. The tracks of any layers that the tuner's
+	// video pipeline does not produce are nil, as are all of the video tracks
+	// for a program without video.
+	Video [NumLayers]webrtc.TrackLocal
+
+	// Audio is the audio track, or nil for a program without audio.
 	Audio webrtc.TrackLocal
+
+	// SurroundAudio carries the same audio as Audio in 5.1 channels, for
+	// clients that negotiate SurroundAudioCodecCapability. It is nil unless the
+	// tuner uses AudioProfileSurround, as well as for a program without audio.
+	SurroundAudio webrtc.TrackLocal
 }
 
 // VideoPipeline controls which pipeline Hypcast uses to process video.
@@ -84,6 +146,97 @@ func ParseVideoPipeline(name string) VideoPipeline {
 	}
 }
 
+// AudioProfile controls how Hypcast encodes audio.
+type AudioProfile string
+
+const (
+	// AudioProfileStereo encodes audio with 2 channels, mixing down any
+	// multichannel sound such as the 5.1 mix of an AC-3 stream.
+	AudioProfileStereo AudioProfile = "stereo"
+
+	// AudioProfileSurround encodes audio with 5.1 channels in addition to
+	// stereo, so that clients able to play multichannel Opus can receive the
+	// full mix while others fall back to stereo. Stereo programs are upmixed,
+	// leaving the extra channels silent.
+	AudioProfileSurround AudioProfile = "surround"
+)
+
+// ParseAudioProfile selects an AudioProfile by name. Unknown names will return
+// the stereo profile.
+func ParseAudioProfile(name string) AudioProfile {
+	if name == string(AudioProfileSurround) {
+		return AudioProfileSurround
+	}
+	return AudioProfileStereo
+}
+
+// Config provides settings for a Tuner.
+type Config struct {
+	// NewPipeline creates the pipelines that process the tuner's signal, and
+	// must not be nil. In production this is gst.Factory.
+	NewPipeline pipeline.Factory
+
+	// VideoPipeline selects the pipeline used to process video.
+	VideoPipeline VideoPipeline
+
+	// PipelineTemplate, if not nil, replaces parts of the built-in pipeline
+	// description template for the user-defined pipeline named by
+	// VideoPipeline. See LoadPipelineTemplates.
+	PipelineTemplate *PipelineTemplate
+
+	// AudioProfile selects the channel layouts in which the tuner encodes
+	// audio.
+	AudioProfile AudioProfile
+
+	// NormalizeLoudness enables a stage in each audio branch that adjusts the
+	// volume of every program toward LoudnessTarget, so that commercials and
+	// loud channels don't stand out from the rest. It adds a few seconds of
+	// latency to the stream. See also [Tuner.SetLoudnessNormalization].
+	//
+	// LoudnessTarget is the integrated loudness to aim for, in LUFS. A zero
+	// value selects DefaultLoudnessTarget.
+	NormalizeLoudness bool
+	LoudnessTarget    float64
+
+	// Source selects where the tuner receives its signal from, and SourceDir
+	// provides the directory of transport stream files for SourceFile.
+	Source    Source
+	SourceDir string
+
+	// Adapter and Frontend select the DVB device for SourceDVB, corresponding
+	// to /dev/dvb/adapter{Adapter}/frontend{Frontend}.
+	Adapter  uint
+	Frontend uint
+
+	// TuneTimeout is the longest that the tuner will wait for video data after
+	// starting a stream before failing with ErrNoSignal. A zero value disables
+	// the timeout.
+	TuneTimeout time.Duration
+
+	// WatchdogTimeout is the longest that a playing stream may go without
+	// delivering video or audio data before the tuner considers it lost. A zero
+	// value disables the watchdog.
+	WatchdogTimeout time.Duration
+
+	// RetryMinDelay and RetryMaxDelay bound the exponential backoff between
+	// attempts to restart a lost stream on the same channel. A zero
+	// RetryMinDelay disables automatic retuning. The tuner only retries
+	// channels that have played successfully since the last call to Tune.
+	RetryMinDelay time.Duration
+	RetryMaxDelay time.Duration
+
+	// TimeshiftWindow is how far behind live that viewers of the current
+	// channel can pause and rewind. The tuner keeps every encoded sample of the
+	// current channel within the window in memory, which for the built-in
+	// pipelines can take on the order of 100 MB per minute. A zero value
+	// disables timeshifting. See [Viewer.Pause].
+	TimeshiftWindow time.Duration
+}
+
+// DefaultLoudnessTarget is the loudness in LUFS that the tuner normalizes audio
+// to by default, per the ATSC A/85 recommendation for broadcast programs.
+const DefaultLoudnessTarget = -24
+
 // Tuner represents an ATSC tuner whose video and audio signals are encoded for
 // use by WebRTC clients, and whose consumers are notified of ongoing state
 // changes.
@@ -93,22 +246,94 @@ type Tuner struct {
 	channels   []atsc.Channel
 	channelMap map[string]atsc.Channel
 
-	videoPipeline VideoPipeline
-	pipeline      *gst.Pipeline
+	config     Config
+	pipeline   pipeline.Pipeline
+	channel    atsc.Channel
+	programs   map[string]*program
+	startTimer *time.Timer
+
+	established bool
+	retryTimer  *time.Timer
+	retryGen    uint64
+	retryDelay  time.Duration
+
+	// The tuner writes the current channel's program to currentTracks, and the
+	// program for each individual channel to its entry in programTrackPairs.
+	// These tracks live as long as the tuner itself, so that clients can keep a
+	// single negotiated WebRTC session across channel changes.
+	current           atomic.Pointer[program]
+	currentTracks     *trackSet
+	programTrackPairs map[string]*trackSet
+
+	// streams holds the formats of each channel's streams, as last read from
+	// the program map tables of its multiplex, and audioPIDs holds the audio
+	// stream last selected for each channel through SelectAudio.
+	streams   map[string]programStreams
+	audioPIDs map[string]uint
+
+	// normalizeLoudness starts from Config.NormalizeLoudness, and changes
+	// through SetLoudnessNormalization.
+	normalizeLoudness bool
 
-	status *watch.Value[Status]
-	tracks *watch.Value[Tracks]
+	status        *watch.Value[Status]
+	tracks        *watch.Value[Tracks]
+	programTracks map[string]*watch.Value[Tracks]
+
+	// The tuner publishes the captions of the current channel's program to
+	// captions, and those of each individual channel's program to its entry in
+	// programCaptions. captionsMu orders updates to captions from the caption
+	// sinks of different programs with changes to the current program.
+	captionsMu      sync.Mutex
+	captions        *watch.Value[Captions]
+	programCaptions map[string]*watch.Value[Captions]
+
+	viewers map[*Viewer]struct{}
+
+	// preemption accompanies every status that the tuner publishes. See
+	// [Tuner.SetPreemption].
+	preemption *Preemption
+
+	// timeshift holds the recent samples of the current channel's program for
+	// viewers behind live, or is nil if Config.TimeshiftWindow is zero.
+	timeshift *timeshiftBuffer
+
+	// recordings holds every recording that has not yet ended, and
+	// recordingOnly indicates that Record started the tuner, which stops once
+	// it has no recordings left. See [Tuner.Record].
+	recordings    map[*Recording]struct{}
+	recordingOnly bool
 }
 
 // NewTuner creates a new Tuner that can tune to any of the provided channels.
-func NewTuner(channels []atsc.Channel, videoPipeline VideoPipeline) *Tuner {
-	return &Tuner{
+func NewTuner(channels []atsc.Channel, config Config) *Tuner {
+	config.RetryMaxDelay = max(config.RetryMinDelay, config.RetryMaxDelay)
+	t := &Tuner{
 		channels:      channels,
 		channelMap:    makeChannelMap(channels),
-		videoPipeline: videoPipeline,
+		config:        config,
+		programs:      make(map[string]*program),
 		status:        watch.NewValue(Status{}),
 		tracks:        watch.NewValue(Tracks{}),
+		programTracks: make(map[string]*watch.Value[Tracks], len(channels)),
+		viewers:       make(map[*Viewer]struct{}),
+		recordings:    make(map[*Recording]struct{}),
+		streams:       make(map[string]programStreams),
+		audioPIDs:     make(map[string]uint),
+
+		normalizeLoudness: config.NormalizeLoudness,
+
+		programTrackPairs: make(map[string]*trackSet),
+		captions:          watch.NewValue(Captions{}),
+		programCaptions:   make(map[string]*watch.Value[Captions], len(channels)),
+	}
+	if config.TimeshiftWindow > 0 {
+		t.timeshift = newTimeshiftBuffer(config.TimeshiftWindow)
 	}
+	for _, ch := range channels {
+		t.programTracks[ch.Name] = watch.NewValue(Tracks{})
+		t.programCaptions[ch.Name] = watch.NewValue(Captions{})
+	}
+	return t
 }
 
 func makeChannelMap(channels []atsc.Channel) map[string]atsc.Channel {
@@ -131,6 +356,41 @@ func (t *Tuner) ChannelNames() iter.Seq[string] {
 	}
 }
 
+// Status returns the current status of the tuner.
+func (t *Tuner) Status() Status {
+	return t.status.Get()
+}
+
+// SetPreemption warns viewers of the tuner, through its status, that the tuner
+// will switch to another channel, or withdraws the warning if p is nil. The
+// warning remains in the tuner's status across changes in state, until it is
+// replaced or withdrawn. The tuner itself does not act on the warning.
+func (t *Tuner) SetPreemption(p *Preemption) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p == t.preemption || (p != nil && t.preemption != nil && *p == *t.preemption) {
+		return
+	}
+	t.preemption = p
+	t.setStatus(t.status.Get())
+}
+
+// setStatus publishes s as the status of the tuner, along with any warning of
+// preemption. t.mu must be held.
+func (t *Tuner) setStatus(s Status) {
+	s.Preemption = t.preemption
+	t.status.Set(s)
+}
+
+// Viewers returns the number of viewers that the tuner has, of its current
+// channel or of any other program. See [Tuner.AddViewer].
+func (t *Tuner) Viewers() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.viewers)
+}
+
 // WatchStatus sets up a handler function to continuously receive the status of
 // the tuner as it is updated. See the watch package documentation for details.
 func (t *Tuner) WatchStatus(handler func(Status)) watch.Watch {
@@ -140,18 +400,29 @@ func (t *Tuner) WatchStatus(handler func(Status)) watch.Watch {
 // WatchTracks sets up a handler function to continuously receive the tuner's
 // WebRTC tracks as they are updated. See the watch package documentation for
 // details.
+//
+// The tuner keeps the same tracks across calls to Tune, and clears them only
+// when it stops streaming entirely, so clients need not renegotiate their
+// sessions when the tuner changes channels.
 func (t *Tuner) WatchTracks(handler func(Tracks)) watch.Watch {
 	return t.tracks.Watch(handler)
 }
 
 // Stop ends any active stream and releases the DVB device associated with this
-// tuner.
+// tuner. Any recordings end with ErrRecordingInterrupted.
 func (t *Tuner) Stop() error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	return t.stop()
+}
 
+// stop implements Stop. t.mu must be held.
+func (t *Tuner) stop() error {
+	t.recordingOnly = false
+	t.cancelRetry()
+	t.interruptRecordings()
 	err := t.destroyAnyRunningPipeline()
-	t.status.Set(Status{Error: err})
+	t.setStatus(Status{Error: err})
 	t.tracks.Set(Tracks{})
 	return err
 }
@@ -160,8 +431,29 @@ func (t *Tuner) Stop() error {
 // the tuner's channel list.
 var ErrChannelNotFound error = errors.New("channel not found")
 
+// ErrNoSignal is reported through the tuner's status when a stream does not
+// produce any video within the configured tune timeout.
+var ErrNoSignal error = errors.New("no signal")
+
 // Tune attempts to start a stream for the named channel.
-func (t *Tuner) Tune(channelName string) (err error) {
+//
+// Tune returns once the stream has started, but before the tuner has locked
+// onto a signal. The tuner reports StatePlaying once the stream delivers its
+// first video data, or fails with ErrNoSignal if it does not do so within the
+// configured tune timeout.
+//
+// When the named channel is carried on the same frequency as a different channel
+// that the tuner is already streaming, Tune switches to the new channel's
+// program without restarting the tuner's source. If the tuner was already
+// streaming the new program through [Tuner.AddProgram], it reports
+// StatePlaying immediately.
+//
+// If the stream is lost after Tune returns, and the tuner is configured to
+// retry, the tuner will automatically attempt to restart the stream on the
+// same channel until it succeeds or the tuner is stopped or retuned.
+//
+// Tuning to another frequency ends any recordings with ErrRecordingInterrupted.
+func (t *Tuner) Tune(channelName string) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -169,8 +461,36 @@ func (t *Tuner) Tune(channelName string) (err error) {
 	if !ok {
 		return ErrChannelNotFound
 	}
+	return t.tuneChannel(channel)
+}
+
+// tuneChannel implements Tune for a known channel, and publishes any failure.
+// t.mu must be held.
+func (t *Tuner) tuneChannel(channel atsc.Channel) error {
+	t.cancelRetry()
+	t.established = false
+	t.retryDelay = t.config.RetryMinDelay
+	t.recordingOnly = false
+
+	var err error
+	if t.pipeline != nil && channel.Name != t.channel.Name && sameMultiplex(channel, t.channel) {
+		err = t.switchProgram(channel)
+	} else {
+		err = t.tune(channel)
+	}
+	if err != nil {
+		t.interruptRecordings()
+		t.setStatus(Status{Error: err})
+		t.tracks.Set(Tracks{})
+	}
+	return err
+}
 
-	t.status.Set(Status{
+// tune replaces any running pipeline with a new one streaming channel. If it
+// fails, it leaves the tuner with no running pipeline, and it is up to the
+// caller to publish an appropriate status and tracks. t.mu must be held.
+func (t *Tuner) tune(channel atsc.Channel) (err error) {
+	t.setStatus(Status{
 		State:       StateStarting,
 		ChannelName: channel.Name,
 	})
@@ -178,24 +498,24 @@ func (t *Tuner) Tune(channelName string) (err error) {
 	defer func() {
 		if err != nil {
 			t.destroyAnyRunningPipeline()
-			t.status.Set(Status{Error: err})
 		}
 	}()
 
 	t.destroyAnyRunningPipeline()
+	t.channel = channel
 
 	t.pipeline, err = t.newPipeline(channel)
 	if err != nil {
 		return err
 	}
 
-	vt, at, err := t.createTrackPair()
-	if err != nil {
+	p := t.pipeline
+	p.SetEventHandler(func(ev pipeline.Event) { t.handlePipelineEvent(p, ev) })
+
+	if err := t.startCurrentProgram(); err != nil {
 		return err
 	}
-
-	t.pipeline.SetSink(sinkNameVideo, createTrackSink(vt))
-	t.pipeline.SetSink(sinkNameAudio, createTrackSink(at))
+	t.resumeRecordings()
 
 	slog.Info("Starting transcode pipeline")
 	err = t.pipeline.Start()
@@ -204,40 +524,212 @@ func (t *Tuner) Tune(channelName string) (err error) {
 	}
 	slog.Info("Started transcode pipeline")
 
-	t.status.Set(Status{State: StatePlaying, ChannelName: channelName})
-	t.tracks.Set(Tracks{Video: vt, Audio: at})
+	t.startTuneTimer(p)
+
+	// Clients can negotiate their WebRTC sessions while we wait for the signal,
+	// so they're ready to play as soon as the first samples arrive.
+	t.tracks.Set(t.currentTracks.Tracks())
+	return nil
+}
+
+// streamFrom replaces any running pipeline with p, and streams channel's
+// program from it. p must be a new pipeline that feeds channel's multiplex to
+// a tee named by muxElementName, and streams describes the formats of the
+// program's streams, for which the tuner would otherwise probe p.
+//
+// Unlike the pipelines that the tuner creates on its own, the caller handles
+// p's events, so the tuner applies no tune timeout or retries to p. The tuner
+// still starts p, and closes p when it stops or loses the stream. If streamFrom
+// fails, it leaves the tuner with no running pipeline, following the same rules
+// as tune. t.mu must be held.
+func (t *Tuner) streamFrom(p pipeline.Pipeline, channel atsc.Channel, streams programStreams) (err error) {
+	t.setStatus(Status{
+		State:       StateStarting,
+		ChannelName: channel.Name,
+	})
+
+	defer func() {
+		if err != nil {
+			t.destroyAnyRunningPipeline()
+		}
+	}()
+
+	t.destroyAnyRunningPipeline()
+	t.channel = channel
+	t.pipeline = p
+	t.streams[channel.Name] = streams
+
+	if err := t.startCurrentProgram(); err != nil {
+		return err
+	}
+	if err := p.Start(); err != nil {
+		return err
+	}
+	t.tracks.Set(t.currentTracks.Tracks())
 	return nil
 }
 
-func (t *Tuner) newPipeline(channel atsc.Channel) (*gst.Pipeline, error) {
-	description, err := t.createPipelineDescription(channel)
+// startCurrentProgram starts the program of the current channel within the
+// current pipeline, and makes it the source of the tuner's current tracks.
+// t.mu must be held.
+func (t *Tuner) startCurrentProgram() error {
+	if t.currentTracks == nil {
+		var err error
+		t.currentTracks, err = t.newTrackSet(fmt.Sprintf("Tuner(%p)", t))
+		if err != nil {
+			return err
+		}
+	}
+
+	prog, err := t.startProgram(t.channel)
+	if err != nil {
+		return err
+	}
+	t.current.Store(prog)
+	t.resetTimeshift(prog)
+	t.updateCurrentCaptions()
+	t.updateBitrates()
+	return nil
+}
+
+// newPipeline creates a pipeline that receives the multiplex carrying channel,
+// to which the tuner adds a branch for each program that it streams.
+func (t *Tuner) newPipeline(channel atsc.Channel) (pipeline.Pipeline, error) {
+	description, err := t.createPipelineDescription("source", channel, programStreams{})
 	if err != nil {
 		return nil, err
 	}
-	return gst.NewPipeline(description)
+	return t.config.NewPipeline(description)
 }
 
-func (t *Tuner) createPipelineDescription(channel atsc.Channel) (string, error) {
-	var buf strings.Builder
+// createPipelineDescription renders the named pipeline description template for
+// channel, whose program carries the given streams.
+func (t *Tuner) createPipelineDescription(name string, channel atsc.Channel, streams programStreams) (string, error) {
+	// Only the source pipeline reads the source file. The tuner of a Player,
+	// which streams from the Player's own pipeline, has none.
+	var sourceFile string
+	if name == "source" {
+		var err error
+		sourceFile, err = t.sourceFile(channel)
+		if err != nil {
+			return "", err
+		}
+	}
+	return t.renderPipelineDescription(name, channel, streams, sourceFile)
+}
 
-	err := pipelineDescriptionTemplate.Execute(&buf, struct {
+// renderPipelineDescription implements createPipelineDescription, with the
+// given file for the source pipeline to read.
+func (t *Tuner) renderPipelineDescription(name string, channel atsc.Channel, streams programStreams, sourceFile string) (string, error) {
+	var passthroughSink string
+	if streams.Passthrough {
+		passthroughSink = LayerHigh.sinkName()
+	}
+
+	var buf strings.Builder
+	err := t.pipelineTemplate().ExecuteTemplate(&buf, name, struct {
+		Source        string
+		SourceFile    string
+		Adapter       uint
+		Frontend      uint
+		Live          bool
+		ChannelName   string
 		Modulation    string
 		FrequencyHz   uint
 		ProgramID     uint
 		VideoPipeline string
+		Video         string
+		Audio         string
+		AudioPID      uint
+		Passthrough   string
+		Layers        []templateLayer
+		AudioBitrate  uint
+		Mux           string
+		Probe         string
+		Captions      string
+		Record        string
+
+		SurroundAudio        string
+		SurroundAudioBitrate uint
+
+		NormalizeLoudness bool
+		LoudnessTarget    float64
 	}{
+		Source:        string(t.config.Source),
+		SourceFile:    sourceFile,
+		Adapter:       t.config.Adapter,
+		Frontend:      t.config.Frontend,
+		Live:          t.config.Source != SourceFile,
+		ChannelName:   channel.Name,
 		Modulation:    pipelineModulations[channel.Modulation],
 		FrequencyHz:   channel.FrequencyHz,
 		ProgramID:     channel.ProgramID,
-		VideoPipeline: string(t.videoPipeline),
+		VideoPipeline: string(t.config.VideoPipeline),
+		Video:         string(streams.Video),
+		Audio:         string(streams.Audio),
+		AudioPID:      streams.AudioPID,
+		Passthrough:   passthroughSink,
+		Layers:        t.templateLayers(streams.Passthrough),
+		AudioBitrate:  audioBitrate,
+		Mux:           muxElementName,
+		Probe:         sinkNameProbe,
+		Captions:      sinkNameCaptions,
+		Record:        sinkNameRecord,
+
+		SurroundAudio:        t.surroundAudioSink(),
+		SurroundAudioBitrate: surroundAudioBitrate,
+
+		NormalizeLoudness: t.normalizeLoudness,
+		LoudnessTarget:    t.loudnessTarget(),
 	})
 	if err != nil {
-		return "", fmt.Errorf("building pipeline template: %w", err)
+		return "", fmt.Errorf("building %s pipeline template: %w", name, err)
 	}
 
 	return buf.String(), nil
 }
 
+// loudnessTarget returns the loudness in LUFS that the tuner normalizes audio
+// to when normalization is on.
+func (t *Tuner) loudnessTarget() float64 {
+	if t.config.LoudnessTarget == 0 {
+		return DefaultLoudnessTarget
+	}
+	return t.config.LoudnessTarget
+}
+
+// templateLayer describes a video layer for the pipeline description template.
+type templateLayer struct {
+	Name    string
+	Encoder string
+	Sink    string
+	Width   uint
+	Height  uint
+	Bitrate uint
+}
+
+// templateLayers returns the layers that the tuner encodes from each program's
+// decoded video, which exclude LayerHigh when the program's video passes
+// through to it directly.
+func (t *Tuner) templateLayers(passthrough bool) []templateLayer {
+	configs := t.layerConfigs()
+	var layers []templateLayer
+	for _, l := range t.Layers() {
+		if l == LayerHigh && passthrough {
+			continue
+		}
+		layers = append(layers, templateLayer{
+			Name:    l.String(),
+			Encoder: l.encoderName(),
+			Sink:    l.sinkName(),
+			Width:   configs[l].Width,
+			Height:  configs[l].Height,
+			Bitrate: configs[l].MaxBitrate,
+		})
+	}
+	return layers
+}
+
 var pipelineModulations = map[atsc.Modulation]string{
 	atsc.Modulation8VSB:   "8vsb",
 	atsc.ModulationQAM64:  "qam-64",
@@ -245,51 +737,318 @@ var pipelineModulations = map[atsc.Modulation]string{
 }
 
 const (
+	// sinkNameVideo is the prefix for the names of the video sinks in each
+	// program branch. See [Layer.sinkName].
 	sinkNameVideo = "video"
 	sinkNameAudio = "audio"
+
+	// sinkNameSurroundAudio is the name of the sink that receives each
+	// program's 5.1 audio under AudioProfileSurround.
+	sinkNameSurroundAudio = "audio-surround"
+
+	// sinkNameProbe is the name of the sink that receives the raw multiplex in
+	// the branch that probes for the formats of a program's streams.
+	sinkNameProbe = "probe"
+
+	// sinkNameCaptions is the name of the sink that receives the caption data
+	// (cc_data) accompanying each frame of a program's video.
+	sinkNameCaptions = "captions"
+
+	// sinkNameRecord is the name of the sink that receives the raw multiplex in
+	// the branch that feeds each recording.
+	sinkNameRecord = "record"
+
+	// muxElementName is the name of the tee that feeds the full multiplex from
+	// the source pipeline to each program branch.
+	muxElementName = "mux"
 )
 
-var pipelineDescriptionTemplate = template.Must(template.New("").Parse(`
-	dvbsrc delsys=atsc modulation={{.Modulation}} frequency={{.FrequencyHz}}
-	{{- block "queue-max-time" 2_500_000_000 }}
-	! queue leaky=downstream max-size-time={{.}} max-size-buffers=0 max-size-bytes=0
+var pipelineTemplateFuncs = template.FuncMap{
+	// quote produces a double-quoted string value for a gst-launch description.
+	"quote": func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	},
+	// location escapes a path for use as a multifilesrc location, which is
+	// interpreted as a printf-style format string.
+	"location": func(s string) string {
+		return strings.ReplaceAll(s, "%", "%%")
+	},
+}
+
+// pipelineDescriptionTemplate defines the pipeline descriptions for a channel.
+// The "source" pipeline receives the channel's multiplex and feeds it to a tee
+// named by .Mux. For each program, a "program" branch and a "program-audio"
+// branch attach to this tee to demux, decode, and encode the program's video
+// and audio for WebRTC, so that the tuner can switch between the program's
+// audio streams without interrupting its video. Each program branch encodes its
+// decoded video once for each of .Layers, through a tee of its own. Audio
+// branches encode stereo audio, and when .SurroundAudio names a sink, 5.1 audio
+// for that sink as well. With .NormalizeLoudness, they first adjust the audio
+// toward the integrated loudness given by .LoudnessTarget.
+//
+// Program branches select their decoders by the .Video and .Audio formats of
+// the program's streams, which the tuner learns from a "probe" branch that
+// delivers the raw multiplex to an appsink named by .Probe. When .Passthrough
+// names a sink, the program's H.264 video goes directly to that sink as well as
+// to the decoder for the remaining layers. The audio branch decodes the stream
+// with the PID given by .AudioPID, or the first audio stream if .AudioPID is
+// zero. An empty .Video or .Audio indicates that the program lacks that stream,
+// and the branch generates a slate or silence in its place. Program branches
+// for real video also extract its closed captions to an appsink named by
+// .Captions.
+//
+// Each recording attaches a "record" branch to the tee, which delivers the raw
+// multiplex to an appsink named by .Record. Unlike the other branches, the
+// record branch never drops data: its queue doesn't leak even for live sources,
+// and its appsink blocks when full, since a gap corrupts the recorded stream.
+// The recording drains the appsink into a buffer of its own, so that a slow
+// disk doesn't back up into the tee.
+//
+// A Player reads a recording through the "playback" pipeline in place of the
+// source pipeline, which feeds .SourceFile to the same tee once through, in a
+// way that supports pausing and seeking.
+//
+// The test source has no multiplex, so its source pipeline is empty and its
+// program and record branches generate their own test signals.
+var pipelineDescriptionTemplate = template.Must(template.New("").Funcs(pipelineTemplateFuncs).Parse(`
+	{{- define "queue-element" -}}
+	queue {{- if .Live }} leaky=downstream{{ end }} max-size-time=2500000000 max-size-buffers=0 max-size-bytes=0
 	{{- end }}
-	! tsdemux name=demux program-number={{.ProgramID}} latency=500
 
-	demux.
-	{{- template "queue-max-time" 2_500_000_000 }}
-	{{- if eq .VideoPipeline "vaapi" }}
-	! vaapimpeg2dec
-	! vaapipostproc deinterlace-mode=auto
-	! vaapih264enc rate-control=cbr bitrate=12000 cpb-length=1000 quality-level=1 tune=high-compression
-	{{- else }}
-	! mpeg2dec
-	! deinterlace
+	{{- define "queue" }}
+	! {{ template "queue-element" . }}
+	{{- end }}
+
+	{{- define "video-encode" }}
 	{{- if eq .VideoPipeline "lowpower" }}
-	{{- template "queue-max-time" 2_500_000_000 }}
+	{{- template "queue" . }}
 	! videorate max-rate=30
-	! videoscale add-borders=true method=nearest-neighbour
-	{{- template "queue-max-time" 2_500_000_000 }}
-	! video/x-raw,width=640,height=360
-	! x264enc bitrate=2500 vbv-buf-capacity=1000 speed-preset=ultrafast bframes=0 mb-tree=false key-int-max=60 rc-lookahead=30
+	{{- end }}
+	! tee name=layers
+	{{- range .Layers }}
+
+	layers.
+	{{- template "queue" $ }}
+	{{- if .Height }}
+	{{- if eq $.VideoPipeline "vaapi" }}
+	! vaapipostproc width={{.Width}} height={{.Height}}
 	{{- else }}
-	! x264enc bitrate=8000 vbv-buf-capacity=1000 speed-preset=ultrafast tune=zerolatency
+	! videoscale add-borders=true {{- if eq $.VideoPipeline "lowpower" }} method=nearest-neighbour{{ end }}
+	! video/x-raw,width={{.Width}},height={{.Height}}
+	{{- end }}
 	{{- end }}
+	{{- if eq $.VideoPipeline "vaapi" }}
+	! vaapih264enc name={{.Encoder}} rate-control=cbr bitrate={{.Bitrate}} cpb-length=1000 quality-level=1 tune=high-compression
+	{{- else if eq $.VideoPipeline "lowpower" }}
+	! x264enc name={{.Encoder}} bitrate={{.Bitrate}} vbv-buf-capacity=1000 speed-preset=ultrafast bframes=0 mb-tree=false key-int-max=60 rc-lookahead=30
+	{{- else }}
+	! x264enc name={{.Encoder}} bitrate={{.Bitrate}} vbv-buf-capacity=1000 speed-preset=ultrafast tune=zerolatency
 	{{- end }}
 	! video/x-h264,profile=constrained-baseline,stream-format=byte-stream
-	! appsink name=video max-buffers=50 drop=true
+	! appsink name={{.Sink}} max-buffers=50 drop=true
+	{{- end }}
+	{{- end }}
 
-	demux.
-	{{- template "queue-max-time" 2_500_000_000 }}
+	{{- define "video-decode" }}
+	{{- if eq .Video "h264" }}
+	! h264parse
+	! {{ if eq .VideoPipeline "vaapi" }}vaapih264dec{{ else }}avdec_h264{{ end }}
+	{{- else if eq .Video "h265" }}
+	! h265parse
+	! {{ if eq .VideoPipeline "vaapi" }}vaapih265dec{{ else }}avdec_h265{{ end }}
+	{{- else }}
+	! mpegvideoparse
+	! {{ if eq .VideoPipeline "vaapi" }}vaapimpeg2dec{{ else }}mpeg2dec{{ end }}
+	{{- end }}
+	{{- if eq .VideoPipeline "vaapi" }}
+	! vaapipostproc deinterlace-mode=auto
+	{{- else }}
+	! deinterlace
+	{{- end }}
+	{{- end }}
+
+	{{- define "video-caps" -}}
+	{{- if eq .Video "h264" }}video/x-h264
+	{{- else if eq .Video "h265" }}video/x-h265
+	{{- else }}video/mpeg,mpegversion=2
+	{{- end }}
+	{{- end }}
+
+	{{- define "audio-decode" }}
+	{{- if eq .Audio "eac3" }}
+	! avdec_eac3
+	{{- else if eq .Audio "aac" }}
+	! aacparse
+	! avdec_aac
+	{{- else if eq .Audio "aac-latm" }}
+	! aacparse
+	! avdec_aac_latm
+	{{- else if eq .Audio "mpeg" }}
+	! mpegaudioparse
+	! mpg123audiodec
+	{{- else }}
 	! a52dec
+	{{- end }}
+	{{- end }}
+
+	{{- define "audio-caps" -}}
+	{{- if eq .Audio "eac3" }}audio/x-eac3
+	{{- else if eq .Audio "aac" }}audio/mpeg,mpegversion=4,stream-format=adts
+	{{- else if eq .Audio "aac-latm" }}audio/mpeg,mpegversion=4,stream-format=loas
+	{{- else if eq .Audio "mpeg" }}audio/mpeg,mpegversion=1
+	{{- else }}audio/x-ac3
+	{{- end }}
+	{{- end }}
+
+	{{- define "audio-encode" }}
 	! audioconvert
 	! audioresample
+	{{- if .NormalizeLoudness }}
+	! audioloudnorm loudness-target={{.LoudnessTarget}}
+	! audioconvert
+	! audioresample
+	{{- end }}
+	{{- if .SurroundAudio }}
+	! audio/x-raw,rate=48000
+	! tee name=surround
+
+	surround.
+	{{- template "queue" . }}
+	! audioconvert
+	! audio/x-raw,channels=6
+	! opusenc bitrate={{.SurroundAudioBitrate}}
+	! appsink name={{ .SurroundAudio }} max-buffers=50 drop=true
+
+	surround.
+	{{- template "queue" . }}
+	! audioconvert
+	{{- end }}
 	! audio/x-raw,rate=48000,channels=2
-	! opusenc bitrate=128000
+	! opusenc bitrate={{.AudioBitrate}}
 	! appsink name=audio max-buffers=50 drop=true
+	{{- end }}
+
+	{{- define "source" }}
+	{{- if eq .Source "file" }}
+	multifilesrc location={{ quote (location .SourceFile) }} loop=true
+	{{- template "queue" . }}
+	! tee name={{ .Mux }} allow-not-linked=true
+	{{- else if ne .Source "test" }}
+	dvbsrc adapter={{.Adapter}} frontend={{.Frontend}} delsys=atsc modulation={{.Modulation}} frequency={{.FrequencyHz}}
+	{{- template "queue" . }}
+	! tee name={{ .Mux }} allow-not-linked=true
+	{{- end }}
+	{{- end }}
+
+	{{- define "playback" }}
+	filesrc location={{ quote .SourceFile }}
+	{{- template "queue" . }}
+	! tee name={{ .Mux }} allow-not-linked=true
+	{{- end }}
+
+	{{- define "probe" }}
+	{{ template "queue-element" . }}
+	! appsink name={{ .Probe }} sync=false max-buffers=50 drop=true
+	{{- end }}
+
+	{{- define "record" }}
+	{{- if eq .Source "test" }}
+	videotestsrc is-live=true pattern=smpte
+	! video/x-raw,width=1280,height=720,framerate=30000/1001
+	! textoverlay text={{ quote .ChannelName }} font-desc="Sans 48"
+	{{- template "queue" . }}
+	! x264enc speed-preset=ultrafast tune=zerolatency
+	! mpegtsmux name=recordmux
+	! appsink name={{ .Record }} sync=false max-buffers=500 drop=false
+
+	audiotestsrc is-live=true wave=sine volume=0.1
+	{{- template "queue" . }}
+	! audioconvert
+	! avenc_ac3
+	! recordmux.
+	{{- else }}
+	queue max-size-time=2500000000 max-size-buffers=0 max-size-bytes=0
+	! appsink name={{ .Record }} sync=false max-buffers=500 drop=false
+	{{- end }}
+	{{- end }}
+
+	{{- define "program" }}
+	{{- if eq .Source "test" }}
+	videotestsrc is-live=true pattern=smpte
+	! video/x-raw,width=1280,height=720,framerate=30000/1001
+	! textoverlay text={{ quote .ChannelName }} font-desc="Sans 48"
+	{{- template "queue" . }}
+	{{- template "video-encode" . }}
+
+	{{- else if not .Video }}
+	videotestsrc is-live=true pattern=black
+	! video/x-raw,width=1280,height=720,framerate=30000/1001
+	! textoverlay text={{ quote (print .ChannelName " (audio only)") }} font-desc="Sans 48"
+	{{- template "queue" . }}
+	{{- template "video-encode" . }}
+
+	{{- else }}
+	{{ template "queue-element" . }}
+	! tsdemux name=demux {{- if .ProgramID }} program-number={{.ProgramID}}{{ end }} latency=500
+
+	demux.
+	! {{ template "video-caps" . }}
+	{{- template "queue" . }}
+	{{- if .Passthrough }}
+	! h264parse config-interval=-1
+	! video/x-h264,stream-format=byte-stream,alignment=au
+	! tee name=passthrough
+
+	passthrough.
+	{{- template "queue" . }}
+	! appsink name={{ .Passthrough }} max-buffers=50 drop=true
+
+	passthrough.
+	{{- template "queue" . }}
+	{{- end }}
+	{{- template "video-decode" . }}
+	! ccextractor name=cc
+	{{- template "video-encode" . }}
+
+	cc.caption
+	{{- template "queue" . }}
+	! ccconverter
+	! closedcaption/x-cea-708,format=cc_data
+	! appsink name={{ .Captions }} max-buffers=50 drop=true
+	{{- end }}
+	{{- end }}
+
+	{{- define "program-audio" }}
+	{{- if eq .Source "test" }}
+	audiotestsrc is-live=true wave=sine volume=0.1
+	{{- template "queue" . }}
+	{{- template "audio-encode" . }}
+
+	{{- else if not .Audio }}
+	audiotestsrc is-live=true wave=silence
+	{{- template "queue" . }}
+	{{- template "audio-encode" . }}
+
+	{{- else }}
+	{{ template "queue-element" . }}
+	! tsdemux name=demux {{- if .ProgramID }} program-number={{.ProgramID}}{{ end }} latency=500
+
+	demux. {{- with .AudioPID }}audio_0_{{ printf "%04x" . }}{{ end }}
+	! {{ template "audio-caps" . }}
+	{{- template "queue" . }}
+	{{- template "audio-decode" . }}
+	{{- template "audio-encode" . }}
+	{{- end }}
+	{{- end }}
 `))
 
 func (t *Tuner) destroyAnyRunningPipeline() error {
+	t.stopTuneTimer()
+	for _, prog := range t.programs {
+		t.stopProgram(prog)
+	}
+	t.detachRecordings()
+
 	if t.pipeline == nil {
 		return nil
 	}
@@ -327,21 +1086,115 @@ var (
 		ClockRate: 48_000,
 		Channels:  2,
 	}
+
+	// SurroundAudioCodecCapability represents the RTP codec settings for the
+	// 5.1 audio signal produced under AudioProfileSurround, as multichannel
+	// Opus in the format that Chromium-based browsers support. The channel
+	// mapping follows the Vorbis channel order that opusenc produces for 6
+	// channels, carried in 4 streams of which 2 are coupled stereo pairs.
+	SurroundAudioCodecCapability = webrtc.RTPCodecCapability{
+		MimeType:    "audio/multiopus",
+		ClockRate:   48_000,
+		Channels:    6,
+		SDPFmtpLine: "channel_mapping=0,4,1,2,3,5;num_streams=4;coupled_streams=2",
+	}
 )
 
-func (t *Tuner) createTrackPair() (video, audio *webrtc.TrackLocalStaticSample, err error) {
-	streamID := fmt.Sprintf("Tuner(%p)", t)
-	video, verr := webrtc.NewTrackLocalStaticSample(VideoCodecCapability, streamID, streamID)
-	audio, aerr := webrtc.NewTrackLocalStaticSample(AudioCodecCapability, streamID, streamID)
-	err = errors.Join(verr, aerr)
-	return
+// trackSet holds the video and audio tracks that the tuner writes samples to,
+// with a video track for each layer that the tuner's video pipeline produces.
+type trackSet struct {
+	video [NumLayers]*webrtc.TrackLocalStaticSample
+	audio *webrtc.TrackLocalStaticSample
+
+	// surroundAudio is nil unless the tuner encodes surround audio.
+	surroundAudio *webrtc.TrackLocalStaticSample
+}
+
+func (t *Tuner) newTrackSet(streamID string) (*trackSet, error) {
+	var ts trackSet
+	var errs []error
+	for _, l := range t.Layers() {
+		var err error
+		ts.video[l], err = webrtc.NewTrackLocalStaticSample(VideoCodecCapability, streamID, streamID)
+		errs = append(errs, err)
+	}
+	var err error
+	ts.audio, err = webrtc.NewTrackLocalStaticSample(AudioCodecCapability, streamID, streamID)
+	errs = append(errs, err)
+	if t.surroundAudioSink() != "" {
+		// Multichannel Opus packets go into RTP just like any other Opus packets,
+		// but pion only knows how to packetize codecs by their MIME types.
+		ts.surroundAudio, err = webrtc.NewTrackLocalStaticSample(
+			SurroundAudioCodecCapability, streamID, streamID,
+			webrtc.WithPayloader(func(webrtc.RTPCodecCapability) (rtp.Payloader, error) {
+				return &codecs.OpusPayloader{}, nil
+			}))
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return &ts, nil
 }
 
-func createTrackSink(track *webrtc.TrackLocalStaticSample) gst.SinkFunc {
-	return gst.SinkFunc(func(data []byte, duration time.Duration) {
-		track.WriteSample(media.Sample{
+// Tracks returns the set as a Tracks value for use by WebRTC clients.
+func (ts *trackSet) Tracks() Tracks {
+	tracks := Tracks{Audio: ts.audio}
+	if ts.surroundAudio != nil {
+		tracks.SurroundAudio = ts.surroundAudio
+	}
+	for l, video := range ts.video {
+		if video != nil {
+			tracks.Video[l] = video
+		}
+	}
+	return tracks
+}
+
+// forSink returns the track that receives samples from the named sink.
+func (ts *trackSet) forSink(name string) *webrtc.TrackLocalStaticSample {
+	for l, video := range ts.video {
+		if name == Layer(l).sinkName() {
+			return video
+		}
+	}
+	if name == sinkNameSurroundAudio {
+		return ts.surroundAudio
+	}
+	return ts.audio
+}
+
+// surroundAudioSink returns the name of the sink for each program's 5.1 audio,
+// or an empty string if the tuner encodes stereo audio alone. The latter is
+// also true of a user-defined pipeline template that doesn't encode surround
+// audio, even under AudioProfileSurround.
+func (t *Tuner) surroundAudioSink() string {
+	if t.config.AudioProfile != AudioProfileSurround {
+		return ""
+	}
+	if pt := t.config.PipelineTemplate; pt != nil && !pt.surroundAudio {
+		return ""
+	}
+	return sinkNameSurroundAudio
+}
+
+// createProgramSink writes the samples of prog's named sink to the program's
+// own track, and to the tuner's current track and timeshift buffer while prog
+// is the tuner's current program.
+func (t *Tuner) createProgramSink(prog *program, name string) pipeline.SinkFunc {
+	own := prog.tracks.forSink(name)
+	current := t.currentTracks.forSink(name)
+	return pipeline.SinkFunc(func(data []byte, duration time.Duration) {
+		sample := media.Sample{
 			Data:     data,
 			Duration: duration,
-		})
+		}
+		own.WriteSample(sample)
+		if t.current.Load() == prog {
+			current.WriteSample(sample)
+			if t.timeshift != nil {
+				t.timeshift.add(prog, name, sample)
+			}
+		}
 	})
 }
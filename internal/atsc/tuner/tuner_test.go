@@ -0,0 +1,1425 @@
+package tuner
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/featherbread/hypcast/internal/atsc"
+	"github.com/featherbread/hypcast/internal/atsc/captions"
+	"github.com/featherbread/hypcast/internal/atsc/mpegts"
+	"github.com/featherbread/hypcast/internal/atsc/mpegts/mpegtstest"
+	"github.com/featherbread/hypcast/internal/pipeline"
+	"github.com/featherbread/hypcast/internal/pipeline/pipelinetest"
+)
+
+const timeout = 2 * time.Second
+
+var testChannels = []atsc.Channel{
+	{Name: "KCTS-HD", FrequencyHz: 189_000_000, Modulation: atsc.Modulation8VSB, VideoPID: 49, AudioPID: 52, ProgramID: 3},
+	{Name: "KIDS", FrequencyHz: 189_000_000, Modulation: atsc.Modulation8VSB, VideoPID: 65, AudioPID: 68, ProgramID: 4},
+	{Name: "WLFI", FrequencyHz: 255_000_000, Modulation: atsc.ModulationQAM256, VideoPID: 66, AudioPID: 68, ProgramID: 4},
+}
+
+func TestTuneUnknownChannel(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+
+	err := tuner.Tune("NOPE")
+	assert.ErrorIs(t, err, ErrChannelNotFound)
+	assert.Nil(t, factory.Next(0), "created a pipeline for an unknown channel")
+}
+
+func TestTuneAndStop(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	statuses := watchStatus(t, tuner)
+	tracks := watchTracks(t, tuner)
+
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p := nextPipeline(t, factory)
+	assert.True(t, p.Started())
+	assert.Contains(t, p.Description, "frequency=189000000")
+	assert.Contains(t, videoBranchAt(t, p, 0).Description, "program-number=3")
+
+	awaitStatus(t, statuses, StateStarting, "KCTS-HD")
+	awaitTracks(t, tracks, true)
+
+	// Audio alone isn't enough to consider the stream to be playing.
+	audioBranchAt(t, p, 0).SendSample(sinkNameAudio, []byte("audio"), time.Millisecond)
+	assert.Equal(t, StateStarting, tuner.status.Get().State)
+
+	videoBranchAt(t, p, 0).SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	awaitStatus(t, statuses, StatePlaying, "KCTS-HD")
+
+	require.NoError(t, tuner.Stop())
+	s := awaitStatus(t, statuses, StateStopped, "")
+	assert.NoError(t, s.Error)
+	awaitTracks(t, tracks, false)
+	assert.True(t, p.Closed())
+}
+
+func TestPreemptionWarning(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	statuses := watchStatus(t, tuner)
+
+	// A warning should appear in the tuner's status right away, and stay there
+	// as the tuner changes state.
+	p := &Preemption{ChannelName: "KIDS", At: time.Now().Add(time.Minute)}
+	tuner.SetPreemption(p)
+	assert.Equal(t, p, tuner.Status().Preemption)
+
+	require.NoError(t, tuner.Tune("WLFI"))
+	nextPipeline(t, factory)
+	s := awaitStatus(t, statuses, StateStarting, "WLFI")
+	assert.Equal(t, p, s.Preemption)
+
+	tuner.SetPreemption(nil)
+	s = tuner.Status()
+	assert.Equal(t, StateStarting, s.State)
+	assert.Nil(t, s.Preemption)
+}
+
+func TestRetuneReplacesPipeline(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	statuses := watchStatus(t, tuner)
+
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	first := nextPipeline(t, factory)
+	videoBranchAt(t, first, 0).SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	awaitStatus(t, statuses, StatePlaying, "KCTS-HD")
+
+	firstTracks := tuner.tracks.Get()
+	require.NoError(t, tuner.Tune("WLFI"))
+	second := nextPipeline(t, factory)
+	assert.Equal(t, firstTracks, tuner.tracks.Get(), "replaced tracks on channel change")
+	assert.True(t, first.Closed())
+	assert.True(t, second.Started())
+	assert.Contains(t, second.Description, "modulation=qam-256")
+	awaitStatus(t, statuses, StateStarting, "WLFI")
+
+	// Late samples from the old pipeline must not affect the new channel.
+	videoBranchAt(t, first, 0).SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	assert.Equal(t, StateStarting, tuner.status.Get().State)
+}
+
+func TestFastChannelChange(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	statuses := watchStatus(t, tuner)
+	tracks := watchTracks(t, tuner)
+
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p := nextPipeline(t, factory)
+	kcts := videoBranchAt(t, p, 0)
+	kcts.SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	awaitStatus(t, statuses, StatePlaying, "KCTS-HD")
+	kctsTracks := awaitTracks(t, tracks, true)
+
+	// Switching to another program on the same frequency should keep the source
+	// running, and replace only the program branch.
+	require.NoError(t, tuner.Tune("KIDS"))
+	assert.Nil(t, factory.Next(50*time.Millisecond), "created a new pipeline on the same frequency")
+	assert.False(t, p.Closed())
+	assert.True(t, kcts.Closed())
+	kids := videoBranchAt(t, p, 1)
+	assert.True(t, kids.Started())
+	assert.Contains(t, kids.Description, "program-number=4")
+	awaitStatus(t, statuses, StateStarting, "KIDS")
+	assert.Equal(t, kctsTracks, awaitTracks(t, tracks, true), "replaced tracks on channel change")
+
+	kids.SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	awaitStatus(t, statuses, StatePlaying, "KIDS")
+
+	// Switching to a program that is already streaming should play immediately,
+	// and keep the previous program streaming for as long as it is in use.
+	release, err := tuner.AddProgram("KCTS-HD")
+	require.NoError(t, err)
+	kcts = videoBranchAt(t, p, 2)
+	kcts.SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	awaitProgramStarted(t, tuner, "KCTS-HD")
+
+	releaseKIDS, err := tuner.AddProgram("KIDS")
+	require.NoError(t, err)
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	s := awaitStatus(t, statuses, StatePlaying, "KCTS-HD")
+	assert.Equal(t, []string{"KIDS"}, s.Programs)
+	assert.False(t, kids.Closed())
+
+	releaseKIDS()
+	assert.True(t, kids.Closed())
+	release()
+	assert.False(t, kcts.Closed(), "released the program for the current channel")
+}
+
+func TestTuneStartFailure(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	statuses := watchStatus(t, tuner)
+	tracks := watchTracks(t, tuner)
+
+	startErr := errors.New("failed to start pipeline")
+	factory.FailStart(startErr)
+
+	err := tuner.Tune("KCTS-HD")
+	assert.ErrorIs(t, err, startErr)
+	assert.True(t, nextPipeline(t, factory).Closed())
+
+	s := awaitStatus(t, statuses, StateStopped, "")
+	assert.ErrorIs(t, s.Error, startErr)
+	awaitTracks(t, tracks, false)
+}
+
+func TestPipelineErrorWithoutRetry(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	statuses := watchStatus(t, tuner)
+	tracks := watchTracks(t, tuner)
+
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p := nextPipeline(t, factory)
+	videoBranchAt(t, p, 0).SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	awaitStatus(t, statuses, StatePlaying, "KCTS-HD")
+	awaitTracks(t, tracks, true)
+
+	p.SendError("dvbsrc0", "lost lock")
+	s := awaitStatus(t, statuses, StateStopped, "")
+	var perr *pipeline.Error
+	if assert.ErrorAs(t, s.Error, &perr) {
+		assert.Equal(t, "dvbsrc0", perr.Source)
+	}
+	awaitTracks(t, tracks, false)
+	assert.True(t, p.Closed())
+}
+
+func TestPipelineEOS(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	statuses := watchStatus(t, tuner)
+
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p := nextPipeline(t, factory)
+	p.SendEvent(pipeline.Event{Type: pipeline.EventEOS})
+
+	s := awaitStatus(t, statuses, StateStopped, "")
+	assert.ErrorIs(t, s.Error, errPipelineEOS)
+}
+
+func TestRetryAfterStreamLoss(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{
+		RetryMinDelay: 10 * time.Millisecond,
+		RetryMaxDelay: 40 * time.Millisecond,
+	})
+	statuses := watchStatus(t, tuner)
+
+	require.NoError(t, tuner.Tune("KIDS"))
+	first := nextPipeline(t, factory)
+	videoBranchAt(t, first, 0).SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	awaitStatus(t, statuses, StatePlaying, "KIDS")
+
+	// Fail the first retry attempt, to ensure that we keep trying.
+	startErr := errors.New("failed to start pipeline")
+	factory.FailStart(startErr)
+	first.SendError("dvbsrc0", "lost lock")
+
+	s := awaitStatus(t, statuses, StateRetrying, "KIDS")
+	assert.ErrorContains(t, s.Error, "lost lock")
+	assert.True(t, first.Closed())
+	assert.NotEqual(t, Tracks{}, tuner.tracks.Get(), "cleared tracks while retrying")
+
+	failed := nextPipeline(t, factory)
+	assert.True(t, failed.Closed())
+	s = awaitStatus(t, statuses, StateRetrying, "KIDS")
+	assert.ErrorIs(t, s.Error, startErr)
+
+	factory.FailStart(nil)
+	retried := nextPipeline(t, factory)
+	assert.Contains(t, videoBranchAt(t, retried, 0).Description, "program-number=4")
+	awaitStatus(t, statuses, StateStarting, "KIDS")
+	videoBranchAt(t, retried, 0).SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	awaitStatus(t, statuses, StatePlaying, "KIDS")
+}
+
+func TestNoRetryBeforePlaying(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{RetryMinDelay: 10 * time.Millisecond})
+	statuses := watchStatus(t, tuner)
+
+	require.NoError(t, tuner.Tune("KIDS"))
+	p := nextPipeline(t, factory)
+	p.SendError("dvbsrc0", "no such device")
+
+	s := awaitStatus(t, statuses, StateStopped, "")
+	assert.ErrorContains(t, s.Error, "no such device")
+	assert.Nil(t, factory.Next(100*time.Millisecond), "retried a channel that never played")
+}
+
+func TestStopCancelsRetry(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{RetryMinDelay: 100 * time.Millisecond})
+	statuses := watchStatus(t, tuner)
+
+	require.NoError(t, tuner.Tune("KIDS"))
+	p := nextPipeline(t, factory)
+	videoBranchAt(t, p, 0).SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	awaitStatus(t, statuses, StatePlaying, "KIDS")
+
+	p.SendError("dvbsrc0", "lost lock")
+	awaitStatus(t, statuses, StateRetrying, "KIDS")
+
+	require.NoError(t, tuner.Stop())
+	awaitStatus(t, statuses, StateStopped, "")
+	assert.Nil(t, factory.Next(300*time.Millisecond), "retried after the tuner was stopped")
+}
+
+func TestTuneTimeout(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{TuneTimeout: 20 * time.Millisecond})
+	statuses := watchStatus(t, tuner)
+
+	require.NoError(t, tuner.Tune("WLFI"))
+	p := nextPipeline(t, factory)
+
+	s := awaitStatus(t, statuses, StateStopped, "")
+	assert.ErrorIs(t, s.Error, ErrNoSignal)
+	assert.True(t, p.Closed())
+}
+
+func TestWatchdog(t *testing.T) {
+	factory := pipelinetest.NewFactory()
+	factory.SampleInterval = 5 * time.Millisecond
+	tuner := NewTuner(testChannels, Config{
+		NewPipeline:     factory.New,
+		TuneTimeout:     timeout,
+		WatchdogTimeout: 50 * time.Millisecond,
+	})
+	setTestStreams(tuner)
+	t.Cleanup(func() { tuner.Stop() })
+	statuses := watchStatus(t, tuner)
+
+	require.NoError(t, tuner.Tune("WLFI"))
+	p := nextPipeline(t, factory)
+	awaitStatus(t, statuses, StatePlaying, "WLFI")
+
+	// The watchdog should not fire as long as the pipeline generates samples.
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, StatePlaying, tuner.status.Get().State)
+
+	// Closing the fake stops its sample generator without the tuner knowing.
+	p.Close()
+	s := awaitStatus(t, statuses, StateStopped, "")
+	assert.ErrorContains(t, s.Error, "data received for")
+}
+
+func TestAddProgram(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	statuses := watchStatus(t, tuner)
+
+	_, err := tuner.AddProgram("KIDS")
+	assert.ErrorIs(t, err, ErrProgramUnavailable, "added a program while stopped")
+
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p := nextPipeline(t, factory)
+	videoBranchAt(t, p, 0).SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	awaitStatus(t, statuses, StatePlaying, "KCTS-HD")
+
+	_, err = tuner.AddProgram("WLFI")
+	assert.ErrorIs(t, err, ErrProgramUnavailable, "added a program from another frequency")
+
+	kidsTracks := make(chan Tracks, 100)
+	w, err := tuner.WatchProgramTracks("KIDS", func(ts Tracks) { kidsTracks <- ts })
+	require.NoError(t, err)
+	t.Cleanup(func() { w.Cancel(); w.Wait() })
+
+	release, err := tuner.AddProgram("KIDS")
+	require.NoError(t, err)
+	releaseAgain, err := tuner.AddProgram("KIDS")
+	require.NoError(t, err)
+
+	kids := videoBranchAt(t, p, 1)
+	assert.Len(t, p.Branches(), 4, "started second branches for the same program")
+	assert.True(t, kids.Started())
+	assert.Equal(t, muxElementName, kids.Tee)
+	assert.Contains(t, kids.Description, "program-number=4")
+	awaitTracks(t, kidsTracks, true)
+	assert.Equal(t, []string{"KIDS"}, tuner.Status().Programs)
+
+	// The program should only stop once every caller has released it, and
+	// without affecting the current channel.
+	release()
+	release()
+	assert.False(t, kids.Closed())
+	releaseAgain()
+	assert.True(t, kids.Closed())
+	awaitTracks(t, kidsTracks, false)
+	assert.Empty(t, tuner.Status().Programs)
+	assert.False(t, videoBranchAt(t, p, 0).Closed())
+	assert.Equal(t, StatePlaying, tuner.Status().State)
+
+	// Retuning to another frequency should stop every program.
+	release, err = tuner.AddProgram("KIDS")
+	require.NoError(t, err)
+	require.NoError(t, tuner.Tune("WLFI"))
+	assert.True(t, videoBranchAt(t, p, 2).Closed())
+	awaitTracks(t, kidsTracks, false)
+	release()
+	assert.Len(t, nextPipeline(t, factory).Branches(), 2)
+}
+
+func TestProbeStreams(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	clear(tuner.streams)
+	statuses := watchStatus(t, tuner)
+
+	require.NoError(t, tuner.Tune("KIDS"))
+	p := nextPipeline(t, factory)
+	probe := branchAt(t, p, 0)
+	assert.Contains(t, probe.Description, "appsink name="+sinkNameProbe)
+
+	kctsProgram := mpegts.Program{Number: 3, PMTPID: 48, PCRPID: 49, Streams: []mpegts.ElementaryStream{
+		{Type: mpegts.StreamTypeMPEG2Video, PID: 49},
+		{Type: mpegts.StreamTypeAC3, PID: 52},
+	}}
+	kidsProgram := mpegts.Program{Number: 4, PMTPID: 64, PCRPID: 65, Streams: []mpegts.ElementaryStream{
+		{Type: mpegts.StreamTypeH264, PID: 65, Descriptors: []mpegts.Descriptor{
+			{Tag: mpegts.DescriptorTagAVCVideo, Data: []byte{66, 0xC0, 31, 0x3F}},
+		}},
+		{Type: mpegts.StreamTypePrivate, PID: 68, Descriptors: []mpegts.Descriptor{
+			{Tag: mpegts.DescriptorTagDVBEAC3, Data: []byte{0x00}},
+		}},
+	}}
+	psi := mpegtstest.PSI(kctsProgram, kidsProgram)
+	probe.SendSample(sinkNameProbe, psi[:200], 0)
+	assert.Len(t, p.Branches(), 1, "started the program before reading its map table")
+	probe.SendSample(sinkNameProbe, psi[200:], 0)
+
+	require.Eventually(t, func() bool { return len(p.Branches()) == 3 }, timeout, time.Millisecond)
+	assert.True(t, probe.Closed())
+
+	// The program's H.264 video fits WebRTC as is, so its high layer should
+	// come straight from the broadcast.
+	kids := videoBranchAt(t, p, 0)
+	assert.True(t, kids.Started())
+	assert.Contains(t, kids.Description, "avdec_h264")
+	assert.Contains(t, audioBranchAt(t, p, 0).Description, "avdec_eac3")
+	assert.Contains(t, kids.Description, "tee name=passthrough")
+	assert.Contains(t, kids.Description, "appsink name="+LayerHigh.sinkName())
+	assert.NotContains(t, kids.Description, "name="+LayerHigh.encoderName())
+	assert.Contains(t, kids.Description, "name="+LayerMedium.encoderName())
+
+	kids.SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	awaitStatus(t, statuses, StatePlaying, "KIDS")
+	tuner.RequestKeyFrame(LayerHigh)
+	tuner.RequestKeyFrame(LayerMedium)
+	assert.Equal(t, 0, kids.KeyFrameRequests(LayerHigh.sinkName()))
+	assert.Equal(t, 1, kids.KeyFrameRequests(LayerMedium.sinkName()))
+
+	// The probe should have covered the other program on the multiplex.
+	release, err := tuner.AddProgram("KCTS-HD")
+	require.NoError(t, err)
+	kcts := videoBranchAt(t, p, 1)
+	assert.Contains(t, kcts.Description, "mpeg2dec")
+	assert.Contains(t, audioBranchAt(t, p, 1).Description, "a52dec")
+	release()
+
+	// A program that the multiplex does not carry should fail to tune.
+	require.NoError(t, tuner.Tune("WLFI"))
+	p = nextPipeline(t, factory)
+	branchAt(t, p, 0).SendSample(sinkNameProbe, mpegtstest.PSI(kctsProgram), 0)
+	s := awaitStatus(t, statuses, StateStopped, "")
+	assert.ErrorContains(t, s.Error, "program 4 not found")
+
+	// A program shouldn't wait on the map tables of the others.
+	clear(tuner.streams)
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p = nextPipeline(t, factory)
+	probe = branchAt(t, p, 0)
+	probe.SendSample(sinkNameProbe, mpegtstest.PSI(kctsProgram, kidsProgram)[:2*mpegts.PacketSize], 0)
+	require.Eventually(t, func() bool { return len(p.Branches()) == 3 }, timeout, time.Millisecond)
+	assert.True(t, probe.Closed())
+	assert.Contains(t, videoBranchAt(t, p, 0).Description, "mpeg2dec")
+}
+
+func TestMissingStreams(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	statuses := watchStatus(t, tuner)
+	tracks := watchTracks(t, tuner)
+
+	kidsTracks := make(chan Tracks, 100)
+	w, err := tuner.WatchProgramTracks("KIDS", func(ts Tracks) { kidsTracks <- ts })
+	require.NoError(t, err)
+	t.Cleanup(func() { w.Cancel(); w.Wait() })
+
+	// An audio-only program should start with its audio, and fill the current
+	// video tracks with a slate.
+	delete(tuner.streams, "KIDS")
+	require.NoError(t, tuner.Tune("KIDS"))
+	p := nextPipeline(t, factory)
+	branchAt(t, p, 0).SendSample(sinkNameProbe, mpegtstest.PSI(
+		mpegts.Program{Number: 4, PMTPID: 64, PCRPID: 68, Streams: []mpegts.ElementaryStream{
+			{Type: mpegts.StreamTypeAC3, PID: 68},
+		}},
+	), 0)
+	require.Eventually(t, func() bool { return len(p.Branches()) == 3 }, timeout, time.Millisecond)
+
+	kids := videoBranchAt(t, p, 0)
+	assert.Contains(t, kids.Description, "videotestsrc")
+	assert.Contains(t, audioBranchAt(t, p, 0).Description, "demux.audio_0_0044\n\t! audio/x-ac3")
+	assert.NotContains(t, kids.Description, "video/mpeg")
+
+	current := awaitTracks(t, tracks, true)
+	assert.NotNil(t, current.Video[LayerHigh])
+	assert.NotNil(t, current.Audio)
+	var ts Tracks
+	require.Eventually(t, func() bool {
+		for {
+			select {
+			case ts = <-kidsTracks:
+			default:
+				return ts.Audio != nil
+			}
+		}
+	}, timeout, time.Millisecond)
+	assert.Equal(t, [NumLayers]webrtc.TrackLocal{}, ts.Video)
+
+	kids.SendSample(LayerHigh.sinkName(), []byte("slate"), time.Millisecond)
+	audioBranchAt(t, p, 0).SendSample(sinkNameAudio, []byte("audio"), time.Millisecond)
+	s := awaitStatus(t, statuses, StatePlaying, "KIDS")
+	assert.True(t, s.AudioOnly)
+	assert.False(t, s.VideoOnly)
+
+	// A video-only program should fill the current audio track with silence.
+	tuner.mu.Lock()
+	tuner.streams["WLFI"] = programStreams{Video: videoCodecMPEG2}
+	tuner.mu.Unlock()
+	require.NoError(t, tuner.Tune("WLFI"))
+	p = nextPipeline(t, factory)
+	wlfi := videoBranchAt(t, p, 0)
+	assert.Contains(t, audioBranchAt(t, p, 0).Description, "audiotestsrc is-live=true wave=silence")
+	assert.Contains(t, wlfi.Description, "mpeg2dec")
+
+	wlfi.SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	s = awaitStatus(t, statuses, StatePlaying, "WLFI")
+	assert.False(t, s.AudioOnly)
+	assert.True(t, s.VideoOnly)
+}
+
+func TestSelectAudio(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	statuses := watchStatus(t, tuner)
+
+	assert.ErrorIs(t, tuner.SelectAudio(52), ErrAudioStreamNotFound, "selected audio while stopped")
+
+	delete(tuner.streams, "KCTS-HD")
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p := nextPipeline(t, factory)
+	language := func(code string, audioType byte) []mpegts.Descriptor {
+		return []mpegts.Descriptor{{Tag: mpegts.DescriptorTagISO639Language, Data: append([]byte(code), audioType)}}
+	}
+	branchAt(t, p, 0).SendSample(sinkNameProbe, mpegtstest.PSI(
+		mpegts.Program{Number: 3, PMTPID: 48, PCRPID: 49, Streams: []mpegts.ElementaryStream{
+			{Type: mpegts.StreamTypeAC3, PID: 51, Descriptors: language("spa", 0)},
+			{Type: mpegts.StreamTypeMPEG2Video, PID: 49},
+			{Type: mpegts.StreamTypeAC3, PID: 52, Descriptors: language("eng", 0)},
+			{Type: mpegts.StreamTypeAC3, PID: 53, Descriptors: language("eng", 3)},
+		}},
+	), 0)
+	require.Eventually(t, func() bool { return len(p.Branches()) == 3 }, timeout, time.Millisecond)
+
+	// The tuner should prefer the audio PID from the channel list.
+	kcts := videoBranchAt(t, p, 0)
+	kcts.SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	s := awaitStatus(t, statuses, StatePlaying, "KCTS-HD")
+	assert.Equal(t, []AudioStream{
+		{PID: 51, Language: "spa", codec: audioCodecAC3},
+		{PID: 52, Language: "eng", codec: audioCodecAC3},
+		{PID: 53, Language: "eng", Descriptive: true, codec: audioCodecAC3},
+	}, s.AudioStreams)
+	assert.Equal(t, uint(52), s.AudioPID)
+	assert.Contains(t, audioBranchAt(t, p, 0).Description, "demux.audio_0_0034")
+
+	// Switching audio should replace the audio branch alone.
+	require.NoError(t, tuner.SelectAudio(51))
+	assert.True(t, audioBranchAt(t, p, 0).Closed())
+	assert.False(t, kcts.Closed())
+	assert.Contains(t, audioBranchAt(t, p, 1).Description, "demux.audio_0_0033")
+	assert.Equal(t, uint(51), awaitStatus(t, statuses, StatePlaying, "KCTS-HD").AudioPID)
+
+	assert.ErrorIs(t, tuner.SelectAudio(49), ErrAudioStreamNotFound)
+	assert.Len(t, p.Branches(), 4)
+
+	// The tuner should remember the selection for the channel.
+	require.NoError(t, tuner.Tune("KIDS"))
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	assert.Contains(t, audioBranchAt(t, p, 3).Description, "demux.audio_0_0033")
+}
+
+func TestSurroundAudio(t *testing.T) {
+	assert.Equal(t, AudioProfileSurround, ParseAudioProfile("surround"))
+	assert.Equal(t, AudioProfileStereo, ParseAudioProfile("quad"))
+
+	// The stereo profile shouldn't produce any surround audio.
+	tuner, factory := newTestTuner(t, Config{})
+	tracks := watchTracks(t, tuner)
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p := nextPipeline(t, factory)
+	assert.NotContains(t, audioBranchAt(t, p, 0).Description, "appsink name="+sinkNameSurroundAudio)
+	assert.Nil(t, awaitTracks(t, tracks, true).SurroundAudio)
+
+	// The surround profile should encode both stereo and surround audio.
+	tuner, factory = newTestTuner(t, Config{AudioProfile: AudioProfileSurround})
+	tracks = watchTracks(t, tuner)
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p = nextPipeline(t, factory)
+	audio := audioBranchAt(t, p, 0)
+	assert.Contains(t, audio.Description, "channels=6")
+	assert.Contains(t, audio.Description, "appsink name="+sinkNameSurroundAudio)
+	assert.Contains(t, audio.Description, "appsink name="+sinkNameAudio+" ")
+	ts := awaitTracks(t, tracks, true)
+	assert.NotNil(t, ts.Audio)
+	if assert.NotNil(t, ts.SurroundAudio) {
+		assert.Equal(t, SurroundAudioCodecCapability, ts.SurroundAudio.(*webrtc.TrackLocalStaticSample).Codec())
+	}
+	audio.SendSample(sinkNameSurroundAudio, []byte("audio"), time.Millisecond)
+
+	// A user-defined template that only encodes stereo audio should fall back
+	// to stereo.
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stereo.tmpl"), []byte(`
+		{{- define "audio-encode" }}
+		! audioconvert
+		! opusenc
+		! appsink name=audio
+		{{- end }}
+	`), 0o644))
+	templates, err := LoadPipelineTemplates(dir)
+	require.NoError(t, err)
+	tuner, factory = newTestTuner(t, Config{
+		VideoPipeline:    "stereo",
+		PipelineTemplate: templates["stereo"],
+		AudioProfile:     AudioProfileSurround,
+	})
+	tracks = watchTracks(t, tuner)
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	nextPipeline(t, factory)
+	assert.Nil(t, awaitTracks(t, tracks, true).SurroundAudio)
+}
+
+func TestLoudnessNormalization(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{NormalizeLoudness: true, LoudnessTarget: -16})
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p := nextPipeline(t, factory)
+	release, err := tuner.AddProgram("KIDS")
+	require.NoError(t, err)
+	defer release()
+	assert.Contains(t, audioBranchAt(t, p, 0).Description, "audioloudnorm loudness-target=-16")
+	assert.Contains(t, audioBranchAt(t, p, 1).Description, "audioloudnorm loudness-target=-16")
+
+	// Switching normalization off should replace every audio branch without
+	// touching the video.
+	require.NoError(t, tuner.SetLoudnessNormalization(false))
+	assert.False(t, tuner.LoudnessNormalization())
+	for i := range 2 {
+		assert.True(t, audioBranchAt(t, p, i).Closed())
+		assert.False(t, videoBranchAt(t, p, i).Closed())
+	}
+	for i := range 2 {
+		assert.NotContains(t, audioBranchAt(t, p, 2+i).Description, "audioloudnorm")
+	}
+
+	// Setting the same value again should change nothing.
+	require.NoError(t, tuner.SetLoudnessNormalization(false))
+	assert.Len(t, p.Branches(), 6)
+
+	// New programs should follow the setting, at the default target.
+	tuner, factory = newTestTuner(t, Config{})
+	require.NoError(t, tuner.SetLoudnessNormalization(true))
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p = nextPipeline(t, factory)
+	assert.Contains(t, audioBranchAt(t, p, 0).Description, "audioloudnorm loudness-target=-24")
+}
+
+func TestRecord(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	statuses := watchStatus(t, tuner)
+
+	_, err := tuner.Record("NOPE", io.Discard)
+	assert.ErrorIs(t, err, ErrChannelNotFound)
+
+	// Recording on a stopped tuner should tune it to the channel.
+	var out bytes.Buffer
+	rec, err := tuner.Record("KCTS-HD", &out)
+	require.NoError(t, err)
+	p := nextPipeline(t, factory)
+	awaitStatus(t, statuses, StateStarting, "KCTS-HD")
+	record := recordBranchAt(t, p, 0)
+	assert.True(t, record.Started())
+	assert.Equal(t, muxElementName, record.Tee)
+
+	_, err = tuner.Record("WLFI", io.Discard)
+	assert.ErrorIs(t, err, ErrProgramUnavailable, "recorded a program from another frequency")
+
+	// The recording should carry its own program alone, and continue when the
+	// tuner switches to another program on the same frequency.
+	psi := mpegtstest.PSI(
+		mpegts.Program{Number: 3, PMTPID: 48, PCRPID: 49, Streams: []mpegts.ElementaryStream{
+			{Type: mpegts.StreamTypeMPEG2Video, PID: 49},
+		}},
+		mpegts.Program{Number: 4, PMTPID: 64, PCRPID: 65, Streams: []mpegts.ElementaryStream{
+			{Type: mpegts.StreamTypeMPEG2Video, PID: 65},
+		}},
+	)
+	record.SendSample(sinkNameRecord, slices.Concat(psi, psi), 0)
+	require.NoError(t, tuner.Tune("KIDS"))
+	assert.False(t, record.Closed())
+	record.SendSample(sinkNameRecord, slices.Concat(tsPacket(49), tsPacket(65)), 0)
+
+	require.NoError(t, rec.Stop())
+	assert.True(t, record.Closed())
+	assert.False(t, p.Closed(), "stopped a tuner that a client tuned")
+	assert.Equal(t, []uint16{0, 48, 49}, packetPIDs(out.Bytes()))
+
+	// Tuning to another frequency should interrupt any recording.
+	rec, err = tuner.Record("KCTS-HD", io.Discard)
+	require.NoError(t, err)
+	require.NoError(t, tuner.Tune("WLFI"))
+	<-rec.Done()
+	assert.ErrorIs(t, rec.Err(), ErrRecordingInterrupted)
+	assert.ErrorIs(t, rec.Stop(), ErrRecordingInterrupted)
+	nextPipeline(t, factory)
+
+	// A tuner that started only to record should stop with the last recording.
+	tuner, factory = newTestTuner(t, Config{})
+	rec, err = tuner.Record("KCTS-HD", io.Discard)
+	require.NoError(t, err)
+	p = nextPipeline(t, factory)
+	recAgain, err := tuner.Record("KIDS", io.Discard)
+	require.NoError(t, err)
+	require.NoError(t, rec.Stop())
+	assert.False(t, p.Closed())
+	require.NoError(t, recAgain.Stop())
+	assert.True(t, p.Closed())
+	assert.Equal(t, StateStopped, tuner.Status().State)
+}
+
+func TestRecordRetry(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{RetryMinDelay: time.Millisecond})
+	statuses := watchStatus(t, tuner)
+
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	first := nextPipeline(t, factory)
+	videoBranchAt(t, first, 0).SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	awaitStatus(t, statuses, StatePlaying, "KCTS-HD")
+
+	rec, err := tuner.Record("KIDS", io.Discard)
+	require.NoError(t, err)
+
+	// The recording should carry on into the pipeline that replaces a lost one.
+	first.SendError("dvbsrc0", "lost signal")
+	second := nextPipeline(t, factory)
+	assert.True(t, recordBranchAt(t, first, 0).Closed())
+	assert.True(t, recordBranchAt(t, second, 0).Started())
+	select {
+	case <-rec.Done():
+		t.Fatal("retry ended the recording")
+	default:
+	}
+
+	// Failing writes should end the recording.
+	rec.Stop()
+	rec, err = tuner.Record("KIDS", failingWriter{})
+	require.NoError(t, err)
+	record := recordBranchAt(t, second, 1)
+	psi := mpegtstest.PSI(mpegts.Program{Number: 4, PMTPID: 64, PCRPID: 65})
+	record.SendSample(sinkNameRecord, slices.Concat(psi, psi), 0)
+	<-rec.Done()
+	assert.ErrorIs(t, rec.Err(), errWriteFailed)
+	assert.True(t, record.Closed())
+}
+
+func TestRecordSlowWriter(t *testing.T) {
+	defer func(size int) { recordBufferSize = size }(recordBufferSize)
+	recordBufferSize = 6 * mpegts.PacketSize
+
+	tuner, factory := newTestTuner(t, Config{})
+	w := &blockingWriter{entered: make(chan struct{}), release: make(chan struct{})}
+	rec, err := tuner.Record("KCTS-HD", w)
+	require.NoError(t, err)
+	record := recordBranchAt(t, nextPipeline(t, factory), 0)
+
+	// While the writer is stuck, the recording should buffer what it can, and
+	// count what it can't. The data being written counts toward the buffer.
+	psi := mpegtstest.PSI(mpegts.Program{Number: 3, PMTPID: 48, PCRPID: 49})
+	record.SendSample(sinkNameRecord, slices.Concat(psi, psi), 0)
+	<-w.entered
+	record.SendSample(sinkNameRecord, slices.Concat(tsPacket(49), tsPacket(49)), 0)
+	record.SendSample(sinkNameRecord, tsPacket(49), 0)
+	assert.Equal(t, 1, rec.Dropped())
+
+	// Stopping should wait for the writer to catch up on what was buffered.
+	close(w.release)
+	require.NoError(t, rec.Stop())
+	assert.Equal(t, 1, rec.Dropped())
+	assert.Equal(t, []uint16{0, 48, 49}, packetPIDs(w.buf.Bytes()))
+	assert.Len(t, w.buf.Bytes(), 4*mpegts.PacketSize)
+}
+
+func TestCaptions(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	delete(tuner.streams, "KIDS")
+
+	require.NoError(t, tuner.Tune("KIDS"))
+	p := nextPipeline(t, factory)
+	branchAt(t, p, 0).SendSample(sinkNameProbe, mpegtstest.PSI(
+		mpegts.Program{Number: 4, PMTPID: 64, PCRPID: 65, Streams: []mpegts.ElementaryStream{
+			{Type: mpegts.StreamTypeMPEG2Video, PID: 65, Descriptors: []mpegts.Descriptor{
+				{Tag: mpegts.DescriptorTagCaptionService, Data: []byte{
+					0xC1, 'e', 'n', 'g', 0xC1, 0x3F, 0xFF,
+				}},
+			}},
+			{Type: mpegts.StreamTypeAC3, PID: 68},
+		}},
+	), 0)
+	require.Eventually(t, func() bool { return len(p.Branches()) == 3 }, timeout, time.Millisecond)
+
+	kids := videoBranchAt(t, p, 0)
+	assert.Contains(t, kids.Description, "ccextractor")
+	assert.Contains(t, kids.Description, "appsink name="+sinkNameCaptions)
+	assert.Equal(t, []captions.Service{{Name: "Service1", Language: "eng"}}, tuner.captions.Get().Services)
+
+	// Roll-up captions on CC1, which the program map table didn't announce.
+	kids.SendSample(sinkNameCaptions, []byte{0xFC, 0x14, 0x25, 0xFC, 0x14, 0x25, 0xFC, 'H', 'I'}, 0)
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"HI"}, tuner.captions.Get().Text["CC1"])
+	}, timeout, time.Millisecond)
+	assert.Equal(t, []captions.Service{
+		{Name: "Service1", Language: "eng"},
+		{Name: "CC1"},
+	}, tuner.captions.Get().Services)
+
+	// The current captions should follow the current channel.
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	assert.Empty(t, tuner.captions.Get().Text)
+	kcts := videoBranchAt(t, p, 1)
+	kcts.SendSample(sinkNameCaptions, []byte{0xFC, 0x14, 0x25, 0xFC, 'O', 'K'}, 0)
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"OK"}, tuner.captions.Get().Text["CC1"])
+	}, timeout, time.Millisecond)
+
+	require.NoError(t, tuner.Stop())
+	assert.Equal(t, Captions{}, tuner.captions.Get())
+}
+
+func TestRequestKeyFrame(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+
+	tuner.RequestKeyFrame(LayerHigh) // Should not panic without a pipeline.
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p := nextPipeline(t, factory)
+	kcts := videoBranchAt(t, p, 0)
+
+	// Requests from many clients at once should produce a single key frame.
+	for range 3 {
+		tuner.RequestKeyFrame(LayerHigh)
+		tuner.RequestProgramKeyFrame("KCTS-HD", LayerHigh)
+	}
+	assert.Equal(t, 1, kcts.KeyFrameRequests(LayerHigh.sinkName()))
+
+	// Each layer has its own encoder, so requests for one layer should not
+	// limit requests for another.
+	tuner.RequestKeyFrame(LayerLow)
+	assert.Equal(t, 1, kcts.KeyFrameRequests(LayerLow.sinkName()))
+
+	tuner.RequestProgramKeyFrame("KIDS", LayerHigh)
+	release, err := tuner.AddProgram("KIDS")
+	require.NoError(t, err)
+	defer release()
+	tuner.RequestProgramKeyFrame("KIDS", LayerHigh)
+	kids := videoBranchAt(t, p, 1)
+	assert.Equal(t, 1, kids.KeyFrameRequests(LayerHigh.sinkName()))
+
+	// Switching to a program that is already streaming should request a key
+	// frame for clients that are joining it, regardless of other requests.
+	kids.SendSample(LayerHigh.sinkName(), []byte("video"), time.Millisecond)
+	awaitProgramStarted(t, tuner, "KIDS")
+	require.NoError(t, tuner.Tune("KIDS"))
+	assert.Equal(t, 2, kids.KeyFrameRequests(LayerHigh.sinkName()))
+}
+
+func TestViewerBitrate(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{})
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p := nextPipeline(t, factory)
+	kcts := videoBranchAt(t, p, 0)
+	assert.Contains(t, kcts.Description, "x264enc name=venc-high bitrate=8000")
+	assert.Contains(t, kcts.Description, "x264enc name=venc-low bitrate=1200")
+
+	assertBitrate := func(b *pipelinetest.Branch, l Layer, want string) {
+		t.Helper()
+		got, _ := b.Property(l.encoderName(), "bitrate")
+		assert.Equal(t, want, got, "bitrate for %v layer", l)
+	}
+
+	// Viewers should start on the highest quality layer, and move to the best
+	// layer that fits their bandwidth after accounting for audio and transport
+	// overhead. Moving up should require some headroom.
+	viewer := tuner.AddViewer("")
+	defer viewer.Close()
+	assert.Equal(t, LayerHigh, viewer.Layer())
+	viewer.SetAvailableBitrate(3_000_000)
+	assert.Equal(t, LayerMedium, viewer.Layer())
+	assertBitrate(kcts, LayerMedium, "2422")
+	viewer.SetAvailableBitrate(4_500_000)
+	assert.Equal(t, LayerMedium, viewer.Layer())
+	assertBitrate(kcts, LayerMedium, "3697")
+	viewer.SetAvailableBitrate(5_000_000)
+	assert.Equal(t, LayerHigh, viewer.Layer())
+	assertBitrate(kcts, LayerHigh, "4122")
+	assertBitrate(kcts, LayerMedium, "4000")
+
+	// The most constrained viewer of a layer should set its bitrate, within the
+	// bounds for the layer.
+	slowViewer := tuner.AddViewer("KCTS-HD")
+	slowViewer.SetLayer(LayerHigh)
+	slowViewer.SetAvailableBitrate(100_000)
+	assert.Equal(t, LayerHigh, slowViewer.Layer())
+	assertBitrate(kcts, LayerHigh, "3000")
+	slowViewer.SetAutoLayer()
+	assert.Equal(t, LayerLow, slowViewer.Layer())
+	assertBitrate(kcts, LayerHigh, "4122")
+	assertBitrate(kcts, LayerLow, "300")
+	slowViewer.Close()
+	assertBitrate(kcts, LayerLow, "1200")
+
+	// Small fluctuations should not reconfigure the encoder.
+	viewer.SetAvailableBitrate(5_100_000)
+	assertBitrate(kcts, LayerHigh, "4122")
+
+	// Viewers of other programs should not affect the current program.
+	release, err := tuner.AddProgram("KIDS")
+	require.NoError(t, err)
+	defer release()
+	kids := videoBranchAt(t, p, 1)
+	kidsViewer := tuner.AddViewer("KIDS")
+	defer kidsViewer.Close()
+	kidsViewer.SetAvailableBitrate(1_000_000)
+	assertBitrate(kids, LayerLow, "722")
+	assertBitrate(kcts, LayerHigh, "4122")
+
+	// Viewers of the current channel should follow it to a new program.
+	require.NoError(t, tuner.Tune("KIDS"))
+	assertBitrate(kids, LayerHigh, "4207")
+	kidsViewer.Close()
+	assertBitrate(kids, LayerLow, "1200")
+}
+
+func TestTimeshift(t *testing.T) {
+	keyFrame := []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x65, 0x88}
+	deltaFrame := []byte{0, 0, 1, 0x41, 0x9a}
+	assert.True(t, isKeyFrame(keyFrame))
+	assert.False(t, isKeyFrame(deltaFrame))
+	assert.False(t, isKeyFrame(nil))
+
+	// Without a timeshift window, viewers can only watch live.
+	liveOnly, _ := newTestTuner(t, Config{})
+	require.NoError(t, liveOnly.Tune("KCTS-HD"))
+	liveViewer := liveOnly.AddViewer("")
+	defer liveViewer.Close()
+	assert.False(t, liveViewer.CanTimeshift())
+	assert.ErrorIs(t, liveViewer.Pause(), ErrTimeshiftUnavailable)
+
+	tuner, factory := newTestTuner(t, Config{TimeshiftWindow: time.Minute})
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p := nextPipeline(t, factory)
+	video, audio := videoBranchAt(t, p, 0), audioBranchAt(t, p, 0)
+
+	viewer := tuner.AddViewer("")
+	defer viewer.Close()
+	other := tuner.AddViewer("")
+	defer other.Close()
+	statuses := make(chan TimeshiftStatus, 10)
+	w := viewer.WatchTimeshift(func(s TimeshiftStatus) { statuses <- s })
+	defer w.Cancel()
+	awaitTimeshift := func(live, paused bool) TimeshiftStatus {
+		t.Helper()
+		select {
+		case s := <-statuses:
+			assert.Equal(t, live, s.Live, "live")
+			assert.Equal(t, paused, s.Paused, "paused")
+			return s
+		case <-time.After(timeout):
+			t.Fatalf("timed out waiting for timeshift status")
+			return TimeshiftStatus{}
+		}
+	}
+	awaitTimeshift(true, false)
+	assert.True(t, viewer.CanTimeshift())
+
+	// There's nothing to rewind into before the program produces samples.
+	require.NoError(t, viewer.Rewind(time.Minute))
+	assert.True(t, viewer.Timeshift().Live)
+
+	sendGOP := func() {
+		video.SendSample(LayerHigh.sinkName(), keyFrame, time.Millisecond)
+		audio.SendSample(sinkNameAudio, []byte("audio"), time.Millisecond)
+		video.SendSample(LayerHigh.sinkName(), deltaFrame, time.Millisecond)
+	}
+	sendGOP()
+	time.Sleep(10 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	sendGOP()
+
+	// Seeking should land on the last key frame of the viewer's layer at or
+	// before the target, or the first one after it.
+	seq, _, ok := tuner.timeshift.seek(time.Now(), LayerHigh.sinkName())
+	require.True(t, ok)
+	assert.Equal(t, uint64(3), seq)
+	seq, _, _ = tuner.timeshift.seek(middle, LayerHigh.sinkName())
+	assert.Equal(t, uint64(0), seq)
+	seq, _, _ = tuner.timeshift.seek(time.Time{}, LayerMedium.sinkName())
+	assert.Equal(t, uint64(0), seq, "no key frames for the layer")
+
+	// Pausing should move the viewer to its own tracks, without affecting other
+	// viewers.
+	require.NoError(t, viewer.Pause())
+	awaitTimeshift(false, true)
+	own := viewer.TimeshiftTracks()
+	assert.NotNil(t, own.Video[LayerHigh])
+	assert.NotEqual(t, tuner.tracks.Get(), own)
+	assert.True(t, other.Timeshift().Live)
+
+	// Rewinding while paused should stay paused, and resuming should play behind
+	// live.
+	require.NoError(t, viewer.Rewind(time.Hour))
+	status := awaitTimeshift(false, true)
+	assert.Greater(t, status.Delay, 20*time.Millisecond)
+	assert.GreaterOrEqual(t, status.Available, status.Delay)
+	require.NoError(t, viewer.Resume())
+	status = awaitTimeshift(false, false)
+	assert.Greater(t, status.Delay, 20*time.Millisecond)
+	sendGOP()
+
+	// Skipping forward past live should return to live.
+	require.NoError(t, viewer.Rewind(-time.Hour))
+	awaitTimeshift(true, false)
+	require.NoError(t, viewer.Rewind(5*time.Millisecond))
+	awaitTimeshift(false, false)
+	viewer.GoLive()
+	awaitTimeshift(true, false)
+
+	// Changing channels should empty the buffer and return viewers to live.
+	require.NoError(t, viewer.Pause())
+	awaitTimeshift(false, true)
+	require.NoError(t, tuner.Tune("KIDS"))
+	awaitTimeshift(true, false)
+	_, ok = tuner.timeshift.oldest()
+	assert.False(t, ok, "buffer kept samples across a channel change")
+
+	// Viewers of additional programs, and of a stopped tuner, can't timeshift.
+	release, err := tuner.AddProgram("KCTS-HD")
+	require.NoError(t, err)
+	defer release()
+	programViewer := tuner.AddViewer("KCTS-HD")
+	defer programViewer.Close()
+	assert.False(t, programViewer.CanTimeshift())
+	require.NoError(t, tuner.Stop())
+	assert.ErrorIs(t, viewer.Pause(), ErrTimeshiftUnavailable)
+}
+
+func TestTimeshiftWindow(t *testing.T) {
+	var prog program
+	b := newTimeshiftBuffer(20 * time.Millisecond)
+	b.add(&prog, sinkNameAudio, media.Sample{Data: []byte("ignored")})
+	assert.Equal(t, uint64(0), b.end(), "buffer took samples from another program")
+
+	b.reset(&prog)
+	b.add(&prog, LayerHigh.sinkName(), media.Sample{Data: []byte{0, 0, 1, 0x65}})
+	b.add(&prog, sinkNameAudio, media.Sample{Data: []byte("audio")})
+	time.Sleep(30 * time.Millisecond)
+	b.add(&prog, sinkNameAudio, media.Sample{Data: []byte("audio")})
+	assert.Equal(t, uint64(3), b.end())
+	assert.True(t, b.evicted(1), "buffer kept a sample outside of its window")
+	assert.False(t, b.evicted(2))
+
+	// A reader that fell out of the buffer should pick up from the oldest key
+	// frame, or the oldest sample without one.
+	sample, seq, added := b.next(0, LayerHigh.sinkName())
+	assert.Nil(t, added)
+	assert.Equal(t, uint64(2), seq)
+	assert.Equal(t, []byte("audio"), sample.Data)
+	_, seq, added = b.next(3, LayerHigh.sinkName())
+	assert.Equal(t, uint64(3), seq)
+	require.NotNil(t, added)
+	b.add(&prog, sinkNameAudio, media.Sample{Data: []byte("audio")})
+	select {
+	case <-added:
+	default:
+		t.Error("buffer did not signal the arrival of a sample")
+	}
+}
+
+func TestLayers(t *testing.T) {
+	for l := range Layer(NumLayers) {
+		parsed, err := ParseLayer(l.String())
+		assert.NoError(t, err)
+		assert.Equal(t, l, parsed)
+	}
+	_, err := ParseLayer("ultra")
+	assert.Error(t, err)
+
+	// The low-power pipeline only produces a single layer, which every viewer
+	// should receive.
+	tuner, factory := newTestTuner(t, Config{VideoPipeline: VideoPipelineLowPower})
+	tracks := watchTracks(t, tuner)
+	require.NoError(t, tuner.Tune("KCTS-HD"))
+	p := nextPipeline(t, factory)
+	assert.NotContains(t, videoBranchAt(t, p, 0).Description, LayerHigh.sinkName())
+
+	ts := awaitTracks(t, tracks, true)
+	assert.Nil(t, ts.Video[LayerHigh])
+	assert.NotNil(t, ts.Video[LayerLow])
+
+	viewer := tuner.AddViewer("")
+	defer viewer.Close()
+	assert.Equal(t, LayerLow, viewer.Layer())
+	viewer.SetLayer(LayerHigh)
+	assert.Equal(t, LayerLow, viewer.Layer())
+}
+
+func TestLoadPipelineTemplates(t *testing.T) {
+	writeTemplate := func(t *testing.T, name, text string) string {
+		t.Helper()
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(text), 0o644))
+		return dir
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		dir := writeTemplate(t, "quiet.tmpl", `
+			{{- define "audio-encode" }}
+			! audioconvert
+			! opusenc bitrate=64000
+			! appsink name=audio
+			{{- end }}
+		`)
+		require.NoError(t, writeEmptyFile(dir, "notes.txt"))
+
+		templates, err := LoadPipelineTemplates(dir)
+		require.NoError(t, err)
+		require.Len(t, templates, 1)
+
+		tuner, factory := newTestTuner(t, Config{VideoPipeline: "quiet", PipelineTemplate: templates["quiet"]})
+		require.NoError(t, tuner.Tune("KCTS-HD"))
+		p := nextPipeline(t, factory)
+		assert.Contains(t, audioBranchAt(t, p, 0).Description, "opusenc bitrate=64000")
+		assert.Contains(t, videoBranchAt(t, p, 0).Description, "x264enc name=venc-high")
+	})
+
+	t.Run("MissingSink", func(t *testing.T) {
+		dir := writeTemplate(t, "broken.tmpl", `
+			{{- define "audio-encode" }}
+			! fakesink
+			{{- end }}
+		`)
+		_, err := LoadPipelineTemplates(dir)
+		assert.ErrorContains(t, err, "broken.tmpl")
+		assert.ErrorContains(t, err, `appsink named "audio"`)
+	})
+
+	t.Run("SyntaxError", func(t *testing.T) {
+		dir := writeTemplate(t, "broken.tmpl", `{{ define "program" }}`)
+		_, err := LoadPipelineTemplates(dir)
+		assert.ErrorContains(t, err, "broken.tmpl")
+	})
+}
+
+func TestFileSource(t *testing.T) {
+	dir := t.TempDir()
+	channels, err := SimulatedChannels(SourceFile, dir)
+	assert.Error(t, err, "listed channels from an empty directory")
+	assert.Empty(t, channels)
+
+	for _, name := range []string{"Beta", "Alpha 100%"} {
+		require.NoError(t, writeEmptyFile(dir, name+".ts"))
+	}
+	require.NoError(t, writeEmptyFile(dir, "README.txt"))
+
+	channels, err = SimulatedChannels(SourceFile, dir)
+	require.NoError(t, err)
+	if assert.Len(t, channels, 2) {
+		assert.Equal(t, "Alpha 100%", channels[0].Name)
+		assert.Equal(t, "Beta", channels[1].Name)
+		assert.NotEqual(t, channels[0].FrequencyHz, channels[1].FrequencyHz)
+	}
+
+	factory := pipelinetest.NewFactory()
+	tuner := NewTuner(channels, Config{
+		NewPipeline: factory.New,
+		Source:      SourceFile,
+		SourceDir:   dir,
+	})
+	t.Cleanup(func() { tuner.Stop() })
+
+	require.NoError(t, tuner.Tune("Alpha 100%"))
+	p := nextPipeline(t, factory)
+	assert.Contains(t, p.Description, "multifilesrc location=")
+	assert.Contains(t, p.Description, "Alpha 100%%.ts")
+	assert.NotContains(t, p.Description, "dvbsrc")
+	assert.NotContains(t, p.Description, "leaky")
+}
+
+func TestPlayer(t *testing.T) {
+	tuner, factory := newTestTuner(t, Config{
+		WatchdogTimeout: time.Millisecond,
+		RetryMinDelay:   time.Millisecond,
+	})
+
+	path := filepath.Join(t.TempDir(), "recording.ts")
+	_, err := tuner.NewPlayer("KCTS-HD", path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, os.WriteFile(path, slices.Repeat(tsPacket(0x1FFF), 10), 0o644))
+	_, err = tuner.NewPlayer("KCTS-HD", path)
+	assert.ErrorContains(t, err, "no program found")
+
+	// The player should read the program from the recording itself, rather than
+	// probe the pipeline for it.
+	require.NoError(t, os.WriteFile(path, mpegtstest.PSI(mpegts.Program{
+		Number: 3, PMTPID: 48, PCRPID: 49,
+		Streams: []mpegts.ElementaryStream{
+			{Type: mpegts.StreamTypeH264, PID: 49},
+			{Type: mpegts.StreamTypeAACADTS, PID: 52},
+		},
+	}), 0o644))
+	player, err := tuner.NewPlayer("KCTS-HD", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { player.Close() })
+	assert.Equal(t, StateStopped, tuner.Status().State, "player disturbed the tuner")
+
+	p := nextPipeline(t, factory)
+	assert.Contains(t, p.Description, "filesrc location=")
+	assert.NotContains(t, p.Description, "leaky")
+	assert.Contains(t, videoBranchAt(t, p, 0).Description, "program-number=3")
+	assert.Contains(t, audioBranchAt(t, p, 0).Description, "aacparse")
+
+	statuses := watchStatus(t, player.Tuner())
+	videoBranchAt(t, p, 0).SendSample(LayerHigh.sinkName(), []byte("video"), 0)
+	awaitStatus(t, statuses, StatePlaying, "KCTS-HD")
+
+	// Pausing must not look like a lost stream, however long it lasts.
+	require.NoError(t, player.Pause())
+	assert.True(t, p.Paused())
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, p.Closed())
+	assert.True(t, player.Status().Paused)
+
+	require.NoError(t, player.Seek(-time.Second))
+	p.SetPosition(0, time.Minute)
+	require.NoError(t, player.Seek(30*time.Second))
+	assert.Equal(t, PlaybackStatus{Position: 30 * time.Second, Duration: time.Minute, Paused: true}, player.Status())
+	require.NoError(t, player.Resume())
+	assert.False(t, p.Paused())
+
+	// The end of the recording should leave the player ready to seek back.
+	p.SendEvent(pipeline.Event{Type: pipeline.EventEOS})
+	require.Eventually(t, func() bool { return player.Status().Ended }, timeout, time.Millisecond)
+	assert.Equal(t, time.Minute, player.Status().Position)
+	assert.False(t, p.Closed())
+	require.NoError(t, player.Seek(0))
+	assert.False(t, player.Status().Ended)
+
+	require.NoError(t, player.Close())
+	assert.True(t, p.Closed())
+	assert.ErrorIs(t, player.Pause(), ErrPlaybackStopped)
+
+	// A failure should end playback for good, without any retries.
+	player, err = tuner.NewPlayer("KCTS-HD", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { player.Close() })
+	p = nextPipeline(t, factory)
+	statuses = watchStatus(t, player.Tuner())
+	p.SendEvent(pipeline.Event{Type: pipeline.EventError, Err: errors.New("bad file")})
+	s := awaitStatus(t, statuses, StateStopped, "")
+	assert.ErrorContains(t, s.Error, "bad file")
+	assert.True(t, p.Closed())
+	assert.ErrorIs(t, player.Seek(0), ErrPlaybackStopped)
+	assert.Nil(t, factory.Next(10*time.Millisecond), "retried playback")
+}
+
+func newTestTuner(t *testing.T, config Config) (*Tuner, *pipelinetest.Factory) {
+	t.Helper()
+	factory := pipelinetest.NewFactory()
+	config.NewPipeline = factory.New
+	tuner := NewTuner(testChannels, config)
+	setTestStreams(tuner)
+	t.Cleanup(func() { tuner.Stop() })
+	return tuner, factory
+}
+
+// setTestStreams spares tuner from probing the formats of testChannels, so
+// that tests can start with the branch for each program.
+func setTestStreams(tuner *Tuner) {
+	for _, ch := range testChannels {
+		tuner.streams[ch.Name] = defaultStreams
+	}
+}
+
+func nextPipeline(t *testing.T, factory *pipelinetest.Factory) *pipelinetest.Pipeline {
+	t.Helper()
+	p := factory.Next(timeout)
+	if p == nil {
+		t.Fatal("timed out waiting for the tuner to create a pipeline")
+	}
+	return p
+}
+
+// videoBranchAt and audioBranchAt return the video or audio branch of the
+// program at index i of the programs added to p.
+func videoBranchAt(t *testing.T, p *pipelinetest.Pipeline, i int) *pipelinetest.Branch {
+	t.Helper()
+	return filteredBranchAt(t, p, i, "appsink name="+sinkNameVideo+"-")
+}
+
+func audioBranchAt(t *testing.T, p *pipelinetest.Pipeline, i int) *pipelinetest.Branch {
+	t.Helper()
+	return filteredBranchAt(t, p, i, "appsink name="+sinkNameAudio)
+}
+
+func filteredBranchAt(t *testing.T, p *pipelinetest.Pipeline, i int, substr string) *pipelinetest.Branch {
+	t.Helper()
+	var branches []*pipelinetest.Branch
+	for _, b := range p.Branches() {
+		if strings.Contains(b.Description, substr) {
+			branches = append(branches, b)
+		}
+	}
+	if i >= len(branches) {
+		t.Fatalf("pipeline has %d matching branches, wanted at least %d", len(branches), i+1)
+	}
+	return branches[i]
+}
+
+func recordBranchAt(t *testing.T, p *pipelinetest.Pipeline, i int) *pipelinetest.Branch {
+	t.Helper()
+	return filteredBranchAt(t, p, i, "appsink name="+sinkNameRecord)
+}
+
+// branchAt returns the branch at index i of the branches added to p.
+func branchAt(t *testing.T, p *pipelinetest.Pipeline, i int) *pipelinetest.Branch {
+	t.Helper()
+	branches := p.Branches()
+	if i >= len(branches) {
+		t.Fatalf("pipeline has %d branches, wanted at least %d", len(branches), i+1)
+	}
+	return branches[i]
+}
+
+// awaitProgramStarted waits for the tuner to see the first video from the named
+// channel's program.
+func awaitProgramStarted(t *testing.T, tuner *Tuner, channelName string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		tuner.mu.Lock()
+		defer tuner.mu.Unlock()
+		prog, ok := tuner.programs[channelName]
+		return ok && prog.started
+	}, timeout, time.Millisecond)
+}
+
+func watchStatus(t *testing.T, tuner *Tuner) <-chan Status {
+	ch := make(chan Status, 100)
+	w := tuner.WatchStatus(func(s Status) { ch <- s })
+	t.Cleanup(func() { w.Cancel(); w.Wait() })
+	return ch
+}
+
+// awaitStatus consumes statuses until one matches the desired state and channel
+// name. Since watches may skip intermediate values, it is not an error to see
+// other statuses along the way.
+func awaitStatus(t *testing.T, ch <-chan Status, state State, channelName string) Status {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case s := <-ch:
+			if s.State == state && s.ChannelName == channelName {
+				return s
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for state %d on channel %q", state, channelName)
+			return Status{}
+		}
+	}
+}
+
+func watchTracks(t *testing.T, tuner *Tuner) <-chan Tracks {
+	ch := make(chan Tracks, 100)
+	w := tuner.WatchTracks(func(ts Tracks) { ch <- ts })
+	t.Cleanup(func() { w.Cancel(); w.Wait() })
+	return ch
+}
+
+// awaitTracks consumes track updates until tracks are present or absent as
+// desired, following the same rules as awaitStatus.
+func awaitTracks(t *testing.T, ch <-chan Tracks, present bool) Tracks {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case ts := <-ch:
+			if (ts != Tracks{}) == present {
+				return ts
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for tracks to be present = %v", present)
+			return Tracks{}
+		}
+	}
+}
+
+// tsPacket returns a transport stream packet of elementary stream data for pid.
+func tsPacket(pid uint16) []byte {
+	pkt := []byte{0x47, byte(pid >> 8), byte(pid), 0x10}
+	return append(pkt, make([]byte, mpegts.PacketSize-len(pkt))...)
+}
+
+// packetPIDs returns the distinct PIDs of the packets in data, in sorted order.
+func packetPIDs(data []byte) []uint16 {
+	var pids []uint16
+	for pkt := range slices.Chunk(data, mpegts.PacketSize) {
+		pid := uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+		if !slices.Contains(pids, pid) {
+			pids = append(pids, pid)
+		}
+	}
+	slices.Sort(pids)
+	return pids
+}
+
+var errWriteFailed = errors.New("write failed")
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errWriteFailed }
+
+// blockingWriter signals entered on its first write, and blocks every write
+// until release is closed.
+type blockingWriter struct {
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.entered) })
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func writeEmptyFile(dir, name string) error {
+	return os.WriteFile(filepath.Join(dir, name), nil, 0o644)
+}
@@ -0,0 +1,348 @@
+package dvr
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/featherbread/hypcast/internal/atsc/tuner"
+)
+
+// Priority decides whether a scheduled recording may take a tuner away from
+// its viewers when no other tuner can make the recording.
+type Priority string
+
+const (
+	// PriorityRecordings lets a scheduled recording retune the tuner with the
+	// fewest viewers to the recording's channel, after warning its viewers
+	// through the tuner's status. Viewers can't take the tuner back until the
+	// recording ends; see [Recorder.Tune].
+	PriorityRecordings Priority = "recordings"
+
+	// PriorityViewers leaves viewers undisturbed, so that a scheduled recording
+	// fails to start when no tuner is free.
+	PriorityViewers Priority = "viewers"
+)
+
+// ParsePriority selects a Priority by name.
+func ParsePriority(name string) (Priority, error) {
+	switch p := Priority(name); p {
+	case PriorityRecordings, PriorityViewers:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown recording priority %q", name)
+	}
+}
+
+// Policy controls how a Recorder allocates tuners to recordings, and how much
+// disk space its recordings may take.
+//
+// A recording always shares a tuner that already receives its channel's
+// frequency if there is one, and otherwise takes a tuner that is stopped or
+// that nobody is watching. Failing that, Priority decides whether a scheduled
+// recording preempts a tuner that viewers are watching. Recordings started on
+// request never preempt viewers, and no recording ever preempts another.
+type Policy struct {
+	Priority Priority
+
+	// Warning is how long before the start of a scheduled recording that the
+	// Recorder warns the viewers of the tuner that it will preempt. A zero
+	// value disables warnings.
+	Warning time.Duration
+
+	// Quota is the most space in bytes that recordings may take before the
+	// Recorder removes the oldest finished recordings, regardless of their
+	// retention rules. A zero value allows recordings to fill the disk.
+	Quota int64
+}
+
+// Resolution describes how a Recorder will resolve a conflict.
+type Resolution string
+
+const (
+	// ResolutionPreempt means that the recording will take a tuner away from
+	// its viewers.
+	ResolutionPreempt Resolution = "preempt"
+
+	// ResolutionFail means that the recording will fail to start.
+	ResolutionFail Resolution = "fail"
+)
+
+// Conflict describes an upcoming scheduled recording that won't find a free
+// tuner, assuming that every tuner's viewers keep watching until then.
+type Conflict struct {
+	ScheduleID  string
+	ChannelName string
+	Start       time.Time
+	End         time.Time
+
+	Resolution Resolution
+
+	// TunerID identifies the tuner whose viewers the recording preempts, or
+	// that the viewers keep under PriorityViewers. ViewerChannel is the channel
+	// that the viewers will be watching. Both are empty if every tuner will be
+	// busy with other recordings.
+	TunerID       string `json:",omitempty"`
+	ViewerChannel string `json:",omitempty"`
+}
+
+// allocAction is the way that a recording gets a tuner.
+type allocAction int
+
+const (
+	// allocNone finds no tuner for the recording.
+	allocNone allocAction = iota
+	// allocShare records from a tuner that already receives the recording's
+	// frequency.
+	allocShare
+	// allocStart starts a tuner that is stopped or has no viewers.
+	allocStart
+	// allocPreempt retunes a tuner away from its viewers.
+	allocPreempt
+)
+
+// tunerState is a snapshot of the aspects of a tuner that matter for
+// allocating it to a recording.
+type tunerState struct {
+	id string
+
+	// channelName is the channel that the tuner receives, or is empty if the
+	// tuner is stopped.
+	channelName string
+
+	viewers    int
+	recordings int
+}
+
+// allocate chooses the tuner with which to record the named channel from a
+// snapshot of the pool, along with the way to get it. For allocNone, it
+// returns the tuner whose viewers the policy protects, if any, or -1.
+// sameMultiplex reports whether two channels share a frequency.
+func (p Policy) allocate(channelName string, tuners []tunerState, preempt bool, sameMultiplex func(a, b string) bool) (int, allocAction) {
+	for i, ts := range tuners {
+		if ts.channelName != "" && sameMultiplex(channelName, ts.channelName) {
+			return i, allocShare
+		}
+	}
+	for i, ts := range tuners {
+		if ts.channelName == "" || (ts.viewers == 0 && ts.recordings == 0) {
+			return i, allocStart
+		}
+	}
+
+	victim := -1
+	for i, ts := range tuners {
+		if ts.recordings == 0 && (victim < 0 || ts.viewers < tuners[victim].viewers) {
+			victim = i
+		}
+	}
+	if victim >= 0 && preempt && p.Priority == PriorityRecordings {
+		return victim, allocPreempt
+	}
+	return victim, allocNone
+}
+
+// snapshot returns the current state of every tuner in the pool, counting the
+// recordings that r has in progress on each. r.mu must be held.
+func (r *Recorder) snapshot() []tunerState {
+	var states []tunerState
+	for id, t := range r.tuners.All() {
+		ts := tunerState{id: id, viewers: t.Viewers()}
+		if s := t.Status(); s.State != tuner.StateStopped {
+			ts.channelName = s.ChannelName
+		}
+		for _, ar := range r.active {
+			if ar.TunerID == id {
+				ts.recordings++
+			}
+		}
+		states = append(states, ts)
+	}
+	return states
+}
+
+// Tune tunes the tuner with the given ID to the named channel on behalf of its
+// viewers. Under PriorityRecordings, it returns ErrTunerRecording rather than
+// retune the tuner away from the frequency of a scheduled recording in
+// progress. Otherwise, the tuner ends any recordings on other frequencies, as
+// with [tuner.Tuner.Tune].
+func (r *Recorder) Tune(tunerID, channelName string) error {
+	if !slices.Contains(slices.Collect(r.tuners.Default().ChannelNames()), channelName) {
+		return tuner.ErrChannelNotFound
+	}
+	return r.changeTuner(tunerID, channelName, func(t *tuner.Tuner) error { return t.Tune(channelName) })
+}
+
+// StopTuner stops the tuner with the given ID on behalf of its viewers. Under
+// PriorityRecordings, it returns ErrTunerRecording rather than stop a tuner
+// that is making a scheduled recording. Otherwise, the tuner ends any
+// recordings, as with [tuner.Tuner.Stop].
+func (r *Recorder) StopTuner(tunerID string) error {
+	return r.changeTuner(tunerID, "", (*tuner.Tuner).Stop)
+}
+
+// changeTuner applies a change by viewers to the tuner with the given ID, which
+// leaves it receiving the named channel, or stopped if channelName is empty,
+// unless the change would interrupt a scheduled recording that the policy
+// favors over viewers. Recordings started on request yield to viewers, just as
+// they never preempt them.
+func (r *Recorder) changeTuner(tunerID, channelName string, change func(*tuner.Tuner) error) error {
+	t, ok := r.tuners.Get(tunerID)
+	if !ok {
+		return fmt.Errorf("tuner %q not found", tunerID)
+	}
+
+	// Holding r.tunerMu through the change keeps a scheduled recording from
+	// starting on the tuner after we've checked it.
+	r.tunerMu.Lock()
+	defer r.tunerMu.Unlock()
+
+	if r.policy.Priority == PriorityRecordings {
+		r.mu.Lock()
+		for _, ar := range r.active {
+			if ar.TunerID != tunerID || ar.ScheduleID == "" {
+				continue
+			}
+			if channelName == "" || !r.tuners.Default().SameMultiplex(channelName, ar.ChannelName) {
+				err := fmt.Errorf("%w: recording %s", ErrTunerRecording, ar.ChannelName)
+				if s, ok := r.schedules[ar.ScheduleID]; ok {
+					err = fmt.Errorf("%w until %s", err, s.End.Format(time.RFC3339))
+				}
+				r.mu.Unlock()
+				return err
+			}
+		}
+		r.mu.Unlock()
+	}
+	return change(t)
+}
+
+// Conflicts predicts how the Recorder will allocate tuners to every schedule
+// whose window has yet to open, and returns the schedules that won't find a
+// free tuner, in order of start time. The prediction assumes that the viewers
+// of each tuner keep watching it, and follow it to any channel to which a
+// recording retunes it.
+func (r *Recorder) Conflicts() []Conflict {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conflicts()
+}
+
+// conflicts implements Conflicts. r.mu must be held.
+func (r *Recorder) conflicts() []Conflict {
+	type booking struct {
+		channelName string
+		end         time.Time // Zero for a recording without an end.
+	}
+	type simTuner struct {
+		live     string // The channel that viewers watch, if any.
+		viewers  int
+		bookings []booking
+	}
+
+	states := r.snapshot()
+	sim := make([]simTuner, len(states))
+	for i, ts := range states {
+		if ts.viewers > 0 {
+			sim[i].live, sim[i].viewers = ts.channelName, ts.viewers
+		}
+	}
+	for _, ar := range r.active {
+		i := slices.IndexFunc(states, func(ts tunerState) bool { return ts.id == ar.TunerID })
+		if i < 0 {
+			continue
+		}
+		var end time.Time
+		if s, ok := r.schedules[ar.ScheduleID]; ok {
+			end = s.End
+		}
+		sim[i].bookings = append(sim[i].bookings, booking{ar.ChannelName, end})
+	}
+
+	var pending []*schedule
+	for _, s := range r.schedules {
+		if !s.started {
+			pending = append(pending, s)
+		}
+	}
+	slices.SortFunc(pending, func(a, b *schedule) int { return a.Start.Compare(b.Start) })
+
+	conflicts := make([]Conflict, 0)
+	for _, s := range pending {
+		// Each schedule sees the tuners as they will be at its start, with the
+		// bookings of recordings that are still going by then.
+		for i := range states {
+			states[i].channelName = sim[i].live
+			states[i].viewers = sim[i].viewers
+			states[i].recordings = 0
+			for _, b := range sim[i].bookings {
+				if b.end.IsZero() || b.end.After(s.Start) {
+					states[i].channelName = b.channelName
+					states[i].recordings++
+				}
+			}
+		}
+
+		i, action := r.policy.allocate(s.ChannelName, states, true, r.tuners.Default().SameMultiplex)
+		if action != allocShare && action != allocStart {
+			c := Conflict{
+				ScheduleID:  s.ID,
+				ChannelName: s.ChannelName,
+				Start:       s.Start,
+				End:         s.End,
+				Resolution:  ResolutionFail,
+			}
+			if i >= 0 {
+				c.TunerID, c.ViewerChannel = states[i].id, sim[i].live
+			}
+			if action == allocPreempt {
+				c.Resolution = ResolutionPreempt
+				sim[i].live = s.ChannelName // The viewers follow the tuner.
+			}
+			conflicts = append(conflicts, c)
+		}
+		if action != allocNone {
+			sim[i].bookings = append(sim[i].bookings, booking{s.ChannelName, s.End})
+		}
+	}
+	return conflicts
+}
+
+// updateWarnings warns the viewers of each tuner that an upcoming schedule
+// will preempt, as of the last prediction for each schedule within its warning
+// period, and withdraws any other warnings. r.mu must be held.
+func (r *Recorder) updateWarnings() {
+	warnings := make(map[string]*tuner.Preemption)
+	for _, s := range r.schedules {
+		if s.warnTunerID == "" || s.started {
+			continue
+		}
+		if w, ok := warnings[s.warnTunerID]; !ok || s.Start.Before(w.At) {
+			warnings[s.warnTunerID] = &tuner.Preemption{ChannelName: s.ChannelName, At: s.Start}
+		}
+	}
+	for id, t := range r.tuners.All() {
+		t.SetPreemption(warnings[id])
+	}
+}
+
+// handleWarningTimer checks whether s will preempt any tuner's viewers once its
+// window opens, and warns them if so.
+func (r *Recorder) handleWarningTimer(s *schedule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed || r.schedules[s.ID] != s || s.started {
+		return
+	}
+	s.warnTunerID = ""
+	for _, c := range r.conflicts() {
+		if c.ScheduleID == s.ID && c.Resolution == ResolutionPreempt {
+			slog.Warn("Scheduled recording will preempt viewers", "id", s.ID, "channel", s.ChannelName,
+				"tuner", c.TunerID, "start", s.Start)
+			s.warnTunerID = c.TunerID
+		}
+	}
+	r.updateWarnings()
+}
@@ -0,0 +1,824 @@
+// Package dvr records channels to disk through a pool of tuners, either
+// immediately on request or within scheduled time windows, and plays the
+// recordings back. A Policy decides whether scheduled recordings may take
+// tuners away from viewers, and how much disk space recordings may fill, while
+// the Retention of each schedule decides how long to keep its recordings.
+//
+// A Recorder keeps its recordings and schedules in a single directory. Each
+// recording is a transport stream file named ID.ts, accompanied by a file named
+// ID.json that describes it. The schedules live in schedules.json, so that the
+// Recorder can pick them up again after a restart.
+package dvr
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/featherbread/hypcast/internal/atsc/tuner"
+)
+
+// Recording describes a single recording, whether in progress or finished.
+type Recording struct {
+	ID          string
+	ChannelName string
+
+	// TunerID identifies the tuner within the pool that made the recording. It
+	// is empty if no tuner could make the recording.
+	TunerID string
+
+	// Start and End are the times when the recording started and ended. End is
+	// zero while the recording is in progress.
+	Start time.Time
+	End   time.Time
+
+	// ScheduleID identifies the schedule that started the recording, and is
+	// empty for a recording started on request.
+	ScheduleID string `json:",omitempty"`
+
+	// Error describes the failure that ended the recording early, if any.
+	Error string `json:",omitempty"`
+
+	// Dropped counts the buffers of the multiplex that the recording lost
+	// because its file could not keep up, each of which leaves a gap in the
+	// recording.
+	Dropped int `json:",omitempty"`
+
+	// Retention comes from the schedule that started the recording, with the
+	// schedule's ID in place of an empty Series.
+	Retention Retention `json:",omitzero"`
+
+	// Size is the size of the recording's file in bytes, as of the call to
+	// Recordings that returned it. It is not saved with the recording.
+	Size int64 `json:"-"`
+}
+
+// Duration returns the length of the recording, or the time since it started
+// if it is still in progress.
+func (rec Recording) Duration() time.Duration {
+	if rec.End.IsZero() {
+		return time.Since(rec.Start)
+	}
+	return rec.End.Sub(rec.Start)
+}
+
+// Schedule describes a window of time in which to record a channel.
+type Schedule struct {
+	ID          string
+	ChannelName string
+	Start       time.Time
+	End         time.Time
+	Retention   Retention `json:",omitzero"`
+}
+
+var (
+	// ErrRecordingNotFound is returned when accessing a recording that does not
+	// exist, or when stopping one that has already ended.
+	ErrRecordingNotFound = errors.New("recording not found")
+
+	// ErrScheduleNotFound is returned when canceling a schedule that does not
+	// exist or has already ended.
+	ErrScheduleNotFound = errors.New("schedule not found")
+
+	// ErrInvalidSchedule is returned when creating a schedule whose window is
+	// empty or has already ended, or whose retention rules are negative.
+	ErrInvalidSchedule = errors.New("invalid schedule")
+
+	// ErrNoTunerAvailable is returned when every tuner in the pool is busy
+	// receiving a frequency other than the one that carries the channel to be
+	// recorded, and the Recorder's Policy does not allow the recording to
+	// preempt any of them.
+	ErrNoTunerAvailable = errors.New("no tuner available")
+
+	// ErrTunerRecording is returned when viewers ask to retune a tuner away
+	// from the frequency of a scheduled recording in progress, or to stop it,
+	// and the Recorder's Policy gives recordings priority over viewers.
+	ErrTunerRecording = errors.New("tuner is busy with a scheduled recording")
+)
+
+// errServerStopped ends any recording that was still in progress when the
+// Recorder last shut down.
+var errServerStopped = errors.New("server stopped during recording")
+
+const (
+	recordingExt  = ".ts"
+	metadataExt   = ".json"
+	schedulesFile = "schedules.json"
+
+	// writeBufferSize is the amount of each recording that the Recorder buffers
+	// in memory between writes to disk.
+	writeBufferSize = 256 << 10
+)
+
+// The Recorder waits between scheduleRetryMinDelay and scheduleRetryMaxDelay
+// before trying again to start a scheduled recording that failed to start
+// within its window, doubling the delay after each failure.
+var (
+	scheduleRetryMinDelay = 5 * time.Second
+	scheduleRetryMaxDelay = time.Minute
+)
+
+// Recorder records channels through a pool of tuners.
+type Recorder struct {
+	dir    string
+	tuners *tuner.Pool
+	policy Policy
+
+	// tunerMu serializes the Recorder's changes to its tuners, which can wait
+	// as long as it takes to tear down a pipeline. Starting a recording holds
+	// it from the allocation of a tuner until the tuner is recording, while
+	// releasing mu in between, so that the allocation stays valid without
+	// stalling the rest of the Recorder. Closing the Recorder and canceling a
+	// schedule also hold it, so that no recording is halfway started for
+	// them. It must be acquired before mu.
+	tunerMu sync.Mutex
+
+	mu        sync.Mutex
+	active    map[string]*activeRecording
+	schedules map[string]*schedule
+	removals  []Removal
+	closed    bool
+
+	// cleanMu serializes passes of the janitor, which cleanup wakes and
+	// stopJanitor stops. See [Recorder.Removals].
+	cleanMu     sync.Mutex
+	cleanup     chan struct{}
+	stopJanitor chan struct{}
+	janitorDone chan struct{}
+}
+
+// activeRecording is a recording in progress.
+type activeRecording struct {
+	Recording
+	rec  *tuner.Recording
+	done chan struct{} // Closed once the recording's files are complete.
+}
+
+// schedule is a schedule that has not yet ended.
+type schedule struct {
+	Schedule
+	timer *time.Timer
+
+	// started indicates that the schedule's window has opened, and the Recorder
+	// has tried to start its recording. recordingID identifies the recording
+	// while it is in progress.
+	started     bool
+	recordingID string
+
+	// Until the window ends, the Recorder keeps trying to start a recording
+	// that failed to start or that was interrupted, with retryDelay between
+	// attempts. failure is the record of the latest run of failed attempts,
+	// which the Recorder updates with each attempt in the run.
+	retryDelay time.Duration
+	failure    *Recording
+
+	// warnTimer fires at the start of the schedule's warning period, after
+	// which warnTunerID identifies the tuner whose viewers the Recorder warned
+	// of preemption, if any. See Policy.Warning.
+	warnTimer   *time.Timer
+	warnTunerID string
+}
+
+// New creates a Recorder that keeps its recordings and schedules in dir,
+// creating the directory if necessary, and records through the tuners of pool
+// as allowed by policy. It resumes any schedules saved by a previous Recorder in
+// dir, and starts any whose window is already open. It also enforces retention
+// rules and policy's quota, in the background until the Recorder closes.
+func New(dir string, tuners *tuner.Pool, policy Policy) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		dir:       dir,
+		tuners:    tuners,
+		policy:    policy,
+		active:    make(map[string]*activeRecording),
+		schedules: make(map[string]*schedule),
+
+		cleanup:     make(chan struct{}, 1),
+		stopJanitor: make(chan struct{}),
+		janitorDone: make(chan struct{}),
+	}
+	if err := r.finishInterruptedRecordings(); err != nil {
+		return nil, err
+	}
+	if err := r.loadSchedules(); err != nil {
+		return nil, err
+	}
+	r.clean(time.Now())
+	go r.runJanitor()
+	return r, nil
+}
+
+// Close stops every recording in progress and every pending schedule, and
+// waits for recordings to finish writing. Schedules remain saved for the next
+// Recorder in the same directory.
+func (r *Recorder) Close() {
+	r.tunerMu.Lock()
+	r.mu.Lock()
+	if !r.closed {
+		close(r.stopJanitor)
+	}
+	r.closed = true
+	for _, s := range r.schedules {
+		s.stopTimers()
+		s.warnTunerID = ""
+	}
+	r.updateWarnings()
+	active := slices.Collect(maps.Values(r.active))
+	r.mu.Unlock()
+	r.tunerMu.Unlock()
+
+	<-r.janitorDone
+	for _, ar := range active {
+		ar.rec.Stop()
+		<-ar.done
+	}
+}
+
+// Start starts recording the named channel right away, and records until a
+// call to Stop.
+func (r *Recorder) Start(channelName string) (Recording, error) {
+	r.tunerMu.Lock()
+	defer r.tunerMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ar, err := r.start(channelName, "")
+	if err != nil {
+		return Recording{}, err
+	}
+	return ar.Recording, nil
+}
+
+// Stop ends the recording with the given ID, and waits for its files to be
+// complete.
+func (r *Recorder) Stop(id string) error {
+	r.mu.Lock()
+	ar, ok := r.active[id]
+	r.mu.Unlock()
+	if !ok {
+		return ErrRecordingNotFound
+	}
+
+	ar.rec.Stop()
+	<-ar.done
+	return nil
+}
+
+// Active returns every recording in progress, in order of start time.
+func (r *Recorder) Active() []Recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	recordings := make([]Recording, 0, len(r.active))
+	for _, ar := range r.active {
+		recordings = append(recordings, ar.Recording)
+	}
+	slices.SortFunc(recordings, func(a, b Recording) int { return a.Start.Compare(b.Start) })
+	return recordings
+}
+
+// Recordings returns every recording in the Recorder's directory, whether in
+// progress, finished, or failed to start, in order of start time.
+func (r *Recorder) Recordings() ([]Recording, error) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var recordings []Recording
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), metadataExt)
+		if !ok || entry.Name() == schedulesFile {
+			continue
+		}
+		rec, err := r.Get(id)
+		if errors.Is(err, ErrRecordingNotFound) {
+			continue // Deleted since we read the directory.
+		}
+		if err != nil {
+			return nil, err
+		}
+		recordings = append(recordings, rec)
+	}
+	slices.SortFunc(recordings, func(a, b Recording) int { return a.Start.Compare(b.Start) })
+	return recordings, nil
+}
+
+// Get returns the recording with the given ID.
+func (r *Recorder) Get(id string) (Recording, error) {
+	if !validID(id) {
+		return Recording{}, ErrRecordingNotFound
+	}
+
+	var rec Recording
+	err := readJSON(r.path(id, metadataExt), &rec)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Recording{}, ErrRecordingNotFound
+	}
+	if err != nil {
+		return Recording{}, err
+	}
+	if info, err := os.Stat(r.path(id, recordingExt)); err == nil {
+		rec.Size = info.Size()
+	}
+	return rec, nil
+}
+
+// Delete removes the recording with the given ID from disk, and ends it first
+// if it is in progress.
+func (r *Recorder) Delete(id string) error {
+	rec, err := r.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := r.Stop(id); err != nil && !errors.Is(err, ErrRecordingNotFound) {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err = r.removeFiles(id)
+	slog.Info("Deleted recording", "id", id, "channel", rec.ChannelName, "error", err)
+	return err
+}
+
+// removeFiles removes the files of the recording with the given ID. r.mu must
+// be held.
+func (r *Recorder) removeFiles(id string) error {
+	err := os.Remove(r.path(id, recordingExt))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil // A recording that failed to start has no file.
+	}
+	return errors.Join(err, os.Remove(r.path(id, metadataExt)))
+}
+
+// Play starts playing the recording with the given ID, through the pipelines
+// of the pool's default tuner. A recording in progress plays up to the point
+// that it has reached on disk.
+func (r *Recorder) Play(id string) (*tuner.Player, error) {
+	rec, err := r.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	player, err := r.tuners.Default().NewPlayer(rec.ChannelName, r.path(id, recordingExt))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: recording %s has no file", ErrRecordingNotFound, id)
+	}
+	return player, err
+}
+
+// Schedule arranges to record the named channel between start and end, and to
+// keep the recording as long as retention allows. A window that has already
+// opened starts recording right away.
+func (r *Recorder) Schedule(channelName string, start, end time.Time, retention Retention) (Schedule, error) {
+	if !slices.Contains(slices.Collect(r.tuners.Default().ChannelNames()), channelName) {
+		return Schedule{}, tuner.ErrChannelNotFound
+	}
+	if !end.After(start) || !end.After(time.Now()) {
+		return Schedule{}, fmt.Errorf("%w: window from %v to %v has already ended or is empty", ErrInvalidSchedule, start, end)
+	}
+	if retention.KeepLast < 0 || retention.KeepDays < 0 {
+		return Schedule{}, fmt.Errorf("%w: negative retention", ErrInvalidSchedule)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &schedule{Schedule: Schedule{
+		ID:          newID(),
+		ChannelName: channelName,
+		Start:       start.UTC(),
+		End:         end.UTC(),
+		Retention:   retention,
+	}}
+	r.schedules[s.ID] = s
+	if err := r.saveSchedules(); err != nil {
+		delete(r.schedules, s.ID)
+		return Schedule{}, err
+	}
+
+	slog.Info("Scheduled recording", "id", s.ID, "channel", channelName, "start", start, "end", end)
+	r.arm(s)
+	return s.Schedule, nil
+}
+
+// CancelSchedule removes the schedule with the given ID, and ends its recording
+// if it is in progress.
+func (r *Recorder) CancelSchedule(id string) error {
+	r.tunerMu.Lock()
+	r.mu.Lock()
+	s, ok := r.schedules[id]
+	if !ok {
+		r.mu.Unlock()
+		r.tunerMu.Unlock()
+		return ErrScheduleNotFound
+	}
+
+	s.stopTimers()
+	delete(r.schedules, id)
+	err := r.saveSchedules()
+	if s.warnTunerID != "" {
+		r.updateWarnings()
+	}
+	ar := r.active[s.recordingID]
+	r.mu.Unlock()
+	r.tunerMu.Unlock()
+
+	slog.Info("Canceled scheduled recording", "id", id, "channel", s.ChannelName)
+	if ar != nil {
+		ar.rec.Stop()
+		<-ar.done
+	}
+	return err
+}
+
+// Schedules returns every schedule that has not yet ended, in order of start
+// time.
+func (r *Recorder) Schedules() []Schedule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	schedules := make([]Schedule, 0, len(r.schedules))
+	for _, s := range r.schedules {
+		schedules = append(schedules, s.Schedule)
+	}
+	slices.SortFunc(schedules, func(a, b Schedule) int { return a.Start.Compare(b.Start) })
+	return schedules
+}
+
+// arm sets s's timer to fire at the start of its window. Once the window has
+// opened, it sets the timer to fire at the end of the window, or at the next
+// attempt to start the recording if it isn't in progress, whichever comes
+// first. Before the window opens, it also sets s's warning timer if the
+// Recorder's policy calls for one. r.mu must be held.
+func (r *Recorder) arm(s *schedule) {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	next := s.Start
+	if s.started {
+		next = s.End
+		if retry := time.Now().Add(s.retryDelay); s.recordingID == "" && retry.Before(next) {
+			next = retry
+		}
+	}
+	s.timer = time.AfterFunc(time.Until(next), func() { r.handleScheduleTimer(s) })
+
+	if !s.started && r.policy.Priority == PriorityRecordings && r.policy.Warning > 0 {
+		warnAt := s.Start.Add(-r.policy.Warning)
+		s.warnTimer = time.AfterFunc(time.Until(warnAt), func() { r.handleWarningTimer(s) })
+	}
+}
+
+// stopTimers stops both of s's timers.
+func (s *schedule) stopTimers() {
+	s.timer.Stop()
+	if s.warnTimer != nil {
+		s.warnTimer.Stop()
+	}
+}
+
+// handleScheduleTimer starts s's recording at the start of its window, retries
+// it until it starts, and stops it at the end.
+func (r *Recorder) handleScheduleTimer(s *schedule) {
+	r.tunerMu.Lock()
+	r.mu.Lock()
+	if r.closed || r.schedules[s.ID] != s {
+		r.mu.Unlock()
+		r.tunerMu.Unlock()
+		return // Canceled.
+	}
+
+	if time.Now().Before(s.End) {
+		if !s.started {
+			s.started = true
+			if s.warnTimer != nil {
+				s.warnTimer.Stop()
+			}
+		}
+		if s.recordingID == "" {
+			r.startScheduled(s)
+		}
+		if s.warnTunerID != "" {
+			s.warnTunerID = ""
+			r.updateWarnings()
+		}
+		r.arm(s)
+		r.mu.Unlock()
+		r.tunerMu.Unlock()
+		return
+	}
+
+	delete(r.schedules, s.ID)
+	if err := r.saveSchedules(); err != nil {
+		slog.Error("Failed to save recording schedules", "error", err)
+	}
+	ar := r.active[s.recordingID]
+	r.mu.Unlock()
+	r.tunerMu.Unlock()
+
+	slog.Info("Scheduled recording window ended", "id", s.ID, "channel", s.ChannelName)
+	if ar != nil {
+		ar.rec.Stop()
+		<-ar.done
+	}
+}
+
+// startScheduled tries to start s's recording, and backs off s's retry delay if
+// it fails. r.tunerMu and r.mu must be held, as for start.
+func (r *Recorder) startScheduled(s *schedule) {
+	ar, err := r.start(s.ChannelName, s.ID)
+	if err != nil {
+		s.retryDelay = min(max(2*s.retryDelay, scheduleRetryMinDelay), scheduleRetryMaxDelay)
+		if retry := time.Now().Add(s.retryDelay); retry.Before(s.End) {
+			slog.Info("Will retry scheduled recording", "id", s.ID, "channel", s.ChannelName, "at", retry)
+		}
+		return
+	}
+	s.recordingID = ar.ID
+	s.retryDelay = 0
+	s.failure = nil
+}
+
+// start starts a recording of the named channel on behalf of the schedule with
+// the given ID, if any. A failure to start a scheduled recording, whether to
+// create its file or to get a tuner, leaves behind a record of the failure in
+// place of the recording, which the schedule's further failures update until
+// one of its recordings starts. r.tunerMu and r.mu must be held, and start
+// releases r.mu while it waits on the tuner.
+func (r *Recorder) start(channelName, scheduleID string) (*activeRecording, error) {
+	if r.closed {
+		return nil, errors.New("recorder is closed")
+	}
+
+	ar := &activeRecording{
+		Recording: Recording{
+			ID:          newID(),
+			ChannelName: channelName,
+			Start:       time.Now().UTC(),
+			ScheduleID:  scheduleID,
+		},
+		done: make(chan struct{}),
+	}
+	if s, ok := r.schedules[scheduleID]; ok && s.Retention != (Retention{}) {
+		ar.Retention = s.Retention
+		if ar.Retention.Series == "" {
+			ar.Retention.Series = s.ID
+		}
+	}
+
+	f, w, err := r.open(ar, scheduleID != "")
+	if err != nil {
+		slog.Error("Failed to start recording", "channel", channelName, "schedule", scheduleID, "error", err)
+		if s, ok := r.schedules[scheduleID]; ok {
+			if s.failure == nil {
+				s.failure = &ar.Recording
+				s.failure.TunerID = ""
+			}
+			s.failure.End = time.Now().UTC()
+			s.failure.Error = err.Error()
+			r.saveMetadata(*s.failure)
+		}
+		return nil, err
+	}
+
+	slog.Info("Started recording", "id", ar.ID, "channel", channelName, "tuner", ar.TunerID, "schedule", scheduleID)
+	r.active[ar.ID] = ar
+	go r.finish(ar, f, w)
+	return ar, nil
+}
+
+// open creates ar's file, and starts recording ar's channel into it through a
+// tuner. On failure, it leaves no file behind. r.tunerMu and r.mu must be
+// held, as for start.
+func (r *Recorder) open(ar *activeRecording, preempt bool) (*os.File, *bufio.Writer, error) {
+	f, err := os.Create(r.path(ar.ID, recordingExt))
+	if err != nil {
+		return nil, nil, err
+	}
+	w := bufio.NewWriterSize(f, writeBufferSize)
+
+	ar.TunerID, ar.rec, err = r.record(ar.ChannelName, w, preempt)
+	if err == nil {
+		err = r.saveMetadata(ar.Recording)
+		if err != nil {
+			// The tuner writes to w from a goroutine of its own, which must be
+			// done before we close the file out from under it.
+			ar.rec.Stop()
+			<-ar.rec.Done()
+		}
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(r.path(ar.ID, recordingExt))
+		return nil, nil, err
+	}
+	return f, w, nil
+}
+
+// record starts recording the named channel to w, through the tuner that the
+// Recorder's policy allocates to it. It prefers tuners that are already
+// running, which can record without disturbing anyone as long as they receive
+// the right frequency, over starting a tuner that is stopped or that nobody is
+// watching. If preempt is set, the recording may retune a tuner that viewers
+// are watching as a last resort, and they continue watching the recording's
+// channel. r.tunerMu and r.mu must be held, and record releases r.mu while it
+// waits on the tuner.
+func (r *Recorder) record(channelName string, w *bufio.Writer, preempt bool) (tunerID string, rec *tuner.Recording, err error) {
+	states := r.snapshot()
+	i, action := r.policy.allocate(channelName, states, preempt, r.tuners.Default().SameMultiplex)
+	if action == allocNone {
+		return "", nil, ErrNoTunerAvailable
+	}
+
+	ts := states[i]
+	t, _ := r.tuners.Get(ts.id)
+
+	// r.tunerMu keeps the allocation valid, along with any schedule behind the
+	// recording, so there's nothing to check again once we have r.mu back.
+	r.mu.Unlock()
+	defer r.mu.Lock()
+
+	switch {
+	case action == allocStart && ts.channelName != "":
+		// Stopping the tuner lets Record start it for this recording alone, so
+		// that it stops again afterward.
+		slog.Info("Taking over unwatched tuner", "tuner", ts.id, "from", ts.channelName, "to", channelName)
+		if err := t.Stop(); err != nil {
+			return ts.id, nil, err
+		}
+	case action == allocPreempt:
+		slog.Warn("Preempting viewers for scheduled recording", "tuner", ts.id,
+			"from", ts.channelName, "to", channelName, "viewers", ts.viewers)
+		if err := t.Tune(channelName); err != nil {
+			return ts.id, nil, err
+		}
+	}
+	rec, err = t.Record(channelName, w)
+	return ts.id, rec, err
+}
+
+// finish waits for ar to end, then completes its files.
+func (r *Recorder) finish(ar *activeRecording, f *os.File, w *bufio.Writer) {
+	<-ar.rec.Done()
+	err := ar.rec.Err()
+	err = errors.Join(err, w.Flush(), f.Close())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.active, ar.ID)
+	ar.End = time.Now().UTC()
+	ar.Dropped = ar.rec.Dropped()
+	if err != nil {
+		ar.Error = err.Error()
+	}
+	if s, ok := r.schedules[ar.ScheduleID]; ok && s.recordingID == ar.ID {
+		s.recordingID = ""
+		if errors.Is(err, tuner.ErrRecordingInterrupted) && !r.closed {
+			// The rest of the window deserves a recording of its own.
+			slog.Info("Restarting interrupted scheduled recording", "id", s.ID, "channel", s.ChannelName)
+			r.arm(s)
+		}
+	}
+	if err := r.saveMetadata(ar.Recording); err != nil {
+		slog.Error("Failed to save recording metadata", "id", ar.ID, "error", err)
+	}
+	slog.Info("Finished recording", "id", ar.ID, "channel", ar.ChannelName,
+		"dropped", ar.Dropped, "error", err)
+	close(ar.done)
+	r.requestCleanup()
+}
+
+// finishInterruptedRecordings marks any recordings left in progress by a
+// previous Recorder as ended at the last time their files changed.
+func (r *Recorder) finishInterruptedRecordings() error {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), metadataExt)
+		if !ok || entry.Name() == schedulesFile {
+			continue
+		}
+
+		var rec Recording
+		if err := readJSON(r.path(id, metadataExt), &rec); err != nil {
+			return err
+		}
+		if !rec.End.IsZero() {
+			continue
+		}
+
+		rec.End = rec.Start
+		if info, err := os.Stat(r.path(id, recordingExt)); err == nil {
+			rec.End = info.ModTime().UTC()
+		}
+		rec.Error = errServerStopped.Error()
+		slog.Warn("Found interrupted recording", "id", id, "channel", rec.ChannelName)
+		if err := r.saveMetadata(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSchedules resumes the schedules saved by a previous Recorder, and drops
+// any whose window ended while no Recorder was running.
+func (r *Recorder) loadSchedules() error {
+	var schedules []Schedule
+	err := readJSON(filepath.Join(r.dir, schedulesFile), &schedules)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, sched := range schedules {
+		if !sched.End.After(now) {
+			slog.Warn("Missed scheduled recording", "id", sched.ID, "channel", sched.ChannelName,
+				"start", sched.Start, "end", sched.End)
+			continue
+		}
+		s := &schedule{Schedule: sched}
+		r.schedules[s.ID] = s
+		r.arm(s)
+	}
+	return r.saveSchedules()
+}
+
+// saveSchedules writes every schedule to disk. r.mu must be held.
+func (r *Recorder) saveSchedules() error {
+	schedules := make([]Schedule, 0, len(r.schedules))
+	for _, s := range r.schedules {
+		schedules = append(schedules, s.Schedule)
+	}
+	slices.SortFunc(schedules, func(a, b Schedule) int { return a.Start.Compare(b.Start) })
+	return writeJSON(filepath.Join(r.dir, schedulesFile), schedules)
+}
+
+func (r *Recorder) saveMetadata(rec Recording) error {
+	return writeJSON(r.path(rec.ID, metadataExt), rec)
+}
+
+func (r *Recorder) path(id, ext string) string {
+	return filepath.Join(r.dir, id+ext)
+}
+
+// newID returns a random identifier for a recording or schedule.
+func newID() string {
+	return strings.ToLower(rand.Text()[:16])
+}
+
+// validID returns whether id could identify a recording, which keeps IDs from
+// clients from naming files outside of the Recorder's directory.
+func validID(id string) bool {
+	return id != "" && !strings.ContainsFunc(id, func(c rune) bool {
+		return (c < 'a' || c > 'z') && (c < '0' || c > '9')
+	})
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeJSON replaces the file at path with the JSON encoding of v, such that
+// the file never holds a partial encoding.
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
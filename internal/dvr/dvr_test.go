@@ -0,0 +1,538 @@
+package dvr
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/featherbread/hypcast/internal/atsc"
+	"github.com/featherbread/hypcast/internal/atsc/mpegts"
+	"github.com/featherbread/hypcast/internal/atsc/mpegts/mpegtstest"
+	"github.com/featherbread/hypcast/internal/atsc/tuner"
+	"github.com/featherbread/hypcast/internal/pipeline/pipelinetest"
+)
+
+const timeout = 2 * time.Second
+
+var testChannels = []atsc.Channel{
+	{Name: "KCTS-HD", FrequencyHz: 189_000_000, Modulation: atsc.Modulation8VSB, ProgramID: 3},
+	{Name: "KIDS", FrequencyHz: 189_000_000, Modulation: atsc.Modulation8VSB, ProgramID: 4},
+	{Name: "WLFI", FrequencyHz: 255_000_000, Modulation: atsc.ModulationQAM256, ProgramID: 4},
+	{Name: "KOMO", FrequencyHz: 563_000_000, Modulation: atsc.Modulation8VSB, ProgramID: 1},
+}
+
+func TestStartAndStop(t *testing.T) {
+	r, factories := newTestRecorder(t, 1)
+
+	_, err := r.Start("NOPE")
+	assert.ErrorIs(t, err, tuner.ErrChannelNotFound)
+
+	rec, err := r.Start("KCTS-HD")
+	require.NoError(t, err)
+	assert.Equal(t, "0", rec.TunerID)
+	assert.Equal(t, []Recording{rec}, r.Active())
+
+	p := nextPipeline(t, factories[0])
+	psi := mpegtstest.PSI(mpegts.Program{Number: 3, PMTPID: 48, PCRPID: 49})
+	recordBranch(t, p).SendSample("record", slices.Concat(psi, psi), 0)
+
+	require.NoError(t, r.Stop(rec.ID))
+	assert.ErrorIs(t, r.Stop(rec.ID), ErrRecordingNotFound)
+	assert.Empty(t, r.Active())
+	assert.True(t, p.Closed(), "left the tuner running after recording")
+
+	got := readRecording(t, r, rec.ID)
+	assert.False(t, got.End.Before(got.Start))
+	assert.Empty(t, got.Error)
+
+	data, err := os.ReadFile(r.path(rec.ID, recordingExt))
+	require.NoError(t, err)
+	assert.Len(t, data, 2*mpegts.PacketSize, "expected a PAT and a PMT")
+}
+
+func TestLibrary(t *testing.T) {
+	r, factories := newTestRecorder(t, 1)
+
+	rec, err := r.Start("KCTS-HD")
+	require.NoError(t, err)
+	p := nextPipeline(t, factories[0])
+	psi := mpegtstest.PSI(mpegts.Program{
+		Number: 3, PMTPID: 48, PCRPID: 49,
+		Streams: []mpegts.ElementaryStream{{Type: mpegts.StreamTypeH264, PID: 49}},
+	})
+	recordBranch(t, p).SendSample("record", slices.Concat(psi, psi), 0)
+	require.NoError(t, r.Stop(rec.ID))
+
+	recordings, err := r.Recordings()
+	require.NoError(t, err)
+	require.Len(t, recordings, 1)
+	assert.Equal(t, rec.ID, recordings[0].ID)
+	assert.Equal(t, int64(2*mpegts.PacketSize), recordings[0].Size)
+	assert.Equal(t, recordings[0].End.Sub(recordings[0].Start), recordings[0].Duration())
+
+	for _, id := range []string{"nope", "../" + rec.ID, ""} {
+		_, err := r.Get(id)
+		assert.ErrorIs(t, err, ErrRecordingNotFound, "id %q", id)
+	}
+
+	// Playback should go through the default tuner's pipelines, while leaving
+	// the tuner itself alone.
+	player, err := r.Play(rec.ID)
+	require.NoError(t, err)
+	p = nextPipeline(t, factories[0])
+	assert.Contains(t, p.Description, r.path(rec.ID, recordingExt))
+	assert.Equal(t, tuner.StateStopped, r.tuners.Default().Status().State)
+	require.NoError(t, player.Close())
+
+	// Deleting a recording in progress should end it first.
+	active, err := r.Start("KIDS")
+	require.NoError(t, err)
+	p = nextPipeline(t, factories[0])
+	require.NoError(t, r.Delete(active.ID))
+	assert.True(t, p.Closed())
+	assert.Empty(t, r.Active())
+
+	require.NoError(t, r.Delete(rec.ID))
+	assert.ErrorIs(t, r.Delete(rec.ID), ErrRecordingNotFound)
+	recordings, err = r.Recordings()
+	require.NoError(t, err)
+	assert.Empty(t, recordings)
+	entries, err := os.ReadDir(r.dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestTunerSelection(t *testing.T) {
+	r, factories := newTestRecorder(t, 2)
+
+	// A recording should share a tuner that already receives its frequency,
+	// rather than tie up another one.
+	first, _ := r.tuners.Get("0")
+	second, _ := r.tuners.Get("1")
+	require.NoError(t, second.Tune("KIDS"))
+	nextPipeline(t, factories[1])
+
+	rec, err := r.Start("KCTS-HD")
+	require.NoError(t, err)
+	assert.Equal(t, "1", rec.TunerID)
+
+	// Otherwise, it should start a tuner that is stopped.
+	rec, err = r.Start("WLFI")
+	require.NoError(t, err)
+	assert.Equal(t, "0", rec.TunerID)
+	nextPipeline(t, factories[0])
+	assert.Equal(t, tuner.StateStarting, first.Status().State)
+
+	_, err = r.Start("KOMO")
+	assert.ErrorIs(t, err, ErrNoTunerAvailable)
+}
+
+func TestPreemption(t *testing.T) {
+	r, factories := newTestRecorderIn(t, t.TempDir(), 1, Policy{
+		Priority: PriorityRecordings,
+		Warning:  150 * time.Millisecond,
+	})
+	busy, _ := r.tuners.Get("0")
+	require.NoError(t, busy.Tune("WLFI"))
+	nextPipeline(t, factories[0])
+	viewer := busy.AddViewer("")
+	defer viewer.Close()
+
+	// Recordings on request should never preempt viewers.
+	_, err := r.Start("KCTS-HD")
+	assert.ErrorIs(t, err, ErrNoTunerAvailable)
+
+	start := time.Now().Add(200 * time.Millisecond)
+	s, err := r.Schedule("KCTS-HD", start, start.Add(time.Hour), Retention{})
+	require.NoError(t, err)
+	assert.Equal(t, []Conflict{{
+		ScheduleID:    s.ID,
+		ChannelName:   "KCTS-HD",
+		Start:         s.Start,
+		End:           s.End,
+		Resolution:    ResolutionPreempt,
+		TunerID:       "0",
+		ViewerChannel: "WLFI",
+	}}, r.Conflicts())
+	assert.Nil(t, busy.Status().Preemption, "warned viewers too early")
+
+	// The viewers should be warned ahead of the recording, which should then
+	// retune their tuner and withdraw the warning.
+	require.Eventually(t, func() bool { return busy.Status().Preemption != nil }, timeout, time.Millisecond)
+	assert.Equal(t, tuner.Preemption{ChannelName: "KCTS-HD", At: s.Start}, *busy.Status().Preemption)
+	nextPipeline(t, factories[0])
+	assert.False(t, time.Now().Before(start))
+	active := awaitActive(t, r, 1)
+	assert.Equal(t, "0", active[0].TunerID)
+	assert.Equal(t, "KCTS-HD", busy.Status().ChannelName)
+	assert.Nil(t, busy.Status().Preemption)
+	assert.Empty(t, r.Conflicts())
+}
+
+func TestViewerChanges(t *testing.T) {
+	for _, priority := range []Priority{PriorityRecordings, PriorityViewers} {
+		t.Run(string(priority), func(t *testing.T) {
+			r, factories := newTestRecorderIn(t, t.TempDir(), 1, Policy{Priority: priority})
+			busy, _ := r.tuners.Get("0")
+			s, err := r.Schedule("KCTS-HD", time.Now(), time.Now().Add(time.Hour), Retention{})
+			require.NoError(t, err)
+			nextPipeline(t, factories[0])
+			rec := awaitActive(t, r, 1)[0]
+			viewer := busy.AddViewer("")
+			t.Cleanup(viewer.Close)
+
+			// Viewers can always change programs on the recording's frequency.
+			require.NoError(t, r.Tune("0", "KIDS"))
+			assert.Equal(t, []Recording{rec}, r.Active())
+			assert.ErrorIs(t, r.Tune("0", "NOPE"), tuner.ErrChannelNotFound)
+
+			if priority == PriorityRecordings {
+				// The recording should keep its tuner until its window ends.
+				assert.ErrorIs(t, r.Tune("0", "WLFI"), ErrTunerRecording)
+				assert.ErrorIs(t, r.StopTuner("0"), ErrTunerRecording)
+				assert.Equal(t, []Recording{rec}, r.Active())
+				assert.Equal(t, "KIDS", busy.Status().ChannelName)
+
+				require.NoError(t, r.CancelSchedule(s.ID))
+				require.NoError(t, r.Tune("0", "WLFI"))
+				return
+			}
+
+			// Viewers should get their way, at the expense of the recording.
+			require.NoError(t, r.Tune("0", "WLFI"))
+			nextPipeline(t, factories[0])
+			awaitActive(t, r, 0)
+			assert.Equal(t, tuner.ErrRecordingInterrupted.Error(), readRecording(t, r, rec.ID).Error)
+		})
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	for _, priority := range []Priority{PriorityRecordings, PriorityViewers} {
+		t.Run(string(priority), func(t *testing.T) {
+			r, factories := newTestRecorderIn(t, t.TempDir(), 2, Policy{Priority: priority})
+			for i, channelName := range []string{"WLFI", "KOMO"} {
+				tuner, _ := r.tuners.Get(strconv.Itoa(i))
+				require.NoError(t, tuner.Tune(channelName))
+				nextPipeline(t, factories[i])
+				for range 2 - i {
+					viewer := tuner.AddViewer("")
+					t.Cleanup(viewer.Close)
+				}
+			}
+
+			// A recording that preempts viewers takes the tuner with the fewest
+			// of them, and later recordings can share it, or any tuner whose
+			// viewers watch the same frequency. Once every tuner is recording, a
+			// recording on another frequency can't preempt any of them.
+			hour := time.Now().Add(time.Hour).Truncate(time.Second)
+			schedule := func(channelName string, start, end float64) Schedule {
+				t.Helper()
+				s, err := r.Schedule(channelName,
+					hour.Add(time.Duration(start*float64(time.Hour))),
+					hour.Add(time.Duration(end*float64(time.Hour))),
+					Retention{})
+				require.NoError(t, err)
+				return s
+			}
+			first := schedule("KCTS-HD", 0, 1)
+			schedule("KIDS", 0.5, 1.5)
+			schedule("WLFI", 0.5, 2)
+			last := schedule("KOMO", 0.75, 1)
+
+			conflicts := r.Conflicts()
+			require.NotEmpty(t, conflicts)
+			assert.Equal(t, first.ID, conflicts[0].ScheduleID)
+			assert.Equal(t, "1", conflicts[0].TunerID)
+			assert.Equal(t, "KOMO", conflicts[0].ViewerChannel)
+
+			if priority == PriorityViewers {
+				// The viewers keep their tuner, so every recording but the one
+				// that shares it fails.
+				assert.Equal(t, ResolutionFail, conflicts[0].Resolution)
+				assert.Len(t, conflicts, 2)
+				return
+			}
+			require.Len(t, conflicts, 2)
+			assert.Equal(t, ResolutionPreempt, conflicts[0].Resolution)
+			assert.Equal(t, Conflict{
+				ScheduleID:  last.ID,
+				ChannelName: "KOMO",
+				Start:       last.Start,
+				End:         last.End,
+				Resolution:  ResolutionFail,
+			}, conflicts[1])
+		})
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	r, factories := newTestRecorder(t, 1)
+
+	_, err := r.Schedule("NOPE", time.Now(), time.Now().Add(time.Hour), Retention{})
+	assert.ErrorIs(t, err, tuner.ErrChannelNotFound)
+	_, err = r.Schedule("KCTS-HD", time.Now().Add(-time.Hour), time.Now().Add(-time.Minute), Retention{})
+	assert.ErrorIs(t, err, ErrInvalidSchedule)
+	_, err = r.Schedule("KCTS-HD", time.Now(), time.Now().Add(time.Hour), Retention{KeepLast: -1})
+	assert.ErrorIs(t, err, ErrInvalidSchedule)
+
+	later, err := r.Schedule("WLFI", time.Now().Add(time.Hour), time.Now().Add(2*time.Hour), Retention{})
+	require.NoError(t, err)
+	start := time.Now().Add(50 * time.Millisecond)
+	s, err := r.Schedule("KCTS-HD", start, start.Add(200*time.Millisecond), Retention{KeepDays: 7})
+	require.NoError(t, err)
+	assert.Equal(t, []Schedule{s, later}, r.Schedules())
+
+	// The recording should start and stop with its window, and take its
+	// schedule with it.
+	p := nextPipeline(t, factories[0])
+	active := awaitActive(t, r, 1)
+	assert.Equal(t, s.ID, active[0].ScheduleID)
+	assert.False(t, active[0].Start.Before(start))
+
+	<-p.Done()
+	require.Eventually(t, func() bool { return len(r.Active()) == 0 }, timeout, time.Millisecond)
+	assert.Equal(t, []Schedule{later}, r.Schedules())
+	got := readRecording(t, r, active[0].ID)
+	assert.False(t, got.End.Before(s.End))
+	assert.Equal(t, Retention{Series: s.ID, KeepDays: 7}, got.Retention)
+
+	// Canceling a schedule whose window is open should end its recording.
+	s, err = r.Schedule("KIDS", time.Now(), time.Now().Add(time.Hour), Retention{})
+	require.NoError(t, err)
+	p = nextPipeline(t, factories[0])
+	require.NoError(t, r.CancelSchedule(s.ID))
+	assert.True(t, p.Closed())
+	assert.ErrorIs(t, r.CancelSchedule(s.ID), ErrScheduleNotFound)
+	assert.Equal(t, []Schedule{later}, r.Schedules())
+}
+
+func TestScheduleWithoutTuner(t *testing.T) {
+	r, factories := newTestRecorder(t, 1)
+	busy, _ := r.tuners.Get("0")
+	require.NoError(t, busy.Tune("WLFI"))
+	nextPipeline(t, factories[0])
+	viewer := busy.AddViewer("")
+	defer viewer.Close()
+
+	// A schedule that can't record should leave a record of the failure.
+	s, err := r.Schedule("KCTS-HD", time.Now(), time.Now().Add(50*time.Millisecond), Retention{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(r.Schedules()) == 0 }, timeout, time.Millisecond)
+
+	failed := failedRecordings(t, r)
+	require.Len(t, failed, 1)
+	assert.Equal(t, s.ID, failed[0].ScheduleID)
+	assert.Equal(t, ErrNoTunerAvailable.Error(), failed[0].Error)
+}
+
+func TestScheduleRetry(t *testing.T) {
+	defer func(min, max time.Duration) { scheduleRetryMinDelay, scheduleRetryMaxDelay = min, max }(scheduleRetryMinDelay, scheduleRetryMaxDelay)
+	scheduleRetryMinDelay, scheduleRetryMaxDelay = 5*time.Millisecond, 20*time.Millisecond
+
+	r, factories := newTestRecorder(t, 1)
+	busy, _ := r.tuners.Get("0")
+	require.NoError(t, busy.Tune("WLFI"))
+	nextPipeline(t, factories[0])
+	viewer := busy.AddViewer("")
+
+	// The schedule should keep trying for a tuner, and take it as soon as the
+	// viewers leave, with one record of the failures along the way.
+	s, err := r.Schedule("KCTS-HD", time.Now(), time.Now().Add(time.Hour), Retention{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(failedRecordings(t, r)) == 1 }, timeout, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	viewer.Close()
+	nextPipeline(t, factories[0])
+	rec := awaitActive(t, r, 1)[0]
+	assert.Equal(t, s.ID, rec.ScheduleID)
+	failed := failedRecordings(t, r)
+	require.Len(t, failed, 1)
+	assert.Equal(t, ErrNoTunerAvailable.Error(), failed[0].Error)
+	assert.True(t, failed[0].End.After(failed[0].Start), "did not record the later attempts")
+
+	// An interrupted recording should start again once the tuner frees up.
+	viewer = busy.AddViewer("")
+	require.NoError(t, r.Tune("0", "WLFI"))
+	nextPipeline(t, factories[0])
+	awaitActive(t, r, 0)
+	assert.Equal(t, tuner.ErrRecordingInterrupted.Error(), readRecording(t, r, rec.ID).Error)
+	viewer.Close()
+	nextPipeline(t, factories[0])
+	restarted := awaitActive(t, r, 1)[0]
+	assert.Equal(t, s.ID, restarted.ScheduleID)
+	assert.NotEqual(t, rec.ID, restarted.ID)
+}
+
+func TestRetention(t *testing.T) {
+	r, _ := newTestRecorderIn(t, t.TempDir(), 1, Policy{Priority: PriorityViewers, Quota: 250})
+
+	now := time.Now().UTC()
+	days := func(n int) time.Time { return now.Add(time.Duration(n) * 24 * time.Hour) }
+	news := Retention{Series: "news", KeepLast: 2}
+	for _, rec := range []struct {
+		Recording
+		size int
+	}{
+		{Recording{ID: "news1", Start: days(-4), End: days(-4), Retention: news}, 100},
+		{Recording{ID: "news2", Start: days(-3), End: days(-3), Retention: news}, 100},
+		{Recording{ID: "news3", Start: days(-2), End: days(-2), Retention: news}, 100},
+		{Recording{ID: "news4", Start: days(-1), End: days(-1), Retention: news, Error: "failed"}, 0},
+		{Recording{ID: "expired", Start: days(-10), End: days(-8), Retention: Retention{KeepDays: 7}}, 10},
+		{Recording{ID: "plain", Start: days(-20), End: days(-20)}, 100},
+		{Recording{ID: "active", Start: now}, 40},
+	} {
+		writeRecording(t, r, rec.Recording, rec.size)
+	}
+
+	// Retention rules should go first, leaving in-progress and failed
+	// recordings alone, and the quota should then take the oldest of the rest.
+	r.clean(now)
+	recordings, err := r.Recordings()
+	require.NoError(t, err)
+	var ids []string
+	for _, rec := range recordings {
+		ids = append(ids, rec.ID)
+	}
+	assert.Equal(t, []string{"news2", "news3", "news4", "active"}, ids)
+
+	assertRemovals := func(want ...string) {
+		t.Helper()
+		var got []string
+		for _, rm := range r.Removals() {
+			got = append(got, rm.ID+":"+string(rm.Reason))
+		}
+		assert.Equal(t, want, got)
+	}
+	assertRemovals("news1:keep-last", "expired:keep-days", "plain:quota")
+
+	// The janitor should enforce the rules on its own whenever it wakes.
+	writeRecording(t, r, Recording{ID: "news5", Start: now, End: now, Retention: news}, 10)
+	r.requestCleanup()
+	require.Eventually(t, func() bool { return len(r.Removals()) == 4 }, timeout, time.Millisecond)
+	assertRemovals("news1:keep-last", "expired:keep-days", "plain:quota", "news2:keep-last")
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	policy := Policy{Priority: PriorityViewers}
+	r, _ := newTestRecorderIn(t, dir, 1, policy)
+
+	s, err := r.Schedule("KCTS-HD", time.Now().Add(time.Hour), time.Now().Add(2*time.Hour), Retention{})
+	require.NoError(t, err)
+	r.Close()
+
+	// A recording left in progress by a crash should be marked as interrupted.
+	interrupted := Recording{ID: "crashed", ChannelName: "KIDS", TunerID: "0", Start: time.Now().Add(-time.Hour).UTC()}
+	require.NoError(t, writeJSON(r.path(interrupted.ID, metadataExt), interrupted))
+	require.NoError(t, os.WriteFile(r.path(interrupted.ID, recordingExt), []byte("data"), 0o644))
+
+	r, _ = newTestRecorderIn(t, dir, 1, policy)
+	assert.Equal(t, []Schedule{s}, r.Schedules())
+
+	got := readRecording(t, r, interrupted.ID)
+	assert.Equal(t, errServerStopped.Error(), got.Error)
+	assert.True(t, got.End.After(interrupted.Start))
+
+	// A schedule that ended while the server was down should be dropped.
+	require.NoError(t, writeJSON(filepath.Join(dir, schedulesFile), []Schedule{
+		{ID: "missed", ChannelName: "KIDS", Start: time.Now().Add(-2 * time.Hour), End: time.Now().Add(-time.Hour)},
+		s,
+	}))
+	r.Close()
+	r, _ = newTestRecorderIn(t, dir, 1, policy)
+	assert.Equal(t, []Schedule{s}, r.Schedules())
+}
+
+func newTestRecorder(t *testing.T, numTuners int) (*Recorder, []*pipelinetest.Factory) {
+	return newTestRecorderIn(t, t.TempDir(), numTuners, Policy{Priority: PriorityViewers})
+}
+
+func newTestRecorderIn(t *testing.T, dir string, numTuners int, policy Policy) (*Recorder, []*pipelinetest.Factory) {
+	t.Helper()
+	factories := make([]*pipelinetest.Factory, numTuners)
+	tuners := make([]*tuner.Tuner, numTuners)
+	for i := range numTuners {
+		factories[i] = pipelinetest.NewFactory()
+		tuners[i] = tuner.NewTuner(testChannels, tuner.Config{
+			NewPipeline: factories[i].New,
+			Source:      tuner.SourceTest,
+		})
+		t.Cleanup(func() { tuners[i].Stop() })
+	}
+
+	r, err := New(dir, tuner.NewPool(tuners...), policy)
+	require.NoError(t, err)
+	t.Cleanup(r.Close)
+	return r, factories
+}
+
+func nextPipeline(t *testing.T, factory *pipelinetest.Factory) *pipelinetest.Pipeline {
+	t.Helper()
+	p := factory.Next(timeout)
+	if p == nil {
+		t.Fatal("timed out waiting for a tuner to create a pipeline")
+	}
+	return p
+}
+
+// awaitActive waits for r to have n recordings in progress, as a scheduled
+// recording only joins them once its tuner is recording, and returns them.
+func awaitActive(t *testing.T, r *Recorder, n int) []Recording {
+	t.Helper()
+	require.Eventually(t, func() bool { return len(r.Active()) == n }, timeout, time.Millisecond)
+	return r.Active()
+}
+
+// failedRecordings returns the records of the scheduled recordings in r's
+// directory that failed to start.
+func failedRecordings(t *testing.T, r *Recorder) []Recording {
+	t.Helper()
+	entries, err := os.ReadDir(r.dir)
+	require.NoError(t, err)
+	var failed []Recording
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), metadataExt)
+		if !ok || entry.Name() == schedulesFile {
+			continue
+		}
+		if rec := readRecording(t, r, id); rec.TunerID == "" {
+			failed = append(failed, rec)
+		}
+	}
+	return failed
+}
+
+func recordBranch(t *testing.T, p *pipelinetest.Pipeline) *pipelinetest.Branch {
+	t.Helper()
+	for _, b := range p.Branches() {
+		if !b.Closed() && strings.Contains(b.Description, "appsink name=record") {
+			return b
+		}
+	}
+	t.Fatal("pipeline has no open record branch")
+	return nil
+}
+
+func writeRecording(t *testing.T, r *Recorder, rec Recording, size int) {
+	t.Helper()
+	rec.ChannelName = "KCTS-HD"
+	require.NoError(t, r.saveMetadata(rec))
+	if size > 0 {
+		require.NoError(t, os.WriteFile(r.path(rec.ID, recordingExt), make([]byte, size), 0o644))
+	}
+}
+
+func readRecording(t *testing.T, r *Recorder, id string) Recording {
+	t.Helper()
+	var rec Recording
+	require.NoError(t, readJSON(r.path(id, metadataExt), &rec))
+	return rec
+}
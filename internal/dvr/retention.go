@@ -0,0 +1,186 @@
+package dvr
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Retention limits how long the Recorder keeps the recordings of a schedule.
+// The zero value keeps them until they are deleted, or until the Recorder needs
+// the space under its Policy.Quota.
+type Retention struct {
+	// Series names the show that a schedule records, so that KeepLast counts
+	// the episodes that every schedule for the same series has recorded. An
+	// empty Series counts only the recordings of the one schedule.
+	Series string `json:",omitempty"`
+
+	// KeepLast is how many of the most recent episodes of the series to keep,
+	// or zero to keep every episode.
+	KeepLast int `json:",omitempty"`
+
+	// KeepDays is how many days to keep each recording after it ends, or zero
+	// to keep it indefinitely.
+	KeepDays int `json:",omitempty"`
+}
+
+// RemovalReason describes the rule that led the Recorder to remove a recording.
+type RemovalReason string
+
+const (
+	// RemovedKeepLast means that newer episodes of the recording's series
+	// replaced it under Retention.KeepLast.
+	RemovedKeepLast RemovalReason = "keep-last"
+
+	// RemovedKeepDays means that the recording outlived Retention.KeepDays.
+	RemovedKeepDays RemovalReason = "keep-days"
+
+	// RemovedQuota means that the recording was among the oldest when the
+	// recordings exceeded Policy.Quota.
+	RemovedQuota RemovalReason = "quota"
+)
+
+// Removal describes a recording that the Recorder removed on its own.
+type Removal struct {
+	ID          string
+	ChannelName string
+	Start       time.Time
+	End         time.Time
+	Size        int64
+
+	Reason  RemovalReason
+	Removed time.Time
+}
+
+const (
+	// janitorInterval is how often the Recorder enforces retention rules and
+	// its quota, in addition to whenever a recording finishes. Recordings in
+	// progress grow toward the quota between checks.
+	janitorInterval = time.Minute
+
+	// maxRemovals is the number of removals that the Recorder remembers for
+	// Removals.
+	maxRemovals = 100
+)
+
+// Removals returns the most recent recordings that the Recorder removed under
+// retention rules or its quota since it started, in the order it removed them.
+func (r *Recorder) Removals() []Removal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append(make([]Removal, 0, len(r.removals)), r.removals...)
+}
+
+// runJanitor cleans up the Recorder's directory periodically and whenever a
+// recording finishes, until the Recorder closes.
+func (r *Recorder) runJanitor() {
+	defer close(r.janitorDone)
+
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopJanitor:
+			return
+		case <-ticker.C:
+		case <-r.cleanup:
+		}
+		r.clean(time.Now())
+	}
+}
+
+// requestCleanup wakes the janitor without waiting for it.
+func (r *Recorder) requestCleanup() {
+	select {
+	case r.cleanup <- struct{}{}:
+	default:
+	}
+}
+
+// clean removes every finished recording that has outlived its retention rules
+// as of now, then removes the oldest finished recordings until the size of
+// every recording fits within the quota, if there is one.
+func (r *Recorder) clean(now time.Time) {
+	r.cleanMu.Lock()
+	defer r.cleanMu.Unlock()
+
+	recordings, err := r.Recordings()
+	if err != nil {
+		slog.Error("Failed to list recordings for cleanup", "error", err)
+		return
+	}
+
+	// Count episodes from the newest, so that each recording knows how many
+	// newer ones its series has. Recordings that failed before saving anything
+	// don't count as episodes.
+	var kept []Recording
+	episodes := make(map[string]int)
+	for _, rec := range slices.Backward(recordings) {
+		if rec.End.IsZero() {
+			kept = append(kept, rec)
+			continue
+		}
+
+		ret := rec.Retention
+		if ret.Series != "" && rec.Size > 0 {
+			episodes[ret.Series]++
+		}
+		switch {
+		case ret.KeepLast > 0 && episodes[ret.Series] > ret.KeepLast:
+			r.remove(rec, RemovedKeepLast, now)
+		case ret.KeepDays > 0 && now.Sub(rec.End) >= time.Duration(ret.KeepDays)*24*time.Hour:
+			r.remove(rec, RemovedKeepDays, now)
+		default:
+			kept = append(kept, rec)
+		}
+	}
+
+	quota := r.policy.Quota
+	if quota <= 0 {
+		return
+	}
+	var total int64
+	for _, rec := range kept {
+		total += rec.Size
+	}
+	for _, rec := range slices.Backward(kept) {
+		if total <= quota {
+			return
+		}
+		if !rec.End.IsZero() {
+			r.remove(rec, RemovedQuota, now)
+			total -= rec.Size
+		}
+	}
+	if total > quota {
+		slog.Warn("Recordings in progress exceed quota", "size", total, "quota", quota)
+	}
+}
+
+// remove deletes a finished recording on behalf of the janitor, and remembers
+// the removal.
+func (r *Recorder) remove(rec Recording, reason RemovalReason, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.removeFiles(rec.ID); err != nil {
+		slog.Error("Failed to remove recording", "id", rec.ID, "channel", rec.ChannelName,
+			"reason", reason, "error", err)
+		return
+	}
+	slog.Info("Removed recording", "id", rec.ID, "channel", rec.ChannelName,
+		"reason", reason, "size", rec.Size)
+
+	r.removals = append(r.removals, Removal{
+		ID:          rec.ID,
+		ChannelName: rec.ChannelName,
+		Start:       rec.Start,
+		End:         rec.End,
+		Size:        rec.Size,
+		Reason:      reason,
+		Removed:     now,
+	})
+	if excess := len(r.removals) - maxRemovals; excess > 0 {
+		r.removals = slices.Delete(r.removals, 0, excess)
+	}
+}
@@ -0,0 +1,131 @@
+package gst
+
+// #include "gst.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"runtime/cgo"
+	"unsafe"
+
+	"github.com/featherbread/hypcast/internal/pipeline"
+)
+
+// Branch represents a GStreamer bin that was added to a running or stopped
+// pipeline, and that can be removed from the pipeline while the rest of the
+// pipeline continues to run. It implements [pipeline.Branch].
+type Branch struct {
+	pipeline          *Pipeline
+	gstBin            *C.GstElement
+	sinkHandlesByName map[string]cgo.Handle
+}
+
+var _ pipeline.Branch = (*Branch)(nil)
+
+// AddBranch creates a GStreamer bin based on the syntax used in the
+// gst-launch-1.0 utility, and adds it to the pipeline. If the bin has an
+// unlinked sink pad, it is linked to a new source pad requested from the
+// element named tee, which is expected to be a tee element.
+func (p *Pipeline) AddBranch(tee, description string) (pipeline.Branch, error) {
+	if p.gstPipeline == nil {
+		panic("pipeline not initialized")
+	}
+
+	teeCString := C.CString(tee)
+	defer C.free(unsafe.Pointer(teeCString))
+	descriptionCString := C.CString(description)
+	defer C.free(unsafe.Pointer(descriptionCString))
+
+	var gerror *C.GError
+	gstBin := C.hypcast_add_branch(p.gstPipeline, teeCString, descriptionCString, &gerror)
+	if gerror != nil {
+		defer C.g_error_free(gerror)
+		return nil, errors.New(C.GoString(gerror.message))
+	}
+
+	b := &Branch{
+		pipeline:          p,
+		gstBin:            gstBin,
+		sinkHandlesByName: make(map[string]cgo.Handle),
+	}
+	p.branches[b] = struct{}{}
+	return b, nil
+}
+
+// SetSink associates fn with a named appsink element in the branch, following
+// the same rules as [Pipeline.SetSink].
+func (b *Branch) SetSink(name string, fn pipeline.SinkFunc) {
+	setSink(b.gstBin, b.sinkHandlesByName, name, fn)
+}
+
+// RequestKeyFrame sends a force-key-unit event upstream from the named appsink
+// element in the branch, which causes any video encoder upstream of the sink to
+// produce a key frame.
+func (b *Branch) RequestKeyFrame(sink string) error {
+	element := getGstElementByName(b.gstBin, sink)
+	if element == nil {
+		return fmt.Errorf("unknown sink name %s", sink)
+	}
+	defer C.gst_object_unref(C.gpointer(element))
+
+	if C.hypcast_request_key_unit(element) == C.FALSE {
+		return errors.New("key frame request not handled")
+	}
+	return nil
+}
+
+// SetProperty sets a property of the named element in the branch, deserializing
+// value in the same way as the gst-launch-1.0 utility.
+func (b *Branch) SetProperty(element, property, value string) error {
+	gstElement := getGstElementByName(b.gstBin, element)
+	if gstElement == nil {
+		return fmt.Errorf("unknown element name %s", element)
+	}
+	defer C.gst_object_unref(C.gpointer(gstElement))
+
+	propertyCString := C.CString(property)
+	defer C.free(unsafe.Pointer(propertyCString))
+	valueCString := C.CString(value)
+	defer C.free(unsafe.Pointer(valueCString))
+
+	if C.hypcast_set_property(gstElement, propertyCString, valueCString) == C.FALSE {
+		return fmt.Errorf("element %s has no property %s", element, property)
+	}
+	return nil
+}
+
+// Start attempts to set the branch to the same state as its pipeline.
+func (b *Branch) Start() error {
+	if b.gstBin == nil {
+		panic("branch not initialized")
+	}
+
+	if C.gst_element_sync_state_with_parent(b.gstBin) == C.FALSE {
+		return errors.New("failed to start branch")
+	}
+	return nil
+}
+
+// Close stops the branch, removes it from its pipeline, and releases any
+// resources associated with it.
+func (b *Branch) Close() error {
+	if b.gstBin == nil {
+		return nil
+	}
+
+	C.hypcast_remove_branch(b.pipeline.gstPipeline, b.gstBin)
+	delete(b.pipeline.branches, b)
+	b.release()
+	return nil
+}
+
+// release frees the resources held by the Go side of the branch, which must not
+// be processing any data.
+func (b *Branch) release() {
+	deleteSinkHandles(b.sinkHandlesByName)
+
+	if b.gstBin != nil {
+		C.gst_object_unref(C.gpointer(b.gstBin))
+		b.gstBin = nil
+	}
+}
@@ -0,0 +1,106 @@
+package gst
+
+// #include "gst.h"
+import "C"
+import (
+	"runtime/cgo"
+
+	"github.com/featherbread/hypcast/internal/pipeline"
+)
+
+// SetEventHandler associates fn with the bus of the pipeline, causing it to be
+// called with every error, warning, end-of-stream, state change, and element
+// message that the pipeline posts. Errors and warnings are reported as
+// *pipeline.Error values.
+//
+// GStreamer calls fn synchronously from whichever thread posted the message,
+// which may be a streaming thread or a thread calling a method of the pipeline.
+// fn must not block, and must not call any method of the pipeline.
+//
+// SetEventHandler must only be called while the pipeline is stopped, and may
+// only be called up to once over the life of the pipeline. It will panic if fn
+// is nil, or if SetEventHandler has already been called once.
+func (p *Pipeline) SetEventHandler(fn pipeline.EventFunc) {
+	if fn == nil {
+		panic("attempted to set nil event handler")
+	}
+	if p.eventHandle > 0 {
+		panic("called SetEventHandler more than once")
+	}
+
+	p.eventHandle = cgo.NewHandle(fn)
+	C.hypcast_connect_bus(p.gstPipeline, C.uintptr_t(p.eventHandle))
+}
+
+// GStreamer calls hypcastBusMessage to pass messages from a pipeline's bus into
+// Go handler functions. See gst.c for details.
+//
+//export hypcastBusMessage
+func hypcastBusMessage(message *C.GstMessage, eventHandle uintptr) {
+	event, ok := parseEvent(message)
+	if !ok {
+		return
+	}
+
+	eventFn := cgo.Handle(eventHandle).Value().(pipeline.EventFunc)
+	eventFn(event)
+}
+
+func parseEvent(message *C.GstMessage) (event pipeline.Event, ok bool) {
+	event.Source = C.GoString(C.hypcast_message_src_name(message))
+
+	switch C.hypcast_message_type(message) {
+	default:
+		return pipeline.Event{}, false
+
+	case C.GST_MESSAGE_ERROR:
+		event.Type = pipeline.EventError
+		var (
+			gerror *C.GError
+			debug  *C.gchar
+		)
+		C.gst_message_parse_error(message, &gerror, &debug)
+		event.Err = newError(event.Source, gerror, debug)
+
+	case C.GST_MESSAGE_WARNING:
+		event.Type = pipeline.EventWarning
+		var (
+			gerror *C.GError
+			debug  *C.gchar
+		)
+		C.gst_message_parse_warning(message, &gerror, &debug)
+		event.Err = newError(event.Source, gerror, debug)
+
+	case C.GST_MESSAGE_EOS:
+		event.Type = pipeline.EventEOS
+
+	case C.GST_MESSAGE_STATE_CHANGED:
+		event.Type = pipeline.EventStateChanged
+		var oldState, newState, pending C.GstState
+		C.gst_message_parse_state_changed(message, &oldState, &newState, &pending)
+		event.OldState, event.NewState = pipeline.State(oldState), pipeline.State(newState)
+
+	case C.GST_MESSAGE_ELEMENT:
+		event.Type = pipeline.EventElement
+		if structure := C.gst_message_get_structure(message); structure != nil {
+			structureCString := C.gst_structure_to_string(structure)
+			defer C.g_free(C.gpointer(structureCString))
+			event.Structure = C.GoString(structureCString)
+		}
+	}
+
+	return event, true
+}
+
+// newError takes ownership of gerror and debug, which must be non-nil and
+// possibly nil respectively (per the contract of gst_message_parse_error).
+func newError(source string, gerror *C.GError, debug *C.gchar) *pipeline.Error {
+	defer C.g_error_free(gerror)
+	defer C.g_free(C.gpointer(debug))
+
+	return &pipeline.Error{
+		Source:  source,
+		Message: C.GoString(gerror.message),
+		Debug:   C.GoString(debug),
+	}
+}
@@ -18,3 +18,193 @@ GstFlowReturn hypcast_sink_sample(GstElement *object, gpointer user_data) {
   // At this point, the Go side takes over the ownership of sample.
   return hypcastSinkSample(sample, sink_handle);
 }
+
+void hypcast_connect_bus(GstElement *pipeline, uintptr_t bus_handle) {
+  GstBus *bus = gst_element_get_bus(pipeline);
+  gst_bus_set_sync_handler(bus, hypcast_bus_message,
+                           GSIZE_TO_POINTER(bus_handle), NULL);
+  gst_object_unref(bus);
+}
+
+void hypcast_disconnect_bus(GstElement *pipeline) {
+  GstBus *bus = gst_element_get_bus(pipeline);
+  gst_bus_set_sync_handler(bus, NULL, NULL, NULL);
+  gst_object_unref(bus);
+}
+
+GstBusSyncReply hypcast_bus_message(GstBus *bus, GstMessage *message,
+                                    gpointer user_data) {
+  uintptr_t bus_handle = GPOINTER_TO_SIZE(user_data);
+
+  // Nobody pops messages off of the bus's own queue, so we handle every message
+  // synchronously and drop it afterward. A sync handler that drops a message
+  // is responsible for unreffing it.
+  hypcastBusMessage(message, bus_handle);
+  gst_message_unref(message);
+  return GST_BUS_DROP;
+}
+
+GstElement *hypcast_add_branch(GstElement *pipeline, const gchar *tee_name,
+                               const gchar *description, GError **error) {
+  GstElement *bin = gst_parse_bin_from_description(description, TRUE, error);
+  if (*error != NULL) {
+    if (bin != NULL) {
+      gst_object_unref(bin);
+    }
+    return NULL;
+  }
+
+  // The pipeline takes its own reference to the bin, and we keep the original
+  // reference for the Go side to release when it's done with the branch.
+  gst_object_ref_sink(bin);
+  gst_bin_add(GST_BIN(pipeline), bin);
+
+  // gst_parse_bin_from_description ghosts the input of the branch (if any) to
+  // a pad named "sink", which is what we feed from the tee.
+  GstPad *sink_pad = gst_element_get_static_pad(bin, "sink");
+  if (sink_pad == NULL) {
+    return bin;
+  }
+  gst_object_unref(sink_pad);
+
+  gboolean linked = FALSE;
+  GstElement *tee = gst_bin_get_by_name(GST_BIN(pipeline), tee_name);
+  if (tee != NULL) {
+    linked = gst_element_link(tee, bin);
+    gst_object_unref(tee);
+  }
+  if (!linked) {
+    gst_bin_remove(GST_BIN(pipeline), bin);
+    gst_object_unref(bin);
+    g_set_error(error, GST_CORE_ERROR, GST_CORE_ERROR_NEGOTIATION,
+                "failed to link branch to %s", tee_name);
+    return NULL;
+  }
+
+  return bin;
+}
+
+// HypcastBranchRemoval tracks the removal of a branch from its tee by
+// hypcast_remove_branch_idle, so that hypcast_remove_branch can wait for it.
+typedef struct {
+  GstElement *pipeline;
+  GstElement *bin;
+  GMutex lock;
+  GCond cond;
+  gboolean done;
+} HypcastBranchRemoval;
+
+// hypcast_detach_branch disconnects bin from tee_pad, releases tee_pad back to
+// its tee, and stops and removes bin.
+static void hypcast_detach_branch(GstElement *pipeline, GstElement *bin,
+                                  GstPad *tee_pad) {
+  GstPad *sink_pad = gst_element_get_static_pad(bin, "sink");
+  GstElement *tee = gst_pad_get_parent_element(tee_pad);
+  gst_pad_unlink(tee_pad, sink_pad);
+  if (tee != NULL) {
+    gst_element_release_request_pad(tee, tee_pad);
+    gst_object_unref(tee);
+  }
+  gst_object_unref(sink_pad);
+
+  gst_element_set_state(bin, GST_STATE_NULL);
+  gst_bin_remove(GST_BIN(pipeline), bin);
+}
+
+static GstPadProbeReturn hypcast_remove_branch_idle(GstPad *tee_pad,
+                                                    GstPadProbeInfo *info,
+                                                    gpointer user_data) {
+  HypcastBranchRemoval *removal = user_data;
+  hypcast_detach_branch(removal->pipeline, removal->bin, tee_pad);
+
+  g_mutex_lock(&removal->lock);
+  removal->done = TRUE;
+  g_cond_signal(&removal->cond);
+  g_mutex_unlock(&removal->lock);
+  return GST_PAD_PROBE_REMOVE;
+}
+
+void hypcast_remove_branch(GstElement *pipeline, GstElement *bin) {
+  GstPad *sink_pad = gst_element_get_static_pad(bin, "sink");
+  GstPad *tee_pad = NULL;
+  if (sink_pad != NULL) {
+    tee_pad = gst_pad_get_peer(sink_pad);
+    gst_object_unref(sink_pad);
+  }
+  if (tee_pad == NULL) {
+    gst_element_set_state(bin, GST_STATE_NULL);
+    gst_bin_remove(GST_BIN(pipeline), bin);
+    return;
+  }
+
+  // A playing tee may be pushing into the branch at any moment, so we detach
+  // the branch from an idle probe, which runs between pushes (or right away if
+  // the tee isn't pushing), and wait for it. A tee in a pipeline that isn't
+  // playing may instead be stuck in a push into the branch until the pipeline
+  // resumes, so we detach the branch right away. The tee marks the pad as
+  // removed when we release it, and ignores the result of any push into it
+  // that was in flight. Callers must not change the pipeline's state while
+  // removing a branch.
+  GstState state = GST_STATE_VOID_PENDING;
+  gst_element_get_state(pipeline, &state, NULL, 0);
+  if (state != GST_STATE_PLAYING) {
+    hypcast_detach_branch(pipeline, bin, tee_pad);
+    gst_object_unref(tee_pad);
+    return;
+  }
+
+  HypcastBranchRemoval removal = {.pipeline = pipeline, .bin = bin};
+  g_mutex_init(&removal.lock);
+  g_cond_init(&removal.cond);
+  gst_pad_add_probe(tee_pad, GST_PAD_PROBE_TYPE_IDLE,
+                    hypcast_remove_branch_idle, &removal, NULL);
+
+  g_mutex_lock(&removal.lock);
+  while (!removal.done) {
+    g_cond_wait(&removal.cond, &removal.lock);
+  }
+  g_mutex_unlock(&removal.lock);
+  g_mutex_clear(&removal.lock);
+  g_cond_clear(&removal.cond);
+  gst_object_unref(tee_pad);
+}
+
+gboolean hypcast_request_key_unit(GstElement *element) {
+  // This is the event that gst_video_event_new_upstream_force_key_unit would
+  // create, built by hand to avoid a dependency on the gstreamer-video library.
+  // Upstream events sent to a sink travel back through the pipeline until they
+  // reach the encoder.
+  GstStructure *structure = gst_structure_new(
+      "GstForceKeyUnit", "running-time", GST_TYPE_CLOCK_TIME,
+      GST_CLOCK_TIME_NONE, "all-headers", G_TYPE_BOOLEAN, TRUE, "count",
+      G_TYPE_UINT, 0, NULL);
+  GstEvent *event = gst_event_new_custom(GST_EVENT_CUSTOM_UPSTREAM, structure);
+  return gst_element_send_event(element, event);
+}
+
+gboolean hypcast_set_property(GstElement *element, const gchar *name,
+                              const gchar *value) {
+  // gst_util_set_object_arg only logs a warning for an unknown property, so we
+  // check for it ourselves to report it to the caller.
+  if (g_object_class_find_property(G_OBJECT_GET_CLASS(element), name) == NULL) {
+    return FALSE;
+  }
+  gst_util_set_object_arg(G_OBJECT(element), name, value);
+  return TRUE;
+}
+
+gboolean hypcast_seek(GstElement *pipeline, gint64 position) {
+  // Seeking to a key frame lets the decoders resume right away, rather than
+  // decoding and discarding everything from the previous key frame.
+  return gst_element_seek_simple(pipeline, GST_FORMAT_TIME,
+                                 GST_SEEK_FLAG_FLUSH | GST_SEEK_FLAG_KEY_UNIT,
+                                 position);
+}
+
+GstMessageType hypcast_message_type(GstMessage *message) {
+  return GST_MESSAGE_TYPE(message);
+}
+
+const gchar *hypcast_message_src_name(GstMessage *message) {
+  return GST_MESSAGE_SRC_NAME(message);
+}
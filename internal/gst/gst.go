@@ -12,28 +12,34 @@ import (
 	"errors"
 	"fmt"
 	"runtime/cgo"
+	"strings"
 	"time"
 	"unsafe"
+
+	"github.com/featherbread/hypcast/internal/pipeline"
 )
 
 func init() {
 	C.gst_init(nil, nil)
 }
 
-// SinkFunc is a type for functions that receive data from the appsink elements
-// of a Pipeline.
-type SinkFunc func([]byte, time.Duration)
-
 // Pipeline represents a GStreamer pipeline that can provide sample data to Go
-// programs through appsink elements.
+// programs through appsink elements. It implements [pipeline.Pipeline].
 type Pipeline struct {
 	gstPipeline       *C.GstElement
 	sinkHandlesByName map[string]cgo.Handle
+	eventHandle       cgo.Handle
+	branches          map[*Branch]struct{}
 }
 
 // NewPipeline creates a GStreamer pipeline based on the syntax used in the
-// gst-launch-1.0 utility.
+// gst-launch-1.0 utility. An empty description creates an empty pipeline, to
+// which branches may be added.
 func NewPipeline(description string) (*Pipeline, error) {
+	if strings.TrimSpace(description) == "" {
+		return newPipeline(C.gst_pipeline_new(nil)), nil
+	}
+
 	descriptionCString := C.CString(description)
 	defer C.free(unsafe.Pointer(descriptionCString))
 
@@ -43,14 +49,31 @@ func NewPipeline(description string) (*Pipeline, error) {
 		defer C.g_error_free(gerror)
 		return nil, errors.New(C.GoString(gerror.message))
 	}
-	// gst_parse_launch returns a "floating ref," see here for details:
-	// https://docs.gtk.org/gobject/floating-refs.html
+	return newPipeline(gstPipeline), nil
+}
+
+func newPipeline(gstPipeline *C.GstElement) *Pipeline {
+	// Both gst_parse_launch and gst_pipeline_new return a "floating ref," see
+	// here for details: https://docs.gtk.org/gobject/floating-refs.html
 	C.gst_object_ref_sink(C.gpointer(gstPipeline))
 
 	return &Pipeline{
 		gstPipeline:       gstPipeline,
 		sinkHandlesByName: make(map[string]cgo.Handle),
-	}, nil
+		branches:          make(map[*Branch]struct{}),
+	}
+}
+
+var _ pipeline.Pipeline = (*Pipeline)(nil)
+
+// Factory creates GStreamer pipelines for components that accept any
+// [pipeline.Pipeline] implementation. See [NewPipeline] for details.
+func Factory(description string) (pipeline.Pipeline, error) {
+	p, err := NewPipeline(description)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
 // Start attempts to set the GStreamer pipeline to the PLAYING state, in which
@@ -67,6 +90,50 @@ func (p *Pipeline) Start() error {
 	return nil
 }
 
+// Pause attempts to set the GStreamer pipeline to the PAUSED state, in which
+// elements hold their current position and sinks stop receiving output.
+func (p *Pipeline) Pause() error {
+	if p.gstPipeline == nil {
+		panic("pipeline not initialized")
+	}
+
+	result := C.gst_element_set_state(p.gstPipeline, C.GST_STATE_PAUSED)
+	if result == C.GST_STATE_CHANGE_FAILURE {
+		return errors.New("failed to pause pipeline")
+	}
+	return nil
+}
+
+// Seek performs a flushing seek of the pipeline to the nearest key frame at or
+// before position.
+func (p *Pipeline) Seek(position time.Duration) error {
+	if p.gstPipeline == nil {
+		panic("pipeline not initialized")
+	}
+
+	if C.hypcast_seek(p.gstPipeline, C.gint64(position.Nanoseconds())) == 0 {
+		return errors.New("failed to seek pipeline")
+	}
+	return nil
+}
+
+// Position queries the current position of the pipeline and the duration of
+// its source. A source of unknown duration reports a duration of zero.
+func (p *Pipeline) Position() (position, duration time.Duration, err error) {
+	if p.gstPipeline == nil {
+		panic("pipeline not initialized")
+	}
+
+	var pos, dur C.gint64
+	if C.gst_element_query_position(p.gstPipeline, C.GST_FORMAT_TIME, &pos) == 0 {
+		return 0, 0, errors.New("failed to query pipeline position")
+	}
+	if C.gst_element_query_duration(p.gstPipeline, C.GST_FORMAT_TIME, &dur) == 0 {
+		dur = 0
+	}
+	return time.Duration(pos), time.Duration(dur), nil
+}
+
 // Stop attempts to set the pipeline to the NULL state, in which no elements are
 // processing data and sinks are not receiving any output.
 func (p *Pipeline) Stop() error {
@@ -92,11 +159,21 @@ func (p *Pipeline) Close() error {
 	// things involving the C heap. As such we always check for non-zero-ness
 	// before freeing and zero out after freeing.
 
-	for name, handle := range p.sinkHandlesByName {
-		handle.Delete()
-		delete(p.sinkHandlesByName, name)
+	if p.eventHandle > 0 {
+		if p.gstPipeline != nil {
+			C.hypcast_disconnect_bus(p.gstPipeline)
+		}
+		p.eventHandle.Delete()
+		p.eventHandle = 0
+	}
+
+	for b := range p.branches {
+		b.release()
+		delete(p.branches, b)
 	}
 
+	deleteSinkHandles(p.sinkHandlesByName)
+
 	if p.gstPipeline != nil {
 		C.gst_object_unref(C.gpointer(p.gstPipeline))
 		p.gstPipeline = nil
@@ -112,18 +189,24 @@ func (p *Pipeline) Close() error {
 // called up to once per appsink over the life of the pipeline. It will panic if
 // name does not correspond to the name of a defined appsink, if fn is nil, or
 // if SetSink has already been called once for the named appsink.
-func (p *Pipeline) SetSink(name string, fn SinkFunc) {
+func (p *Pipeline) SetSink(name string, fn pipeline.SinkFunc) {
+	setSink(p.gstPipeline, p.sinkHandlesByName, name, fn)
+}
+
+// setSink implements SetSink for the appsinks within any GStreamer bin,
+// including pipelines and branches.
+func setSink(gstBin *C.GstElement, handles map[string]cgo.Handle, name string, fn pipeline.SinkFunc) {
 	if fn == nil {
 		panic("attempted to set nil sink function")
 	}
-	if p.sinkHandlesByName[name] > 0 {
+	if handles[name] > 0 {
 		panic("called SetSink more than once for the same appsink")
 	}
 
 	handle := cgo.NewHandle(fn)
-	p.sinkHandlesByName[name] = handle
+	handles[name] = handle
 
-	element := p.getGstElementByName(name)
+	element := getGstElementByName(gstBin, name)
 	if element == nil {
 		panic(fmt.Errorf("unknown sink name %s", name))
 	}
@@ -132,12 +215,18 @@ func (p *Pipeline) SetSink(name string, fn SinkFunc) {
 	C.hypcast_connect_sink(element, C.uintptr_t(handle))
 }
 
-func (p *Pipeline) getGstElementByName(name string) *C.GstElement {
+func deleteSinkHandles(handles map[string]cgo.Handle) {
+	for name, handle := range handles {
+		handle.Delete()
+		delete(handles, name)
+	}
+}
+
+func getGstElementByName(gstBin *C.GstElement, name string) *C.GstElement {
 	nameCString := C.CString(name)
 	defer C.free(unsafe.Pointer(nameCString))
 
-	pipelineBin := (*C.GstBin)(unsafe.Pointer(p.gstPipeline))
-	return C.gst_bin_get_by_name(pipelineBin, nameCString)
+	return C.gst_bin_get_by_name((*C.GstBin)(unsafe.Pointer(gstBin)), nameCString)
 }
 
 // GStreamer calls hypcastSinkSample to pass data from the encoding pipeline
@@ -161,7 +250,7 @@ func hypcastSinkSample(sample *C.GstSample, sinkHandle uintptr) C.GstFlowReturn
 
 	C.gst_sample_unref(sample) // Invalidates sample and buffer
 
-	sinkFn := cgo.Handle(sinkHandle).Value().(SinkFunc)
+	sinkFn := cgo.Handle(sinkHandle).Value().(pipeline.SinkFunc)
 	sinkFn(data, duration)
 
 	return C.GST_FLOW_OK
@@ -9,8 +9,23 @@
 #include <gst/gst.h>
 
 extern GstFlowReturn hypcastSinkSample(GstSample *, uintptr_t);
+extern void hypcastBusMessage(GstMessage *, uintptr_t);
 
 void hypcast_connect_sink(GstElement *, uintptr_t);
 GstFlowReturn hypcast_sink_sample(GstElement *, gpointer);
 
+void hypcast_connect_bus(GstElement *, uintptr_t);
+void hypcast_disconnect_bus(GstElement *);
+GstBusSyncReply hypcast_bus_message(GstBus *, GstMessage *, gpointer);
+
+GstElement *hypcast_add_branch(GstElement *, const gchar *, const gchar *,
+                               GError **);
+void hypcast_remove_branch(GstElement *, GstElement *);
+gboolean hypcast_request_key_unit(GstElement *);
+gboolean hypcast_set_property(GstElement *, const gchar *, const gchar *);
+gboolean hypcast_seek(GstElement *, gint64);
+
+GstMessageType hypcast_message_type(GstMessage *);
+const gchar *hypcast_message_src_name(GstMessage *);
+
 #endif
@@ -0,0 +1,209 @@
+// Package pipeline defines the interface through which Hypcast drives media
+// pipelines, so that components like the tuner do not depend directly on
+// GStreamer and can be tested without it.
+//
+// The gst package provides the real implementation of this interface, and the
+// pipelinetest package provides a fake implementation for tests.
+package pipeline
+
+import (
+	"fmt"
+	"time"
+)
+
+// Pipeline represents a media pipeline that provides sample data to Go programs
+// through named sinks, and reports events as it runs.
+type Pipeline interface {
+	// SetSink associates fn with a named sink in the pipeline, causing it to be
+	// continuously called with new samples while the pipeline is running.
+	//
+	// SetSink must only be called while the pipeline is stopped, and may only be
+	// called up to once per sink over the life of the pipeline. It will panic if
+	// name does not correspond to a defined sink, if fn is nil, or if SetSink has
+	// already been called once for the named sink.
+	SetSink(name string, fn SinkFunc)
+
+	// SetEventHandler associates fn with the pipeline, causing it to be called
+	// with every event that the pipeline reports. fn may be called from any
+	// goroutine, including one calling another method of the pipeline. fn must
+	// not block, and must not call any method of the pipeline.
+	//
+	// SetEventHandler must only be called while the pipeline is stopped, and may
+	// only be called up to once over the life of the pipeline. It will panic if
+	// fn is nil, or if SetEventHandler has already been called once.
+	SetEventHandler(fn EventFunc)
+
+	// AddBranch creates a new Branch within the pipeline based on the syntax used
+	// in the gst-launch-1.0 utility. If the branch has an unlinked input, it is
+	// fed from a new output of the tee element named tee, which must already
+	// exist in the pipeline.
+	//
+	// AddBranch may be called whether or not the pipeline is started. The branch
+	// does not process any data until it is started.
+	AddBranch(tee, description string) (Branch, error)
+
+	// Start attempts to start the pipeline, such that it begins processing data
+	// and sinks begin receiving output. Start also resumes a paused pipeline.
+	Start() error
+
+	// Pause attempts to pause the pipeline, such that it holds its current
+	// position without delivering any more output until it is started again.
+	Pause() error
+
+	// Seek moves a pipeline that reads from a seekable source, such as a file,
+	// to the nearest key frame at or before position, discarding any data that
+	// the pipeline was processing. It returns an error if the source cannot
+	// seek.
+	Seek(position time.Duration) error
+
+	// Position returns the current position of a pipeline that reads from a
+	// seekable source, along with the total duration of the source, or zero if
+	// the pipeline cannot determine it.
+	Position() (position, duration time.Duration, err error)
+
+	// Close stops the pipeline if it is started and releases any resources
+	// associated with it, including those of its branches. It is invalid to call
+	// any other method of a pipeline or its branches after it has been closed.
+	Close() error
+}
+
+// Branch represents a section of a Pipeline that can be added and removed while
+// the rest of the pipeline continues to run.
+type Branch interface {
+	// SetSink associates fn with a named sink in the branch, following the same
+	// rules as [Pipeline.SetSink].
+	SetSink(name string, fn SinkFunc)
+
+	// RequestKeyFrame asks the video encoder feeding the named sink to produce a
+	// key frame as soon as possible, so that consumers of the sink can recover
+	// from lost data or begin decoding in the middle of the stream.
+	RequestKeyFrame(sink string) error
+
+	// SetProperty changes a property of the named element in the branch while
+	// the branch is running, parsing value as the gst-launch-1.0 utility would.
+	// It returns an error if the branch has no such element or the element has
+	// no such property.
+	SetProperty(element, property, value string) error
+
+	// Start brings the branch to the same state as the rest of its pipeline, such
+	// that it begins processing data if the pipeline is started. A branch that
+	// is started before its pipeline will start along with the pipeline.
+	Start() error
+
+	// Close stops the branch, disconnects it from the rest of the pipeline, and
+	// releases any resources associated with it. It is invalid to call any other
+	// method of a branch after it has been closed. Close waits for the branch's
+	// tee to finish any data that it is pushing into the branch, so the branch's
+	// sink functions must not wait on anything that the caller of Close holds.
+	Close() error
+}
+
+// Factory is a type for functions that create a Pipeline based on the syntax
+// used in the gst-launch-1.0 utility. An empty description creates an empty
+// pipeline, to which branches may be added.
+type Factory func(description string) (Pipeline, error)
+
+// SinkFunc is a type for functions that receive data from the sinks of a
+// Pipeline.
+type SinkFunc func([]byte, time.Duration)
+
+// EventFunc is a type for functions that receive events from a Pipeline.
+type EventFunc func(Event)
+
+// EventType represents the kind of message that produced an Event.
+type EventType int
+
+const (
+	// EventError indicates that an element of the pipeline encountered an error
+	// from which it cannot recover. The pipeline will not produce any more data
+	// after an error.
+	EventError EventType = iota
+	// EventWarning indicates that an element of the pipeline encountered a
+	// problem that does not prevent it from continuing to process data.
+	EventWarning
+	// EventEOS indicates that every sink in the pipeline has reached the end of
+	// its stream.
+	EventEOS
+	// EventStateChanged indicates that an element of the pipeline has changed
+	// its state.
+	EventStateChanged
+	// EventElement indicates an element-specific message, whose meaning depends
+	// on the element that posted it.
+	EventElement
+)
+
+var eventTypeStrings = map[EventType]string{
+	EventError:        "error",
+	EventWarning:      "warning",
+	EventEOS:          "eos",
+	EventStateChanged: "state-changed",
+	EventElement:      "element",
+}
+
+func (et EventType) String() string {
+	if s, ok := eventTypeStrings[et]; ok {
+		return s
+	}
+	return fmt.Sprintf("EventType(%d)", int(et))
+}
+
+// State represents the state of a pipeline element. The values of the State
+// constants match those of the GstState enumeration.
+type State int
+
+const (
+	StateVoidPending State = iota
+	StateNull
+	StateReady
+	StatePaused
+	StatePlaying
+)
+
+var stateStrings = map[State]string{
+	StateVoidPending: "void-pending",
+	StateNull:        "null",
+	StateReady:       "ready",
+	StatePaused:      "paused",
+	StatePlaying:     "playing",
+}
+
+func (s State) String() string {
+	if str, ok := stateStrings[s]; ok {
+		return str
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Event represents a message reported by a Pipeline.
+type Event struct {
+	Type EventType
+
+	// Source is the name of the element or pipeline that posted the event.
+	Source string
+
+	// Err describes the problem reported by an EventError or EventWarning, and
+	// is always an *Error for these events.
+	Err error
+
+	// OldState and NewState describe the transition reported by an
+	// EventStateChanged.
+	OldState State
+	NewState State
+
+	// Structure is the serialized form of the GstStructure carried by an
+	// EventElement, whose name identifies the type of the message.
+	Structure string
+}
+
+// Error represents an error or warning reported by an element of a Pipeline.
+type Error struct {
+	Source  string
+	Message string
+	// Debug contains additional information that the pipeline implementation
+	// considers useful for debugging, and may be empty.
+	Debug string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Source, e.Message)
+}
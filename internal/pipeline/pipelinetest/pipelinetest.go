@@ -0,0 +1,494 @@
+// Package pipelinetest provides a fake implementation of pipeline.Pipeline for
+// tests that should not depend on GStreamer.
+package pipelinetest
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/featherbread/hypcast/internal/pipeline"
+)
+
+// Factory creates fake pipelines, and keeps track of them so that tests can
+// drive their sinks and events.
+type Factory struct {
+	// SampleInterval, if positive, causes every pipeline created by the factory
+	// to emit a synthetic sample to each of its sinks at this interval between
+	// being started and being closed.
+	SampleInterval time.Duration
+
+	mu       sync.Mutex
+	newErr   error
+	startErr error
+	created  chan *Pipeline
+}
+
+// maxPipelines is the number of pipelines that a Factory can create before
+// tests must start receiving them from [Factory.Next].
+const maxPipelines = 100
+
+// NewFactory creates a Factory for fake pipelines.
+func NewFactory() *Factory {
+	return &Factory{created: make(chan *Pipeline, maxPipelines)}
+}
+
+// FailNew causes future calls to New to return err. A nil err restores the
+// normal behavior of New.
+func (f *Factory) FailNew(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.newErr = err
+}
+
+// FailStart causes pipelines created by future calls to New to return err from
+// Start. A nil err restores the normal behavior of Start.
+func (f *Factory) FailStart(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.startErr = err
+}
+
+// New creates a fake pipeline, and satisfies the pipeline.Factory type. The
+// names of the pipeline's sinks are taken from the "name" properties of any
+// appsink elements in description.
+func (f *Factory) New(description string) (pipeline.Pipeline, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.newErr != nil {
+		return nil, f.newErr
+	}
+
+	p := &Pipeline{
+		Description:    description,
+		sampleInterval: f.SampleInterval,
+		startErr:       f.startErr,
+		sinks:          parseSinkNames(description),
+		done:           make(chan struct{}),
+	}
+
+	select {
+	case f.created <- p:
+	default:
+		panic(fmt.Errorf("created more than %d pipelines without calling Next", maxPipelines))
+	}
+	return p, nil
+}
+
+var (
+	appsinkNamePattern = regexp.MustCompile(`appsink\s+name=([\w-]+)`)
+	elementNamePattern = regexp.MustCompile(`\bname=([\w-]+)`)
+)
+
+func parseSinkNames(description string) map[string]pipeline.SinkFunc {
+	sinks := make(map[string]pipeline.SinkFunc)
+	for _, match := range appsinkNamePattern.FindAllStringSubmatch(description, -1) {
+		sinks[match[1]] = nil
+	}
+	return sinks
+}
+
+// Next returns the oldest pipeline created by the factory that has not yet been
+// returned by Next, waiting up to timeout for a new pipeline to be created. It
+// returns nil if no pipeline is created before the timeout.
+func (f *Factory) Next(timeout time.Duration) *Pipeline {
+	select {
+	case p := <-f.created:
+		return p
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// Pipeline is a fake implementation of pipeline.Pipeline, which delivers
+// samples and events on request from tests.
+type Pipeline struct {
+	// Description is the description that the pipeline was created with.
+	Description string
+
+	sampleInterval time.Duration
+	startErr       error
+
+	mu       sync.Mutex
+	sinks    map[string]pipeline.SinkFunc
+	eventFn  pipeline.EventFunc
+	branches []*Branch
+	started  bool
+	paused   bool
+	closed   bool
+	done     chan struct{}
+
+	position time.Duration
+	duration time.Duration
+}
+
+var _ pipeline.Pipeline = (*Pipeline)(nil)
+
+// SetSink implements pipeline.Pipeline.
+func (p *Pipeline) SetSink(name string, fn pipeline.SinkFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	setSink(p.sinks, name, fn)
+}
+
+// setSink enforces the contract of SetSink for both pipelines and branches.
+func setSink(sinks map[string]pipeline.SinkFunc, name string, fn pipeline.SinkFunc) {
+	if fn == nil {
+		panic("attempted to set nil sink function")
+	}
+	existing, ok := sinks[name]
+	if !ok {
+		panic(fmt.Errorf("unknown sink name %s", name))
+	}
+	if existing != nil {
+		panic("called SetSink more than once for the same appsink")
+	}
+	sinks[name] = fn
+}
+
+// SetEventHandler implements pipeline.Pipeline.
+func (p *Pipeline) SetEventHandler(fn pipeline.EventFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if fn == nil {
+		panic("attempted to set nil event handler")
+	}
+	if p.eventFn != nil {
+		panic("called SetEventHandler more than once")
+	}
+	p.eventFn = fn
+}
+
+// AddBranch implements pipeline.Pipeline. Like New, it takes the names of the
+// branch's sinks from any appsink elements in description.
+func (p *Pipeline) AddBranch(tee, description string) (pipeline.Branch, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		panic("added a branch to a closed pipeline")
+	}
+	b := &Branch{
+		Description: description,
+		Tee:         tee,
+		pipeline:    p,
+		sinks:       parseSinkNames(description),
+		keyFrames:   make(map[string]int),
+		properties:  make(map[[2]string]string),
+	}
+	p.branches = append(p.branches, b)
+	return b, nil
+}
+
+// Branches returns every branch ever added to the pipeline, in the order that
+// they were added, including branches that were later closed.
+func (p *Pipeline) Branches() []*Branch {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.branches)
+}
+
+// Start implements pipeline.Pipeline. It returns the error configured by
+// [Factory.FailStart] at the time the pipeline was created, if any.
+func (p *Pipeline) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		panic("started a closed pipeline")
+	}
+	if p.startErr != nil {
+		return p.startErr
+	}
+	if !p.started && p.sampleInterval > 0 {
+		go p.generateSamples()
+	}
+	p.started = true
+	p.paused = false
+	return nil
+}
+
+// Pause implements pipeline.Pipeline. A paused pipeline delivers no samples
+// until it is started again.
+func (p *Pipeline) Pause() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		panic("paused a closed pipeline")
+	}
+	p.paused = true
+	return nil
+}
+
+// Seek implements pipeline.Pipeline, by moving the position that the pipeline
+// reports to the requested position.
+func (p *Pipeline) Seek(position time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		panic("sought a closed pipeline")
+	}
+	p.position = position
+	return nil
+}
+
+// Position implements pipeline.Pipeline. It reports the position of the last
+// call to Seek or SetPosition, and the duration of the last call to
+// SetPosition.
+func (p *Pipeline) Position() (position, duration time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.position, p.duration, nil
+}
+
+// SetPosition sets the position and duration that the pipeline reports, as if
+// it had played up to position within a source of the given duration.
+func (p *Pipeline) SetPosition(position, duration time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.position, p.duration = position, duration
+}
+
+// Close implements pipeline.Pipeline.
+func (p *Pipeline) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+	for _, b := range p.branches {
+		b.closed = true
+	}
+	return nil
+}
+
+// Started indicates whether the pipeline was successfully started.
+func (p *Pipeline) Started() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.started
+}
+
+// Paused indicates whether the pipeline was paused and not started again
+// since.
+func (p *Pipeline) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// Closed indicates whether the pipeline was closed.
+func (p *Pipeline) Closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// Done returns a channel that is closed when the pipeline is closed.
+func (p *Pipeline) Done() <-chan struct{} {
+	return p.done
+}
+
+// SendSample synchronously delivers a sample to the named sink, as long as the
+// pipeline is started and neither paused nor closed. It returns whether the
+// sample was delivered.
+func (p *Pipeline) SendSample(name string, data []byte, duration time.Duration) bool {
+	p.mu.Lock()
+	fn := p.sinks[name]
+	running := p.started && !p.paused && !p.closed
+	p.mu.Unlock()
+
+	if !running || fn == nil {
+		return false
+	}
+	fn(data, duration)
+	return true
+}
+
+// SendEvent synchronously delivers ev to the pipeline's event handler, if it
+// has one.
+func (p *Pipeline) SendEvent(ev pipeline.Event) {
+	p.mu.Lock()
+	fn := p.eventFn
+	p.mu.Unlock()
+
+	if fn != nil {
+		fn(ev)
+	}
+}
+
+// SendError delivers an EventError reporting msg from the named source.
+func (p *Pipeline) SendError(source, msg string) {
+	p.SendEvent(pipeline.Event{
+		Type:   pipeline.EventError,
+		Source: source,
+		Err:    &pipeline.Error{Source: source, Message: msg},
+	})
+}
+
+func (p *Pipeline) generateSamples() {
+	ticker := time.NewTicker(p.sampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		names := slices.Collect(maps.Keys(p.sinks))
+		branches := slices.Clone(p.branches)
+		p.mu.Unlock()
+
+		for _, name := range names {
+			p.SendSample(name, []byte(name), p.sampleInterval)
+		}
+		for _, b := range branches {
+			b.sendSamples(p.sampleInterval)
+		}
+	}
+}
+
+// Branch is a fake implementation of pipeline.Branch, which delivers samples on
+// request from tests.
+//
+// The fields of a branch are protected by the lock of its pipeline, so that
+// closing the pipeline closes its branches atomically.
+type Branch struct {
+	// Description is the description that the branch was created with.
+	Description string
+	// Tee is the name of the tee element that the branch was attached to.
+	Tee string
+
+	pipeline   *Pipeline
+	sinks      map[string]pipeline.SinkFunc
+	keyFrames  map[string]int
+	properties map[[2]string]string
+	started    bool
+	closed     bool
+}
+
+var _ pipeline.Branch = (*Branch)(nil)
+
+// SetSink implements pipeline.Branch.
+func (b *Branch) SetSink(name string, fn pipeline.SinkFunc) {
+	b.pipeline.mu.Lock()
+	defer b.pipeline.mu.Unlock()
+	setSink(b.sinks, name, fn)
+}
+
+// RequestKeyFrame implements pipeline.Branch.
+func (b *Branch) RequestKeyFrame(sink string) error {
+	b.pipeline.mu.Lock()
+	defer b.pipeline.mu.Unlock()
+
+	if _, ok := b.sinks[sink]; !ok {
+		return fmt.Errorf("unknown sink name %s", sink)
+	}
+	b.keyFrames[sink]++
+	return nil
+}
+
+// KeyFrameRequests returns the number of times that RequestKeyFrame was called
+// for the named sink.
+func (b *Branch) KeyFrameRequests(sink string) int {
+	b.pipeline.mu.Lock()
+	defer b.pipeline.mu.Unlock()
+	return b.keyFrames[sink]
+}
+
+// SetProperty implements pipeline.Branch. It accepts any property of an element
+// named in the branch's description, and records the value for Property.
+func (b *Branch) SetProperty(element, property, value string) error {
+	b.pipeline.mu.Lock()
+	defer b.pipeline.mu.Unlock()
+
+	if !slices.ContainsFunc(elementNamePattern.FindAllStringSubmatch(b.Description, -1),
+		func(match []string) bool { return match[1] == element }) {
+		return fmt.Errorf("unknown element name %s", element)
+	}
+	b.properties[[2]string{element, property}] = value
+	return nil
+}
+
+// Property returns the last value set for a property of the named element with
+// SetProperty, and whether any value was set.
+func (b *Branch) Property(element, property string) (value string, ok bool) {
+	b.pipeline.mu.Lock()
+	defer b.pipeline.mu.Unlock()
+	value, ok = b.properties[[2]string{element, property}]
+	return
+}
+
+// Start implements pipeline.Branch.
+func (b *Branch) Start() error {
+	b.pipeline.mu.Lock()
+	defer b.pipeline.mu.Unlock()
+
+	if b.closed {
+		panic("started a closed branch")
+	}
+	b.started = true
+	return nil
+}
+
+// Close implements pipeline.Branch.
+func (b *Branch) Close() error {
+	b.pipeline.mu.Lock()
+	defer b.pipeline.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+// Started indicates whether the branch was started.
+func (b *Branch) Started() bool {
+	b.pipeline.mu.Lock()
+	defer b.pipeline.mu.Unlock()
+	return b.started
+}
+
+// Closed indicates whether the branch was closed, either directly or by closing
+// its pipeline.
+func (b *Branch) Closed() bool {
+	b.pipeline.mu.Lock()
+	defer b.pipeline.mu.Unlock()
+	return b.closed
+}
+
+// SendSample synchronously delivers a sample to the named sink, as long as both
+// the branch and its pipeline are started and not closed, and the pipeline is
+// not paused. It returns whether the sample was delivered.
+func (b *Branch) SendSample(name string, data []byte, duration time.Duration) bool {
+	p := b.pipeline
+	p.mu.Lock()
+	fn := b.sinks[name]
+	running := p.started && !p.paused && !p.closed && b.started && !b.closed
+	p.mu.Unlock()
+
+	if !running || fn == nil {
+		return false
+	}
+	fn(data, duration)
+	return true
+}
+
+func (b *Branch) sendSamples(duration time.Duration) {
+	b.pipeline.mu.Lock()
+	names := slices.Collect(maps.Keys(b.sinks))
+	b.pipeline.mu.Unlock()
+
+	for _, name := range names {
+		b.SendSample(name, []byte(name), duration)
+	}
+}